@@ -17,42 +17,538 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/threatkey-oss/hvresult/internal"
 	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"golang.org/x/term"
 )
 
 // applyCmd represents the apply command
 var applyCmd = &cobra.Command{
-	Use:   "apply",
+	Use:   "apply [plan file]",
 	Short: "Apply Vault policy and auth roles from a local directory to Vault",
 	Long: `This command reads Vault policy and auth role configurations from a local
 directory and applies them to the Vault server. It can be used to synchronize
-the state of your Vault server with a GitOps repository.`,
+the state of your Vault server with a GitOps repository.
+
+Given a file written by 'gitops plan --out', it applies exactly the changes in
+it instead, refusing if anything they touch changed in Vault since.`,
+	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
-			ctx          = context.Background()
 			_f           = cmd.Flags()
 			directory, _ = _f.GetString("directory")
 		)
+		// an interrupted apply stops and releases its lock instead of leaving it held until it expires
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		watch, _ := _f.GetBool("watch")
+		output, _ := _f.GetString("output")
+		if output != "text" && output != "json" {
+			log.Fatal().Str("output", output).Msg("--output must be text or json")
+		}
+		if len(args) == 1 {
+			for _, flag := range []string{"dry-run", "watch", "archive", "since", "cluster", "recurse-namespaces", "overlay", "render", "var-file", "target", "only-policies", "only-auth", "prune", "disable-mounts"} {
+				if _f.Changed(flag) {
+					log.Fatal().Msgf("--%s can't be used with a plan file, which already has exactly what to change", flag)
+				}
+			}
+			err := applySavedPlan(ctx, cmd, args[0])
+			var partial *gitops.PartialApplyError
+			if errors.As(err, &partial) {
+				log.Error().Err(err).Int("applied", partial.Applied).Msg("error applying some changes to Vault")
+				os.Exit(2)
+			}
+			if err != nil {
+				log.Fatal().Err(err).Msg("error applying plan to Vault")
+			}
+			return
+		}
+		if archive, _ := _f.GetString("archive"); archive != "" {
+			if watch {
+				log.Fatal().Msg("--watch can't be used with --archive")
+			}
+			directory = extractArchiveFile(archive)
+			defer os.RemoveAll(directory)
+		}
+		// git still needs the repository itself
+		repository := directory
+		directory, cleanup := loadDirectory(cmd, directory)
+		defer cleanup()
+		if watch && directory != repository {
+			log.Fatal().Msg("--watch can't be used with --overlay, --render, or --var-file")
+		}
 
-		vc, err := vault.NewClient(vault.DefaultConfig())
-		if err != nil {
-			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error creating Vault client")
+		if clusters, _ := _f.GetStringSlice("cluster"); len(clusters) > 0 {
+			if watch {
+				log.Fatal().Msg("--watch can't be used with --cluster")
+			}
+			code := applyClusters(ctx, cmd, clusters, directory, repository)
+			cleanup()
+			os.Exit(code)
 		}
 
-		if err := gitops.ApplyChanges(ctx, vc, filepath.Join(directory, "auth"), filepath.Join(directory, "sys", "policies", "acl")); err != nil {
-			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error applying changes to Vault")
+		vc := newGitopsClient(cmd)
+		applyAll := applyFunc(ctx, cmd, vc, directory, repository)
+		if applyAll == nil {
+			return
+		}
+		if !watch {
+			err := applyAll(ctx)
+			// some automation needs to know Vault was left half applied rather than untouched
+			var partial *gitops.PartialApplyError
+			if errors.As(err, &partial) {
+				log.Error().Err(err).Int("applied", partial.Applied).Msg("error applying some changes to Vault")
+				cleanup()
+				os.Exit(2)
+			}
+			if err != nil {
+				log.Fatal().Err(err).Msg("error applying changes to Vault")
+			}
+			return
+		}
+		// a broken file shouldn't stop the watch, since fixing it is the point
+		if err := applyAll(ctx); err != nil {
+			log.Error().Err(err).Msg("error applying changes to Vault, waiting for the next change")
+		}
+		// backups written inside the directory aren't changes to apply
+		var exclude []string
+		if dir := backupDirectory(cmd, vc); dir != "" {
+			exclude = append(exclude, dir)
+		}
+		if err := gitops.WatchDirectory(ctx, directory, exclude, gitops.DefaultWatchDebounce, applyAll); err != nil {
+			log.Fatal().Err(err).Msg("error watching for changes")
 		}
-		log.Info().Msg("Successfully applied changes to Vault.")
 	},
 }
 
 func init() {
 	gitopsCmd.AddCommand(applyCmd)
+	flags := applyCmd.Flags()
+	flags.Bool("dry-run", false, "print what would be added, changed, and deleted with a diff of each instead of changing anything")
+	flags.Bool("skip-unchanged", true, "read each object from Vault first and skip writes that wouldn't change anything, ignoring role formatting and list order but not policy formatting (--skip-unchanged=false rewrites everything)")
+	flags.Bool("skip-invalid", false, "skip policies and auth roles that fail validation instead of refusing to apply anything")
+	flags.Bool("skip-forbidden", false, "skip mounts and objects the token isn't allowed to list or write instead of failing")
+	flags.Bool("prune", false, "delete policies and auth roles that don't have local files (otherwise they're only listed)")
+	flags.Bool("disable-mounts", false, "with --prune, also disable auth mounts without a "+gitops.AuthMountFileName+" and secrets engines without a file in sys/mounts, deleting everything in them")
+	flags.Bool("force", false, "delete policies even if auth roles, entities, or groups still use them")
+	flags.Bool("auto-approve", false, "delete objects without asking first, which apply refuses to do otherwise when there's no terminal to ask on")
+	flags.Bool("strict", false, "fail instead of skipping auth mounts with unsupported types")
+	flags.String("output", "text", "how to print what was created, updated, deleted, left unchanged, and failed for each kind of object: text or json")
+	flags.Bool("keep-going", false, "keep making changes after some fail and report every failure at the end (with --no-rollback, exits 2 if anything was changed)")
+	flags.String("state", "", stateFlagUsage)
+	flags.Bool("no-rollback", false, "leave changes that were made in place when the apply fails partway instead of putting back what was there before")
+	flags.Bool("verify", false, "read each object back after writing it and fail if it doesn't match")
+	flags.Int("max-deletions", 0, "refuse to apply if more than this many objects would be deleted (0 means no limit)")
+	flags.Float64("max-delete-percent", 20, "refuse to apply if more than this percentage of existing objects would be deleted (0 means no limit)")
+	flags.String("backup-dir", "", "save everything that's about to change or be deleted to a timestamped directory in here first, unredacted (default is a directory for the cluster in the user cache directory, see 'gitops restore')")
+	flags.Bool("no-backup", false, "don't back up before applying")
+	flags.String("since", "", "only apply files changed since this git reference (e.g. the last applied commit) instead of reconciling everything")
+	flags.Bool("github-status", false, "report the apply as a GitHub deployment and commit status (uses $GITHUB_TOKEN, $GITHUB_REPOSITORY, and $GITHUB_SHA)")
+	flags.String("github-environment", "", "GitHub deployment environment name (default is the Vault address)")
+	flags.String("servicenow-instance", "", "if specified, open a ServiceNow change request with the planned changes before applying and close it with what was applied (uses $SERVICENOW_USERNAME and $SERVICENOW_PASSWORD)")
+	flags.String("journal", "", "append a hash-chained record of the apply to this file, signed with $HVRESULT_JOURNAL_KEY if it's set (see 'gitops verify-journal')")
+	flags.Bool("watch", false, "after applying, keep applying whenever a file in --directory changes (for iterating against a dev Vault)")
+	flags.String("archive", "", "apply a tarball written by 'download --archive' instead of --directory (not usable with git-based flags)")
+	flags.StringSlice("cluster", nil, "apply to these clusters from the clusters file one after another instead of $VAULT_ADDR, e.g. prod-us,prod-eu")
+	flags.String("clusters-file", "", "file listing each cluster's address, namespace, and auth method (default is "+gitops.ClustersFileName+" in --directory)")
+	addTargetFlags(applyCmd)
+	addLoadFlags(applyCmd)
+}
+
+// Builds the function that applies `directory` to the Vault `vc` points at, which can be called again to apply it again.
+// With --dry-run, prints what it'd change instead and returns nil.
+func applyFunc(ctx context.Context, cmd *cobra.Command, vc *vault.Client, directory, repository string) func(ctx context.Context) error {
+	var (
+		_f     = cmd.Flags()
+		report = &gitops.Report{}
+	)
+	watch, _ := _f.GetBool("watch")
+	output, _ := _f.GetString("output")
+
+	var opts gitops.ApplyOptions
+	opts.RequestTimeout = requestTimeout(cmd)
+	opts.Retries = maxRetries(cmd)
+	opts.Concurrency = concurrency(cmd)
+	opts.SkipUnchanged, _ = _f.GetBool("skip-unchanged")
+	opts.SkipInvalid, _ = _f.GetBool("skip-invalid")
+	opts.Force, _ = _f.GetBool("force")
+	opts.Prune, _ = _f.GetBool("prune")
+	opts.DisableMounts, _ = _f.GetBool("disable-mounts")
+	opts.Verify, _ = _f.GetBool("verify")
+	opts.KeepGoing, _ = _f.GetBool("keep-going")
+	noRollback, _ := _f.GetBool("no-rollback")
+	opts.Rollback = !noRollback
+	opts.Strict, _ = _f.GetBool("strict")
+	opts.SkipForbidden, _ = _f.GetBool("skip-forbidden")
+	opts.Report = report
+	opts.MaxDeletions, _ = _f.GetInt("max-deletions")
+	opts.Only = onlyKinds(cmd)
+	opts.Targets, _ = _f.GetStringSlice("target")
+	opts.MaxDeletionPercent, _ = _f.GetFloat64("max-delete-percent")
+	opts.ConfirmDeletions = confirmDeletions(cmd)
+	opts.BackupDirectory = backupDirectory(cmd, vc)
+	opts.Cache = openStateCache(cmd, vc)
+	if since, _ := _f.GetString("since"); since != "" {
+		if watch {
+			log.Fatal().Msg("--watch can't be used with --since, since every change is applied by reconciling everything")
+		}
+		if overlay, _ := _f.GetString("overlay"); overlay != "" {
+			log.Fatal().Msg("--since can't be used with --overlay, since changed files are in base/ or overlays/")
+		}
+		changes, _, err := gitops.GetChangedFiles(ctx, repository, since)
+		if err != nil {
+			log.Fatal().Err(err).Str("since", since).Msg("error getting changed files")
+		}
+		opts.Incremental = true
+		opts.Changes = changes
+	}
+	targets := namespaceTargets(ctx, cmd, vc, directory, false)
+	if dryRun, _ := _f.GetBool("dry-run"); dryRun {
+		opts.Diff = true
+		opts.State = loadAppliedState(ctx, cmd, vc)
+		printNamespacePlans(vc, planNamespaces(ctx, cmd, vc, targets, opts), printPlan)
+		return nil
+	}
+	checkRootToken(ctx, cmd, vc)
+
+	reporters := applyReporters(cmd, vc, repository, report)
+	opts.Planned = reportPlanned(reporters)
+	applyAll := func(ctx context.Context) error {
+		// each apply while watching gets its own summary
+		report.Reset()
+		// someone else applying fails this apply, not the watch or the remaining clusters
+		lockCtx, lock, err := acquireLock(ctx, cmd, vc)
+		if err != nil {
+			return err
+		}
+		// reporting is best effort and shouldn't block changes
+		for _, reporter := range reporters {
+			if err := reporter.Started(ctx); err != nil {
+				log.Warn().Err(err).Msg("error reporting apply start")
+			}
+		}
+		opts.Progress = startProgress(cmd, "apply")
+		// loaded while holding the lock, since it can be shared
+		opts.State = loadAppliedState(ctx, cmd, vc)
+		err = createNamespaces(lockCtx, vc, targets)
+		if err == nil {
+			err = forEachNamespace(lockCtx, vc, targets, func(ctx context.Context, nsClient *vault.Client, target namespaceTarget) error {
+				return gitops.ApplyChangesWithOptions(ctx, nsClient, filepath.Join(target.Directory, "auth"), filepath.Join(target.Directory, "sys", "policies", "acl"), namespaceOptions(cmd, opts, target))
+			})
+		}
+		err = lockError(lockCtx, err)
+		opts.Progress.Stop()
+		saveStateCache(opts.Cache)
+		// the shared state and the journal are only written while holding the lock, so another apply can't interleave
+		if err := opts.State.Save(ctx); err != nil {
+			log.Warn().Err(err).Msg("error saving applied state")
+		}
+		for _, reporter := range reporters {
+			if err := reporter.Finished(ctx, err); err != nil {
+				log.Warn().Err(err).Msg("error reporting apply result")
+			}
+		}
+		releaseLock(ctx, lock)
+		logSkipped(opts.Report)
+		printApplySummary(report, output)
+		if err != nil {
+			return internal.VaultAPIError(err)
+		}
+		log.Info().Msg("Successfully applied changes to Vault.")
+		return nil
+	}
+	return applyAll
+}
+
+// The reporters --github-status, --servicenow-instance, and --journal ask for, for applies from `repository`.
+func applyReporters(cmd *cobra.Command, vc *vault.Client, repository string, report *gitops.Report) []gitops.ApplyReporter {
+	_f := cmd.Flags()
+	var reporters []gitops.ApplyReporter
+	if githubStatus, _ := _f.GetBool("github-status"); githubStatus {
+		environment, _ := _f.GetString("github-environment")
+		if environment == "" {
+			environment = vc.Address()
+		}
+		reporter, err := gitops.NewGitHubReporter(repository, environment)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error configuring GitHub status reporting")
+		}
+		reporters = append(reporters, reporter)
+	}
+	if instance, _ := _f.GetString("servicenow-instance"); instance != "" {
+		reporter, err := gitops.NewServiceNowReporter(repository, instance, vc.Address(), report)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error configuring ServiceNow change requests")
+		}
+		reporters = append(reporters, reporter)
+	}
+	if journal, _ := _f.GetString("journal"); journal != "" {
+		key := []byte(os.Getenv("HVRESULT_JOURNAL_KEY"))
+		if len(key) == 0 {
+			log.Warn().Msg("$HVRESULT_JOURNAL_KEY isn't set, journal entries will be hash chained but not signed")
+		}
+		reporters = append(reporters, gitops.NewJournalReporter(repository, journal, key, vc.Address(), report))
+	}
+	return reporters
+}
+
+// Tells the reporters that want to know what's about to be applied, best effort like the rest of reporting.
+func reportPlanned(reporters []gitops.ApplyReporter) func(ctx context.Context, namespace string, plan *gitops.Plan) {
+	return func(ctx context.Context, namespace string, plan *gitops.Plan) {
+		for _, reporter := range reporters {
+			if reporter, ok := reporter.(gitops.PlanReporter); ok {
+				if err := reporter.Planned(ctx, namespace, plan); err != nil {
+					log.Warn().Err(err).Msg("error reporting planned changes")
+				}
+			}
+		}
+	}
+}
+
+// Applies a plan saved by `plan --out`, with the same locking, state, reporting, and summary as applying a
+// directory.
+func applySavedPlan(ctx context.Context, cmd *cobra.Command, file string) error {
+	var (
+		_f     = cmd.Flags()
+		report = &gitops.Report{}
+	)
+	saved, err := gitops.ReadSavedPlan(file)
+	if err != nil {
+		return err
+	}
+	vc := newGitopsClient(cmd)
+	output, _ := _f.GetString("output")
+
+	var opts gitops.ApplyOptions
+	opts.RequestTimeout = requestTimeout(cmd)
+	opts.Retries = maxRetries(cmd)
+	opts.Concurrency = concurrency(cmd)
+	opts.SkipUnchanged, _ = _f.GetBool("skip-unchanged")
+	opts.Verify, _ = _f.GetBool("verify")
+	opts.KeepGoing, _ = _f.GetBool("keep-going")
+	opts.Force, _ = _f.GetBool("force")
+	noRollback, _ := _f.GetBool("no-rollback")
+	opts.Rollback = !noRollback
+	opts.Strict, _ = _f.GetBool("strict")
+	opts.SkipForbidden, _ = _f.GetBool("skip-forbidden")
+	opts.Report = report
+	opts.MaxDeletions, _ = _f.GetInt("max-deletions")
+	opts.MaxDeletionPercent, _ = _f.GetFloat64("max-delete-percent")
+	opts.ConfirmDeletions = confirmDeletions(cmd)
+	opts.BackupDirectory = backupDirectory(cmd, vc)
+	opts.Cache = openStateCache(cmd, vc)
+	checkRootToken(ctx, cmd, vc)
+	// the commit reporters describe is whatever --directory has checked out
+	directory, _ := _f.GetString("directory")
+	reporters := applyReporters(cmd, vc, directory, report)
+	opts.Planned = reportPlanned(reporters)
+
+	lockCtx, lock, err := acquireLock(ctx, cmd, vc)
+	if err != nil {
+		return err
+	}
+	for _, reporter := range reporters {
+		if err := reporter.Started(ctx); err != nil {
+			log.Warn().Err(err).Msg("error reporting apply start")
+		}
+	}
+	opts.State = loadAppliedState(ctx, cmd, vc)
+	opts.Progress = startProgress(cmd, "apply")
+	err = lockError(lockCtx, gitops.ApplySavedPlanWithOptions(lockCtx, vc, saved, opts))
+	opts.Progress.Stop()
+	saveStateCache(opts.Cache)
+	// the shared state and the journal are only written while holding the lock, so another apply can't interleave
+	if err := opts.State.Save(ctx); err != nil {
+		log.Warn().Err(err).Msg("error saving applied state")
+	}
+	for _, reporter := range reporters {
+		if err := reporter.Finished(ctx, err); err != nil {
+			log.Warn().Err(err).Msg("error reporting apply result")
+		}
+	}
+	releaseLock(ctx, lock)
+	logSkipped(opts.Report)
+	printApplySummary(report, output)
+	if err != nil {
+		return internal.VaultAPIError(err)
+	}
+	log.Info().Msg("Successfully applied the plan to Vault.")
+	return nil
+}
+
+// Applies `directory` to each cluster in turn, carrying on past ones that fail, and prints how each went. Returns the exit
+// code: 2 if any were left half applied, 1 if any failed otherwise, and 0 if every one succeeded.
+func applyClusters(ctx context.Context, cmd *cobra.Command, names []string, directory, repository string) int {
+	_f := cmd.Flags()
+	if state, _ := _f.GetString("state"); state != "" && !strings.HasPrefix(state, gitops.VaultStatePrefix) {
+		log.Fatal().Msg("--state has to be in Vault with --cluster, since each cluster needs its own")
+	}
+	filename, _ := _f.GetString("clusters-file")
+	if filename == "" {
+		filename = filepath.Join(repository, gitops.ClustersFileName)
+	}
+	config, err := gitops.LoadClustersConfig(filename)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading clusters")
+	}
+	// a typo shouldn't only be noticed after applying to the clusters before it
+	clusters := make([]gitops.ClusterConfig, len(names))
+	for i, name := range names {
+		if clusters[i], err = config.Cluster(name); err != nil {
+			log.Fatal().Err(err).Str("clusters-file", filename).Msg("unknown cluster")
+		}
+	}
+	dryRun, _ := _f.GetBool("dry-run")
+	namespace, _ := _f.GetString("namespace")
+	results := make([]error, len(names))
+	for i, name := range names {
+		results[i] = func() error {
+			vc, err := internal.NewVaultClient(concurrency(cmd))
+			if err != nil {
+				return err
+			}
+			// the cluster's namespace wins
+			if namespace != "" {
+				vc.SetNamespace(namespace)
+			}
+			if err := clusters[i].Login(ctx, vc); err != nil {
+				return err
+			}
+			log.Info().Str("cluster", name).Str("address", vc.Address()).Msg("applying to cluster")
+			if dryRun {
+				fmt.Printf("## Cluster `%s`\n\n", name)
+			}
+			if applyAll := applyFunc(ctx, cmd, vc, directory, repository); applyAll != nil {
+				return applyAll(ctx)
+			}
+			return nil
+		}()
+		if results[i] != nil {
+			log.Error().Err(results[i]).Str("cluster", name).Msg("error applying to cluster, moving on to the next one")
+		}
+	}
+	var (
+		code int
+		rows []string
+	)
+	output, _ := _f.GetString("output")
+	for i, name := range names {
+		result := "applied"
+		var partial *gitops.PartialApplyError
+		switch {
+		case errors.As(results[i], &partial):
+			result = fmt.Sprintf("partially applied (%d changes): %s", partial.Applied, results[i])
+			code = 2
+		case results[i] != nil:
+			result = "failed: " + internal.VaultAPIError(results[i]).Error()
+			code = max(code, 1)
+		}
+		rows = append(rows, fmt.Sprintf("| %s | %s | %s |", name, clusters[i].Address, strings.ReplaceAll(result, "|", "\\|")))
+	}
+	// JSON summaries were already printed for each cluster
+	if output == "text" && !dryRun {
+		fmt.Println("| Cluster | Address | Result |")
+		fmt.Println("| --- | --- | --- |")
+		fmt.Println(strings.Join(rows, "\n"))
+	}
+	return code
+}
+
+// Lists what's about to be deleted and asks for approval on the terminal, unless --auto-approve was passed. Without a
+// terminal, deletions are refused instead.
+func confirmDeletions(cmd *cobra.Command) func(deletes []gitops.PlannedChange) error {
+	if autoApprove, _ := cmd.Flags().GetBool("auto-approve"); autoApprove {
+		return nil
+	}
+	// namespaces are applied concurrently, but only one can ask at a time
+	var mu sync.Mutex
+	return func(deletes []gitops.PlannedChange) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return fmt.Errorf("refusing to delete %d objects without --auto-approve, since there's no terminal to confirm them on", len(deletes))
+		}
+		// stdout might be JSON
+		fmt.Fprintf(os.Stderr, "\nThese %d objects will be deleted:\n\n", len(deletes))
+		for _, change := range deletes {
+			fmt.Fprintf(os.Stderr, "  - %s %s\n", change.Kind, change.Path)
+		}
+		fmt.Fprint(os.Stderr, "\nOnly 'yes' will be accepted to approve: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			return errors.New("deletions weren't approved")
+		}
+		return nil
+	}
+}
+
+// points `opts` at a namespace's directory, leaving out the state cache for anything but the namespace it was opened for
+func namespaceOptions(cmd *cobra.Command, opts gitops.ApplyOptions, target namespaceTarget) gitops.ApplyOptions {
+	opts.Protect = loadProtectConfig(cmd, target.Directory)
+	opts.IdentityDirectory = identityDirectory(target.Directory)
+	opts.SentinelDirectory = sentinelDirectory(target.Directory)
+	opts.SecretsDirectory = secretsDirectory(target.Directory)
+	opts.MountsDirectory = mountsDirectory(target.Directory)
+	opts.QuotasDirectory = quotasDirectory(target.Directory)
+	if recurse, _ := cmd.Flags().GetBool("recurse-namespaces"); recurse && opts.Incremental {
+		opts.Changes = gitops.NamespaceChanges(opts.Changes, target.Namespace)
+	}
+	if target.Namespace != "" {
+		opts.Cache = nil
+		if opts.BackupDirectory != "" {
+			opts.BackupDirectory = gitops.NamespaceDirectory(opts.BackupDirectory, target.Namespace)
+		}
+	}
+	return opts
+}
+
+// extracts to a temporary directory that the caller should remove
+func extractArchiveFile(archive string) string {
+	f, err := os.Open(archive)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error opening archive")
+	}
+	defer f.Close()
+	directory, err := os.MkdirTemp("", "hvresult-archive-*")
+	if err != nil {
+		log.Fatal().Err(err).Msg("error creating temporary directory")
+	}
+	if err := gitops.ExtractArchive(f, directory); err != nil {
+		os.RemoveAll(directory)
+		log.Fatal().Err(err).Msg("error extracting archive")
+	}
+	return directory
+}
+
+// prints the summary of an apply as a table, or as JSON along with every path in the report
+func printApplySummary(report *gitops.Report, output string) {
+	if output == "json" {
+		encoded, err := json.MarshalIndent(struct {
+			Summary map[gitops.ResourceKind]*gitops.SummaryCounts `json:"summary"`
+			*gitops.Report
+		}{report.Summary(), report}, "", "  ")
+		if err != nil {
+			log.Fatal().Err(err).Msg("error encoding apply summary")
+		}
+		fmt.Println(string(encoded))
+		return
+	}
+	if table := report.SummaryTable(); table != "" {
+		fmt.Println(table)
+	}
 }
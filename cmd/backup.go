@@ -0,0 +1,82 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup [ARCHIVE]",
+	Short: "Save everything in Vault that hvresult manages to a tarball",
+	Long: `Downloads every policy, auth mount and role, identity entity and group, and
+secrets engine and role to a gzip-compressed tarball without touching the
+local repository, e.g. as a safety net before a large refactor. ARCHIVE is
+hvresult-snapshot-<timestamp>.tar.gz by default.
+
+'gitops restore ARCHIVE' applies it back.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			ctx     = context.Background()
+			archive = fmt.Sprintf("hvresult-snapshot-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+		)
+		if len(args) > 0 {
+			archive = args[0]
+		}
+		directory, err := os.MkdirTemp("", "hvresult-snapshot-*")
+		if err != nil {
+			log.Fatal().Err(err).Msg("error creating temporary directory")
+		}
+		defer os.RemoveAll(directory)
+
+		vc := newGitopsClient(cmd)
+		opts := gitops.DownloadOptions{Report: &gitops.Report{}, Concurrency: concurrency(cmd), RequestTimeout: requestTimeout(cmd), Retries: maxRetries(cmd)}
+		opts.SkipForbidden, _ = cmd.Flags().GetBool("skip-forbidden")
+		kinds := downloadKindFlags(cmd)
+		targets := namespaceTargets(ctx, cmd, vc, directory, true)
+		err = forEachNamespace(ctx, vc, targets, func(ctx context.Context, nsClient *vault.Client, target namespaceTarget) error {
+			return downloadAll(ctx, nsClient, target.Directory, opts, kinds)
+		})
+		if err != nil {
+			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error downloading")
+		}
+		logSkipped(opts.Report)
+		if err := writeArchiveFile(archive, directory); err != nil {
+			log.Fatal().Err(err).Msg("error writing archive")
+		}
+		log.Info().Str("archive", archive).Str("namespace", path.Join("/", vc.Namespace())).Msg("Saved snapshot of Vault")
+	},
+}
+
+func init() {
+	gitopsCmd.AddCommand(backupCmd)
+	flags := backupCmd.Flags()
+	flags.Bool("skip-forbidden", false, "skip mounts and objects the token isn't allowed to list or read instead of failing")
+	addDownloadKindFlags(backupCmd)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Exit successfully only if Vault already matches the repository",
+	Long: `Plans everything 'gitops apply' would do, reading every object that exists on
+both sides to compare it with its file, and exits 1 with a markdown table of
+the differences if there are any. Running it right after an apply should
+always succeed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			ctx          = context.Background()
+			_f           = cmd.Flags()
+			directory, _ = _f.GetString("directory")
+		)
+		directory, cleanup := loadDirectory(cmd, directory)
+		defer cleanup()
+		vc := newGitopsClient(cmd)
+		var opts gitops.ApplyOptions
+		opts.RequestTimeout = requestTimeout(cmd)
+		opts.Retries = maxRetries(cmd)
+		opts.Concurrency = concurrency(cmd)
+		opts.Protect = loadProtectConfig(cmd, directory)
+		opts.IdentityDirectory = identityDirectory(directory)
+		opts.SentinelDirectory = sentinelDirectory(directory)
+		opts.SecretsDirectory = secretsDirectory(directory)
+		opts.MountsDirectory = mountsDirectory(directory)
+		opts.QuotasDirectory = quotasDirectory(directory)
+		opts.SkipUnchanged = true
+		opts.Strict, _ = _f.GetBool("strict")
+		opts.Prune, _ = _f.GetBool("prune")
+		opts.DisableMounts, _ = _f.GetBool("disable-mounts")
+		var (
+			plans     = planNamespaces(ctx, cmd, vc, namespaceTargets(ctx, cmd, vc, directory, false), opts)
+			outOfSync bool
+		)
+		printNamespacePlans(vc, plans, func(plan *gitops.Plan) {
+			printUnpruned(plan)
+			if len(plan.Changes) == 0 {
+				fmt.Println("Vault is in sync.")
+				return
+			}
+			outOfSync = true
+			fmt.Printf("Vault is out of sync: %d to add, %d to change, %d to delete.\n\n", plan.Count(gitops.Add), plan.Count(gitops.Change), plan.Count(gitops.Delete))
+			fmt.Println(plan.MarkdownTable())
+		})
+		for _, plan := range plans {
+			// a namespace that doesn't exist yet
+			if plan.Plan == nil {
+				outOfSync = true
+			}
+		}
+		if outOfSync {
+			cleanup()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	gitopsCmd.AddCommand(checkCmd)
+	flags := checkCmd.Flags()
+	addLoadFlags(checkCmd)
+	flags.Bool("strict", false, "fail instead of skipping auth mounts with unsupported types")
+	flags.Bool("prune", false, "also fail if Vault has policies or auth roles without local files")
+	flags.Bool("disable-mounts", false, "with --prune, also fail if Vault has auth mounts without a "+gitops.AuthMountFileName+" or secrets engines without a file in sys/mounts")
+}
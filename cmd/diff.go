@@ -18,9 +18,15 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal"
 	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"golang.org/x/term"
 )
 
 // diffCmd represents the diff command
@@ -28,7 +34,11 @@ var diffCmd = &cobra.Command{
 	Use:   "diff",
 	Short: "Emits markdown of changes to the RSoP of a git repository",
 	Long: `Emits a markdown tables for changes to the RSoP of each auth principal
-modified in a git repository.`,
+modified in a git repository.
+
+With --live, compares the directory with what's in Vault instead and prints a
+diff of every object that doesn't match, exiting 0 if nothing differs and 2 if
+something does, like 'terraform plan -detailed-exitcode'.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
 			ctx           = context.Background()
@@ -36,12 +46,63 @@ modified in a git repository.`,
 			directory, _  = _f.GetString("directory")
 			compareRef, _ = _f.GetString("compare-ref")
 		)
+		if live, _ := _f.GetBool("live"); live {
+			directory, cleanup := loadDirectory(cmd, directory)
+			code := liveDiff(ctx, cmd, directory)
+			cleanup()
+			os.Exit(code)
+		}
 		gitops.MustEmitMarkdownDiffs(ctx, directory, compareRef)
 	},
 }
 
+// prints how Vault differs from `directory` and returns the exit code
+func liveDiff(ctx context.Context, cmd *cobra.Command, directory string) int {
+	_f := cmd.Flags()
+	vc := newGitopsClient(cmd)
+	var opts gitops.ApplyOptions
+	opts.RequestTimeout = requestTimeout(cmd)
+	opts.Retries = maxRetries(cmd)
+	opts.Concurrency = concurrency(cmd)
+	opts.Protect = loadProtectConfig(cmd, directory)
+	opts.IdentityDirectory = identityDirectory(directory)
+	opts.SentinelDirectory = sentinelDirectory(directory)
+	opts.SecretsDirectory = secretsDirectory(directory)
+	opts.MountsDirectory = mountsDirectory(directory)
+	opts.QuotasDirectory = quotasDirectory(directory)
+	opts.SkipUnchanged = true
+	opts.Diff = true
+	opts.Prune, _ = _f.GetBool("prune")
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, filepath.Join(directory, "auth"), filepath.Join(directory, "sys", "policies", "acl"), opts)
+	if err != nil {
+		log.Fatal().Err(internal.VaultAPIError(err)).Msg("error planning changes")
+	}
+	var color bool
+	switch mode, _ := _f.GetString("color"); mode {
+	case "always":
+		color = true
+	case "never":
+	case "auto":
+		color = term.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("NO_COLOR") == ""
+	default:
+		log.Fatal().Str("color", mode).Msg("--color must be auto, always, or never")
+	}
+	printUnpruned(plan)
+	if len(plan.Changes) == 0 {
+		fmt.Println("No differences.")
+		return 0
+	}
+	fmt.Print(plan.UnifiedDiffs(color))
+	fmt.Printf("%d to add, %d to change, %d to delete.\n", plan.Count(gitops.Add), plan.Count(gitops.Change), plan.Count(gitops.Delete))
+	return 2
+}
+
 func init() {
 	gitopsCmd.AddCommand(diffCmd)
 	flags := diffCmd.Flags()
 	flags.String("compare-ref", "", "if specified, compare to this git reference instead of the default branch (e.g. 'main')")
+	flags.Bool("live", false, "compare the directory with what's in Vault instead of with a git reference, exiting 2 if they differ")
+	flags.Bool("prune", false, "with --live, also show objects in Vault without local files")
+	flags.String("color", "auto", "with --live, color the diff: auto, always, or never")
+	addLoadFlags(diffCmd)
 }
@@ -18,7 +18,11 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/rs/zerolog/log"
@@ -40,20 +44,286 @@ start using pull requests for Vault policy change management.`,
 			_f           = cmd.Flags()
 			directory, _ = _f.GetString("directory")
 		)
-		vc, err := vault.NewClient(vault.DefaultConfig())
+		vc := newGitopsClient(cmd)
+		opts := gitops.DownloadOptions{Cache: openStateCache(cmd, vc), Report: &gitops.Report{}}
+		opts.SkipForbidden, _ = _f.GetBool("skip-forbidden")
+		opts.Concurrency = concurrency(cmd)
+		opts.RequestTimeout = requestTimeout(cmd)
+		opts.Retries = maxRetries(cmd)
+		redact, _ := _f.GetBool("redact-secrets")
+		opts.KeepSecrets = !redact
+		fileMode, _ := _f.GetString("file-mode")
+		mode, err := strconv.ParseUint(fileMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			log.Fatal().Str("file-mode", fileMode).Msg("--file-mode must be octal permissions like 0600")
+		}
+		opts.FileMode = os.FileMode(mode)
+		opts.Mounts, _ = _f.GetStringSlice("mount")
+		opts.Format, _ = _f.GetString("format")
+		if opts.Format != gitops.JSONFormat && opts.Format != gitops.YAMLFormat {
+			log.Fatal().Str("format", opts.Format).Msg("--format must be json or yaml")
+		}
+		kinds := downloadKindFlags(cmd)
+		// a partial download would leave out everything else
+		writeManifest, _ := _f.GetBool("manifest")
+		if _f.Changed("types") || _f.Changed("mount") {
+			writeManifest = false
+		}
+		resume, _ := _f.GetBool("resume")
+		targets := namespaceTargets(ctx, cmd, vc, directory, true)
+		warnRemovedNamespaces(directory, targets)
+		opts.Progress = startProgress(cmd, "download")
+		err = forEachNamespace(ctx, vc, targets, func(ctx context.Context, nsClient *vault.Client, target namespaceTarget) error {
+			nsOpts := opts
+			// the cache only covers the namespace it was opened for
+			if target.Namespace != "" {
+				nsOpts.Cache = nil
+			}
+			if writeManifest {
+				nsOpts.Manifest = gitops.NewManifest(nsClient, target.Directory)
+			}
+			checkpoint, err := gitops.OpenCheckpoint(nsClient, target.Directory, resume)
+			if err != nil {
+				return err
+			}
+			nsOpts.Checkpoint = checkpoint
+			if err := downloadAll(ctx, nsClient, target.Directory, nsOpts, kinds); err != nil {
+				// so --resume can pick up from here
+				if err := nsOpts.Checkpoint.Save(); err != nil {
+					log.Warn().Err(err).Msg("error saving checkpoint")
+				}
+				return err
+			}
+			if err := nsOpts.Checkpoint.Remove(); err != nil {
+				return err
+			}
+			if nsOpts.Manifest == nil {
+				return nil
+			}
+			return nsOpts.Manifest.Write()
+		})
+		opts.Progress.Stop()
 		if err != nil {
-			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error creating Vault client")
+			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error downloading")
 		}
-		// do the thing that's more error prone first
-		if err := gitops.DownloadAuth(ctx, vc, filepath.Join(directory, "auth")); err != nil {
-			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error downloading auth mounts")
+		saveStateCache(opts.Cache)
+		logSkipped(opts.Report)
+		// files that didn't change in Vault aren't rewritten, so this is what the next commit has in it
+		if table := opts.Report.SummaryTable(); table != "" {
+			fmt.Println(table)
 		}
-		if err := gitops.DownloadPolicies(ctx, vc, filepath.Join(directory, "sys", "policies", "acl")); err != nil {
-			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error downloading policies")
+		if archive, _ := _f.GetString("archive"); archive != "" {
+			if err := writeArchiveFile(archive, directory); err != nil {
+				log.Fatal().Err(err).Msg("error writing archive")
+			}
+			log.Info().Str("archive", archive).Msg("wrote archive")
 		}
+		commitDownload(ctx, cmd, vc, directory, opts.Report)
 	},
 }
 
+// mentions namespace directories left over from namespaces that were deleted in Vault, which a download leaves alone
+func warnRemovedNamespaces(directory string, targets []namespaceTarget) {
+	if len(targets) < 2 {
+		return
+	}
+	local, err := gitops.LocalNamespaces(directory)
+	if err != nil {
+		log.Warn().Err(err).Msg("error finding local namespaces")
+		return
+	}
+	downloading := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		downloading[target.Namespace] = true
+	}
+	for _, namespace := range local {
+		if !downloading[namespace] {
+			log.Warn().Str("namespace", namespace).Str("directory", gitops.NamespaceDirectory(directory, namespace)).Msg("Namespace no longer exists in Vault, remove its directory or apply would create it again")
+		}
+	}
+}
+
+// commits the download for --git-commit, then pushes it and opens a pull request if asked to
+func commitDownload(ctx context.Context, cmd *cobra.Command, vc *vault.Client, directory string, report *gitops.Report) {
+	var (
+		_f             = cmd.Flags()
+		commit, _      = _f.GetBool("git-commit")
+		opts           gitops.CommitOptions
+		pullRequest, _ = _f.GetString("pull-request")
+	)
+	opts.Branch, _ = _f.GetString("git-branch")
+	opts.Message, _ = _f.GetString("git-message")
+	opts.Push, _ = _f.GetBool("git-push")
+	opts.Remote, _ = _f.GetString("git-remote")
+	if pullRequest != "" {
+		if pullRequest != "github" && pullRequest != "gitlab" {
+			log.Fatal().Str("pull-request", pullRequest).Msg("--pull-request must be github or gitlab")
+		}
+		if opts.Branch == "" {
+			log.Fatal().Msg("--pull-request needs --git-branch to open it from")
+		}
+		opts.Push = true
+	}
+	if !commit && opts.Branch == "" && !opts.Push {
+		return
+	}
+	if opts.Message == "" {
+		opts.Message = "Download Vault state from " + vc.Address()
+	}
+	committed, err := gitops.CommitDirectory(directory, opts)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error committing download")
+	}
+	if committed == nil || pullRequest == "" {
+		return
+	}
+	pr := gitops.PullRequest{
+		Title: opts.Message,
+		Body:  "Refreshed by `hvresult gitops download` from " + vc.Address() + ".",
+		Head:  committed.Branch,
+		Base:  committed.Base,
+	}
+	if table := report.SummaryTable(); table != "" {
+		pr.Body += "\n\n" + table
+	}
+	open := gitops.OpenGitHubPullRequest
+	if pullRequest == "gitlab" {
+		open = gitops.OpenGitLabMergeRequest
+	}
+	url, err := open(ctx, pr)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error opening pull request")
+	}
+	log.Info().Str("url", url).Msg("Opened pull request")
+	fmt.Println(url)
+}
+
 func init() {
 	gitopsCmd.AddCommand(downloadCmd)
+	flags := downloadCmd.Flags()
+	flags.Bool("skip-forbidden", false, "skip mounts and objects the token isn't allowed to list or read instead of failing")
+	flags.String("archive", "", "also write what was downloaded to this gzip-compressed tarball")
+	flags.Bool("redact-secrets", true, "write secret auth mount config and secrets engine role fields like bindpass and password as "+gitops.RedactedValue+", which apply leaves alone in Vault")
+	addDownloadKindFlags(downloadCmd)
+	flags.StringSlice("types", nil, "only download these kinds of objects, leaving the other files alone: policies, auth, identity, secrets, mounts, quotas, or sentinel (overrides --identity and the like)")
+	flags.StringSlice("mount", nil, "only download these auth mounts and secrets engines, like approle,kubernetes, which also means --types auth,secrets,mounts unless it's set")
+	flags.String("format", gitops.JSONFormat, "format of auth role and identity files: json, or yaml to write them as <name>.yaml")
+	flags.Bool("resume", false, "pick up a download that failed from the "+gitops.CheckpointFileName+" it left behind, skipping objects it already wrote whose files haven't changed since")
+	flags.Bool("manifest", true, "write a "+gitops.ManifestFileName+" of every downloaded object's path and SHA-256, the Vault address and namespace, and the time, except with --types or --mount")
+	flags.Bool("git-commit", false, "commit everything the download changed in --directory, which has to be in a git repository")
+	flags.String("git-branch", "", "create or reset this branch and commit to it instead of the current one, e.g. drift/$(date +%F) (implies --git-commit)")
+	flags.String("git-message", "", "commit message (default \"Download Vault state from <address>\")")
+	flags.Bool("git-push", false, "push the commit's branch, overwriting it on the remote (implies --git-commit)")
+	flags.String("git-remote", "origin", "remote to push to")
+	flags.String("pull-request", "", "after pushing, open a pull request from --git-branch into the branch it started from: github ($GITHUB_TOKEN, $GITHUB_REPOSITORY) or gitlab ($GITLAB_TOKEN, $CI_PROJECT_ID)")
+	flags.String("file-mode", "0600", "octal permissions of downloaded files; directories also get execute wherever files get read")
+}
+
+// Which kinds of objects to download.
+type downloadKinds struct {
+	Policies, Auth, Identity, Sentinel, Secrets, Mounts, Quotas bool
+}
+
+func addDownloadKindFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.Bool("identity", true, "also download identity entities and groups, which apply then manages too")
+	flags.Bool("secrets", true, "also download database, PKI, and AWS secrets engine roles and transit keys, which apply then manages too")
+	flags.Bool("mounts", true, "also download secrets engines to sys/mounts, which apply then enables and tunes too")
+	flags.Bool("quotas", true, "also download rate limit and lease count quotas to sys/quotas, which apply then manages too")
+	flags.Bool("sentinel", false, "also download Sentinel EGPs and RGPs (Vault Enterprise only), which apply then manages too")
+}
+
+func downloadKindFlags(cmd *cobra.Command) downloadKinds {
+	var (
+		_f    = cmd.Flags()
+		kinds = downloadKinds{Policies: true, Auth: true}
+	)
+	// --types and --mount aren't on every command that downloads
+	types, _ := _f.GetStringSlice("types")
+	if mounts, _ := _f.GetStringSlice("mount"); len(mounts) > 0 && len(types) == 0 {
+		types = []string{"auth", "secrets", "mounts"}
+	}
+	if len(types) == 0 {
+		kinds.Identity, _ = _f.GetBool("identity")
+		kinds.Sentinel, _ = _f.GetBool("sentinel")
+		kinds.Secrets, _ = _f.GetBool("secrets")
+		kinds.Mounts, _ = _f.GetBool("mounts")
+		kinds.Quotas, _ = _f.GetBool("quotas")
+		return kinds
+	}
+	kinds = downloadKinds{}
+	for _, t := range types {
+		switch strings.TrimSpace(t) {
+		case "policies":
+			kinds.Policies = true
+		case "auth":
+			kinds.Auth = true
+		case "identity":
+			kinds.Identity = true
+		case "secrets":
+			kinds.Secrets = true
+		case "mounts":
+			kinds.Mounts = true
+		case "quotas":
+			kinds.Quotas = true
+		case "sentinel":
+			kinds.Sentinel = true
+		default:
+			log.Fatal().Str("type", t).Msg("--types can only have policies, auth, identity, secrets, mounts, quotas, and sentinel")
+		}
+	}
+	return kinds
+}
+
+// downloads one namespace to `directory`, laid out like a repository
+func downloadAll(ctx context.Context, vc *vault.Client, directory string, opts gitops.DownloadOptions, kinds downloadKinds) error {
+	// do the thing that's more error prone first
+	if kinds.Auth {
+		if err := gitops.DownloadAuthWithOptions(ctx, vc, filepath.Join(directory, "auth"), opts); err != nil {
+			return fmt.Errorf("error downloading auth mounts: %w", err)
+		}
+	}
+	if kinds.Policies {
+		if err := gitops.DownloadPoliciesWithOptions(ctx, vc, filepath.Join(directory, "sys", "policies", "acl"), opts); err != nil {
+			return fmt.Errorf("error downloading policies: %w", err)
+		}
+	}
+	if kinds.Secrets {
+		if err := gitops.DownloadSecretsWithOptions(ctx, vc, filepath.Join(directory, "secrets"), opts); err != nil {
+			return fmt.Errorf("error downloading secrets engine roles: %w", err)
+		}
+	}
+	if kinds.Mounts {
+		if err := gitops.DownloadSecretsMountsWithOptions(ctx, vc, filepath.Join(directory, "sys", "mounts"), opts); err != nil {
+			return fmt.Errorf("error downloading secrets engines: %w", err)
+		}
+	}
+	if kinds.Quotas {
+		if err := gitops.DownloadQuotasWithOptions(ctx, vc, filepath.Join(directory, "sys", "quotas"), opts); err != nil {
+			return fmt.Errorf("error downloading quotas: %w", err)
+		}
+	}
+	if kinds.Sentinel {
+		if err := gitops.DownloadSentinelPoliciesWithOptions(ctx, vc, filepath.Join(directory, "sys", "policies"), opts); err != nil {
+			return fmt.Errorf("error downloading Sentinel policies: %w", err)
+		}
+	}
+	if kinds.Identity {
+		if err := gitops.DownloadIdentityWithOptions(ctx, vc, filepath.Join(directory, "identity"), opts); err != nil {
+			return fmt.Errorf("error downloading identity entities and groups: %w", err)
+		}
+	}
+	return nil
+}
+
+func writeArchiveFile(archive, directory string) error {
+	f, err := os.OpenFile(archive, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := gitops.WriteArchive(f, directory); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
@@ -0,0 +1,57 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// fmtCmd represents the fmt command
+var fmtCmd = &cobra.Command{
+	Use:   "fmt",
+	Short: "Rewrite policies in the repository in canonical HCL formatting",
+	Long: `Formats every ACL and password policy in the repository like 'terraform fmt',
+keeping comments, and prints the files it changed. Apply sends policies to
+Vault exactly as they're written, so this is the way to normalize them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			_f           = cmd.Flags()
+			directory, _ = _f.GetString("directory")
+			check, _     = _f.GetBool("check")
+		)
+		unformatted, err := gitops.FormatPolicies(directory, check)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error formatting policies")
+		}
+		for _, file := range unformatted {
+			fmt.Println(file)
+		}
+		if check && len(unformatted) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	gitopsCmd.AddCommand(fmtCmd)
+	fmtCmd.Flags().Bool("check", false, "only list the policies that aren't formatted, exiting 1 if there are any")
+}
@@ -17,7 +17,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
 )
 
 // gitopsCmd represents the gitops command
@@ -31,4 +44,453 @@ func init() {
 
 	persistent := gitopsCmd.PersistentFlags()
 	persistent.StringP("directory", "d", "vault-policy", "directory that contains policies and roles")
+	persistent.Bool("no-cache", false, "don't read or update the local cache of object hashes")
+	persistent.String("lock-path", gitops.DefaultLockPath, "KV v2 data path of the lock that keeps applies from running concurrently (empty to only lock locally)")
+	persistent.String("root-token", "warn", "what to do when a mutating command is run with a root token: allow, warn, or refuse")
+	persistent.Duration("lock-wait", 0, "how long to wait for another apply's lock to be released instead of failing right away")
+	persistent.Bool("no-lock", false, "don't take the apply lock (only if you're sure nothing else is applying)")
+	persistent.String("protect-file", "", "file listing policies, auth mounts, and roles apply must never change (default is "+gitops.ProtectFileName+" in --directory)")
+	persistent.StringSlice("managed-policies", nil, "only manage policies matching these globs, leaving the rest alone (adds to managed_policies in the protect file)")
+	persistent.StringSlice("managed-roles", nil, "only manage auth roles matching these globs, optionally prefixed with a mount like approle/ci-* (adds to managed_roles in the protect file)")
+	persistent.String("namespace", "", "Vault Enterprise namespace to work in (default is $VAULT_NAMESPACE)")
+	persistent.Bool("recurse-namespaces", false, "also work on every namespace under --namespace, each in namespaces/<name> under --directory")
+	persistent.Int("concurrency", gitops.DefaultConcurrency, "how many Vault requests to have in flight at once, which drops while Vault is rate limiting (1 to send one at a time)")
+	persistent.Int("max-retries", gitops.DefaultRequestRetries, "how many times to retry a Vault request that was rate limited, timed out, or failed with a 502, 503, or 504 (0 to never retry)")
+	persistent.Duration("request-timeout", gitops.DefaultRequestTimeout, "how long a single Vault request can take before it's retried (0 to only time out the whole command)")
+	persistent.Duration("progress-interval", gitops.DefaultProgressInterval, "how often downloads and applies log how many objects they've gotten through (0 to never)")
+}
+
+// creates a Vault client pointed at --namespace, if it's set
+func newGitopsClient(cmd *cobra.Command) *vault.Client {
+	vc, err := internal.NewVaultClient(concurrency(cmd))
+	if err != nil {
+		log.Fatal().Err(internal.VaultAPIError(err)).Msg("error creating Vault client")
+	}
+	if namespace, _ := cmd.Flags().GetString("namespace"); namespace != "" {
+		vc.SetNamespace(namespace)
+	}
+	return vc
+}
+
+// A namespace a command works on, relative to the one the client points at, and where its files are.
+type namespaceTarget struct {
+	Namespace string
+	Directory string
+}
+
+// The namespace the client points at and, with --recurse-namespaces, every one under it. Downloads find them in
+// Vault and everything else finds them in `directory`.
+func namespaceTargets(ctx context.Context, cmd *cobra.Command, vc *vault.Client, directory string, fromVault bool) []namespaceTarget {
+	targets := []namespaceTarget{{Directory: directory}}
+	if recurse, _ := cmd.Flags().GetBool("recurse-namespaces"); !recurse {
+		return targets
+	}
+	var (
+		namespaces []string
+		err        error
+	)
+	if fromVault {
+		namespaces, err = gitops.ListNamespaces(ctx, vc)
+	} else {
+		namespaces, err = gitops.LocalNamespaces(directory)
+	}
+	if err != nil {
+		log.Fatal().Err(internal.VaultAPIError(err)).Msg("error finding namespaces")
+	}
+	for _, namespace := range namespaces {
+		targets = append(targets, namespaceTarget{Namespace: namespace, Directory: gitops.NamespaceDirectory(directory, namespace)})
+	}
+	log.Info().Int("count", len(targets)).Msg("working on namespaces")
+	return targets
+}
+
+// A namespace's plan, which is nil if the namespace doesn't exist in Vault yet.
+type namespacePlan struct {
+	namespaceTarget
+	Plan *gitops.Plan
+}
+
+// Plans every target for plan, check, and apply --dry-run, skipping namespaces that apply would create first.
+func planNamespaces(ctx context.Context, cmd *cobra.Command, vc *vault.Client, targets []namespaceTarget, opts gitops.ApplyOptions) []namespacePlan {
+	missing := map[string]bool{}
+	if len(targets) > 1 {
+		names := make([]string, len(targets))
+		for i, target := range targets {
+			names[i] = target.Namespace
+		}
+		missingNames, err := gitops.MissingNamespaces(ctx, vc, names)
+		if err != nil {
+			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error finding namespaces")
+		}
+		for _, name := range missingNames {
+			missing[name] = true
+		}
+	}
+	plans := make([]namespacePlan, len(targets))
+	for i, target := range targets {
+		plans[i].namespaceTarget = target
+		if missing[target.Namespace] {
+			continue
+		}
+		nsClient := vc.WithNamespace(path.Join(vc.Namespace(), target.Namespace))
+		plan, err := gitops.PlanChangesWithOptions(ctx, nsClient, filepath.Join(target.Directory, "auth"), filepath.Join(target.Directory, "sys", "policies", "acl"), namespaceOptions(cmd, opts, target))
+		if err != nil {
+			log.Fatal().Err(internal.VaultAPIError(err)).Str("namespace", target.Namespace).Msg("error planning changes")
+		}
+		plans[i].Plan = plan
+	}
+	return plans
+}
+
+// prints each plan with `show`, under a heading for its namespace if there's more than one
+func printNamespacePlans(vc *vault.Client, plans []namespacePlan, show func(plan *gitops.Plan)) {
+	for _, plan := range plans {
+		if len(plans) > 1 {
+			fmt.Printf("## Namespace `%s`\n\n", path.Join(vc.Namespace(), plan.Namespace))
+		}
+		if plan.Plan == nil {
+			fmt.Printf("The namespace doesn't exist in Vault yet, apply creates it and then everything in %s.\n\n", plan.Directory)
+			continue
+		}
+		show(plan.Plan)
+	}
+}
+
+// creates the namespaces with directories that don't exist in Vault yet, before applying to them
+func createNamespaces(ctx context.Context, vc *vault.Client, targets []namespaceTarget) error {
+	if len(targets) < 2 {
+		return nil
+	}
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = target.Namespace
+	}
+	created, err := gitops.CreateNamespaces(ctx, vc, names)
+	if len(created) > 0 {
+		log.Info().Strs("namespaces", created).Msg("created namespaces")
+	}
+	return err
+}
+
+// runs fn for each target concurrently with a client pointed at its namespace
+func forEachNamespace(ctx context.Context, vc *vault.Client, targets []namespaceTarget, fn func(ctx context.Context, nsClient *vault.Client, target namespaceTarget) error) error {
+	var (
+		names  = make([]string, len(targets))
+		byName = make(map[string]namespaceTarget, len(targets))
+	)
+	for i, target := range targets {
+		names[i] = path.Join(vc.Namespace(), target.Namespace)
+		byName[names[i]] = target
+	}
+	return gitops.ForEachNamespace(ctx, vc, names, gitops.DefaultNamespaceConcurrency, func(ctx context.Context, nsClient *vault.Client, namespace string) error {
+		return fn(ctx, nsClient, byName[namespace])
+	})
+}
+
+// opens the state cache for a Vault client unless --no-cache was passed
+func openStateCache(cmd *cobra.Command, vc *vault.Client) *gitops.StateCache {
+	if noCache, _ := cmd.Flags().GetBool("no-cache"); noCache {
+		return nil
+	}
+	cache, err := gitops.OpenStateCache(vc)
+	if err != nil {
+		log.Warn().Err(err).Msg("error opening state cache, continuing without it")
+		return nil
+	}
+	return cache
+}
+
+func saveStateCache(cache *gitops.StateCache) {
+	if err := cache.Save(); err != nil {
+		log.Warn().Err(err).Msg("error saving state cache")
+	}
+}
+
+// loads --state, or returns nil if it wasn't passed
+func loadAppliedState(ctx context.Context, cmd *cobra.Command, vc *vault.Client) *gitops.AppliedState {
+	location, _ := cmd.Flags().GetString("state")
+	if location == "" {
+		return nil
+	}
+	state, err := gitops.LoadAppliedState(ctx, vc, location)
+	if err != nil {
+		log.Fatal().Err(internal.VaultAPIError(err)).Msg("error loading applied state")
+	}
+	return state
+}
+
+const stateFlagUsage = "file, or " + gitops.VaultStatePrefix + " and a KV v2 data path, recording what apply applied, so --prune only deletes objects it applied and changes made in Vault are flagged"
+
+// takes the apply lock unless --no-lock was passed, returning ErrLocked if someone else has it, and a context to apply
+// under that's cancelled if the lock is lost
+func acquireLock(ctx context.Context, cmd *cobra.Command, vc *vault.Client) (context.Context, *gitops.ApplyLock, error) {
+	if noLock, _ := cmd.Flags().GetBool("no-lock"); noLock {
+		return ctx, nil, nil
+	}
+	lockCtx, lock, err := gitops.AcquireLock(ctx, vc, lockOptions(cmd))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error taking apply lock: %w", err)
+	}
+	return lockCtx, lock, nil
+}
+
+// explains an apply that was cancelled because the lock was lost partway through
+func lockError(lockCtx context.Context, err error) error {
+	if cause := context.Cause(lockCtx); err != nil && errors.Is(cause, gitops.ErrLocked) {
+		return fmt.Errorf("stopped applying because the apply lock was lost (%w): %w", cause, err)
+	}
+	return err
+}
+
+// releases the lock even after ctx was cancelled by an interrupt, so it isn't left held until it expires
+func releaseLock(ctx context.Context, lock *gitops.ApplyLock) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	if err := lock.Release(ctx); err != nil {
+		log.Warn().Err(err).Msg("error releasing apply lock")
+	}
+}
+
+// the lock --lock-path and --lock-wait describe
+func lockOptions(cmd *cobra.Command) gitops.LockOptions {
+	var opts gitops.LockOptions
+	opts.VaultPath, _ = cmd.Flags().GetString("lock-path")
+	opts.Wait, _ = cmd.Flags().GetDuration("lock-wait")
+	return opts
+}
+
+// warns about or refuses root tokens for commands that change Vault, depending on --root-token
+func checkRootToken(ctx context.Context, cmd *cobra.Command, vc *vault.Client) {
+	mode, _ := cmd.Flags().GetString("root-token")
+	switch mode {
+	case "allow":
+		return
+	case "warn", "refuse":
+	default:
+		log.Fatal().Str("root-token", mode).Msg("--root-token must be allow, warn, or refuse")
+	}
+	root, err := internal.IsRootToken(ctx, vc)
+	if err != nil {
+		log.Warn().Err(err).Msg("error checking whether the token is a root token")
+		return
+	}
+	if !root {
+		return
+	}
+	if mode == "refuse" {
+		log.Fatal().Msg("refusing to change Vault with a root token, use a token scoped to what hvresult manages (or --root-token=allow)")
+	}
+	log.Warn().Msg("changing Vault with a ROOT TOKEN; automation should use a token scoped to what hvresult manages")
+}
+
+// lists everything that was skipped for lack of permission, if anything was
+func logSkipped(report *gitops.Report) {
+	skipped := report.SortedSkipped()
+	if len(skipped) == 0 {
+		return
+	}
+	for _, item := range skipped {
+		log.Warn().Str("path", item.Path).Str("capability", item.Capability).Msg("skipped")
+	}
+	log.Warn().Int("count", len(skipped)).Msg("some objects were skipped because the token lacks capabilities on them")
+}
+
+// --concurrency, which has to be at least 1
+func concurrency(cmd *cobra.Command) int {
+	n, _ := cmd.Flags().GetInt("concurrency")
+	if n < 1 {
+		log.Fatal().Int("concurrency", n).Msg("--concurrency must be at least 1")
+	}
+	return n
+}
+
+// the ApplyOptions.Retries for --max-retries, where zero turns them off
+func maxRetries(cmd *cobra.Command) int {
+	retries, _ := cmd.Flags().GetInt("max-retries")
+	if retries <= 0 {
+		return -1
+	}
+	return retries
+}
+
+// the ApplyOptions.BackupDirectory for --backup-dir and --no-backup, which defaults to one for the cluster in the user
+// cache directory so backups, which have secrets in them, never land in the repository
+func backupDirectory(cmd *cobra.Command, vc *vault.Client) string {
+	_f := cmd.Flags()
+	if noBackup, _ := _f.GetBool("no-backup"); noBackup {
+		return ""
+	}
+	if dir, _ := _f.GetString("backup-dir"); dir != "" {
+		return dir
+	}
+	dir, err := gitops.DefaultBackupDirectory(vc)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error finding where to back up to, pass --backup-dir or --no-backup")
+	}
+	return dir
+}
+
+// the ApplyOptions.RequestTimeout for --request-timeout, where zero turns it off
+func requestTimeout(cmd *cobra.Command) time.Duration {
+	timeout, _ := cmd.Flags().GetDuration("request-timeout")
+	if timeout <= 0 {
+		return -1
+	}
+	return timeout
+}
+
+// starts logging the progress of `what` every --progress-interval, or returns nil if it's 0
+func startProgress(cmd *cobra.Command, what string) *gitops.Progress {
+	interval, _ := cmd.Flags().GetDuration("progress-interval")
+	if interval <= 0 {
+		return nil
+	}
+	return gitops.StartProgress(what, interval)
+}
+
+// the ApplyOptions.Only kinds for --only-policies and --only-auth
+func onlyKinds(cmd *cobra.Command) []gitops.ResourceKind {
+	var kinds []gitops.ResourceKind
+	if only, _ := cmd.Flags().GetBool("only-policies"); only {
+		kinds = append(kinds, gitops.PolicyResource, gitops.SentinelPolicyResource, gitops.PasswordPolicyResource)
+	}
+	if only, _ := cmd.Flags().GetBool("only-auth"); only {
+		kinds = append(kinds, gitops.AuthMountResource, gitops.AuthConfigResource, gitops.AuthRoleResource)
+	}
+	return kinds
+}
+
+// adds --only-policies, --only-auth, and --target to a command that plans
+func addTargetFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.Bool("only-policies", false, "only change ACL, Sentinel, and password policies")
+	flags.Bool("only-auth", false, "only change auth mounts, their configs, and roles")
+	flags.StringSlice("target", nil, "only change objects whose Vault paths match this glob, e.g. 'auth/approle/role/billing-*' (can be repeated)")
+}
+
+// adds --overlay, --render, and --var-file to a command that reads --directory
+func addLoadFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.String("overlay", "", "environment in "+gitops.OverlaysDirectory+"/ to read on top of "+gitops.OverlayBaseDirectory+"/, which --directory has to have")
+	flags.Bool("render", false, "replace ${NAME} in every file with the environment variable HVRESULT_VAR_NAME before reading them ($${NAME} for a literal ${NAME})")
+	flags.StringSlice("var-file", nil, "JSON or YAML file of variables for ${NAME}, overriding the environment and earlier var files (implies --render, can be repeated)")
+}
+
+// Builds what a command reads from `directory`: base/ with --overlay on top, and then variables rendered if --render or
+// --var-file is set. Returns the directory to read, which is temporary if either was needed, and a function that
+// removes it.
+func loadDirectory(cmd *cobra.Command, directory string) (string, func()) {
+	_f := cmd.Flags()
+	overlay, _ := _f.GetString("overlay")
+	if overlay == "" && gitops.IsOverlayRepository(directory) {
+		log.Fatal().Str("directory", directory).Msg("--directory has " + gitops.OverlayBaseDirectory + "/ and " + gitops.OverlaysDirectory + "/, so --overlay is needed to pick an environment")
+	}
+	cleanup := func() {}
+	if overlay != "" {
+		built, err := os.MkdirTemp("", "hvresult-overlay-*")
+		if err != nil {
+			log.Fatal().Err(err).Msg("error creating temporary directory")
+		}
+		if err := gitops.BuildOverlay(directory, overlay, built); err != nil {
+			os.RemoveAll(built)
+			log.Fatal().Err(err).Msg("error building overlay")
+		}
+		directory = built
+		cleanup = func() { os.RemoveAll(built) }
+	}
+	render, _ := _f.GetBool("render")
+	varFiles, _ := _f.GetStringSlice("var-file")
+	if !render && len(varFiles) == 0 {
+		return directory, cleanup
+	}
+	// the overlay isn't needed once it's rendered
+	defer cleanup()
+	vars := gitops.EnvVars(os.Environ())
+	for _, varFile := range varFiles {
+		fileVars, err := gitops.LoadVarFile(varFile)
+		if err != nil {
+			cleanup()
+			log.Fatal().Err(err).Msg("error loading var file")
+		}
+		maps.Copy(vars, fileVars)
+	}
+	rendered, err := os.MkdirTemp("", "hvresult-render-*")
+	if err != nil {
+		cleanup()
+		log.Fatal().Err(err).Msg("error creating temporary directory")
+	}
+	if err := gitops.RenderDirectory(directory, rendered, vars); err != nil {
+		cleanup()
+		os.RemoveAll(rendered)
+		log.Fatal().Err(err).Msg("error rendering directory")
+	}
+	log.Debug().Str("directory", rendered).Strs("var-files", varFiles).Msg("Rendered directory")
+	return rendered, func() { os.RemoveAll(rendered) }
+}
+
+// Identities are only managed if the repository has an identity directory, which download writes.
+func identityDirectory(directory string) string {
+	dir := filepath.Join(directory, "identity")
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+// Secrets engine roles are only managed if the repository has a secrets directory, which download writes.
+func secretsDirectory(directory string) string {
+	dir := filepath.Join(directory, "secrets")
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+// Secrets engines are only managed if the repository has a sys/mounts directory, which download writes.
+func mountsDirectory(directory string) string {
+	dir := filepath.Join(directory, "sys", "mounts")
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+// Quotas are only managed if the repository has a sys/quotas directory, which download writes.
+func quotasDirectory(directory string) string {
+	dir := filepath.Join(directory, "sys", "quotas")
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+// Sentinel policies are only managed if the repository has an egp or rgp directory, which download --sentinel writes.
+func sentinelDirectory(directory string) string {
+	dir := filepath.Join(directory, "sys", "policies")
+	for _, policyType := range []string{"egp", "rgp"} {
+		if info, err := os.Stat(filepath.Join(dir, policyType)); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
+
+// reads --protect-file, or the protect file in `directory` if there is one
+func loadProtectConfig(cmd *cobra.Command, directory string) *gitops.ProtectConfig {
+	filename, _ := cmd.Flags().GetString("protect-file")
+	if filename == "" {
+		filename = filepath.Join(directory, gitops.ProtectFileName)
+	}
+	config, err := gitops.LoadProtectConfig(filename)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading protect file")
+	}
+	var (
+		policies, _ = cmd.Flags().GetStringSlice("managed-policies")
+		roles, _    = cmd.Flags().GetStringSlice("managed-roles")
+	)
+	if err := config.AddManaged(policies, roles); err != nil {
+		log.Fatal().Err(err).Msg("error reading --managed-policies or --managed-roles")
+	}
+	return config
 }
@@ -0,0 +1,53 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// verifyJournalCmd represents the verify-journal command
+var verifyJournalCmd = &cobra.Command{
+	Use:   "verify-journal JOURNAL",
+	Short: "Check that a journal written by 'gitops apply --journal' hasn't been altered",
+	Long: `Checks every entry in a journal against its hash and the entry before it, and
+its signature if $HVRESULT_JOURNAL_KEY is set, then prints the hash of the
+last entry. Entries removed from the end can only be caught by comparing that
+hash to one kept somewhere else.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		key := []byte(os.Getenv("HVRESULT_JOURNAL_KEY"))
+		if len(key) == 0 {
+			log.Warn().Msg("$HVRESULT_JOURNAL_KEY isn't set, only checking hashes")
+		}
+		entries, last, err := gitops.VerifyJournal(args[0], key)
+		if err != nil {
+			log.Fatal().Err(err).Msg("journal failed verification")
+		}
+		log.Info().Int("entries", len(entries)).Msg("Journal verified.")
+		fmt.Println(last)
+	},
+}
+
+func init() {
+	gitopsCmd.AddCommand(verifyJournalCmd)
+}
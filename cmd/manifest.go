@@ -0,0 +1,59 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// verifyManifestCmd represents the verify-manifest command
+var verifyManifestCmd = &cobra.Command{
+	Use:   "verify-manifest",
+	Short: "Check downloaded files against the " + gitops.ManifestFileName + " 'gitops download' wrote",
+	Long: `Checks every file listed in the directory's manifest against its SHA-256, and
+exits 1 listing the ones that are missing or were changed since they were
+downloaded. Files that aren't in the manifest aren't checked.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		directory, _ := cmd.Flags().GetString("directory")
+		manifest, err := gitops.ReadManifest(directory)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error reading manifest")
+		}
+		changed, err := manifest.Verify()
+		if err != nil {
+			log.Fatal().Err(err).Msg("error verifying manifest")
+		}
+		if len(changed) == 0 {
+			log.Info().Int("files", len(manifest.Resources)).Str("address", manifest.Address).Time("downloaded_at", manifest.DownloadedAt).Msg("Manifest verified.")
+			return
+		}
+		for _, file := range changed {
+			fmt.Println(file)
+		}
+		log.Error().Int("count", len(changed)).Msg("files are missing or changed since they were downloaded")
+		os.Exit(1)
+	},
+}
+
+func init() {
+	gitopsCmd.AddCommand(verifyManifestCmd)
+}
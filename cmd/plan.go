@@ -0,0 +1,150 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// planCmd represents the plan command
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show what apply would change in Vault without changing anything",
+	Long: `Emits a markdown table of every policy and auth role that 'gitops apply'
+would write or delete, noting changes the current token likely isn't allowed
+to make.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			ctx          = context.Background()
+			_f           = cmd.Flags()
+			directory, _ = _f.GetString("directory")
+		)
+		// git still needs the repository itself
+		repository := directory
+		directory, cleanup := loadDirectory(cmd, directory)
+		defer cleanup()
+		vc := newGitopsClient(cmd)
+		var opts gitops.ApplyOptions
+		opts.RequestTimeout = requestTimeout(cmd)
+		opts.Retries = maxRetries(cmd)
+		opts.Concurrency = concurrency(cmd)
+		opts.Protect = loadProtectConfig(cmd, directory)
+		opts.IdentityDirectory = identityDirectory(directory)
+		opts.SentinelDirectory = sentinelDirectory(directory)
+		opts.SecretsDirectory = secretsDirectory(directory)
+		opts.MountsDirectory = mountsDirectory(directory)
+		opts.QuotasDirectory = quotasDirectory(directory)
+		opts.SkipInvalid, _ = _f.GetBool("skip-invalid")
+		opts.Strict, _ = _f.GetBool("strict")
+		opts.SkipUnchanged, _ = _f.GetBool("skip-unchanged")
+		opts.Diff, _ = _f.GetBool("diff")
+		opts.Prune, _ = _f.GetBool("prune")
+		opts.DisableMounts, _ = _f.GetBool("disable-mounts")
+		opts.Only = onlyKinds(cmd)
+		opts.Targets, _ = _f.GetStringSlice("target")
+		opts.State = loadAppliedState(ctx, cmd, vc)
+		if since, _ := _f.GetString("since"); since != "" {
+			if overlay, _ := _f.GetString("overlay"); overlay != "" {
+				log.Fatal().Msg("--since can't be used with --overlay, since changed files are in base/ or overlays/")
+			}
+			changes, _, err := gitops.GetChangedFiles(ctx, repository, since)
+			if err != nil {
+				log.Fatal().Err(err).Str("since", since).Msg("error getting changed files")
+			}
+			opts.Incremental = true
+			opts.Changes = changes
+		}
+		targets := namespaceTargets(ctx, cmd, vc, directory, false)
+		out, _ := _f.GetString("out")
+		if out != "" && len(targets) > 1 {
+			log.Fatal().Msg("--out can't be used with --recurse-namespaces, since a saved plan is for one namespace")
+		}
+		plans := planNamespaces(ctx, cmd, vc, targets, opts)
+		printNamespacePlans(vc, plans, printPlan)
+		if out != "" {
+			savePlan(ctx, vc, plans[0].Plan, opts, out)
+		}
+	},
+}
+
+// writes the plan for `apply <plan file>`
+func savePlan(ctx context.Context, vc *vault.Client, plan *gitops.Plan, opts gitops.ApplyOptions, file string) {
+	saved, err := gitops.SavePlan(ctx, vc, plan, opts)
+	if err != nil {
+		log.Fatal().Err(internal.VaultAPIError(err)).Msg("error saving plan")
+	}
+	encoded, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		log.Fatal().Err(err).Msg("error encoding plan")
+	}
+	// it has the content of everything it writes, which might not be for everyone
+	if err := os.WriteFile(file, append(encoded, '\n'), 0o600); err != nil {
+		log.Fatal().Err(err).Str("file", file).Msg("error writing plan")
+	}
+	log.Info().Str("file", file).Msgf("Saved the plan, apply exactly these changes with: gitops apply %s", file)
+}
+
+// mentions what --prune would delete, if anything
+func printUnpruned(plan *gitops.Plan) {
+	if len(plan.Unpruned) == 0 {
+		return
+	}
+	fmt.Printf("%d objects in Vault have no local files and would be deleted with --prune:\n\n", len(plan.Unpruned))
+	for _, change := range plan.Unpruned {
+		fmt.Printf("- `%s`\n", change.Path)
+	}
+	fmt.Println()
+}
+
+// prints the counts, a table of changes, and any diffs
+func printPlan(plan *gitops.Plan) {
+	printUnpruned(plan)
+	if len(plan.Changes) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+	fmt.Printf("%d to add, %d to change, %d to delete.\n\n", plan.Count(gitops.Add), plan.Count(gitops.Change), plan.Count(gitops.Delete))
+	fmt.Println(plan.MarkdownTable())
+	if diffs := plan.MarkdownDiffs(); diffs != "" {
+		fmt.Print("\n" + diffs)
+	}
+}
+
+func init() {
+	gitopsCmd.AddCommand(planCmd)
+	flags := planCmd.Flags()
+	flags.Bool("skip-invalid", false, "leave out policies and auth roles that fail validation instead of failing")
+	flags.Bool("strict", false, "fail instead of skipping auth mounts with unsupported types")
+	flags.String("since", "", "only plan files changed since this git reference instead of reconciling everything")
+	flags.Bool("skip-unchanged", false, "read objects that exist on both sides and leave out the ones that already match")
+	flags.Bool("diff", false, "also show what each change does to the object")
+	flags.String("state", "", stateFlagUsage)
+	flags.Bool("prune", false, "plan deleting policies and auth roles that don't have local files")
+	flags.Bool("disable-mounts", false, "with --prune, also plan disabling auth mounts without a "+gitops.AuthMountFileName+" and secrets engines without a file in sys/mounts")
+	flags.StringP("out", "o", "", "also save the plan to this file, for 'gitops apply <file>' to apply exactly")
+	addTargetFlags(planCmd)
+	addLoadFlags(planCmd)
+}
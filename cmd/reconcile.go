@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// reconcileCmd represents the reconcile command
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Keep checking Vault against the repository, reporting or fixing drift",
+	Long: `Runs until interrupted, comparing Vault with the directory every --interval
+the way 'gitops check' does and logging every object that has drifted. With
+--fix, drift is applied away like 'gitops apply --skip-unchanged' would.
+
+A failed round is logged and retried at the next interval.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			_f           = cmd.Flags()
+			directory, _ = _f.GetString("directory")
+			interval, _  = _f.GetDuration("interval")
+			fix, _       = _f.GetBool("fix")
+		)
+		if interval <= 0 {
+			log.Fatal().Dur("interval", interval).Msg("--interval must be positive")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		vc := newGitopsClient(cmd)
+		if fix {
+			checkRootToken(ctx, cmd, vc)
+		}
+		log.Info().Dur("interval", interval).Bool("fix", fix).Msg("reconciling")
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := reconcileOnce(ctx, cmd, vc, directory); err != nil && ctx.Err() == nil {
+				log.Error().Err(internal.VaultAPIError(err)).Msg("error reconciling, trying again next interval")
+			}
+			select {
+			case <-ctx.Done():
+				log.Info().Msg("stopped reconciling")
+				return
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+// checks for drift once, fixing it with --fix
+func reconcileOnce(ctx context.Context, cmd *cobra.Command, vc *vault.Client, directory string) error {
+	_f := cmd.Flags()
+	if pull, _ := _f.GetBool("pull"); pull {
+		if output, err := (gitops.Git{Dir: directory}).CombinedOutput("pull", "--ff-only"); err != nil {
+			log.Warn().Err(err).Str("output", output).Msg("error pulling, checking what's already checked out")
+		}
+	}
+	// rendered each round so pulled changes are picked up
+	directory, cleanup := loadDirectory(cmd, directory)
+	defer cleanup()
+	var opts gitops.ApplyOptions
+	opts.RequestTimeout = requestTimeout(cmd)
+	opts.Retries = maxRetries(cmd)
+	opts.Concurrency = concurrency(cmd)
+	opts.Protect = loadProtectConfig(cmd, directory)
+	opts.IdentityDirectory = identityDirectory(directory)
+	opts.SentinelDirectory = sentinelDirectory(directory)
+	opts.SecretsDirectory = secretsDirectory(directory)
+	opts.MountsDirectory = mountsDirectory(directory)
+	opts.QuotasDirectory = quotasDirectory(directory)
+	opts.SkipUnchanged = true
+	opts.Prune, _ = _f.GetBool("prune")
+	opts.DisableMounts, _ = _f.GetBool("disable-mounts")
+	var (
+		authDirectory   = filepath.Join(directory, "auth")
+		policyDirectory = filepath.Join(directory, "sys", "policies", "acl")
+	)
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDirectory, policyDirectory, opts)
+	if err != nil {
+		return err
+	}
+	if len(plan.Changes) == 0 {
+		log.Info().Msg("Vault is in sync")
+		return nil
+	}
+	for _, change := range plan.Changes {
+		log.Warn().Str("action", strings.ToLower(change.Mutation.String())).Str("kind", string(change.Kind)).Str("path", change.Path).Msg("drift")
+	}
+	log.Warn().
+		Int("add", plan.Count(gitops.Add)).
+		Int("change", plan.Count(gitops.Change)).
+		Int("delete", plan.Count(gitops.Delete)).
+		Msg("Vault has drifted from the repository")
+	if fix, _ := _f.GetBool("fix"); !fix {
+		return nil
+	}
+
+	opts.MaxDeletions, _ = _f.GetInt("max-deletions")
+	opts.MaxDeletionPercent, _ = _f.GetFloat64("max-delete-percent")
+	opts.BackupDirectory = backupDirectory(cmd, vc)
+	// another apply holding the lock fails this round, and the next one sees what it did
+	lockCtx, lock, err := acquireLock(ctx, cmd, vc)
+	if err != nil {
+		return err
+	}
+	err = lockError(lockCtx, gitops.ApplyChangesWithOptions(lockCtx, vc, authDirectory, policyDirectory, opts))
+	releaseLock(ctx, lock)
+	if err != nil {
+		return err
+	}
+	log.Info().Msg("fixed drift")
+	return nil
+}
+
+func init() {
+	gitopsCmd.AddCommand(reconcileCmd)
+	flags := reconcileCmd.Flags()
+	flags.Duration("interval", 5*time.Minute, "how long to wait between checks")
+	flags.Bool("fix", false, "apply the repository whenever Vault has drifted instead of only reporting it")
+	flags.Bool("pull", false, "git pull --ff-only in --directory before each check")
+	flags.Bool("prune", false, "also treat objects in Vault without local files as drift (and delete them with --fix)")
+	flags.Bool("disable-mounts", false, "with --prune, also treat auth mounts and secrets engines without files as drift")
+	flags.Int("max-deletions", 0, "with --fix, refuse to apply if more than this many objects would be deleted (0 means no limit)")
+	flags.Float64("max-delete-percent", 20, "with --fix, refuse to apply if more than this percentage of existing objects would be deleted (0 means no limit)")
+	flags.String("backup-dir", "", "with --fix, save everything that's about to change or be deleted to a timestamped directory in here first, unredacted (default is a directory for the cluster in the user cache directory)")
+	flags.Bool("no-backup", false, "don't back up before fixing drift")
+	addLoadFlags(reconcileCmd)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore BACKUP",
+	Short: "Revert an apply using the backup it wrote, or apply a snapshot from 'gitops backup'",
+	Long: `Writes back every policy and auth role saved in a backup directory written by
+'gitops apply' and deletes anything that apply added. BACKUP can also be a
+tarball of a backup directory.
+
+If BACKUP is a snapshot written by 'gitops backup' or a tarball from
+'download --archive', it's applied like a repository instead. Objects that
+were created since are only deleted with --prune.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			ctx    = context.Background()
+			backup = args[0]
+		)
+		info, err := os.Stat(backup)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error opening backup")
+		}
+		if !info.IsDir() {
+			backup = extractArchiveFile(backup)
+			defer os.RemoveAll(backup)
+		}
+		vc := newGitopsClient(cmd)
+		checkRootToken(ctx, cmd, vc)
+		opts := gitops.ApplyOptions{RequestTimeout: requestTimeout(cmd), Retries: maxRetries(cmd), Concurrency: concurrency(cmd)}
+		lockCtx, lock, err := acquireLock(ctx, cmd, vc)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error restoring backup")
+		}
+		if gitops.IsBackup(backup) {
+			err = gitops.RestoreWithOptions(lockCtx, vc, backup, opts)
+		} else {
+			err = restoreSnapshot(lockCtx, cmd, vc, backup, opts)
+		}
+		err = lockError(lockCtx, err)
+		releaseLock(ctx, lock)
+		if err != nil {
+			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error restoring backup")
+		}
+		log.Info().Msg("Successfully restored backup.")
+	},
+}
+
+func init() {
+	gitopsCmd.AddCommand(restoreCmd)
+	flags := restoreCmd.Flags()
+	flags.Bool("prune", false, "when restoring a snapshot, also delete policies and auth roles that aren't in it")
+	flags.Bool("disable-mounts", false, "with --prune, also disable auth mounts and secrets engines that aren't in the snapshot, deleting everything in them")
+}
+
+// applies a snapshot like a repository, putting back whatever was changed if part of it fails
+func restoreSnapshot(ctx context.Context, cmd *cobra.Command, vc *vault.Client, directory string, opts gitops.ApplyOptions) error {
+	_f := cmd.Flags()
+	opts.SkipUnchanged = true
+	opts.Rollback = true
+	opts.Prune, _ = _f.GetBool("prune")
+	opts.DisableMounts, _ = _f.GetBool("disable-mounts")
+	log.Info().Str("snapshot", directory).Msg("Restoring snapshot")
+	targets := namespaceTargets(ctx, cmd, vc, directory, false)
+	return forEachNamespace(ctx, vc, targets, func(ctx context.Context, nsClient *vault.Client, target namespaceTarget) error {
+		return gitops.ApplyChangesWithOptions(ctx, nsClient, filepath.Join(target.Directory, "auth"), filepath.Join(target.Directory, "sys", "policies", "acl"), namespaceOptions(cmd, opts, target))
+	})
+}
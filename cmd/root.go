@@ -19,15 +19,17 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
 	"strings"
 
-	vault "github.com/hashicorp/vault/api"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/idp"
 	"golang.org/x/term"
 )
 
@@ -35,6 +37,7 @@ var (
 	cfgFile     string
 	flagVerbose bool
 	flagFormat  string
+	flagIdP     string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -57,6 +60,14 @@ By default, hvresult will evaluate and print the RSoP for each.
 		if term.IsTerminal(int(os.Stdin.Fd())) {
 			log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 		}
+		if pprofAddr, _ := cmd.Flags().GetString("pprof"); pprofAddr != "" {
+			go func() {
+				log.Info().Str("address", pprofAddr).Msg("serving pprof at /debug/pprof/")
+				if err := http.ListenAndServe(pprofAddr, nil); err != nil {
+					log.Error().Err(err).Msg("error serving pprof")
+				}
+			}()
+		}
 	},
 	PreRun: func(cmd *cobra.Command, args []string) {
 		flagFormat = strings.ToLower(flagFormat)
@@ -69,28 +80,58 @@ By default, hvresult will evaluate and print the RSoP for each.
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
-		vc, err := vault.NewClient(vault.DefaultConfig())
+		vc, err := internal.NewVaultClient(1)
 		if err != nil {
 			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error creating Vault client")
 		}
 		if vc.Token() == "" {
 			log.Fatal().Msg("Vault client from defaults has no token - VAULT_TOKEN environment variable is probably empty")
 		}
-		pp, err := internal.NewReadthroughPolicyProvider("", vc)
+		noDefaultPolicy, _ := cmd.Flags().GetBool("no-default-policy")
+		pp, err := internal.NewReadthroughPolicyProviderWithOptions("", vc, internal.PolicyProviderOptions{
+			ExcludeDefaultPolicy: noDefaultPolicy,
+		})
 		if err != nil {
 			log.Fatal().Err(internal.VaultAPIError(err)).Msg("error creating PolicyProvider")
 		}
+		var resolver idp.GroupResolver
+		if flagIdP != "" {
+			idpDomain, _ := cmd.Flags().GetString("idp-domain")
+			resolver, err = idp.NewGroupResolver(flagIdP, idpDomain, os.Getenv("HVRESULT_IDP_TOKEN"))
+			if err != nil {
+				log.Fatal().Err(err).Msg("error creating identity provider client")
+			}
+		}
 		for _, arg := range args {
 			rsop, err := pp.GetRSoP(ctx, arg)
 			if err != nil {
 				log.Fatal().Err(internal.VaultAPIError(err)).Msg("error generating RSoP")
 			}
 			log.Debug().EmbedObject(rsop).Msgf("printing as %s to stdout", flagFormat)
+			var members []string
+			if resolver != nil {
+				groupName, external, err := idp.ExternalGroupName(ctx, vc, arg)
+				if err != nil {
+					log.Fatal().Err(internal.VaultAPIError(err)).Msg("error reading external group")
+				}
+				if external {
+					members, err = resolver.Members(ctx, groupName)
+					if err != nil {
+						log.Fatal().Err(err).Str("group", groupName).Msg("error expanding identity provider group")
+					}
+				}
+			}
 			capmap := rsop.GetCapabilityMap()
 			switch flagFormat {
 			case "hcl":
+				if len(members) > 0 {
+					fmt.Printf("# members (via %s): %s\n", flagIdP, strings.Join(members, ", "))
+				}
 				fmt.Println(strings.TrimSpace(capmap.HCL()))
 			case "table":
+				if len(members) > 0 {
+					fmt.Printf("Members (via %s): %s\n\n", flagIdP, strings.Join(members, ", "))
+				}
 				empty := &internal.RSoPCapMap{}
 				diff := empty.Diff(capmap)
 				log.Debug().Any("diff", diff).Msg("generated diff")
@@ -114,8 +155,12 @@ func init() {
 	persistent := rootCmd.PersistentFlags()
 	persistent.StringVar(&cfgFile, "config", "", "config file (default is $HOME/.hvaa.yaml)")
 	persistent.BoolVarP(&flagVerbose, "verbose", "v", false, "print debug level logs")
+	persistent.String("pprof", "", "serve net/http/pprof on this address while running, e.g. localhost:6060")
 	flags := rootCmd.Flags()
 	flags.StringVar(&flagFormat, "format", "hcl", "output format")
+	flags.StringVar(&flagIdP, "idp", "", "expand external identity groups into their members with 'okta' or 'azure' (token read from $HVRESULT_IDP_TOKEN)")
+	flags.String("idp-domain", "", "Okta org domain used with --idp okta, e.g. example.okta.com")
+	flags.Bool("no-default-policy", false, "leave out the default policy that Vault attaches to nearly every token")
 	flags.BoolP("toggle", "t", false, "Help message for toggle")
 }
 
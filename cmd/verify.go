@@ -0,0 +1,85 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the repository for problems without contacting Vault",
+	Long: `Checks everything 'gitops apply' would before writing anything, without a Vault
+token or network access, so it can run as a pre-commit hook or in CI:
+
+- files that apply would ignore because they aren't where it looks
+- policies, auth roles, mounts, identities, and everything else that doesn't
+  parse or validate, including auth roles against their mount type's schema
+  when the mount has a ` + gitops.AuthMountFileName + `
+- auth roles, entities, and groups granting policies without a file, and groups
+  with member entities or groups without a file
+
+and exits 1 listing them if there are any.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root, _ := cmd.Flags().GetString("directory")
+		directory, cleanup := loadDirectory(cmd, root)
+		defer cleanup()
+		var problems []string
+		// namespaces are found in the repository, not Vault
+		for _, target := range namespaceTargets(context.Background(), cmd, nil, directory, false) {
+			var opts gitops.ApplyOptions
+			opts.IdentityDirectory = identityDirectory(target.Directory)
+			opts.SentinelDirectory = sentinelDirectory(target.Directory)
+			opts.SecretsDirectory = secretsDirectory(target.Directory)
+			opts.MountsDirectory = mountsDirectory(target.Directory)
+			opts.QuotasDirectory = quotasDirectory(target.Directory)
+			found, err := gitops.VerifyDirectory(target.Directory, opts)
+			if err != nil {
+				cleanup()
+				log.Fatal().Err(err).Str("namespace", target.Namespace).Msg("error verifying directory")
+			}
+			for _, problem := range found {
+				// relative to --directory, even if it was rendered somewhere else
+				problems = append(problems, strings.TrimPrefix(problem.Error(), filepath.Clean(directory)+string(filepath.Separator)))
+			}
+		}
+		if len(problems) == 0 {
+			log.Info().Msg("No problems found.")
+			return
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		log.Error().Int("count", len(problems)).Msg("problems found")
+		cleanup()
+		os.Exit(1)
+	},
+}
+
+func init() {
+	gitopsCmd.AddCommand(verifyCmd)
+	addLoadFlags(verifyCmd)
+}
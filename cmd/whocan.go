@@ -0,0 +1,108 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mdtf "github.com/fbiville/markdown-table-formatter/pkg/markdown"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/idp"
+)
+
+// whoCanCmd represents the who-can command
+var whoCanCmd = &cobra.Command{
+	Use:   "who-can PATH...",
+	Short: "Lists the auth principals that can access Vault paths",
+	Long: `Emits a markdown table for each path of every auth principal and external
+identity group in a git repository that has capabilities on it, and the
+policies responsible. With --idp, external groups list their members in the
+identity provider too.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			_f           = cmd.Flags()
+			directory, _ = _f.GetString("directory")
+			idpKind, _   = _f.GetString("idp")
+			idpDomain, _ = _f.GetString("idp-domain")
+		)
+		index, err := gitops.BuildPathIndex(directory, filepath.Join("sys", "policies", "acl"), "auth", filepath.Join("identity", "group"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("error indexing repository")
+		}
+		var resolver idp.GroupResolver
+		if idpKind != "" {
+			resolver, err = idp.NewGroupResolver(idpKind, idpDomain, os.Getenv("HVRESULT_IDP_TOKEN"))
+			if err != nil {
+				log.Fatal().Err(err).Msg("error creating identity provider client")
+			}
+		}
+		for _, path := range args {
+			results := index.WhoCan(path)
+			fmt.Printf("## `%s`\n\n", path)
+			if len(results) == 0 {
+				fmt.Print("No auth principals have capabilities on this path.\n\n")
+				continue
+			}
+			if resolver != nil {
+				if err := gitops.ExpandExternalGroups(context.Background(), resolver, results); err != nil {
+					log.Fatal().Err(err).Msg("error expanding external groups")
+				}
+			}
+			rows := make([][]string, 0, len(results))
+			for _, result := range results {
+				caps := make([]string, len(result.Capabilities))
+				for i, c := range result.Capabilities {
+					caps[i] = string(c)
+				}
+				rows = append(rows, []string{
+					result.Principal,
+					strings.Join(caps, ", "),
+					fmt.Sprintf("`%s` from %s", result.Pattern, strings.Join(result.Policies, ", ")),
+				})
+				if resolver != nil {
+					rows[len(rows)-1] = append(rows[len(rows)-1], strings.Join(result.Members, ", "))
+				}
+			}
+			columns := []string{"Auth Principal", "Capabilities", "Via"}
+			if resolver != nil {
+				columns = append(columns, fmt.Sprintf("Members (via %s)", idpKind))
+			}
+			table, err := mdtf.NewTableFormatterBuilder().
+				WithPrettyPrint().
+				Build(columns...).
+				Format(rows)
+			if err != nil {
+				log.Fatal().Err(err).Msg("error formatting table")
+			}
+			fmt.Println(table)
+		}
+	},
+}
+
+func init() {
+	gitopsCmd.AddCommand(whoCanCmd)
+	flags := whoCanCmd.Flags()
+	flags.String("idp", "", "list the members of external identity groups with 'okta' or 'azure' (token read from $HVRESULT_IDP_TOKEN)")
+	flags.String("idp-domain", "", "Okta org domain used with --idp okta, e.g. example.okta.com")
+}
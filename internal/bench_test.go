@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+// object counts shared by the benchmarks so regressions show up at every scale
+var benchmarkSizes = []int{1_000, 10_000, 100_000}
+
+// Policies with a few overlapping paths each, roughly what a large estate looks like.
+func syntheticPolicies(n int) []*Policy {
+	policies := make([]*Policy, n)
+	for i := range policies {
+		policies[i] = &Policy{
+			Name: fmt.Sprintf("policy-%06d", i),
+			Paths: []PathConfig{
+				{Path: fmt.Sprintf("secret/data/team-%d/*", i%100), Capabilities: []Capability{Read, List}},
+				{Path: fmt.Sprintf("secret/data/app-%d", i), Capabilities: []Capability{Create, Read, Update}},
+				{Path: "sys/leases/+/renew", Capabilities: []Capability{Update}},
+			},
+		}
+		if i%50 == 0 {
+			policies[i].Paths = append(policies[i].Paths, PathConfig{Path: fmt.Sprintf("secret/data/team-%d/*", i%100), Capabilities: []Capability{Deny}})
+		}
+	}
+	return policies
+}
+
+func BenchmarkParsePolicy(b *testing.B) {
+	const policy = `
+path "secret/data/team/*" { capabilities = ["read", "list"] }
+path "secret/data/app" { capabilities = ["create", "read", "update"] }
+path "sys/leases/+/renew" { capabilities = ["update"] }
+`
+	for i := 0; i < b.N; i++ {
+		if _, err := ParsePolicy(policy, "bench"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetCapabilityMap(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		rsop := &RSoP{Policies: syntheticPolicies(size)}
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rsop.GetCapabilityMap()
+			}
+		})
+	}
+}
+
+func BenchmarkDiff(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		policies := syntheticPolicies(size)
+		before := (&RSoP{Policies: policies[:size/2]}).GetCapabilityMap()
+		after := (&RSoP{Policies: policies[size/4:]}).GetCapabilityMap()
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				before.Diff(after)
+			}
+		})
+	}
+}
+
+func BenchmarkPathTrieMatch(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		var trie PathTrie[string]
+		for _, policy := range syntheticPolicies(size) {
+			for _, path := range policy.Paths {
+				trie.Insert(path.Path, policy.Name)
+			}
+		}
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				trie.Match(fmt.Sprintf("secret/data/app-%d", i%size))
+			}
+		})
+	}
+}
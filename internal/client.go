@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// NewVaultClient creates a Vault client from the environment with a connection pool sized for `concurrency` requests in flight.
+//
+// Create one per command and share it between phases so connections (and their TLS handshakes) get reused.
+func NewVaultClient(concurrency int) (*vault.Client, error) {
+	cfg := vault.DefaultConfig()
+	if cfg.Error != nil {
+		return nil, fmt.Errorf("error reading Vault client configuration: %w", cfg.Error)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// DefaultConfig already negotiates HTTP/2, which multiplexes over a single connection when the server supports it
+	if transport, ok := cfg.HttpClient.Transport.(*http.Transport); ok {
+		transport.DisableKeepAlives = false
+		transport.MaxIdleConnsPerHost = concurrency
+		if transport.MaxIdleConns < concurrency {
+			transport.MaxIdleConns = concurrency
+		}
+		transport.IdleConnTimeout = 90 * time.Second
+	}
+	// behind a load balancer, requests can land on performance standbys that haven't seen our last write yet.
+	// This sends the index state from every response with the next request so they wait for it (or return a 412,
+	// which gets retried) instead of answering with stale data.
+	cfg.ReadYourWrites = true
+	return vault.NewClient(cfg)
+}
+
+// IsRootToken reports whether the client's token is a root token or otherwise carries the root policy.
+func IsRootToken(ctx context.Context, vc *vault.Client) (bool, error) {
+	secret, err := vc.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error looking up token: %w", err)
+	}
+	policies, err := secret.TokenPolicies()
+	if err != nil {
+		return false, fmt.Errorf("error reading token policies: %w", err)
+	}
+	for _, policy := range policies {
+		if policy == "root" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
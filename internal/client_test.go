@@ -0,0 +1,31 @@
+package internal_test
+
+import (
+	"context"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestIsRootToken(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	if root, err := internal.IsRootToken(ctx, vc); err != nil || !root {
+		t.Fatalf("expected the dev server's token to be root, got %v (%v)", root, err)
+	}
+	token, err := vc.Auth().Token().CreateWithContext(ctx, &vault.TokenCreateRequest{Policies: []string{"default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scoped, err := vc.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scoped.SetToken(token.Auth.ClientToken)
+	if root, err := internal.IsRootToken(ctx, scoped); err != nil || root {
+		t.Fatalf("expected a scoped token not to be root, got %v (%v)", root, err)
+	}
+}
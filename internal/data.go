@@ -1,12 +1,19 @@
 package internal
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"sort"
+	"strings"
+	"sync"
 
+	"github.com/agext/levenshtein"
 	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclsimple"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/rs/zerolog"
+	"github.com/zclconf/go-cty/cty"
 )
 
 // Policy represents a Vault policy document.
@@ -43,8 +50,17 @@ func (p PathConfig) MarshalZerologObject(e *zerolog.Event) {
 	e.Any("Capabilities", p.Capabilities)
 }
 
+// parsed policies by sha256 of their HCL, shared by everything in the process
+var parsedPolicies sync.Map
+
 // ParsePolicy creates a Policy object and sorts by path.
+//
+// Parsed policies are cached by content, so parsing the same document again is cheap.
 func ParsePolicy(policyData, name string) (*Policy, error) {
+	key := sha256.Sum256([]byte(policyData))
+	if cached, ok := parsedPolicies.Load(key); ok {
+		return cached.(*Policy).copyAs(name), nil
+	}
 	var policy Policy
 	if err := hclsimple.Decode(name+".hcl", []byte(policyData), nil, &policy); err != nil {
 		return nil, fmt.Errorf("error parsing policy HCL: %w", err)
@@ -53,8 +69,164 @@ func ParsePolicy(policyData, name string) (*Policy, error) {
 	sort.Slice(policy.Paths, func(i, j int) bool {
 		return policy.Paths[i].Path < policy.Paths[j].Path
 	})
-	policy.Name = name
-	return &policy, nil
+	parsedPolicies.Store(key, &policy)
+	return policy.copyAs(name), nil
+}
+
+// ValidatePolicy checks that policy HCL would parse, with file/line diagnostics that refer to `filename`.
+func ValidatePolicy(policyData []byte, filename string) error {
+	file, diags := hclsyntax.ParseConfig(policyData, filename, hcl.InitialPos)
+	if diags.HasErrors() {
+		return diags
+	}
+	var policy Policy
+	if diags := gohcl.DecodeBody(file.Body, nil, &policy); diags.HasErrors() {
+		return diags
+	}
+	if diags := validateCapabilities(file.Body); diags.HasErrors() {
+		return diags
+	}
+	if diags := validatePathArguments(file.Body); diags.HasErrors() {
+		return diags
+	}
+	return nil
+}
+
+// Everything Vault reads from a path block. Vault ignores anything else, so a typo'd restriction silently isn't one.
+//
+// https://developer.hashicorp.com/vault/docs/concepts/policies#parameter-constraints
+var pathArguments = []string{
+	"capabilities",
+	"policy",
+	"allowed_parameters",
+	"denied_parameters",
+	"required_parameters",
+	"min_wrapping_ttl",
+	"max_wrapping_ttl",
+	"mfa_methods",
+	"control_group",
+}
+
+func validatePathArguments(body hcl.Body) hcl.Diagnostics {
+	syntaxBody, ok := body.(*hclsyntax.Body)
+	if !ok {
+		return nil
+	}
+	var diags hcl.Diagnostics
+	unknown := func(name string, subject hcl.Range) {
+		detail := fmt.Sprintf("Vault ignores unknown arguments in path blocks; valid ones are %s.", strings.Join(pathArguments, ", "))
+		if suggestion := closest(name, pathArguments); suggestion != "" {
+			detail = fmt.Sprintf("Did you mean %q? %s", suggestion, detail)
+		}
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Unknown path argument %q", name),
+			Detail:   detail,
+			Subject:  subject.Ptr(),
+		})
+	}
+	for _, block := range syntaxBody.Blocks {
+		if block.Type != "path" {
+			continue
+		}
+		for name, attr := range block.Body.Attributes {
+			if !contains(name, pathArguments...) {
+				unknown(name, attr.NameRange)
+			}
+		}
+		// control_group can be written as a block too
+		for _, nested := range block.Body.Blocks {
+			if !contains(nested.Type, pathArguments...) {
+				unknown(nested.Type, nested.TypeRange)
+			}
+		}
+	}
+	// attributes come out of a map
+	sort.SliceStable(diags, func(i, j int) bool {
+		return diags[i].Subject.Start.Byte < diags[j].Subject.Start.Byte
+	})
+	return diags
+}
+
+// Vault accepts capabilities it doesn't know and ignores them, so a typo silently grants less than intended.
+func validateCapabilities(body hcl.Body) hcl.Diagnostics {
+	syntaxBody, ok := body.(*hclsyntax.Body)
+	if !ok {
+		return nil
+	}
+	var diags hcl.Diagnostics
+	for _, block := range syntaxBody.Blocks {
+		if block.Type != "path" {
+			continue
+		}
+		attr, ok := block.Body.Attributes["capabilities"]
+		if !ok {
+			continue
+		}
+		tuple, ok := attr.Expr.(*hclsyntax.TupleConsExpr)
+		if !ok {
+			continue
+		}
+		for _, expr := range tuple.Exprs {
+			value, valueDiags := expr.Value(nil)
+			if valueDiags.HasErrors() || value.IsNull() || value.Type() != cty.String {
+				continue
+			}
+			capability := Capability(value.AsString())
+			if contains(capability, ValidCapabilities...) {
+				continue
+			}
+			detail := fmt.Sprintf("Vault ignores unknown capabilities; valid ones are %s.", joinCapabilities(ValidCapabilities))
+			if suggestion := closestCapability(capability); suggestion != "" {
+				detail = fmt.Sprintf("Did you mean %q? %s", suggestion, detail)
+			}
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Unknown capability %q", capability),
+				Detail:   detail,
+				Subject:  expr.Range().Ptr(),
+			})
+		}
+	}
+	return diags
+}
+
+func closestCapability(capability Capability) Capability {
+	names := make([]string, len(ValidCapabilities))
+	for i, c := range ValidCapabilities {
+		names[i] = string(c)
+	}
+	return Capability(closest(string(capability), names))
+}
+
+// The valid name `name` is most likely a typo of, if any.
+func closest(name string, valid []string) string {
+	var (
+		best     string
+		distance = 3 // anything further away isn't a typo
+	)
+	for _, candidate := range valid {
+		if d := levenshtein.Distance(name, candidate, nil); d < distance {
+			best, distance = candidate, d
+		}
+	}
+	return best
+}
+
+func joinCapabilities(capabilities []Capability) string {
+	names := make([]string, len(capabilities))
+	for i, c := range capabilities {
+		names[i] = string(c)
+	}
+	return strings.Join(names, ", ")
+}
+
+// callers are free to rename or re-sort what ParsePolicy returns, so the cache hands out copies
+func (p *Policy) copyAs(name string) *Policy {
+	return &Policy{
+		Name:  name,
+		Paths: append([]PathConfig(nil), p.Paths...),
+	}
 }
 
 type ControlGroup struct {
@@ -71,6 +243,7 @@ const (
 	Create    Capability = "create"
 	Read      Capability = "read"
 	Update    Capability = "update"
+	Patch     Capability = "patch"
 	Delete    Capability = "delete"
 	List      Capability = "list"
 	Sudo      Capability = "sudo"
@@ -78,14 +251,19 @@ const (
 	Subscribe Capability = "subscribe"
 )
 
+// ValidCapabilities is every capability Vault knows, in the order it documents them.
+var ValidCapabilities = []Capability{Create, Read, Update, Patch, Delete, List, Sudo, Deny, Subscribe}
+
 // For use with `sort.Slice()`.
 func (c Capability) Less(other Capability) bool {
 	switch c {
 	case Create:
 		return other != Create
 	case Read:
-		return contains(other, Update, Delete, List, Sudo, Deny, Subscribe)
+		return contains(other, Update, Patch, Delete, List, Sudo, Deny, Subscribe)
 	case Update:
+		return contains(other, Patch, Delete, List, Sudo, Deny, Subscribe)
+	case Patch:
 		return contains(other, Delete, List, Sudo, Deny, Subscribe)
 	case Delete:
 		return contains(other, List, Sudo, Deny, Subscribe)
@@ -2,6 +2,7 @@ package internal_test
 
 import (
 	_ "embed"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -38,3 +39,77 @@ func TestHCL(t *testing.T) {
 		t.Fatal(diff)
 	}
 }
+
+func TestParsePolicyCache(t *testing.T) {
+	const hcl = `path "secret/b" { capabilities = ["read"] }
+path "secret/a" { capabilities = ["list"] }`
+	first, err := internal.ParsePolicy(hcl, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := internal.ParsePolicy(hcl, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Name != "first" || second.Name != "second" {
+		t.Fatalf("cached policies share a name: %s, %s", first.Name, second.Name)
+	}
+	// changing one copy doesn't affect the other
+	first.Paths[0].Path = "changed"
+	if second.Paths[0].Path != "secret/a" {
+		t.Fatalf("cached policies share paths: %s", second.Paths[0].Path)
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	if err := internal.ValidatePolicy([]byte(`path "secret/*" { capabilities = ["read"] }`), "ok"); err != nil {
+		t.Fatal(err)
+	}
+	err := internal.ValidatePolicy([]byte("path \"secret/*\" {\n  capabilities = [\"read\"\n}\n"), "sys/policies/acl/broken")
+	if err == nil {
+		t.Fatal("expected an error for a missing bracket")
+	}
+	if !strings.Contains(err.Error(), "sys/policies/acl/broken:") {
+		t.Fatalf("expected a file/line diagnostic, got: %v", err)
+	}
+}
+
+func TestValidatePolicyCapabilities(t *testing.T) {
+	err := internal.ValidatePolicy([]byte(`path "secret/*" { capabilities = ["create", "read", "update", "patch", "delete", "list", "sudo", "deny", "subscribe"] }`), "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = internal.ValidatePolicy([]byte("path \"secret/*\" {\n  capabilities = [\"list\", \"raed\"]\n}\n"), "typo")
+	if err == nil {
+		t.Fatal("expected an error for an unknown capability")
+	}
+	for _, expected := range []string{"typo:2,", `Unknown capability "raed"`, `Did you mean "read"?`} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in: %v", expected, err)
+		}
+	}
+}
+
+func TestValidatePolicyArguments(t *testing.T) {
+	err := internal.ValidatePolicy([]byte(`path "secret/*" {
+  capabilities = ["update"]
+  allowed_parameters = { "foo" = [] }
+  min_wrapping_ttl = "1m"
+  control_group {
+    ttl = "4h"
+  }
+}
+`), "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = internal.ValidatePolicy([]byte("path \"secret/*\" {\n  capabilities = [\"update\"]\n  denied_parameter = { \"foo\" = [] }\n}\n"), "typo")
+	if err == nil {
+		t.Fatal("expected an error for an unknown path argument")
+	}
+	for _, expected := range []string{"typo:3,", `Unknown path argument "denied_parameter"`, `Did you mean "denied_parameters"?`} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in: %v", expected, err)
+		}
+	}
+}
@@ -1,31 +1,167 @@
 package internal
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"syscall"
 
 	vault "github.com/hashicorp/vault/api"
 )
 
-// VaultAPIError provides more user-friendly messages for common Vault API errors.
+// ErrorKind is the broad reason a Vault request failed.
+type ErrorKind string
+
+const (
+	UnknownError     ErrorKind = "error"
+	PermissionDenied ErrorKind = "permission denied"
+	InvalidToken     ErrorKind = "invalid token"
+	VaultSealed      ErrorKind = "sealed"
+	WrongNamespace   ErrorKind = "wrong namespace"
+	TLSError         ErrorKind = "TLS error"
+	ConnectionError  ErrorKind = "connection error"
+)
+
+// VaultError is a failed Vault request with what kind of failure it was and what to do about it.
+type VaultError struct {
+	Kind ErrorKind
+	// The Vault path the request was for, if it's known.
+	Path string
+	// What to try next, if there's anything better than reading the error.
+	Hint string
+	Err  error
+}
+
+func (e *VaultError) Error() string {
+	msg := fmt.Sprintf("Vault %s", e.Kind)
+	if e.Path != "" {
+		msg += " on " + e.Path
+	}
+	msg += ": " + e.Err.Error()
+	if e.Hint != "" {
+		msg += " (" + e.Hint + ")"
+	}
+	return msg
+}
+
+func (e *VaultError) Unwrap() error {
+	return e.Err
+}
+
+// VaultAPIError classifies err into a *VaultError with a remediation hint. It returns nil for nil and err itself if it's
+// already been classified.
 func VaultAPIError(err error) error {
 	if err == nil {
 		return nil
 	}
+	return ClassifyError(err)
+}
 
-	// Check for Vault API errors
-	if apiErr, ok := err.(*vault.ResponseError); ok {
-		if len(apiErr.Errors) > 0 {
-			// Join multiple Vault API errors
-			return fmt.Errorf("Vault API error: %s", strings.Join(apiErr.Errors, "; "))
-		}
+// ClassifyError works out what kind of failure err is from the errors it wraps.
+func ClassifyError(err error) *VaultError {
+	var classified *VaultError
+	if errors.As(err, &classified) {
+		return classified
+	}
+	classified = &VaultError{Kind: UnknownError, Err: err}
+
+	var respErr *vault.ResponseError
+	if errors.As(err, &respErr) {
+		classified.Path = responsePath(respErr)
+		classifyResponse(classified, respErr)
+		return classified
+	}
+
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		verification     *tls.CertificateVerificationError
+		recordHeader     tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &unknownAuthority), errors.As(err, &verification):
+		classified.Kind = TLSError
+		classified.Hint = "the server certificate isn't trusted, set $VAULT_CACERT to the CA that signed it"
+	case errors.As(err, &hostname):
+		classified.Kind = TLSError
+		classified.Hint = "the server certificate doesn't cover this host name, check $VAULT_ADDR or set $VAULT_TLS_SERVER_NAME"
+	case errors.As(err, &invalid):
+		classified.Kind = TLSError
+		classified.Hint = "the server certificate is expired or otherwise invalid"
+	case errors.As(err, &recordHeader):
+		classified.Kind = TLSError
+		classified.Hint = "the server didn't answer with TLS, check whether $VAULT_ADDR should be http://"
+	}
+	if classified.Kind != UnknownError {
+		return classified
 	}
 
-	// Check for common network/connection errors
-	if strings.Contains(err.Error(), "connection refused") || strings.Contains(err.Error(), "no such host") {
-		return fmt.Errorf("Vault connection error: %s. Ensure VAULT_ADDR is correct and Vault is running.", err.Error())
+	var (
+		dnsErr *net.DNSError
+		urlErr *url.Error
+		opErr  *net.OpError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		classified.Kind = ConnectionError
+		classified.Hint = "the Vault host name doesn't resolve, check $VAULT_ADDR"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		classified.Kind = ConnectionError
+		classified.Hint = "nothing is listening at $VAULT_ADDR, check it's correct and Vault is running"
+	case errors.As(err, &opErr), errors.As(err, &urlErr):
+		classified.Kind = ConnectionError
+		classified.Hint = "check $VAULT_ADDR is correct and Vault is reachable"
+	}
+	return classified
+}
+
+func classifyResponse(classified *VaultError, respErr *vault.ResponseError) {
+	has := func(message string) bool {
+		for _, e := range respErr.Errors {
+			if strings.Contains(strings.ToLower(e), message) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("invalid token"), has("token expired"), has("token is expired"), has("bad token"):
+		classified.Kind = InvalidToken
+		classified.Hint = "the token is expired, revoked, or mistyped; log in again or check $VAULT_TOKEN"
+	case respErr.StatusCode == http.StatusServiceUnavailable && has("sealed"):
+		classified.Kind = VaultSealed
+		classified.Hint = "Vault has to be unsealed before anything can be read or changed"
+	case respErr.StatusCode == http.StatusForbidden:
+		classified.Kind = PermissionDenied
+		classified.Hint = "the token's policies don't grant this; see what does with 'hvresult who-can " + classified.Path + "'"
+		if os.Getenv("VAULT_NAMESPACE") != "" {
+			classified.Hint += ", and check $VAULT_NAMESPACE is the namespace the token belongs to"
+		}
+	case respErr.StatusCode == http.StatusNotFound && has("no handler for route"):
+		classified.Kind = WrongNamespace
+		classified.Hint = "nothing is mounted there; check $VAULT_NAMESPACE and the mount path"
 	}
+}
 
-	// Generic fallback
-	return fmt.Errorf("Vault operation failed: %w", err)
+// The Vault path of a request, e.g. sys/policies/acl/foo.
+func responsePath(respErr *vault.ResponseError) string {
+	if respErr.URL == "" {
+		return ""
+	}
+	u, err := url.Parse(respErr.URL)
+	if err != nil {
+		return ""
+	}
+	_, path, found := strings.Cut(u.Path, "/v1/")
+	if !found {
+		return ""
+	}
+	return path
 }
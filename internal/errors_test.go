@@ -0,0 +1,81 @@
+package internal_test
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+func TestClassifyError(t *testing.T) {
+	for name, tc := range map[string]struct {
+		err          error
+		expectedKind internal.ErrorKind
+		expectedPath string
+	}{
+		"permission denied": {
+			err: fmt.Errorf("error writing policy foo to Vault: %w", &vault.ResponseError{
+				URL:        "https://vault.example.com/v1/sys/policies/acl/foo",
+				StatusCode: 403,
+				Errors:     []string{"1 error occurred:\n\t* permission denied\n\n"},
+			}),
+			expectedKind: internal.PermissionDenied,
+			expectedPath: "sys/policies/acl/foo",
+		},
+		"invalid token": {
+			err:          &vault.ResponseError{StatusCode: 403, Errors: []string{"permission denied", "invalid token"}},
+			expectedKind: internal.InvalidToken,
+		},
+		"sealed": {
+			err:          &vault.ResponseError{StatusCode: 503, Errors: []string{"Vault is sealed"}},
+			expectedKind: internal.VaultSealed,
+		},
+		"wrong namespace": {
+			err: &vault.ResponseError{
+				URL:        "https://vault.example.com/v1/auth/kubernetes/role",
+				StatusCode: 404,
+				Errors:     []string{"no handler for route \"auth/kubernetes/role\". route entry not found."},
+			},
+			expectedKind: internal.WrongNamespace,
+			expectedPath: "auth/kubernetes/role",
+		},
+		"untrusted certificate": {
+			err:          &url.Error{Op: "Get", URL: "https://vault.example.com", Err: x509.UnknownAuthorityError{}},
+			expectedKind: internal.TLSError,
+		},
+		"connection refused": {
+			err:          &url.Error{Op: "Get", URL: "https://vault.example.com", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}},
+			expectedKind: internal.ConnectionError,
+		},
+		"unknown": {
+			err:          errors.New("boom"),
+			expectedKind: internal.UnknownError,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			classified := internal.ClassifyError(tc.err)
+			if classified.Kind != tc.expectedKind {
+				t.Errorf("expected kind %q, got %q", tc.expectedKind, classified.Kind)
+			}
+			if classified.Path != tc.expectedPath {
+				t.Errorf("expected path %q, got %q", tc.expectedPath, classified.Path)
+			}
+			if !errors.Is(classified, tc.err) {
+				t.Error("expected the classified error to wrap the original")
+			}
+			if tc.expectedKind != internal.UnknownError && classified.Hint == "" {
+				t.Error("expected a hint")
+			}
+			// classifying again doesn't wrap again
+			if again := internal.ClassifyError(classified); again != classified {
+				t.Error("expected an already classified error to be returned as is")
+			}
+		})
+	}
+}
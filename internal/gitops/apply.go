@@ -3,223 +3,428 @@ package gitops
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/fs"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/sync/errgroup"
 )
 
+// How many Vault requests are in flight at once.
+const DefaultConcurrency = 5
+
+// ApplyOptions change how ApplyChangesWithOptions behaves. The zero value behaves like ApplyChanges.
+type ApplyOptions struct {
+	// Read each remote object before writing it and skip the write if nothing would change.
+	//
+	// Costs a read per object, but every write is a raft entry and an audit event.
+	SkipUnchanged bool
+	// Only apply Changes instead of reconciling everything, e.g. the files changed since the last applied commit.
+	Incremental bool
+	// Paths relative to the repository, as returned by GetChangedFiles.
+	Changes []ChangedFile
+	// If set, the hash of every policy and auth role that's written or found unchanged is recorded in it. It never
+	// skips reading an object before deciding to leave it alone, since it may have been changed in Vault since.
+	Cache *StateCache
+	// Leave policies and auth roles that fail validation alone instead of refusing to apply anything.
+	SkipInvalid bool
+	// Delete policies even if auth roles, entities, or groups still reference them.
+	Force bool
+	// Refuse to apply a plan with more deletions than this. Zero means no limit.
+	MaxDeletions int
+	// Refuse to apply a plan that deletes more than this percentage of the objects in Vault. Zero means no limit.
+	//
+	// Only applies when everything is reconciled, since incremental applies don't list what's in Vault.
+	MaxDeletionPercent float64
+	// If set, everything that's about to be changed or deleted is saved to a new timestamped directory in here
+	// first, which Restore can put back. Backups have secrets in them as Vault returns them, since restoring a
+	// redacted field would overwrite it, so this should be somewhere only whoever applies can read, like
+	// DefaultBackupDirectory.
+	BackupDirectory string
+	// Read each object back after writing it and fail if it doesn't match.
+	Verify bool
+	// Skip mounts and objects the token isn't allowed to list or write instead of failing, recording them in Report.
+	SkipForbidden bool
+	// If set, collects what was applied, skipped, and failed.
+	Report *Report
+	// If set, counts the objects compared and applied.
+	Progress *Progress
+	// Keep making changes after some fail instead of stopping once the phase they failed in is done. Every failure is
+	// still returned at the end, as a PartialApplyError if anything was changed.
+	KeepGoing bool
+	// If an apply fails after changing something, put back what it changed from what was in Vault beforehand, so
+	// Vault isn't left halfway between the old and new configuration. Uses the backup if BackupDirectory is set.
+	Rollback bool
+	// Fail instead of skipping auth mounts whose types aren't supported, since their roles aren't being managed.
+	Strict bool
+	// How long a single Vault request can take before it's retried. Zero means DefaultRequestTimeout and a negative
+	// value means requests only end with the context.
+	RequestTimeout time.Duration
+	// How many times a rate limited, timed out, or transiently failed request is retried. Zero means
+	// DefaultRequestRetries and a negative value turns retrying off.
+	Retries int
+	// How many Vault requests are in flight at once. Zero means DefaultConcurrency. Either way, fewer are sent while
+	// Vault is rate limiting.
+	Concurrency int
+	// Have PlanChangesWithOptions read every object it changes and fill in each change's Diff.
+	Diff bool
+	// Delete policies and auth roles that don't have local files. Otherwise they're left alone and listed in
+	// Plan.Unpruned, so a first apply against an existing cluster can't delete anything by accident. With State, only
+	// objects it has are deleted even then.
+	Prune bool
+	// Disable auth mounts other than token that don't have a _mount.json and, with MountsDirectory, secrets engines
+	// that don't have files, deleting everything in them. Like other deletes, this only happens with Prune.
+	DisableMounts bool
+	// Policies and auth roles that are never changed or deleted, besides root and default.
+	Protect *ProtectConfig
+	// If set, identity entities and groups are managed too, from the entity and group directories in here.
+	IdentityDirectory string
+	// If set, Sentinel EGPs and RGPs are managed too, from the egp and rgp directories in here. Needs Vault Enterprise.
+	SentinelDirectory string
+	// If set, roles in database, PKI, and AWS secrets engines and transit keys are managed too, from
+	// <mount>/<roles|keys> directories in here.
+	SecretsDirectory string
+	// If set, secrets engines are enabled and tuned too, from files named after their paths in here.
+	MountsDirectory string
+	// If set, rate limit and lease count quotas are managed too, from the rate-limit and lease-count directories in
+	// here.
+	QuotasDirectory string
+	// If set, every applied object is recorded in it, only objects it has are deleted when their files are, and
+	// writes to objects whose files haven't changed since they were applied are flagged as changes made in Vault.
+	State *AppliedState
+	// Only change these kinds of objects. Empty means every kind.
+	Only []ResourceKind
+	// Only change objects whose Vault paths match one of these path.Match patterns, e.g. auth/approle/role/billing-*.
+	// Empty means every path.
+	Targets []string
+	// If set, called with every deletion in the plan before anything is written, and nothing is applied if it returns
+	// an error, e.g. because someone at a terminal didn't approve them.
+	ConfirmDeletions func(deletes []PlannedChange) error
+	// If set, called with the namespace and plan of every apply once it's been checked, right before it's applied.
+	Planned func(ctx context.Context, namespace string, plan *Plan)
+}
+
 // ApplyChanges applies local Vault policy and auth role configurations to Vault.
 func ApplyChanges(ctx context.Context, vc *vault.Client, authDirectory, policyDirectory string) error {
+	return ApplyChangesWithOptions(ctx, vc, authDirectory, policyDirectory, ApplyOptions{})
+}
+
+// ApplyChangesWithOptions applies local Vault policy and auth role configurations to Vault.
+//
+// Everything is planned and checked before anything is written.
+func ApplyChangesWithOptions(ctx context.Context, vc *vault.Client, authDirectory, policyDirectory string, opts ApplyOptions) error {
 	log.Info().Msg("Applying changes to Vault...")
+	a := newApplier(vc, opts)
 
-	if err := applyPolicyChanges(ctx, vc, policyDirectory); err != nil {
-		return fmt.Errorf("error applying policy changes: %w", err)
+	plan, err := a.plan(ctx, authDirectory, policyDirectory)
+	if err != nil {
+		return err
 	}
-
-	if err := applyAuthChanges(ctx, vc, authDirectory); err != nil {
-		return fmt.Errorf("error applying auth changes: %w", err)
+	if err := a.checkPoliciesUnused(ctx, plan); err != nil {
+		return err
+	}
+	if err := a.checkDeletionThreshold(plan); err != nil {
+		return err
+	}
+	if err := a.checkCapabilities(ctx, plan); err != nil {
+		return err
 	}
+	if err := a.confirmDeletions(plan); err != nil {
+		return err
+	}
+	if a.opts.Planned != nil {
+		a.opts.Planned(ctx, a.vc.Namespace(), plan)
+	}
+	return a.apply(ctx, plan)
+}
 
+// Backs up and executes a checked plan, rolling back on failure if asked to.
+func (a *applier) apply(ctx context.Context, plan *Plan) error {
+	var (
+		opts = a.opts
+		err  error
+	)
+	log.Info().
+		Int("add", plan.Count(Add)).
+		Int("change", plan.Count(Change)).
+		Int("delete", plan.Count(Delete)).
+		Msg("Planned changes")
+
+	var backup string
+	if opts.BackupDirectory != "" && len(plan.Changes) > 0 {
+		backup, err = a.backup(ctx, plan, opts.BackupDirectory)
+		if err != nil {
+			return fmt.Errorf("error backing up before applying: %w", err)
+		}
+		log.Info().Str("backup", backup).Msg("Backed up objects that are about to change")
+	} else if opts.Rollback && len(plan.Changes) > 0 {
+		// no backup was asked for, so the snapshot to roll back to only lives as long as the apply
+		tmp, err := os.MkdirTemp("", "hvresult-rollback-")
+		if err != nil {
+			return fmt.Errorf("error creating rollback directory: %w", err)
+		}
+		defer os.RemoveAll(tmp)
+		if backup, err = a.backup(ctx, plan, tmp); err != nil {
+			return fmt.Errorf("error saving objects to roll back to before applying: %w", err)
+		}
+	}
+	state := opts.State.snapshot()
+	if err := a.execute(ctx, plan); err != nil {
+		var partial *PartialApplyError
+		if !opts.Rollback || !errors.As(err, &partial) {
+			return err
+		}
+		if rbErr := a.rollback(ctx, backup, partial.Changes); rbErr != nil {
+			return fmt.Errorf("%w, and rolling back failed: %w", err, rbErr)
+		}
+		opts.State.revert(state, partial.Changes)
+		return fmt.Errorf("rolled back %d changes after: %w", partial.Applied, partial.Err)
+	}
+	log.Info().Msg("Changes applied successfully.")
 	return nil
 }
 
-func applyPolicyChanges(ctx context.Context, vc *vault.Client, policyDirectory string) error {
-	log.Info().Str("directory", policyDirectory).Msg("Applying policy changes...")
-
-	// Get existing policies from Vault
-	existingPolicies, err := vc.Sys().ListPoliciesWithContext(ctx)
+// PlanChangesWithOptions works out what ApplyChangesWithOptions would change without changing anything.
+//
+// Changes the token likely isn't allowed to make have a Warning. With SkipUnchanged, objects that already match their
+// local files are read and left out, ignoring the state cache, so an empty plan means Vault is in sync.
+func PlanChangesWithOptions(ctx context.Context, vc *vault.Client, authDirectory, policyDirectory string, opts ApplyOptions) (*Plan, error) {
+	a := newApplier(vc, opts)
+	plan, err := a.plan(ctx, authDirectory, policyDirectory)
 	if err != nil {
-		return fmt.Errorf("error listing existing policies from Vault: %w", err)
+		return nil, err
 	}
-
-	// Read local policy files
-	localPolicies := make(map[string]string)
-	err = filepath.WalkDir(policyDirectory, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+	if opts.SkipUnchanged {
+		if err := a.dropUnchanged(ctx, plan); err != nil {
+			return nil, err
 		}
-		if d.IsDir() {
-			return nil
+	}
+	if opts.Diff {
+		if err := a.addDiffs(ctx, plan); err != nil {
+			return nil, err
 		}
-		policyName := d.Name()
-		content, err := os.ReadFile(path)
-		if err != nil {
-			return fmt.Errorf("error reading local policy file %s: %w", path, err)
+	}
+	if err := a.annotateCapabilities(ctx, plan); err != nil {
+		log.Warn().Err(err).Msg("error checking token capabilities for the plan")
+	}
+	// only changes that were read and still differ are known to be drift
+	if opts.SkipUnchanged {
+		for i, change := range plan.Changes {
+			if change.Warning == "" && a.opts.State.drifted(change) {
+				plan.Changes[i].Warning = "changed in Vault since it was last applied, which this overwrites"
+			}
 		}
-		localPolicies[policyName] = string(content)
-		return nil
-	})
+	}
+	return plan, nil
+}
+
+// Plans and validates changes.
+func (a *applier) plan(ctx context.Context, authDirectory, policyDirectory string) (*Plan, error) {
+	var (
+		plan *Plan
+		err  error
+	)
+	if a.opts.Incremental {
+		plan, err = a.planChangedFiles(authDirectory, policyDirectory)
+	} else {
+		plan, err = a.planAll(ctx, authDirectory, policyDirectory)
+	}
 	if err != nil {
-		return fmt.Errorf("error walking policy directory: %w", err)
+		return nil, fmt.Errorf("error planning changes: %w", err)
+	}
+	if err := checkPlanFiles(plan, authDirectory, policyDirectory, a.opts.IdentityDirectory, a.opts.SentinelDirectory, a.opts.SecretsDirectory, a.opts.MountsDirectory, a.opts.QuotasDirectory); err != nil {
+		return nil, err
+	}
+	if err := plan.keepTargeted(a.opts.Only, a.opts.Targets); err != nil {
+		return nil, err
+	}
+	plan.dropProtected(a.opts.Protect)
+	if a.opts.State != nil {
+		plan.keepOwnedDeletes(a.opts.State)
+	}
+	if !a.opts.Prune {
+		plan.holdBackDeletes()
 	}
+	if err := a.validatePlan(ctx, plan); err != nil {
+		return nil, err
+	}
+	if err := a.checkPolicyReferences(ctx, plan, policyDirectory); err != nil {
+		return nil, err
+	}
+	if err := plan.orderGroups(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
 
-	var eg errgroup.Group
-	eg.SetLimit(5)
+// holds what's needed for a single ApplyChangesWithOptions call
+type applier struct {
+	vc   *vault.Client
+	opts ApplyOptions
+	// every Vault request goes through this so rate limiting slows everything down
+	limiter *AdaptiveLimiter
+	// auth mounts as listed while planning, or the first time they're needed
+	mounts map[string]*vault.AuthMount
+	// secrets engines, see secretsMounts
+	engines  map[string]*vault.MountOutput
+	mountsMu sync.Mutex
+}
 
-	// Apply/Update policies
-	for name, content := range localPolicies {
-		name := name
-		content := content
-		eg.Go(func() error {
-			log.Debug().Str("policy", name).Msg("Writing policy to Vault")
-			if err := vc.Sys().PutPolicyWithContext(ctx, name, content); err != nil {
-				return fmt.Errorf("error writing policy %s to Vault: %w", name, err)
-			}
-			return nil
-		})
+func newApplier(vc *vault.Client, opts ApplyOptions) *applier {
+	if vc != nil {
+		opts.State = opts.State.ForNamespace(vc.Namespace())
 	}
+	return &applier{vc: vc, opts: opts, limiter: newLimiter(opts.Concurrency, opts.RequestTimeout, opts.Retries)}
+}
 
-	// Delete policies not present locally
-	for _, existingPolicy := range existingPolicies {
-		existingPolicy := existingPolicy
-		// Skip deleting root and default policies
-		if existingPolicy == "root" || existingPolicy == "default" {
-			log.Debug().Str("policy", existingPolicy).Msg("Skipping deletion of protected policy")
-			continue
-		}
-		if _, exists := localPolicies[existingPolicy]; !exists {
-				eg.Go(func() error {
-					log.Debug().Str("policy", existingPolicy).Msg("Deleting policy from Vault")
-					if err := vc.Sys().DeletePolicyWithContext(ctx, existingPolicy); err != nil {
-						return fmt.Errorf("error deleting policy %s from Vault: %w", existingPolicy, err)
-					}
-					return nil
-				})
-		}
+// A limiter for `n` requests at once with a request timeout and retries like ApplyOptions has them, where zero means
+// the default and less than zero turns them off.
+func newLimiter(n int, requestTimeout time.Duration, retries int) *AdaptiveLimiter {
+	limiter := NewAdaptiveLimiter(concurrency(n))
+	switch {
+	case requestTimeout == 0:
+		limiter.SetRequestTimeout(DefaultRequestTimeout)
+	case requestTimeout > 0:
+		limiter.SetRequestTimeout(requestTimeout)
 	}
+	if retries != 0 {
+		limiter.SetRetries(retries)
+	}
+	return limiter
+}
 
-	if err := eg.Wait(); err != nil {
-		return err
+// how many requests or goroutines to allow when `n` is configured, where zero means DefaultConcurrency
+func concurrency(n int) int {
+	if n <= 0 {
+		return DefaultConcurrency
 	}
+	return n
+}
 
-	log.Info().Msg("Policy changes applied successfully.")
+func (a *applier) writePolicy(ctx context.Context, name, content string) error {
+	var (
+		cachePath = "sys/policies/acl/" + name
+		hash      = contentHash(content)
+	)
+	// the cache can't skip the read, since the policy may have been changed in Vault since it was cached
+	if a.opts.SkipUnchanged {
+		var remote string
+		err := a.limiter.Do(ctx, func(ctx context.Context) error {
+			var err error
+			remote, err = a.vc.Sys().GetPolicyWithContext(ctx, name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error reading policy %s from Vault: %w", name, err)
+		}
+		if PolicyUnchanged(content, remote) {
+			log.Debug().Str("policy", name).Msg("Policy unchanged, skipping write")
+			a.opts.Cache.Put(cachePath, hash)
+			return errUnchanged
+		}
+	}
+	log.Debug().Str("policy", name).Msg("Writing policy to Vault")
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		return a.vc.Sys().PutPolicyWithContext(ctx, name, content)
+	})
+	if err != nil {
+		return fmt.Errorf("error writing policy %s to Vault: %w", name, err)
+	}
+	if a.opts.Verify {
+		if err := a.verifyPolicy(ctx, name, content); err != nil {
+			return err
+		}
+	}
+	a.opts.Cache.Put(cachePath, hash)
 	return nil
 }
 
-func applyAuthChanges(ctx context.Context, vc *vault.Client, authDirectory string) error {
-	log.Info().Str("directory", authDirectory).Msg("Applying auth role changes...")
+// Determines the paths to roles/users/groups for a mount type. Some have more than one, like users and groups.
+func rolePathPrefixesFor(mountType string) ([]string, bool) {
+	switch mountType {
+	case "aws", "gcp":
+		return []string{"roles"}, true
+	case "azure", "kubernetes", "oidc", "oci", "saml", "approle":
+		return []string{"role"}, true
+	case "kerberos":
+		return []string{"groups"}, true
+	case "ldap", "okta":
+		return []string{"groups", "users"}, true
+	case "radius", "userpass":
+		return []string{"users"}, true
+	case "token":
+		return []string{"roles"}, true
+	case "github":
+		return []string{"map/teams", "map/users"}, true
+	case "cert":
+		return []string{"certs"}, true
+	}
+	return nil, false
+}
 
-	// Get existing auth mounts from Vault
-	mounts, err := vc.Sys().ListAuthWithContext(ctx)
-	if err != nil {
-		return fmt.Errorf("error listing auth mounts from Vault: %w", err)
-	}
-
-	// Iterate over each auth mount
-	for mountName, mount := range mounts {
-		mountName := strings.TrimSuffix(mountName, "/")
-		mount := mount
-
-		log.Debug().Str("mount", mountName).Msg("Processing auth mount")
-
-		// Determine the path to roles/users/groups for this mount type
-		var rolePathPrefix string
-		switch mount.Type {
-		case "aws", "gcp":
-			rolePathPrefix = "roles"
-		case "azure", "kubernetes", "oidc", "oci", "saml", "approle":
-			rolePathPrefix = "role"
-		case "kerberos":
-			rolePathPrefix = "groups"
-		case "ldap", "okta":
-			rolePathPrefix = "groups"
-		case "radius":
-			rolePathPrefix = "users"
-		case "token":
-			rolePathPrefix = "roles"
-		default:
-			log.Warn().Str("mount_type", mount.Type).Msg("Unsupported auth mount type, skipping")
-			continue
-		}
+// Splits auth/<mount>/<prefix>/<name> into its parts, where mounts can be nested and GitHub's prefixes are map/teams
+// and map/users.
+func splitRolePath(rolePath string) (mount, prefix, name string) {
+	rest := strings.TrimPrefix(rolePath, "auth/")
+	name = path.Base(rest)
+	prefix = path.Base(path.Dir(rest))
+	mount = path.Dir(path.Dir(rest))
+	if (prefix == "teams" || prefix == "users") && path.Base(mount) == "map" && path.Dir(mount) != "." {
+		prefix = "map/" + prefix
+		mount = path.Dir(mount)
+	}
+	return mount, prefix, name
+}
 
-		localMountDir := filepath.Join(authDirectory, mountName, rolePathPrefix)
-		log.Debug().Str("local_mount_dir", localMountDir).Msg("Reading local auth roles for mount")
+func readRoleFile(path string) (map[string]interface{}, error) {
+	content, err := readDataFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading local auth role file %s: %w", path, err)
+	}
+	var roleData map[string]interface{}
+	if err := json.Unmarshal(content, &roleData); err != nil {
+		return nil, fmt.Errorf("error unmarshalling local auth role file %s: %w", path, err)
+	}
+	return roleData, nil
+}
 
-		localRoles := make(map[string]map[string]interface{})
-		err = filepath.WalkDir(localMountDir, func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if d.IsDir() {
-				return nil
-			}
-			roleName := d.Name()
-			content, err := os.ReadFile(path)
-			if err != nil {
-				return fmt.Errorf("error reading local auth role file %s: %w", path, err)
-			}
-			var roleData map[string]interface{}
-			if err := json.Unmarshal(content, &roleData); err != nil {
-				return fmt.Errorf("error unmarshalling local auth role file %s: %w", path, err)
-			}
-			localRoles[roleName] = roleData
-			return nil
+// `exists` is whether the role showed up when listing the mount, which saves reading new roles.
+func (a *applier) writeRole(ctx context.Context, writePath string, data map[string]interface{}, exists bool) error {
+	hash := contentHash(data)
+	if a.opts.SkipUnchanged && exists {
+		var remote *vault.Secret
+		err := a.limiter.Do(ctx, func(ctx context.Context) error {
+			var err error
+			remote, err = a.vc.Logical().ReadWithContext(ctx, writePath)
+			return err
 		})
-		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("error walking local auth mount directory %s: %w", localMountDir, err)
-		}
-
-		// Get existing roles for this mount from Vault
-		listPath := fmt.Sprintf("auth/%s/%s", mountName, rolePathPrefix)
-		secret, err := vc.Logical().ListWithContext(ctx, listPath)
 		if err != nil {
-			return fmt.Errorf("error listing existing roles for mount %s from Vault: %w", mountName, err)
+			return fmt.Errorf("error reading auth role %s from Vault: %w", writePath, err)
 		}
-
-		existingRoles := make(map[string]bool)
-		if secret != nil && secret.Data != nil {
-			if keys, ok := secret.Data["keys"].([]interface{}); ok {
-				for _, key := range keys {
-					if s, ok := key.(string); ok {
-						existingRoles[s] = true
-					}
-				}
-			}
+		if remote != nil && RoleUnchanged(data, remote.Data) {
+			log.Debug().Str("path", writePath).Msg("Auth role unchanged, skipping write")
+			a.opts.Cache.Put(writePath, hash)
+			return errUnchanged
 		}
-
-		var egMount errgroup.Group
-		egMount.SetLimit(5)
-
-		// Apply/Update roles
-		for name, data := range localRoles {
-			name := name
-			data := data
-			egMount.Go(func() error {
-				writePath := fmt.Sprintf("auth/%s/%s/%s", mountName, rolePathPrefix, name)
-				log.Debug().Str("role", name).Str("path", writePath).Msg("Writing auth role to Vault")
-				if _, err := vc.Logical().WriteWithContext(ctx, writePath, data); err != nil {
-					return fmt.Errorf("error writing auth role %s to Vault: %w", name, err)
-				}
-				return nil
-			})
-		}
-
-		// Delete roles not present locally
-		for existingRole := range existingRoles {
-			existingRole := existingRole
-			if _, exists := localRoles[existingRole]; !exists {
-				egMount.Go(func() error {
-					deletePath := fmt.Sprintf("auth/%s/%s/%s", mountName, rolePathPrefix, existingRole)
-					log.Debug().Str("role", existingRole).Str("path", deletePath).Msg("Deleting auth role from Vault")
-					if _, err := vc.Logical().DeleteWithContext(ctx, deletePath); err != nil {
-						return fmt.Errorf("error deleting auth role %s from Vault: %w", existingRole, err)
-					}
-					return nil
-				})
-			}
-		}
-
-		if err := egMount.Wait(); err != nil {
+	}
+	log.Debug().Str("path", writePath).Msg("Writing auth role to Vault")
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		_, err := a.vc.Logical().WriteWithContext(ctx, writePath, data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error writing auth role %s to Vault: %w", writePath, err)
+	}
+	if a.opts.Verify {
+		if err := a.verifyRole(ctx, writePath, data); err != nil {
 			return err
 		}
 	}
-
-	log.Info().Msg("Auth role changes applied successfully.")
+	a.opts.Cache.Put(writePath, hash)
 	return nil
 }
@@ -2,10 +2,24 @@ package gitops_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	vault "github.com/hashicorp/vault/api"
 	"github.com/threatkey-oss/hvresult/internal/gitops"
 	"github.com/threatkey-oss/hvresult/internal/testcluster"
@@ -47,7 +61,7 @@ func TestApplyChanges(t *testing.T) {
 	_ = vc.Sys().EnableAuthWithOptions("approle", &vault.EnableAuthOptions{Type: "approle"})
 
 	// Test initial apply
-	err = gitops.ApplyChanges(ctx, vc, authDir, policyDir)
+	err = gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true})
 	if err != nil {
 		t.Fatalf("initial ApplyChanges failed: %v", err)
 	}
@@ -89,7 +103,7 @@ func TestApplyChanges(t *testing.T) {
 	approleRoleUpdatedContent := `{"token_policies": ["test-policy-3"]}`
 	_ = os.WriteFile(approleRolePath, []byte(approleRoleUpdatedContent), 0o644)
 
-	err = gitops.ApplyChanges(ctx, vc, authDir, policyDir)
+	err = gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true})
 	if err != nil {
 		t.Fatalf("update ApplyChanges failed: %v", err)
 	}
@@ -135,7 +149,7 @@ func TestApplyChanges(t *testing.T) {
 	}
 
 	// Test idempotency: run apply again with no changes
-	err = gitops.ApplyChanges(ctx, vc, authDir, policyDir)
+	err = gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true})
 	if err != nil {
 		t.Fatalf("idempotency test failed: %v", err)
 	}
@@ -210,4 +224,2070 @@ func TestPolicyDeletion(t *testing.T) {
 			t.Errorf("policy %s found in list after deletion", policyName)
 		}
 	}
-}
\ No newline at end of file
+}
+func TestApplyInvalidPolicy(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	tempDir := t.TempDir()
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "good"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	_ = os.WriteFile(filepath.Join(policyDir, "bad"), []byte("path \"secret/*\" {\n  capabilities = [\"read\"\n"), 0o644)
+
+	err := gitops.ApplyChanges(ctx, vc, filepath.Join(tempDir, "auth"), policyDir)
+	if err == nil {
+		t.Fatal("expected an invalid policy to stop the apply")
+	}
+	if !strings.Contains(err.Error(), filepath.Join(policyDir, "bad")+":") {
+		t.Fatalf("expected a diagnostic for the bad file, got: %v", err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "good"); policy != "" {
+		t.Fatal("valid policy was written even though another one is invalid")
+	}
+}
+
+func TestApplyPolicyInUse(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+
+	if err := vc.Sys().PutPolicyWithContext(ctx, "in-use", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vc.Logical().WriteWithContext(ctx, "identity/entity", map[string]interface{}{
+		"name":     "someone",
+		"policies": []string{"in-use"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true})
+	if err == nil || !strings.Contains(err.Error(), "identity/entity/name/someone") {
+		t.Fatalf("expected deleting a policy used by an entity to fail, got: %v", err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "in-use"); policy == "" {
+		t.Fatal("policy was deleted without --force")
+	}
+
+	err = gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true, Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "in-use"); policy != "" {
+		t.Fatal("policy wasn't deleted with --force")
+	}
+}
+
+func TestApplyPolicyInUseByRemoteRoles(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vc.Sys().PutPolicyWithContext(ctx, "in-use", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+	// neither has a local file, but only policies are pruned, so both stay in Vault
+	for path, data := range map[string]map[string]interface{}{
+		"auth/approle/role/kept": {"token_policies": "in-use"},
+		"auth/token/roles/ci":    {"allowed_policies": "in-use"},
+	} {
+		if _, err := vc.Logical().WriteWithContext(ctx, path, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true, Targets: []string{"sys/policies/acl/*"}})
+	for _, expected := range []string{"auth/approle/role/kept", "auth/token/roles/ci"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected deleting a policy used by %s to fail, got: %v", expected, err)
+		}
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "in-use"); policy == "" {
+		t.Fatal("policy was deleted without --force")
+	}
+
+	// deleting the roles along with the policy leaves nothing using it
+	err = gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "in-use"); policy != "" {
+		t.Fatal("policy wasn't deleted along with the roles using it")
+	}
+}
+
+func TestApplyDeletionThreshold(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	for _, name := range []string{"one", "two", "three"} {
+		if err := vc.Sys().PutPolicyWithContext(ctx, name, `path "secret/*" { capabilities = ["read"] }`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an empty directory would delete everything
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true, MaxDeletions: 2})
+	if err == nil || !strings.Contains(err.Error(), "refusing to delete 3 objects") {
+		t.Fatalf("expected too many deletions to fail, got: %v", err)
+	}
+	err = gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true, MaxDeletionPercent: 20})
+	if err == nil || !strings.Contains(err.Error(), "refusing to delete 3 of") {
+		t.Fatalf("expected too large a percentage of deletions to fail, got: %v", err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "one"); policy == "" {
+		t.Fatal("policy was deleted despite the threshold")
+	}
+}
+
+func TestApplyPreflight(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "first"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	_ = os.WriteFile(filepath.Join(policyDir, "second"), []byte(`path "secret/*" { capabilities = ["list"] }`), 0o644)
+
+	// can list policies and auth mounts but not write anything
+	err := vc.Sys().PutPolicyWithContext(ctx, "read-only", `
+path "sys/policies/acl" { capabilities = ["list"] }
+path "sys/auth" { capabilities = ["read"] }
+path "identity/*" { capabilities = ["list", "read"] }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := vc.Auth().Token().CreateWithContext(ctx, &vault.TokenCreateRequest{Policies: []string{"read-only"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, err := vc.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited.SetToken(token.Auth.ClientToken)
+
+	err = gitops.ApplyChanges(ctx, limited, filepath.Join(tempDir, "auth"), policyDir)
+	if err == nil || !strings.Contains(err.Error(), "token lacks create on sys/policies/acl/first") {
+		t.Fatalf("expected the preflight check to fail, got: %v", err)
+	}
+
+	report := &gitops.Report{}
+	err = gitops.ApplyChangesWithOptions(ctx, limited, filepath.Join(tempDir, "auth"), policyDir, gitops.ApplyOptions{
+		Prune:         true,
+		SkipForbidden: true,
+		Report:        report,
+	})
+	if err != nil {
+		t.Fatalf("expected forbidden changes to be skipped, got: %v", err)
+	}
+	var skipped []string
+	for _, item := range report.SortedSkipped() {
+		skipped = append(skipped, item.Capability+" "+item.Path)
+	}
+	expected := []string{
+		"create sys/policies/acl/first",
+		"delete sys/policies/acl/read-only",
+		"create sys/policies/acl/second",
+	}
+	if diff := cmp.Diff(expected, skipped); diff != "" {
+		t.Errorf("unexpected skipped items (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyPolicyNameCase(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "Team-Admin"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+
+	// applying twice shouldn't create and then delete the policy
+	for i := 0; i < 2; i++ {
+		if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true}); err != nil {
+			t.Fatal(err)
+		}
+		if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "team-admin"); policy == "" {
+			t.Fatalf("policy is missing after apply %d", i+1)
+		}
+	}
+
+	_ = os.WriteFile(filepath.Join(policyDir, "team-admin"), []byte(`path "secret/*" { capabilities = ["list"] }`), 0o644)
+	err := gitops.ApplyChanges(ctx, vc, authDir, policyDir)
+	if err == nil || !strings.Contains(err.Error(), "differ only by case") {
+		t.Fatalf("expected files that differ only by case to fail, got: %v", err)
+	}
+}
+
+func TestApplyVerify(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(roleDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "ci"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	// Vault returns these as seconds, which shouldn't count as a mismatch
+	_ = os.WriteFile(filepath.Join(roleDir, "ci"), []byte(`{"token_policies": ["ci"], "token_ttl": "1h"}`), 0o644)
+
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplySymlinkOutsideRepository(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	policyDir := filepath.Join(tempDir, "repo", "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	secret := filepath.Join(tempDir, "secret")
+	_ = os.WriteFile(secret, []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	if err := os.Symlink(secret, filepath.Join(policyDir, "sneaky")); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+
+	err := gitops.ApplyChanges(ctx, vc, filepath.Join(tempDir, "repo", "auth"), policyDir)
+	if err == nil || !strings.Contains(err.Error(), "outside of") {
+		t.Fatalf("expected a symlink out of the repository to be refused, got: %v", err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "sneaky"); policy != "" {
+		t.Fatal("policy was written from outside the repository")
+	}
+}
+
+func TestApplyStrict(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "cert", &vault.EnableAuthOptions{Type: "cert"}); err != nil {
+		t.Fatal(err)
+	}
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+
+	if err := gitops.ApplyChanges(ctx, vc, authDir, policyDir); err != nil {
+		t.Fatalf("expected unsupported mounts to be skipped, got: %v", err)
+	}
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Strict: true})
+	if err == nil || !strings.Contains(err.Error(), "cert (cert)") {
+		t.Fatalf("expected --strict to fail on the cert mount, got: %v", err)
+	}
+}
+
+func TestPlanCapabilityWarnings(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "allowed"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	_ = os.WriteFile(filepath.Join(policyDir, "forbidden"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+
+	err := vc.Sys().PutPolicyWithContext(ctx, "planner", `
+path "sys/policies/acl" { capabilities = ["list"] }
+path "sys/policies/acl/allowed" { capabilities = ["create", "update"] }
+path "sys/policies/acl/planner" { capabilities = ["delete"] }
+path "sys/auth" { capabilities = ["read"] }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := vc.Auth().Token().CreateWithContext(ctx, &vault.TokenCreateRequest{Policies: []string{"planner"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, err := vc.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited.SetToken(token.Auth.ClientToken)
+
+	plan, err := gitops.PlanChangesWithOptions(ctx, limited, filepath.Join(tempDir, "auth"), policyDir, gitops.ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := map[string]string{}
+	for _, change := range plan.Changes {
+		warnings[change.Path] = change.Warning
+	}
+	expected := map[string]string{
+		"sys/policies/acl/allowed":   "",
+		"sys/policies/acl/forbidden": "will likely fail: permission denied (token lacks create)",
+		"sys/policies/acl/planner":   "",
+	}
+	if diff := cmp.Diff(expected, warnings); diff != "" {
+		t.Errorf("unexpected warnings (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyReportsEveryFailure(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	// neither mount exists, so both writes fail
+	var changes []gitops.ChangedFile
+	for _, mount := range []string{"missing-one", "missing-two"} {
+		_ = os.MkdirAll(filepath.Join(authDir, mount, "role"), 0o755)
+		_ = os.WriteFile(filepath.Join(authDir, mount, "role", "ci"), []byte(`{"token_policies": ["default"]}`), 0o644)
+		changes = append(changes, gitops.ChangedFile{Path: "auth/" + mount + "/role/ci", Mutation: gitops.Add, Principal: true})
+	}
+
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Incremental: true, Changes: changes})
+	if err == nil {
+		t.Fatal("expected writes to missing mounts to fail")
+	}
+	for _, expected := range []string{"2 of 2 attempted changes failed", "auth/missing-one/role/ci", "auth/missing-two/role/ci"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in: %v", expected, err)
+		}
+	}
+}
+
+func TestApplyThenCheck(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(roleDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "ci"), []byte("path \"secret/*\" { capabilities = [\"read\"] }\n\n"), 0o644)
+	_ = os.WriteFile(filepath.Join(policyDir, "deploy"), []byte(`path "secret/deploy/*" { capabilities = ["read", "list"] }`), 0o644)
+	// spelled differently from how Vault returns them
+	_ = os.WriteFile(filepath.Join(roleDir, "ci"), []byte(`{"token_policies": "deploy,ci", "token_ttl": "1h", "token_max_ttl": 0, "secret_id_num_uses": 5}`), 0o644)
+	_ = os.WriteFile(filepath.Join(roleDir, "deploy"), []byte(`{"token_policies": ["deploy"], "token_period": "24h"}`), 0o644)
+
+	check := func() *gitops.Plan {
+		t.Helper()
+		plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plan
+	}
+	if plan := check(); len(plan.Changes) != 4 {
+		t.Fatalf("expected 4 changes before applying, got %+v", plan.Changes)
+	}
+	// twice, since the second apply writes over what the first one did
+	for i := 0; i < 2; i++ {
+		if err := gitops.ApplyChanges(ctx, vc, authDir, policyDir); err != nil {
+			t.Fatal(err)
+		}
+		if plan := check(); len(plan.Changes) != 0 {
+			t.Fatalf("expected no changes after applying, got %+v", plan.Changes)
+		}
+	}
+	// drift in Vault shows up
+	if _, err := vc.Logical().WriteWithContext(ctx, "auth/approle/role/deploy", map[string]interface{}{"token_period": "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	if plan := check(); len(plan.Changes) != 1 || plan.Changes[0].Path != "auth/approle/role/deploy" {
+		t.Fatalf("expected only the drifted role to change, got %+v", plan.Changes)
+	}
+}
+
+func TestApplyNameCollisions(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	for _, dir := range []string{filepath.Join(policyDir, "team-a"), filepath.Join(policyDir, "team-b"), filepath.Join(roleDir, "old")} {
+		_ = os.MkdirAll(dir, 0o755)
+	}
+	_ = os.WriteFile(filepath.Join(policyDir, "team-a", "deploy"), []byte(`path "secret/a/*" { capabilities = ["read"] }`), 0o644)
+	_ = os.WriteFile(filepath.Join(policyDir, "team-b", "deploy"), []byte(`path "secret/b/*" { capabilities = ["read"] }`), 0o644)
+	err := gitops.ApplyChanges(ctx, vc, authDir, policyDir)
+	for _, expected := range []string{filepath.Join("team-a", "deploy"), filepath.Join("team-b", "deploy")} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected colliding policy files to fail listing %s, got: %v", expected, err)
+		}
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "deploy"); policy != "" {
+		t.Fatal("expected nothing to be applied")
+	}
+
+	_ = os.RemoveAll(filepath.Join(policyDir, "team-b"))
+	_ = os.WriteFile(filepath.Join(roleDir, "ci"), []byte(`{"token_policies": ["deploy"]}`), 0o644)
+	_ = os.WriteFile(filepath.Join(roleDir, "old", "ci"), []byte(`{"token_policies": ["default"]}`), 0o644)
+	err = gitops.ApplyChanges(ctx, vc, authDir, policyDir)
+	if err == nil || !strings.Contains(err.Error(), filepath.Join("role", "ci")) || !strings.Contains(err.Error(), filepath.Join("old", "ci")) {
+		t.Fatalf("expected colliding auth role files to fail listing both, got: %v", err)
+	}
+}
+
+func TestApplyIncrementalSubdirectories(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	for _, dir := range []string{filepath.Join(policyDir, "team-a"), filepath.Join(roleDir, "team-a")} {
+		_ = os.MkdirAll(dir, 0o755)
+	}
+	_ = os.WriteFile(filepath.Join(authDir, "approle", gitops.AuthMountFileName), []byte(`{"type": "approle"}`), 0o644)
+	_ = os.WriteFile(filepath.Join(policyDir, "team-a", "team%2Fa%2Freader"), []byte(`path "secret/a/*" { capabilities = ["read"] }`), 0o644)
+	_ = os.WriteFile(filepath.Join(roleDir, "team-a", "ci.json"), []byte(`{"token_policies": ["team/a/reader"]}`), 0o644)
+	changes := []gitops.ChangedFile{
+		{Path: "sys/policies/acl/team-a/team%2Fa%2Freader", Mutation: gitops.Add, Policy: true},
+		{Path: "auth/approle/role/team-a/ci.json", Mutation: gitops.Add, Principal: true},
+	}
+
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Incremental: true, Changes: changes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "team/a/reader"); policy == "" {
+		t.Error("expected the policy in a subdirectory to be written")
+	}
+	// written to the top level of the mount, like a full apply
+	role, err := vc.Logical().ReadWithContext(ctx, "auth/approle/role/ci")
+	if err != nil || role == nil {
+		t.Fatalf("expected the role in a subdirectory to be written to auth/approle/role/ci, got %v (%v)", role, err)
+	}
+}
+
+func TestPlanDiff(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(roleDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "ci"), []byte("path \"secret/*\" {\n  capabilities = [\"read\"]\n}\n"), 0o644)
+	_ = os.WriteFile(filepath.Join(roleDir, "ci"), []byte(`{"token_policies": ["ci"]}`), 0o644)
+	if err := gitops.ApplyChanges(ctx, vc, authDir, policyDir); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = os.WriteFile(filepath.Join(policyDir, "ci"), []byte("path \"secret/*\" {\n  capabilities = [\"list\"]\n}\n"), 0o644)
+	_ = os.WriteFile(filepath.Join(roleDir, "ci"), []byte(`{"token_policies": ["ci", "default"]}`), 0o644)
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true, Diff: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs := map[string]string{}
+	for _, change := range plan.Changes {
+		diffs[change.Path] = change.Diff
+	}
+	expected := map[string]string{
+		"sys/policies/acl/ci": "  path \"secret/*\" {\n" +
+			"-   capabilities = [\"read\"]\n" +
+			"+   capabilities = [\"list\"]\n" +
+			"  }\n",
+		// only fields that are set locally
+		"auth/approle/role/ci": "  {\n" +
+			"    \"token_policies\": [\n" +
+			"-     \"ci\"\n" +
+			"+     \"ci\",\n" +
+			"+     \"default\"\n" +
+			"    ]\n" +
+			"  }\n",
+	}
+	if diff := cmp.Diff(expected, diffs); diff != "" {
+		t.Fatalf("unexpected diffs (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyWithoutPrune(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().PutPolicyWithContext(ctx, "unmanaged", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "managed"), []byte(`path "secret/*" { capabilities = ["list"] }`), 0o644)
+
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Unpruned) != 1 || plan.Unpruned[0].Path != "sys/policies/acl/unmanaged" || plan.Count(gitops.Delete) != 0 {
+		t.Fatalf("expected the unmanaged policy to be held back, got changes %+v and unpruned %+v", plan.Changes, plan.Unpruned)
+	}
+	if err := gitops.ApplyChanges(ctx, vc, authDir, policyDir); err != nil {
+		t.Fatal(err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "unmanaged"); policy == "" {
+		t.Fatal("policy without a local file was deleted without pruning")
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "managed"); policy == "" {
+		t.Fatal("managed policy wasn't written")
+	}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "unmanaged"); policy != "" {
+		t.Fatal("policy without a local file wasn't pruned")
+	}
+}
+
+func TestApplyProtected(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+	const original = `path "secret/*" { capabilities = ["read"] }`
+	for _, name := range []string{"terraform-ci", "breakglass", "unprotected"} {
+		if err := vc.Sys().PutPolicyWithContext(ctx, name, original); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := vc.Logical().WriteWithContext(ctx, "auth/approle/role/breakglass-admin", map[string]interface{}{"token_policies": "breakglass"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	// tries to change one protected policy and delete everything else
+	_ = os.WriteFile(filepath.Join(policyDir, "terraform-ci"), []byte(`path "secret/*" { capabilities = ["list"] }`), 0o644)
+	protectFile := filepath.Join(tempDir, gitops.ProtectFileName)
+	_ = os.WriteFile(protectFile, []byte("policies:\n  - terraform-*\n  - breakglass\nroles:\n  - approle/breakglass-*\n"), 0o644)
+	protect, err := gitops.LoadProtectConfig(protectFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true, Protect: protect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"terraform-ci": original,
+		"breakglass":   original,
+		"unprotected":  "",
+	} {
+		if policy, _ := vc.Sys().GetPolicyWithContext(ctx, name); policy != expected {
+			t.Errorf("policy %s is %q, expected %q", name, policy, expected)
+		}
+	}
+	if role, err := vc.Logical().ReadWithContext(ctx, "auth/approle/role/breakglass-admin"); err != nil || role == nil {
+		t.Errorf("protected role was deleted (%v)", err)
+	}
+
+	_ = os.WriteFile(protectFile, []byte("polices:\n  - typo\n"), 0o644)
+	if _, err := gitops.LoadProtectConfig(protectFile); err == nil {
+		t.Error("expected an unknown field in the protect file to fail")
+	}
+}
+
+func TestApplyMissingPolicyReference(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vc.Sys().PutPolicyWithContext(ctx, "remote-only", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(roleDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "local"), []byte(`path "secret/*" { capabilities = ["list"] }`), 0o644)
+	_ = os.WriteFile(filepath.Join(roleDir, "fine"), []byte(`{"token_policies": "local,remote-only,default"}`), 0o644)
+	_ = os.WriteFile(filepath.Join(roleDir, "broken"), []byte(`{"token_policies": ["local", "typo"]}`), 0o644)
+
+	err := gitops.ApplyChanges(ctx, vc, authDir, policyDir)
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(roleDir, "broken")) || !strings.Contains(err.Error(), "typo") {
+		t.Fatalf("expected the role with a missing policy to stop the apply, got: %v", err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "local"); policy != "" {
+		t.Fatal("expected nothing to be applied")
+	}
+
+	// a policy that's about to be pruned counts as missing
+	_ = os.Remove(filepath.Join(roleDir, "broken"))
+	err = gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true})
+	if err == nil || !strings.Contains(err.Error(), "remote-only") {
+		t.Fatalf("expected granting a policy that's being deleted to fail, got: %v", err)
+	}
+	if err := gitops.ApplyChanges(ctx, vc, authDir, policyDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyIdentity(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "userpass", &vault.EnableAuthOptions{Type: "userpass"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	identityDir := filepath.Join(tempDir, "identity")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(filepath.Join(identityDir, "entity"), 0o755)
+	_ = os.MkdirAll(filepath.Join(identityDir, "group"), 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "ci"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	_ = os.WriteFile(filepath.Join(identityDir, "entity", "alice"), []byte(`{"policies": ["ci"], "aliases": [{"name": "alice", "mount": "userpass"}]}`), 0o644)
+	// written after the group it's a member of
+	_ = os.WriteFile(filepath.Join(identityDir, "group", "admins"), []byte(`{"policies": ["ci"], "member_entities": ["alice"], "member_groups": ["oncall"]}`), 0o644)
+	_ = os.WriteFile(filepath.Join(identityDir, "group", "oncall"), []byte(`{"member_entities": ["alice"]}`), 0o644)
+
+	opts := gitops.ApplyOptions{IdentityDirectory: identityDir, Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	entity, err := vc.Logical().ReadWithContext(ctx, "identity/entity/name/alice")
+	if err != nil || entity == nil {
+		t.Fatalf("expected entity alice to exist: %v", err)
+	}
+	if aliases, _ := entity.Data["aliases"].([]interface{}); len(aliases) != 1 {
+		t.Fatalf("expected alice to have 1 alias, got %v", entity.Data["aliases"])
+	}
+	group, err := vc.Logical().ReadWithContext(ctx, "identity/group/name/admins")
+	if err != nil || group == nil {
+		t.Fatalf("expected group admins to exist: %v", err)
+	}
+	if diff := cmp.Diff([]interface{}{entity.Data["id"]}, group.Data["member_entity_ids"]); diff != "" {
+		t.Errorf("unexpected admins members (-want +got):\n%s", diff)
+	}
+
+	// downloading gets the same files back, so nothing's left to change
+	downloadDir := filepath.Join(t.TempDir(), "identity")
+	if err := gitops.DownloadIdentity(ctx, vc, downloadDir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(downloadDir, "group", "admins"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"oncall"`) || !strings.Contains(string(content), `"alice"`) {
+		t.Errorf("expected downloaded group to refer to members by name, got:\n%s", content)
+	}
+	opts.IdentityDirectory = downloadDir
+	opts.SkipUnchanged = true
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no changes after downloading, got:\n%s", plan.MarkdownTable())
+	}
+
+	// removing the alias from the file removes it from Vault
+	_ = os.WriteFile(filepath.Join(identityDir, "entity", "alice"), []byte(`{"policies": ["ci"]}`), 0o644)
+	opts = gitops.ApplyOptions{IdentityDirectory: identityDir, Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	entity, _ = vc.Logical().ReadWithContext(ctx, "identity/entity/name/alice")
+	if aliases, _ := entity.Data["aliases"].([]interface{}); len(aliases) != 0 {
+		t.Errorf("expected alice's alias to be deleted, got %v", aliases)
+	}
+}
+
+func TestPlanSentinelPolicies(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	sentinelDir := filepath.Join(tempDir, "sys", "policies")
+	_ = os.MkdirAll(filepath.Join(sentinelDir, "egp"), 0o755)
+	_ = os.MkdirAll(filepath.Join(sentinelDir, "rgp"), 0o755)
+	_ = os.WriteFile(filepath.Join(sentinelDir, "egp", "business-hours"), []byte(`{"policy": "main = rule { true }", "enforcement_level": "soft-mandatory", "paths": ["secret/*"]}`), 0o644)
+	_ = os.WriteFile(filepath.Join(sentinelDir, "rgp", "mfa"), []byte(`{"policy": "main = rule { true }", "enforcement_level": "mandatory"}`), 0o644)
+
+	// incremental plans don't list anything, which needs Vault Enterprise
+	opts := gitops.ApplyOptions{
+		SentinelDirectory: sentinelDir,
+		Incremental:       true,
+		Changes: []gitops.ChangedFile{
+			{Path: "sys/policies/egp/business-hours", Mutation: gitops.Add, Sentinel: true},
+			{Path: "sys/policies/rgp/mfa", Mutation: gitops.Add, Sentinel: true},
+		},
+	}
+	_, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err == nil || !strings.Contains(err.Error(), "enforcement_level") {
+		t.Fatalf("expected the invalid enforcement level to fail planning, got: %v", err)
+	}
+
+	_ = os.WriteFile(filepath.Join(sentinelDir, "rgp", "mfa"), []byte(`{"policy": "main = rule { true }", "enforcement_level": "hard-mandatory"}`), 0o644)
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"business-hours", "mfa"}, plan.Names(gitops.SentinelPolicyResource, gitops.Add)); diff != "" {
+		t.Errorf("unexpected Sentinel policies planned (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplySecrets(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	for _, mountType := range []string{"pki", "transit"} {
+		if err := vc.Sys().MountWithContext(ctx, mountType, &vault.MountInput{Type: mountType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := vc.Logical().WriteWithContext(ctx, "transit/keys/legacy", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	secretsDir := filepath.Join(tempDir, "secrets")
+	_ = os.MkdirAll(filepath.Join(secretsDir, "pki", "roles"), 0o755)
+	_ = os.MkdirAll(filepath.Join(secretsDir, "transit", "keys"), 0o755)
+	_ = os.WriteFile(filepath.Join(secretsDir, "pki", "roles", "web"), []byte(`{"allowed_domains": ["example.com"], "allow_subdomains": true, "max_ttl": "72h"}`), 0o644)
+	_ = os.WriteFile(filepath.Join(secretsDir, "transit", "keys", "app"), []byte(`{"type": "aes256-gcm96", "deletion_allowed": true}`), 0o644)
+
+	opts := gitops.ApplyOptions{SecretsDirectory: secretsDir, Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	role, err := vc.Logical().ReadWithContext(ctx, "pki/roles/web")
+	if err != nil || role == nil {
+		t.Fatalf("expected pki role web to exist: %v", err)
+	}
+	if role.Data["allow_subdomains"] != true {
+		t.Errorf("expected pki role web to allow subdomains, got %v", role.Data["allow_subdomains"])
+	}
+	key, err := vc.Logical().ReadWithContext(ctx, "transit/keys/app")
+	if err != nil || key == nil {
+		t.Fatalf("expected transit key app to exist: %v", err)
+	}
+	if key.Data["deletion_allowed"] != true {
+		t.Errorf("expected transit key app to allow deletion, got %v", key.Data["deletion_allowed"])
+	}
+	if legacy, _ := vc.Logical().ReadWithContext(ctx, "transit/keys/legacy"); legacy == nil {
+		t.Error("expected transit key without a local file not to be deleted")
+	}
+
+	// downloading gets the same files back, so nothing's left to change
+	downloadDir := filepath.Join(t.TempDir(), "secrets")
+	if err := gitops.DownloadSecrets(ctx, vc, downloadDir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(downloadDir, "transit", "keys", "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), `"keys"`) {
+		t.Errorf("expected downloaded transit key to leave out key versions, got:\n%s", content)
+	}
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{SecretsDirectory: downloadDir, SkipUnchanged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no changes after downloading, got:\n%s", plan.MarkdownTable())
+	}
+}
+
+func TestApplyAuthMounts(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "old", &vault.EnableAuthOptions{Type: "userpass"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(filepath.Join(authDir, "ci", "role"), 0o755)
+	_ = os.WriteFile(filepath.Join(authDir, "ci", gitops.AuthMountFileName), []byte(`{"type": "approle", "description": "CI jobs", "config": {"default_lease_ttl": "1h"}}`), 0o644)
+	_ = os.WriteFile(filepath.Join(authDir, "ci", "role", "deploy"), []byte(`{"token_policies": ["default"]}`), 0o644)
+
+	opts := gitops.ApplyOptions{Prune: true, DisableMounts: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := vc.Sys().ListAuthWithContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := mounts["ci/"]
+	if ci == nil {
+		t.Fatal("expected auth mount ci to be enabled")
+	}
+	if ci.Type != "approle" || ci.Description != "CI jobs" || ci.Config.DefaultLeaseTTL != 3600 {
+		t.Errorf("unexpected auth mount ci: %+v", ci)
+	}
+	if mounts["old/"] != nil {
+		t.Error("expected auth mount without a mount file to be disabled")
+	}
+	if mounts["token/"] == nil {
+		t.Error("expected the token auth mount to be left alone")
+	}
+	if role, _ := vc.Logical().ReadWithContext(ctx, "auth/ci/role/deploy"); role == nil {
+		t.Error("expected the role in the new auth mount to be written")
+	}
+
+	// changing the type of an existing mount would delete its roles
+	_ = os.WriteFile(filepath.Join(authDir, "ci", gitops.AuthMountFileName), []byte(`{"type": "userpass"}`), 0o644)
+	if _, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts); err == nil || !strings.Contains(err.Error(), "changing its type") {
+		t.Errorf("expected changing the mount type to fail planning, got: %v", err)
+	}
+}
+
+func TestApplySecretsMounts(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().MountWithContext(ctx, "old", &vault.MountInput{Type: "kv"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	mountsDir := filepath.Join(tempDir, "sys", "mounts")
+	secretsDir := filepath.Join(tempDir, "secrets")
+	_ = os.MkdirAll(filepath.Join(mountsDir, "team"), 0o755)
+	_ = os.MkdirAll(filepath.Join(secretsDir, "pki", "roles"), 0o755)
+	_ = os.WriteFile(filepath.Join(mountsDir, "team", "kv"), []byte(`{"type": "kv", "options": {"version": "2"}}`), 0o644)
+	_ = os.WriteFile(filepath.Join(mountsDir, "pki"), []byte(`{"type": "pki", "config": {"max_lease_ttl": "87600h"}}`), 0o644)
+	_ = os.WriteFile(filepath.Join(secretsDir, "pki", "roles", "web"), []byte(`{"allowed_domains": ["example.com"]}`), 0o644)
+
+	opts := gitops.ApplyOptions{MountsDirectory: mountsDir, SecretsDirectory: secretsDir, Prune: true, DisableMounts: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := vc.Sys().ListMountsWithContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv := mounts["team/kv/"]; kv == nil || kv.Options["version"] != "2" {
+		t.Errorf("expected a KV v2 secrets engine at team/kv, got %+v", kv)
+	}
+	if pki := mounts["pki/"]; pki == nil || pki.Config.MaxLeaseTTL != 87600*60*60 {
+		t.Errorf("expected a PKI secrets engine with a max lease TTL of 10 years, got %+v", pki)
+	}
+	if mounts["old/"] != nil {
+		t.Error("expected secrets engine without a file to be disabled")
+	}
+	if mounts["sys/"] == nil || mounts["cubbyhole/"] == nil {
+		t.Error("expected the secrets engines Vault mounts itself to be left alone")
+	}
+	if role, _ := vc.Logical().ReadWithContext(ctx, "pki/roles/web"); role == nil {
+		t.Error("expected the role in the new secrets engine to be written")
+	}
+
+	// downloading gets the same files back, so nothing's left to change
+	if err := gitops.DownloadSecretsMounts(ctx, vc, mountsDir); err != nil {
+		t.Fatal(err)
+	}
+	opts.SkipUnchanged = true
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string(nil), plan.Names(gitops.SecretsMountResource, gitops.Change)); diff != "" {
+		t.Errorf("unexpected secrets engine changes after downloading (-want +got):\n%s", diff)
+	}
+}
+
+func TestPlanTargeted(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(roleDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "billing"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	for _, name := range []string{"billing-api", "billing-worker", "search"} {
+		_ = os.WriteFile(filepath.Join(roleDir, name), []byte(`{"token_policies": ["billing"]}`), 0o644)
+	}
+
+	paths := func(opts gitops.ApplyOptions) []string {
+		t.Helper()
+		plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, change := range plan.Changes {
+			paths = append(paths, change.Path)
+		}
+		return paths
+	}
+	if diff := cmp.Diff([]string{"auth/approle/role/billing-api", "auth/approle/role/billing-worker"}, paths(gitops.ApplyOptions{Targets: []string{"auth/approle/role/billing-*"}})); diff != "" {
+		t.Errorf("unexpected targeted plan (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"sys/policies/acl/billing"}, paths(gitops.ApplyOptions{Only: []gitops.ResourceKind{gitops.PolicyResource}})); diff != "" {
+		t.Errorf("unexpected policy-only plan (-want +got):\n%s", diff)
+	}
+	if _, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Targets: []string{"auth/["}}); err == nil {
+		t.Error("expected a bad target pattern to fail")
+	}
+}
+
+func TestApplyManaged(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	const original = `path "secret/*" { capabilities = ["read"] }`
+	for _, name := range []string{"team-a-old", "terraform-owned"} {
+		if err := vc.Sys().PutPolicyWithContext(ctx, name, original); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "team-a-new"), []byte(original), 0o644)
+	_ = os.WriteFile(filepath.Join(policyDir, "terraform-owned"), []byte(`path "secret/*" { capabilities = ["list"] }`), 0o644)
+	protectFile := filepath.Join(tempDir, gitops.ProtectFileName)
+	_ = os.WriteFile(protectFile, []byte("managed_policies:\n  - team-a-*\n"), 0o644)
+	protect, err := gitops.LoadProtectConfig(protectFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true, Protect: protect}); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"team-a-new":      original,
+		"team-a-old":      "",
+		"terraform-owned": original,
+	} {
+		if policy, _ := vc.Sys().GetPolicyWithContext(ctx, name); policy != expected {
+			t.Errorf("policy %s is %q, expected %q", name, policy, expected)
+		}
+	}
+
+	if err := protect.AddManaged(nil, []string{"approle/["}); err == nil {
+		t.Error("expected a bad managed role pattern to fail")
+	}
+}
+
+func TestApplyYAMLRoles(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(roleDir, 0o755)
+	_ = os.WriteFile(filepath.Join(roleDir, "ci.yaml"), []byte("token_policies:\n  - default\ntoken_ttl: 600\n"), 0o644)
+
+	if err := gitops.ApplyChanges(ctx, vc, authDir, policyDir); err != nil {
+		t.Fatal(err)
+	}
+	role, err := vc.Logical().ReadWithContext(ctx, "auth/approle/role/ci")
+	if err != nil || role == nil {
+		t.Fatalf("expected the YAML role to be written as ci (%v)", err)
+	}
+	if ttl := fmt.Sprint(role.Data["token_ttl"]); ttl != "600" {
+		t.Errorf("expected token_ttl 600, got %v", role.Data["token_ttl"])
+	}
+
+	// download switches identity files to YAML without leaving the JSON ones behind
+	if _, err := vc.Logical().WriteWithContext(ctx, "identity/entity", map[string]interface{}{"name": "alice", "policies": []string{"default"}}); err != nil {
+		t.Fatal(err)
+	}
+	identityDir := filepath.Join(tempDir, "identity")
+	if err := gitops.DownloadIdentity(ctx, vc, identityDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.DownloadIdentityWithOptions(ctx, vc, identityDir, gitops.DownloadOptions{Format: gitops.YAMLFormat}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(identityDir, "entity", "alice.yaml")); err != nil {
+		t.Errorf("expected download to write alice.yaml: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(identityDir, "entity", "alice")); !os.IsNotExist(err) {
+		t.Errorf("expected download to remove the JSON file for alice, got %v", err)
+	}
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{IdentityDirectory: identityDir, SkipUnchanged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := plan.Names(gitops.IdentityEntityResource, gitops.Change); len(names) > 0 {
+		t.Errorf("expected the downloaded YAML entity to be unchanged, got changes to %v", names)
+	}
+
+	_ = os.WriteFile(filepath.Join(roleDir, "ci.json"), []byte(`{"token_policies": ["default"]}`), 0o644)
+	if _, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{}); err == nil || !strings.Contains(err.Error(), "would both be written") {
+		t.Errorf("expected ci.json and ci.yaml to collide, got %v", err)
+	}
+}
+
+func TestApplyKeepGoing(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().PutPolicyWithContext(ctx, "doomed", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(filepath.Join(authDir, "missing", "role"), 0o755)
+	_ = os.WriteFile(filepath.Join(authDir, "missing", "role", "ci"), []byte(`{"token_policies": ["default"]}`), 0o644)
+	// the role write fails since its mount doesn't exist, and the policy delete comes in a later phase
+	changes := []gitops.ChangedFile{
+		{Path: "auth/missing/role/ci", Mutation: gitops.Add, Principal: true},
+		{Path: "sys/policies/acl/doomed", Mutation: gitops.Delete, Policy: true},
+	}
+
+	opts := gitops.ApplyOptions{Incremental: true, Changes: changes, Prune: true}
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err == nil || !strings.Contains(err.Error(), "the remaining 1 weren't attempted") {
+		t.Fatalf("expected the delete not to be attempted, got %v", err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "doomed"); policy == "" {
+		t.Fatal("policy was deleted after an earlier phase failed")
+	}
+
+	report := &gitops.Report{}
+	opts.KeepGoing = true
+	opts.Report = report
+	err = gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	var partial *gitops.PartialApplyError
+	if !errors.As(err, &partial) || partial.Applied != 1 {
+		t.Fatalf("expected a partial apply with 1 change made, got %v", err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "doomed"); policy != "" {
+		t.Error("expected the policy to be deleted with KeepGoing")
+	}
+	if failed := report.SortedFailed(); len(failed) != 1 || failed[0].Path != "auth/missing/role/ci" {
+		t.Errorf("expected the role write to be reported as failed, got %+v", failed)
+	}
+	expected := map[gitops.ResourceKind]*gitops.SummaryCounts{
+		gitops.AuthRoleResource: {Failed: 1},
+		gitops.PolicyResource:   {Deleted: 1},
+	}
+	if diff := cmp.Diff(expected, report.Summary()); diff != "" {
+		t.Errorf("unexpected summary (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyRollback(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	original := `path "secret/*" { capabilities = ["read"] }`
+	if err := vc.Sys().PutPolicyWithContext(ctx, "doomed", original); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(filepath.Join(authDir, "missing", "role"), 0o755)
+	_ = os.WriteFile(filepath.Join(authDir, "missing", "role", "ci"), []byte(`{"token_policies": ["default"]}`), 0o644)
+	changes := []gitops.ChangedFile{
+		{Path: "auth/missing/role/ci", Mutation: gitops.Add, Principal: true},
+		{Path: "sys/policies/acl/doomed", Mutation: gitops.Delete, Policy: true},
+	}
+
+	// without a backup directory, the rollback snapshot is temporary
+	opts := gitops.ApplyOptions{Incremental: true, Changes: changes, Prune: true, KeepGoing: true, Rollback: true}
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	var partial *gitops.PartialApplyError
+	if err == nil || errors.As(err, &partial) || !strings.Contains(err.Error(), "rolled back 1 changes") {
+		t.Fatalf("expected the deleted policy to be rolled back, got %v", err)
+	}
+	policy, err := vc.Sys().GetPolicyWithContext(ctx, "doomed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(original, policy); diff != "" {
+		t.Errorf("policy wasn't restored (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyAuthUsersAndGroups(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	for _, mountType := range []string{"userpass", "ldap"} {
+		if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, mountType, &vault.EnableAuthOptions{Type: mountType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := vc.Logical().WriteWithContext(ctx, "auth/userpass/users/alice", map[string]interface{}{"password": "hunter2", "token_policies": "default"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vc.Logical().WriteWithContext(ctx, "auth/ldap/users/bob", map[string]interface{}{"policies": "default"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	if err := gitops.DownloadAuth(ctx, vc, authDir); err != nil {
+		t.Fatal(err)
+	}
+	// users and groups round trip, and an LDAP mount plans both
+	_ = os.WriteFile(filepath.Join(authDir, "userpass", "users", "alice"), []byte(`{"token_policies": ["default"], "token_ttl": 600}`), 0o644)
+	_ = os.MkdirAll(filepath.Join(authDir, "ldap", "groups"), 0o755)
+	_ = os.WriteFile(filepath.Join(authDir, "ldap", "groups", "engineering"), []byte(`{"policies": ["default"]}`), 0o644)
+
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true, Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, change := range plan.Changes {
+		paths = append(paths, change.Mutation.String()+" "+change.Path)
+	}
+	expected := []string{"Add auth/ldap/groups/engineering", "Change auth/userpass/users/alice"}
+	if diff := cmp.Diff(expected, paths); diff != "" {
+		t.Errorf("unexpected plan (-want +got):\n%s", diff)
+	}
+
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := vc.Logical().ReadWithContext(ctx, "auth/userpass/users/alice")
+	if err != nil || user == nil {
+		t.Fatalf("expected the userpass user to still exist, got %v", err)
+	}
+	if ttl := fmt.Sprint(user.Data["token_ttl"]); ttl != "600" {
+		t.Errorf("expected the userpass user to be updated, token_ttl is %s", ttl)
+	}
+	if group, err := vc.Logical().ReadWithContext(ctx, "auth/ldap/groups/engineering"); err != nil || group == nil {
+		t.Errorf("expected the LDAP group to be written, got %v", err)
+	}
+	if user, err := vc.Logical().ReadWithContext(ctx, "auth/ldap/users/bob"); err != nil || user == nil {
+		t.Errorf("expected the downloaded LDAP user to be left alone, got %v", err)
+	}
+}
+
+func TestApplyGitHubMappings(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "github", &vault.EnableAuthOptions{Type: "github"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vc.Sys().PutPolicyWithContext(ctx, "ci", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "ci"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	_ = os.MkdirAll(filepath.Join(authDir, "github", "map", "teams"), 0o755)
+	_ = os.MkdirAll(filepath.Join(authDir, "github", "map", "users"), 0o755)
+	_ = os.WriteFile(filepath.Join(authDir, "github", "map", "teams", "platform"), []byte(`{"value": "ci,default"}`), 0o644)
+	_ = os.WriteFile(filepath.Join(authDir, "github", "map", "users", "octocat"), []byte(`{"value": "ci"}`), 0o644)
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"auth/github/map/teams/platform": "ci,default",
+		"auth/github/map/users/octocat":  "ci",
+	} {
+		secret, err := vc.Logical().ReadWithContext(ctx, path)
+		if err != nil || secret == nil {
+			t.Fatalf("expected %s to be written, got %v", path, err)
+		}
+		if value := fmt.Sprint(secret.Data["value"]); value != expected {
+			t.Errorf("expected %s to map to %s, got %s", path, expected, value)
+		}
+	}
+
+	// downloading writes them back to the same files, so nothing's left to apply
+	downloadDir := filepath.Join(t.TempDir(), "auth")
+	if err := gitops.DownloadAuth(ctx, vc, downloadDir); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, downloadDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true, Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected downloaded mappings to match Vault, got %+v", plan.Changes)
+	}
+}
+
+func TestApplyCertRoles(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "cert", &vault.EnableAuthOptions{Type: "cert"}); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hvresult test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(filepath.Join(authDir, "cert", "certs"), 0o755)
+	role, _ := json.Marshal(map[string]interface{}{
+		"certificate":          certificate,
+		"allowed_common_names": []string{"web.example.com"},
+		"token_policies":       []string{"default"},
+	})
+	_ = os.WriteFile(filepath.Join(authDir, "cert", "certs", "web"), role, 0o644)
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := vc.Logical().ReadWithContext(ctx, "auth/cert/certs/web")
+	if err != nil || secret == nil {
+		t.Fatalf("expected the cert role to be written, got %v", err)
+	}
+	if diff := cmp.Diff(certificate, secret.Data["certificate"]); diff != "" {
+		t.Errorf("certificate changed on the way to Vault (-want +got):\n%s", diff)
+	}
+
+	// the whole role comes back down, with the PEM untouched
+	downloadDir := filepath.Join(t.TempDir(), "auth")
+	if err := gitops.DownloadAuth(ctx, vc, downloadDir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(downloadDir, "cert", "certs", "web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloaded map[string]interface{}
+	if err := json.Unmarshal(content, &downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(certificate, downloaded["certificate"]); diff != "" {
+		t.Errorf("certificate changed on the way down (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]interface{}{"web.example.com"}, downloaded["allowed_common_names"]); diff != "" {
+		t.Errorf("constraints weren't downloaded (-want +got):\n%s", diff)
+	}
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, downloadDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true, Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected the downloaded cert role to match Vault, got %+v", plan.Changes)
+	}
+}
+
+func TestApplyAuthConfig(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "ldap", &vault.EnableAuthOptions{Type: "ldap"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := vc.Logical().WriteWithContext(ctx, "auth/ldap/config", map[string]interface{}{
+		"url":      "ldap://old.example.com",
+		"binddn":   "cn=vault,dc=example,dc=com",
+		"bindpass": "hunter2",
+		"userdn":   "ou=users,dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	if err := gitops.DownloadAuth(ctx, vc, authDir); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(authDir, "ldap", gitops.AuthConfigFileName)
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["url"] != "ldap://old.example.com" || config["binddn"] != "cn=vault,dc=example,dc=com" {
+		t.Errorf("expected the LDAP config to be downloaded, got %v", config)
+	}
+
+	// a redacted field is left alone instead of being written as the placeholder
+	config["url"] = "ldap://new.example.com"
+	config["bindpass"] = gitops.RedactedValue
+	content, _ = json.Marshal(config)
+	_ = os.WriteFile(configFile, content, 0o644)
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Kind != gitops.AuthConfigResource || plan.Changes[0].Path != "auth/ldap/config" {
+		t.Fatalf("expected only the config to change, got %+v", plan.Changes)
+	}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true}); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := vc.Logical().ReadWithContext(ctx, "auth/ldap/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url := fmt.Sprint(secret.Data["url"]); url != "ldap://new.example.com" {
+		t.Errorf("expected the config to be updated, url is %s", url)
+	}
+}
+
+func TestApplyMFA(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "userpass", &vault.EnableAuthOptions{Type: "userpass"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	identityDir := filepath.Join(tempDir, "identity")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(filepath.Join(identityDir, "group"), 0o755)
+	_ = os.MkdirAll(filepath.Join(identityDir, "mfa", "method"), 0o755)
+	_ = os.MkdirAll(filepath.Join(identityDir, "mfa", "login-enforcement"), 0o755)
+	_ = os.WriteFile(filepath.Join(identityDir, "group", "admins"), []byte(`{}`), 0o644)
+	_ = os.WriteFile(filepath.Join(identityDir, "mfa", "method", "authenticator"), []byte(`{"type": "totp", "issuer": "Vault", "period": 30}`), 0o644)
+	// refers to the method, mount, and group by name
+	_ = os.WriteFile(filepath.Join(identityDir, "mfa", "login-enforcement", "admins"), []byte(`{"mfa_methods": ["authenticator"], "auth_mounts": ["userpass"], "identity_groups": ["admins"]}`), 0o644)
+
+	opts := gitops.ApplyOptions{IdentityDirectory: identityDir, Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	methods, err := vc.Logical().ListWithContext(ctx, "identity/mfa/method")
+	if err != nil || methods == nil {
+		t.Fatalf("expected an MFA method to exist: %v", err)
+	}
+	keys, _ := methods.Data["keys"].([]interface{})
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 MFA method, got %v", methods.Data["keys"])
+	}
+	enforcement, err := vc.Logical().ReadWithContext(ctx, "identity/mfa/login-enforcement/admins")
+	if err != nil || enforcement == nil {
+		t.Fatalf("expected login enforcement admins to exist: %v", err)
+	}
+	if diff := cmp.Diff([]interface{}{keys[0]}, enforcement.Data["mfa_method_ids"]); diff != "" {
+		t.Errorf("unexpected enforcement methods (-want +got):\n%s", diff)
+	}
+
+	// downloading gets the same files back, so nothing's left to change
+	downloadDir := filepath.Join(t.TempDir(), "identity")
+	if err := gitops.DownloadIdentity(ctx, vc, downloadDir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(downloadDir, "mfa", "login-enforcement", "admins"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"authenticator"`) || !strings.Contains(string(content), `"userpass"`) {
+		t.Errorf("expected downloaded enforcement to refer to things by name, got:\n%s", content)
+	}
+	opts.IdentityDirectory = downloadDir
+	opts.SkipUnchanged = true
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no changes after downloading, got:\n%s", plan.MarkdownTable())
+	}
+
+	// removing both files deletes the enforcement before the method it uses
+	_ = os.Remove(filepath.Join(identityDir, "mfa", "method", "authenticator"))
+	_ = os.Remove(filepath.Join(identityDir, "mfa", "login-enforcement", "admins"))
+	opts = gitops.ApplyOptions{IdentityDirectory: identityDir, Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if methods, _ := vc.Logical().ListWithContext(ctx, "identity/mfa/method"); methods != nil {
+		t.Errorf("expected the MFA method to be deleted, got %v", methods.Data["keys"])
+	}
+}
+
+func TestApplyOIDC(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	identityDir := filepath.Join(tempDir, "identity")
+	_ = os.MkdirAll(policyDir, 0o755)
+	for _, objectType := range []string{"key", "scope", "assignment", "client", "provider"} {
+		_ = os.MkdirAll(filepath.Join(identityDir, "oidc", objectType), 0o755)
+	}
+	_ = os.MkdirAll(filepath.Join(identityDir, "group"), 0o755)
+	_ = os.WriteFile(filepath.Join(identityDir, "group", "engineers"), []byte(`{}`), 0o644)
+	_ = os.WriteFile(filepath.Join(identityDir, "oidc", "key", "apps"), []byte(`{"allowed_client_ids": ["*"], "rotation_period": "24h"}`), 0o644)
+	_ = os.WriteFile(filepath.Join(identityDir, "oidc", "scope", "groups"), []byte(`{"template": "{\"groups\": {{identity.entity.groups.names}}}"}`), 0o644)
+	_ = os.WriteFile(filepath.Join(identityDir, "oidc", "assignment", "everyone"), []byte(`{"entity_ids": ["*"]}`), 0o644)
+	// written after the key and assignment it uses, then the provider after it
+	_ = os.WriteFile(filepath.Join(identityDir, "oidc", "client", "grafana"), []byte(`{"key": "apps", "assignments": ["everyone"], "redirect_uris": ["https://grafana.example.com/login/generic_oauth"]}`), 0o644)
+	_ = os.WriteFile(filepath.Join(identityDir, "oidc", "provider", "apps"), []byte(`{"allowed_client_ids": ["*"], "scopes_supported": ["groups"]}`), 0o644)
+
+	opts := gitops.ApplyOptions{IdentityDirectory: identityDir, Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	client, err := vc.Logical().ReadWithContext(ctx, "identity/oidc/client/grafana")
+	if err != nil || client == nil {
+		t.Fatalf("expected client grafana to exist: %v", err)
+	}
+	if diff := cmp.Diff("apps", client.Data["key"]); diff != "" {
+		t.Errorf("unexpected client key (-want +got):\n%s", diff)
+	}
+	provider, err := vc.Logical().ReadWithContext(ctx, "identity/oidc/provider/apps")
+	if err != nil || provider == nil {
+		t.Fatalf("expected provider apps to exist: %v", err)
+	}
+
+	// downloading gets files that don't change anything, without the client's secret or Vault's built in objects
+	downloadDir := filepath.Join(t.TempDir(), "identity")
+	if err := gitops.DownloadIdentity(ctx, vc, downloadDir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(downloadDir, "oidc", "client", "grafana"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "client_secret") {
+		t.Errorf("expected downloaded client to leave out its secret, got:\n%s", content)
+	}
+	if _, err := os.Stat(filepath.Join(downloadDir, "oidc", "assignment", "allow_all")); err == nil {
+		t.Error("expected the allow_all assignment not to be downloaded")
+	}
+	opts.IdentityDirectory = downloadDir
+	opts.SkipUnchanged = true
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no changes after downloading, got:\n%s", plan.MarkdownTable())
+	}
+
+	// removing everything deletes the provider first and leaves the built in key and provider alone
+	_ = os.RemoveAll(filepath.Join(identityDir, "oidc"))
+	opts = gitops.ApplyOptions{IdentityDirectory: identityDir, Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := vc.Logical().ReadWithContext(ctx, "identity/oidc/key/apps"); key != nil {
+		t.Error("expected key apps to be deleted")
+	}
+	if key, _ := vc.Logical().ReadWithContext(ctx, "identity/oidc/key/default"); key == nil {
+		t.Error("expected the default key to be left alone")
+	}
+}
+
+func TestApplyPasswordPolicies(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	passwordDir := filepath.Join(tempDir, "sys", "policies", "password")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(passwordDir, 0o755)
+	policy := "length = 20\n\nrule \"charset\" {\n  charset = \"abcdefghijklmnopqrstuvwxyz0123456789\"\n}\n"
+	_ = os.WriteFile(filepath.Join(passwordDir, "databases"), []byte(policy), 0o644)
+
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	generated, err := vc.Logical().ReadWithContext(ctx, "sys/policies/password/databases/generate")
+	if err != nil || generated == nil {
+		t.Fatalf("expected password policy databases to exist: %v", err)
+	}
+	if password, _ := generated.Data["password"].(string); len(password) != 20 {
+		t.Errorf("expected a 20 character password, got %q", password)
+	}
+
+	// downloading puts it next to the ACL policies, with nothing left to change
+	downloadDir := t.TempDir()
+	downloadPolicyDir := filepath.Join(downloadDir, "sys", "policies", "acl")
+	if err := gitops.DownloadPolicies(ctx, vc, downloadPolicyDir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(downloadDir, "sys", "policies", "password", "databases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(policy, string(content)); diff != "" {
+		t.Errorf("unexpected downloaded password policy (-want +got):\n%s", diff)
+	}
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, downloadPolicyDir, gitops.ApplyOptions{SkipUnchanged: true, Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no changes after downloading, got:\n%s", plan.MarkdownTable())
+	}
+
+	// removing the file deletes it
+	_ = os.Remove(filepath.Join(passwordDir, "databases"))
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	if secret, _ := vc.Logical().ReadWithContext(ctx, "sys/policies/password/databases"); secret != nil {
+		t.Error("expected password policy databases to be deleted")
+	}
+}
+
+func TestApplyQuotas(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "userpass", &vault.EnableAuthOptions{Type: "userpass"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	quotasDir := filepath.Join(tempDir, "sys", "quotas")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(filepath.Join(quotasDir, "rate-limit"), 0o755)
+	_ = os.WriteFile(filepath.Join(quotasDir, "rate-limit", "logins"), []byte(`{"path": "auth/userpass/", "rate": 10, "interval": 60}`), 0o644)
+
+	opts := gitops.ApplyOptions{QuotasDirectory: quotasDir, Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	quota, err := vc.Logical().ReadWithContext(ctx, "sys/quotas/rate-limit/logins")
+	if err != nil || quota == nil {
+		t.Fatalf("expected quota logins to exist: %v", err)
+	}
+	if diff := cmp.Diff("auth/userpass/", quota.Data["path"]); diff != "" {
+		t.Errorf("unexpected quota path (-want +got):\n%s", diff)
+	}
+
+	// a change made in Vault shows up as drift
+	if _, err := vc.Logical().WriteWithContext(ctx, "sys/quotas/rate-limit/logins", map[string]interface{}{"rate": 100}); err != nil {
+		t.Fatal(err)
+	}
+	opts.SkipUnchanged = true
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Path != "sys/quotas/rate-limit/logins" {
+		t.Errorf("expected the quota to change back, got:\n%s", plan.MarkdownTable())
+	}
+
+	// downloading gets a file that doesn't change anything
+	downloadDir := filepath.Join(t.TempDir(), "sys", "quotas")
+	if err := gitops.DownloadQuotas(ctx, vc, downloadDir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(downloadDir, "rate-limit", "logins"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), `"name"`) || strings.Contains(string(content), `"type"`) {
+		t.Errorf("expected downloaded quota to leave out what Vault sets, got:\n%s", content)
+	}
+	opts.QuotasDirectory = downloadDir
+	plan, err = gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no changes after downloading, got:\n%s", plan.MarkdownTable())
+	}
+
+	// removing the file deletes it
+	_ = os.Remove(filepath.Join(quotasDir, "rate-limit", "logins"))
+	opts = gitops.ApplyOptions{QuotasDirectory: quotasDir, Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if quota, _ := vc.Logical().ReadWithContext(ctx, "sys/quotas/rate-limit/logins"); quota != nil {
+		t.Error("expected quota logins to be deleted")
+	}
+}
+
+func TestApplyTokenRoles(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.MkdirAll(filepath.Join(authDir, "token", "roles"), 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "ci"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	_ = os.WriteFile(filepath.Join(authDir, "token", "roles", "ci"), []byte(`{
+  "allowed_policies": ["ci"],
+  "allowed_policies_glob": ["ci-*"],
+  "disallowed_policies": ["root"],
+  "orphan": true,
+  "renewable": false
+}`), 0o644)
+
+	opts := gitops.ApplyOptions{Prune: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	role, err := vc.Logical().ReadWithContext(ctx, "auth/token/roles/ci")
+	if err != nil || role == nil {
+		t.Fatalf("expected token role ci to exist: %v", err)
+	}
+	if role.Data["orphan"] != true || role.Data["renewable"] != false {
+		t.Errorf("expected an orphan, non-renewable role, got %v", role.Data)
+	}
+
+	// downloading keeps everything that constrains tokens, with nothing left to change
+	downloadDir := filepath.Join(t.TempDir(), "auth")
+	if err := gitops.DownloadAuth(ctx, vc, downloadDir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(downloadDir, "token", "roles", "ci"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloaded map[string]interface{}
+	if err := json.Unmarshal(content, &downloaded); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"allowed_policies", "allowed_policies_glob", "disallowed_policies", "orphan", "renewable"} {
+		if _, ok := downloaded[field]; !ok {
+			t.Errorf("expected downloaded token role to have %s, got:\n%s", field, content)
+		}
+	}
+	if _, ok := downloaded["name"]; ok {
+		t.Errorf("expected downloaded token role to leave out its name, got:\n%s", content)
+	}
+	opts.SkipUnchanged = true
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, downloadDir, policyDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Errorf("expected no changes after downloading, got:\n%s", plan.MarkdownTable())
+	}
+
+	// and turning orphan off again goes back to Vault
+	_ = os.WriteFile(filepath.Join(authDir, "token", "roles", "ci"), []byte(`{"allowed_policies": ["ci"], "orphan": false}`), 0o644)
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	role, _ = vc.Logical().ReadWithContext(ctx, "auth/token/roles/ci")
+	if role.Data["orphan"] != false {
+		t.Errorf("expected the role not to be orphan anymore, got %v", role.Data["orphan"])
+	}
+}
+
+func TestApplyIgnoreFile(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	files := map[string]string{
+		gitops.IgnoreFileName:                        "# not Vault objects\nREADME.md\nOWNERS\ndrafts/\n",
+		"sys/policies/acl/reader":                    `path "secret/*" { capabilities = ["read"] }`,
+		"sys/policies/acl/README.md":                 "# Policies",
+		"sys/policies/acl/.reader.swp":               "swap",
+		"sys/policies/acl/drafts/writer":             `path "secret/*" { capabilities = ["create"] }`,
+		"auth/approle/role/ci":                       `{"token_policies": ["reader"]}`,
+		"auth/approle/role/OWNERS":                   "@platform",
+		"auth/approle/role/" + gitops.IgnoreFileName: "ci-*\n",
+		"auth/approle/role/ci-draft":                 `{"token_policies": ["reader"]}`,
+	}
+	for path, content := range files {
+		path = filepath.Join(tempDir, path)
+		_ = os.MkdirAll(filepath.Dir(path), 0o755)
+		_ = os.WriteFile(path, []byte(content), 0o644)
+	}
+	// ignore files in subdirectories add to the ones above them
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, change := range plan.Changes {
+		if change.Mutation == gitops.Add {
+			paths = append(paths, change.Path)
+		}
+	}
+	slices.Sort(paths)
+	expected := []string{"auth/approle/role/ci", "sys/policies/acl/reader"}
+	if diff := cmp.Diff(expected, paths); diff != "" {
+		t.Fatalf("unexpected additions (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyConfirmDeletions(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().PutPolicyWithContext(ctx, "old", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "new"), []byte(`path "secret/*" { capabilities = ["list"] }`), 0o644)
+
+	var asked []string
+	opts := gitops.ApplyOptions{Prune: true, ConfirmDeletions: func(deletes []gitops.PlannedChange) error {
+		asked = nil
+		for _, change := range deletes {
+			asked = append(asked, change.Path)
+		}
+		return errors.New("not approved")
+	}}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err == nil {
+		t.Fatal("expected an error when deletions weren't approved")
+	}
+	if diff := cmp.Diff([]string{"sys/policies/acl/old"}, asked); diff != "" {
+		t.Errorf("unexpected deletions to confirm (-want +got):\n%s", diff)
+	}
+	// nothing at all is applied without approval
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "new"); policy != "" {
+		t.Fatal("policy was written even though deletions weren't approved")
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "old"); policy == "" {
+		t.Fatal("policy was deleted without approval")
+	}
+
+	opts.ConfirmDeletions = func(deletes []gitops.PlannedChange) error { return nil }
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "old"); policy != "" {
+		t.Fatal("approved deletion didn't happen")
+	}
+}
+
+func TestApplySavedPlan(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().PutPolicyWithContext(ctx, "old", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	planned := `path "secret/*" { capabilities = ["list"] }`
+	_ = os.WriteFile(filepath.Join(policyDir, "new"), []byte(planned), 0o644)
+
+	opts := gitops.ApplyOptions{Prune: true}
+	save := func() string {
+		plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved, err := gitops.SavePlan(ctx, vc, plan, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := json.Marshal(saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(t.TempDir(), "plan.json")
+		if err := os.WriteFile(file, encoded, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	apply := func(file string) error {
+		saved, err := gitops.ReadSavedPlan(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gitops.ApplySavedPlanWithOptions(ctx, vc, saved, gitops.ApplyOptions{})
+	}
+
+	// something the plan touches changed in Vault after planning
+	file := save()
+	if err := vc.Sys().PutPolicyWithContext(ctx, "old", `path "secret/*" { capabilities = ["read", "list"] }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(file); err == nil {
+		t.Fatal("expected an error applying a plan when Vault changed since")
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "new"); policy != "" {
+		t.Fatal("policy was written from a stale plan")
+	}
+
+	// the saved content is applied, not whatever the local file says now
+	file = save()
+	_ = os.WriteFile(filepath.Join(policyDir, "new"), []byte(`path "secret/*" { capabilities = ["deny"] }`), 0o644)
+	if err := apply(file); err != nil {
+		t.Fatal(err)
+	}
+	policy, _ := vc.Sys().GetPolicyWithContext(ctx, "new")
+	if diff := cmp.Diff(planned, policy); diff != "" {
+		t.Errorf("unexpected policy (-want +got):\n%s", diff)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "old"); policy != "" {
+		t.Fatal("planned deletion didn't happen")
+	}
+}
+
+func TestApplySavedPlanPolicyInUse(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().PutPolicyWithContext(ctx, "in-use", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	opts := gitops.ApplyOptions{Prune: true}
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := gitops.SavePlan(ctx, vc, plan, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the entity isn't in the plan, so the plan isn't stale, but the policy is in use by the time it's applied
+	if _, err := vc.Logical().WriteWithContext(ctx, "identity/entity", map[string]interface{}{
+		"name":     "someone",
+		"policies": []string{"in-use"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err = gitops.ApplySavedPlanWithOptions(ctx, vc, saved, gitops.ApplyOptions{})
+	if err == nil || !strings.Contains(err.Error(), "identity/entity/name/someone") {
+		t.Fatalf("expected deleting a policy used by an entity to fail, got: %v", err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "in-use"); policy == "" {
+		t.Fatal("policy was deleted without --force")
+	}
+
+	if err := gitops.ApplySavedPlanWithOptions(ctx, vc, saved, gitops.ApplyOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "in-use"); policy != "" {
+		t.Fatal("policy wasn't deleted with --force")
+	}
+}
+
+func TestApplyNestedPolicyNames(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().PutPolicyWithContext(ctx, "team/payments/reader", `path "secret/payments/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	if err := gitops.DownloadPolicies(ctx, vc, policyDir); err != nil {
+		t.Fatal(err)
+	}
+	// slashes are escaped in the file name instead of making subdirectories
+	if _, err := os.Stat(filepath.Join(policyDir, "team%2Fpayments%2Freader")); err != nil {
+		t.Fatalf("expected the nested policy to be downloaded to an escaped file name: %v", err)
+	}
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true, SkipUnchanged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) > 0 {
+		t.Fatalf("expected a downloaded nested policy to be unchanged, got %+v", plan.Changes)
+	}
+
+	_ = os.WriteFile(filepath.Join(policyDir, "team%2Fpayments%2Fwriter"), []byte(`path "secret/payments/*" { capabilities = ["create"] }`), 0o644)
+	_ = os.Remove(filepath.Join(policyDir, "team%2Fpayments%2Freader"))
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true, ConfirmDeletions: func([]gitops.PlannedChange) error { return nil }}); err != nil {
+		t.Fatal(err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "team/payments/writer"); policy == "" {
+		t.Error("expected the nested policy to be written")
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "team/payments/reader"); policy != "" {
+		t.Error("expected the nested policy to be deleted")
+	}
+}
+
+func TestApplyRedactedRoleFields(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vc.Logical().WriteWithContext(ctx, "auth/approle/role/ci", map[string]interface{}{"token_policies": []string{"default"}, "token_ttl": "1h"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	_ = os.MkdirAll(roleDir, 0o755)
+	_ = os.WriteFile(filepath.Join(roleDir, "ci"), []byte(`{"token_policies": ["default"], "token_ttl": "`+gitops.RedactedValue+`"}`), 0o644)
+
+	// a redacted field is whatever Vault has, so it's not a change
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) > 0 {
+		t.Fatalf("expected no changes, got %+v", plan.Changes)
+	}
+	_ = os.WriteFile(filepath.Join(roleDir, "ci"), []byte(`{"token_policies": ["reader"], "token_ttl": "`+gitops.RedactedValue+`"}`), 0o644)
+	if err := gitops.ApplyChanges(ctx, vc, authDir, policyDir); err != nil {
+		t.Fatal(err)
+	}
+	role, err := vc.Logical().ReadWithContext(ctx, "auth/approle/role/ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]interface{}{"reader"}, role.Data["token_policies"]); diff != "" {
+		t.Errorf("unexpected policies (-want +got):\n%s", diff)
+	}
+	if ttl := fmt.Sprint(role.Data["token_ttl"]); ttl != "3600" {
+		t.Errorf("expected the redacted token_ttl to be left alone, got %v", role.Data["token_ttl"])
+	}
+}
+
+func TestApplyPolicyFormatting(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	if err := vc.Sys().PutPolicyWithContext(ctx, "reader", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	if err := os.MkdirAll(policyDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// the same policy, hand-written
+	const handWritten = "# for the readers\npath \"secret/*\" {\n    capabilities = [ \"read\" ]\n}\n"
+	if err := os.WriteFile(filepath.Join(policyDir, "reader"), []byte(handWritten), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true}); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := vc.Sys().GetPolicyWithContext(ctx, "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(handWritten, policy); diff != "" {
+		t.Errorf("expected the policy to be written byte for byte (-want +got):\n%s", diff)
+	}
+
+	unformatted, err := gitops.FormatPolicies(tempDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{filepath.Join(policyDir, "reader")}, unformatted); diff != "" {
+		t.Errorf("unexpected unformatted policies (-want +got):\n%s", diff)
+	}
+	if _, err := gitops.FormatPolicies(tempDir, false); err != nil {
+		t.Fatal(err)
+	}
+	formatted, err := os.ReadFile(filepath.Join(policyDir, "reader"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("# for the readers\npath \"secret/*\" {\n  capabilities = [\"read\"]\n}\n", string(formatted)); diff != "" {
+		t.Errorf("unexpected formatted policy (-want +got):\n%s", diff)
+	}
+}
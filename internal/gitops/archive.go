@@ -0,0 +1,129 @@
+package gitops
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// WriteArchive streams `directory` to `w` as a gzip-compressed tarball.
+//
+// Files are compressed as they're read, so nothing but the archive itself is written.
+func WriteArchive(w io.Writer, directory string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() && !d.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(directory, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error archiving %s: %w", directory, err)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// ExtractArchive streams an archive written by WriteArchive into `directory`.
+//
+// Uncompressed tarballs are also accepted.
+func ExtractArchive(r io.Reader, directory string) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	var tr *tar.Reader
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("error reading gzip archive: %w", err)
+		}
+		defer gr.Close()
+		tr = tar.NewReader(gr)
+	case bytes.HasPrefix(magic, zstdMagic):
+		return fmt.Errorf("zstd archives aren't supported, recompress with gzip")
+	default:
+		tr = tar.NewReader(br)
+	}
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading archive: %w", err)
+		}
+		target := filepath.Join(directory, filepath.FromSlash(header.Name))
+		// no writing outside of `directory`
+		if rel, err := filepath.Rel(directory, target); err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("archive entry '%s' escapes %s", header.Name, directory)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o750); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := extractFile(tr, target); err != nil {
+				return fmt.Errorf("error extracting %s: %w", header.Name, err)
+			}
+		}
+	}
+}
+
+func extractFile(r io.Reader, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
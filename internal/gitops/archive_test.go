@@ -0,0 +1,50 @@
+package gitops_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestArchive(t *testing.T) {
+	var (
+		src = t.TempDir()
+		dst = t.TempDir()
+	)
+	files := map[string]string{
+		"sys/policies/acl/test":  `path "secret/*" { capabilities = ["read"] }`,
+		"auth/approle/role/test": `{"token_policies": ["test"]}`,
+	}
+	for path, content := range files {
+		path = filepath.Join(src, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := gitops.WriteArchive(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.ExtractArchive(&buf, dst); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range files {
+		actual, err := os.ReadFile(filepath.Join(dst, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expected {
+			t.Errorf("%s: expected %q, got %q", path, expected, actual)
+		}
+	}
+	// zstd is recognized but not supported
+	if err := gitops.ExtractArchive(bytes.NewReader([]byte{0x28, 0xb5, 0x2f, 0xfd, 0}), dst); err == nil {
+		t.Error("expected an error extracting a zstd archive")
+	}
+}
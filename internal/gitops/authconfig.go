@@ -0,0 +1,184 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// The file in an auth mount's directory with its config, e.g. the Kubernetes host and CA or the OIDC discovery URL.
+const AuthConfigFileName = "_config.json"
+
+// What download writes instead of a secret config or role field. Apply leaves fields with it out, so Vault keeps
+// whatever it has.
+const RedactedValue = "<redacted>"
+
+// Config, role, and MFA method fields that are credentials, which Vault mostly doesn't return anyway.
+var secretConfigFields = map[string]bool{
+	"bindpass":             true,
+	"client_secret":        true,
+	"credentials":          true,
+	"keytab":               true,
+	"oidc_client_secret":   true,
+	"password":             true,
+	"private_key":          true,
+	"secret":               true,
+	"secret_key":           true,
+	"token":                true,
+	"api_token":            true,
+	"integration_key":      true,
+	"settings_file_base64": true,
+	"token_reviewer_jwt":   true,
+}
+
+// The path of a mount type's config relative to the mount, if it has one.
+func authConfigPathFor(mountType string) (string, bool) {
+	switch mountType {
+	case "aws":
+		return "config/client", true
+	case "azure", "cert", "gcp", "github", "jwt", "kerberos", "kubernetes", "ldap", "oci", "oidc", "okta", "radius", "saml":
+		return "config", true
+	}
+	return "", false
+}
+
+// Plans writing a mount's config if it has a local config file. Configs are never deleted, since there's always one.
+func planAuthConfig(authDirectory, mountName string, mount *vault.AuthMount) []PlannedChange {
+	configPath, ok := authConfigPathFor(mount.Type)
+	if !ok {
+		return nil
+	}
+	file := filepath.Join(authDirectory, filepath.FromSlash(mountName), AuthConfigFileName)
+	if _, err := os.Stat(file); err != nil {
+		return nil
+	}
+	mutation := Change
+	if mount.Accessor == "" {
+		mutation = Add
+	}
+	return []PlannedChange{{
+		Mutation: mutation,
+		Kind:     AuthConfigResource,
+		Path:     fmt.Sprintf("auth/%s/%s", mountName, configPath),
+		File:     file,
+	}}
+}
+
+// Writes a mount's config from its file, leaving out redacted fields.
+func (a *applier) writeAuthConfig(ctx context.Context, change PlannedChange) error {
+	data, err := readRoleFile(change.File)
+	if err != nil {
+		return err
+	}
+	return a.writeRole(ctx, change.Path, withoutRedacted(data), change.Mutation == Change)
+}
+
+// Leaves out fields that are RedactedValue or have it anywhere in them, like a connection_details object with a
+// redacted password, since Vault replaces objects whole but keeps whatever it has for fields that aren't written.
+func withoutRedacted(data map[string]interface{}) map[string]interface{} {
+	for key, value := range data {
+		if containsRedacted(value) {
+			delete(data, key)
+		}
+	}
+	return data
+}
+
+func containsRedacted(value interface{}) bool {
+	switch value := value.(type) {
+	case string:
+		return value == RedactedValue
+	case map[string]interface{}:
+		for _, nested := range value {
+			if containsRedacted(nested) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if containsRedacted(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Replaces secret fields in `data`, and in any objects and lists in it, with RedactedValue. Returns whether there were
+// any.
+func redactSecrets(data map[string]interface{}) bool {
+	var redacted bool
+	for key, value := range data {
+		if secretConfigFields[key] && value != RedactedValue {
+			data[key] = RedactedValue
+			redacted = true
+		} else if redactNested(value) {
+			redacted = true
+		}
+	}
+	return redacted
+}
+
+func redactNested(value interface{}) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return redactSecrets(value)
+	case []interface{}:
+		var redacted bool
+		for _, item := range value {
+			if redactNested(item) {
+				redacted = true
+			}
+		}
+		return redacted
+	}
+	return false
+}
+
+// Writes a mount's config to its directory in `authDirectory`, with secret fields redacted unless
+// DownloadOptions.KeepSecrets says otherwise.
+func (a *applier) downloadAuthConfig(ctx context.Context, authDirectory, mountName string, mount *vault.AuthMount, opts DownloadOptions) error {
+	configPath, ok := authConfigPathFor(mount.Type)
+	if !ok {
+		return nil
+	}
+	readPath := fmt.Sprintf("auth/%s/%s", mountName, configPath)
+	var secret *vault.Secret
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = a.vc.Logical().ReadWithContext(ctx, readPath)
+		return err
+	})
+	if err != nil {
+		if opts.SkipForbidden && isPermissionDenied(err) {
+			opts.Report.Skip(readPath, "read", err)
+			return nil
+		}
+		return fmt.Errorf("error reading auth mount config %s: %w", readPath, err)
+	}
+	if secret == nil || secret.Data == nil {
+		log.Debug().Str("path", readPath).Msg("Auth mount has no config, skipping")
+		return nil
+	}
+	data := nonDefaultFields(secret.Data)
+	// an unconfigured mount, whose empty config some mount types would refuse to have written back
+	if len(data) == 0 {
+		return nil
+	}
+	if !opts.KeepSecrets {
+		redactSecrets(data)
+	}
+	file := filepath.Join(authDirectory, filepath.FromSlash(mountName), AuthConfigFileName)
+	if err := opts.mkdir(filepath.Dir(file)); err != nil {
+		return fmt.Errorf("error creating auth mount directory: %w", err)
+	}
+	content, err := marshalFile(data)
+	if err != nil {
+		return err
+	}
+	return opts.writeFile(file, AuthConfigResource, readPath, content)
+}
@@ -0,0 +1,286 @@
+package gitops
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// The file in a backup directory that isn't a Vault object.
+const backupManifestName = "manifest.json"
+
+// BackupManifest describes a backup written before an apply.
+type BackupManifest struct {
+	CreatedAt time.Time `json:"created_at"`
+	// Vault paths that didn't exist before the apply, which a restore deletes.
+	Added []string `json:"added"`
+}
+
+// DefaultBackupDirectory is where backups of the cluster a Vault client points at go unless something else is
+// configured: a directory in the user cache directory, which is only readable by its owner, rather than anywhere a
+// repository might pick them up.
+func DefaultBackupDirectory(vc *vault.Client) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding user cache directory: %w", err)
+	}
+	sum := sha256.Sum256([]byte(vc.Address()))
+	dir := filepath.Join(cacheDir, "hvresult", "backups-"+hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("error creating backup directory: %w", err)
+	}
+	// MkdirAll leaves an existing directory's permissions alone
+	if err := os.Chmod(dir, 0o700); err != nil {
+		return "", fmt.Errorf("error setting backup directory permissions: %w", err)
+	}
+	return dir, nil
+}
+
+// Saves the current content of everything `plan` is about to change to a new timestamped directory under `parent`,
+// laid out the same way as a downloaded repository.
+//
+// Returns the directory the backup was written to.
+func (a *applier) backup(ctx context.Context, plan *Plan, parent string) (string, error) {
+	var (
+		dir      = filepath.Join(parent, time.Now().UTC().Format("20060102T150405Z"))
+		manifest = BackupManifest{CreatedAt: time.Now().UTC(), Added: []string{}}
+		mu       sync.Mutex
+	)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("error creating backup directory: %w", err)
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(concurrency(a.opts.Concurrency))
+	for _, change := range plan.Changes {
+		change := change
+		eg.Go(func() error {
+			content, err := a.readRemote(egCtx, change)
+			if err != nil {
+				return err
+			}
+			if content == nil {
+				// configs can't be deleted, so one that was never set is left as it is by a restore
+				if change.Mutation != Delete && change.Kind != AuthConfigResource {
+					mu.Lock()
+					manifest.Added = append(manifest.Added, change.Path)
+					mu.Unlock()
+				}
+				return nil
+			}
+			target := filepath.Join(dir, filepath.FromSlash(backupPath(change)))
+			if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+				return fmt.Errorf("error creating backup directory: %w", err)
+			}
+			if err := os.WriteFile(target, content, 0o600); err != nil {
+				return fmt.Errorf("error writing backup of %s: %w", change.Path, err)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return "", err
+	}
+	sort.Strings(manifest.Added)
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, backupManifestName), encoded, 0o600); err != nil {
+		return "", fmt.Errorf("error writing backup manifest: %w", err)
+	}
+	return dir, nil
+}
+
+// Where a change's object goes in a backup, which is its Vault path except for secrets engine roles, which are in
+// secrets/ like in a repository.
+func backupPath(change PlannedChange) string {
+	if change.Kind == SecretRoleResource {
+		return "secrets/" + change.Path
+	}
+	if change.Kind == PolicyResource {
+		return "sys/policies/acl/" + policyFileName(change.Name())
+	}
+	return change.Path
+}
+
+// The content of a change's object in Vault, in the same format as a local file, or nil if it doesn't exist.
+func (a *applier) readRemote(ctx context.Context, change PlannedChange) ([]byte, error) {
+	if change.Kind == IdentityEntityResource || change.Kind == IdentityGroupResource {
+		return a.readRemoteIdentity(ctx, change)
+	}
+	if change.Kind == MFAMethodResource || change.Kind == MFALoginEnforcementResource {
+		return a.readRemoteMFA(ctx, change)
+	}
+	if change.Kind == OIDCResource {
+		return a.readRemoteOIDC(ctx, change)
+	}
+	if change.Kind == SecretRoleResource {
+		return a.readRemoteSecretRole(ctx, change)
+	}
+	if change.Kind == SentinelPolicyResource {
+		return a.readRemoteSentinelPolicy(ctx, change)
+	}
+	if change.Kind == PasswordPolicyResource {
+		return a.readRemotePasswordPolicy(ctx, change)
+	}
+	if change.Kind == QuotaResource {
+		return a.readRemoteQuota(ctx, change)
+	}
+	if change.Kind == AuthMountResource || change.Kind == SecretsMountResource {
+		return a.readRemoteMount(ctx, change)
+	}
+	if change.Kind == PolicyResource {
+		var policy string
+		err := a.limiter.Do(ctx, func(ctx context.Context) error {
+			var err error
+			policy, err = a.vc.Sys().GetPolicyWithContext(ctx, change.Name())
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading policy %s from Vault: %w", change.Name(), err)
+		}
+		if policy == "" {
+			return nil, nil
+		}
+		return []byte(policy), nil
+	}
+	var secret *vault.Secret
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = a.vc.Logical().ReadWithContext(ctx, change.Path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading auth role %s from Vault: %w", change.Path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	return json.MarshalIndent(secret.Data, "", "  ")
+}
+
+// IsBackup reports whether `dir` is a backup written by an apply, as opposed to a whole repository like the ones
+// download and 'gitops backup' write.
+func IsBackup(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, backupManifestName))
+	return err == nil
+}
+
+// Restore puts back everything in a backup written by an apply: saved objects are written and objects the apply
+// added are deleted.
+func Restore(ctx context.Context, vc *vault.Client, backupDirectory string) error {
+	return RestoreWithOptions(ctx, vc, backupDirectory, ApplyOptions{})
+}
+
+// RestoreWithOptions is Restore with the request timeout from `opts`. Nothing else in it applies to restores.
+func RestoreWithOptions(ctx context.Context, vc *vault.Client, backupDirectory string, opts ApplyOptions) error {
+	plan, manifest, err := loadBackup(backupDirectory)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int("write", plan.Count(Change)).
+		Int("delete", plan.Count(Delete)).
+		Time("created_at", manifest.CreatedAt).
+		Msg("Restoring backup")
+	a := newApplier(vc, ApplyOptions{RequestTimeout: opts.RequestTimeout, Retries: opts.Retries, Concurrency: opts.Concurrency})
+	return a.execute(ctx, plan)
+}
+
+// Reads a backup written by an apply into a plan that puts it back.
+func loadBackup(backupDirectory string) (*Plan, BackupManifest, error) {
+	var manifest BackupManifest
+	content, err := os.ReadFile(filepath.Join(backupDirectory, backupManifestName))
+	if err != nil {
+		return nil, manifest, fmt.Errorf("error reading backup manifest: %w", err)
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, manifest, fmt.Errorf("error decoding backup manifest: %w", err)
+	}
+	plan := &Plan{}
+	err = filepath.WalkDir(backupDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(backupDirectory, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if relPath == backupManifestName {
+			return nil
+		}
+		if secretPath, ok := strings.CutPrefix(relPath, "secrets/"); ok {
+			plan.Changes = append(plan.Changes, PlannedChange{Mutation: Change, Kind: SecretRoleResource, Path: secretPath, File: path})
+			return nil
+		}
+		kind, ok := resourceKindFor(relPath)
+		if !ok {
+			log.Warn().Str("path", path).Msg("Ignoring unexpected file in backup")
+			return nil
+		}
+		if kind == PolicyResource {
+			// nested policy names are escaped in file names, see backupPath
+			relPath = "sys/policies/acl/" + policyNameFromFile(d.Name())
+		}
+		plan.Changes = append(plan.Changes, PlannedChange{Mutation: Change, Kind: kind, Path: relPath, File: path})
+		return nil
+	})
+	if err != nil {
+		return nil, manifest, fmt.Errorf("error walking backup directory: %w", err)
+	}
+	for _, added := range manifest.Added {
+		kind, ok := resourceKindFor(added)
+		if !ok {
+			kind = AuthRoleResource
+		}
+		plan.Changes = append(plan.Changes, PlannedChange{Mutation: Delete, Kind: kind, Path: added})
+	}
+	if err := plan.orderGroups(); err != nil {
+		return nil, manifest, err
+	}
+	if err := checkPlanFiles(plan, backupDirectory, backupDirectory, backupDirectory, backupDirectory, filepath.Join(backupDirectory, "secrets"), filepath.Join(backupDirectory, "sys", "mounts"), filepath.Join(backupDirectory, "sys", "quotas")); err != nil {
+		return nil, manifest, err
+	}
+	return plan, manifest, nil
+}
+
+// Puts back the objects `applied` changed from the backup in `backupDirectory`, after an apply failed partway.
+func (a *applier) rollback(ctx context.Context, backupDirectory string, applied []PlannedChange) error {
+	plan, _, err := loadBackup(backupDirectory)
+	if err != nil {
+		return err
+	}
+	paths := make(map[string]bool, len(applied))
+	for _, change := range applied {
+		paths[change.Path] = true
+		// the cached hash is for the local content that's about to be undone
+		a.opts.Cache.Forget(change.Path)
+	}
+	plan.Changes = slices.DeleteFunc(plan.Changes, func(change PlannedChange) bool {
+		return !paths[change.Path]
+	})
+	log.Warn().
+		Int("write", plan.Count(Change)).
+		Int("delete", plan.Count(Delete)).
+		Msg("Rolling back changes that were applied")
+	// the changes are undone by another applier so they don't end up in the report
+	rb := newApplier(a.vc, ApplyOptions{RequestTimeout: a.opts.RequestTimeout, Retries: a.opts.Retries, Concurrency: a.opts.Concurrency})
+	rb.limiter = a.limiter
+	return rb.execute(ctx, plan)
+}
@@ -0,0 +1,142 @@
+package gitops_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	backupDir := filepath.Join(tempDir, "backups")
+	_ = os.MkdirAll(policyDir, 0o755)
+
+	const (
+		original = `path "secret/*" { capabilities = ["read"] }`
+		changed  = `path "secret/*" { capabilities = ["read", "list"] }`
+	)
+	for _, name := range []string{"changed", "deleted"} {
+		if err := vc.Sys().PutPolicyWithContext(ctx, name, original); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = os.WriteFile(filepath.Join(policyDir, "changed"), []byte(changed), 0o644)
+	_ = os.WriteFile(filepath.Join(policyDir, "added"), []byte(original), 0o644)
+
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{Prune: true, BackupDirectory: backupDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, err := os.ReadDir(backupDir)
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("expected one backup, got %v (%v)", backups, err)
+	}
+	if !gitops.IsBackup(filepath.Join(backupDir, backups[0].Name())) || gitops.IsBackup(tempDir) {
+		t.Error("expected only the backup directory to be a backup")
+	}
+
+	if err := gitops.Restore(ctx, vc, filepath.Join(backupDir, backups[0].Name())); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"changed": original,
+		"deleted": original,
+		"added":   "",
+	} {
+		if policy, _ := vc.Sys().GetPolicyWithContext(ctx, name); policy != expected {
+			t.Errorf("policy %s is %q after restoring, expected %q", name, policy, expected)
+		}
+	}
+}
+
+func TestBackupNestedPolicy(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	backupDir := filepath.Join(tempDir, "backups")
+	_ = os.MkdirAll(policyDir, 0o755)
+
+	const (
+		name     = "team/payments/reader"
+		original = `path "secret/payments/*" { capabilities = ["read"] }`
+		changed  = `path "secret/payments/*" { capabilities = ["read", "list"] }`
+	)
+	if err := vc.Sys().PutPolicyWithContext(ctx, name, original); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(filepath.Join(policyDir, "team%2Fpayments%2Freader"), []byte(changed), 0o644)
+
+	err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{BackupDirectory: backupDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, err := os.ReadDir(backupDir)
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("expected one backup, got %v (%v)", backups, err)
+	}
+	if err := gitops.Restore(ctx, vc, filepath.Join(backupDir, backups[0].Name())); err != nil {
+		t.Fatal(err)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, name); policy != original {
+		t.Errorf("policy %s is %q after restoring, expected %q", name, policy, original)
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "team%2fpayments%2freader"); policy != "" {
+		t.Error("expected the restore not to write a policy named after the escaped file name")
+	}
+
+	// the mount doesn't exist, so the role write fails and the policy is rolled back
+	_ = os.MkdirAll(filepath.Join(authDir, "missing", "role"), 0o755)
+	_ = os.WriteFile(filepath.Join(authDir, "missing", "role", "ci"), []byte(`{"token_policies": ["default"]}`), 0o644)
+	changes := []gitops.ChangedFile{
+		{Path: "auth/missing/role/ci", Mutation: gitops.Add, Principal: true},
+		{Path: "sys/policies/acl/team%2Fpayments%2Freader", Mutation: gitops.Change, Policy: true},
+	}
+	opts := gitops.ApplyOptions{Incremental: true, Changes: changes, KeepGoing: true, Rollback: true}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err == nil {
+		t.Fatal("expected the write to a missing mount to fail")
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, name); policy != original {
+		t.Errorf("policy %s is %q after rolling back, expected %q", name, policy, original)
+	}
+}
+
+func TestDefaultBackupDirectory(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	t.Setenv("HOME", cacheDir)
+	cfg := vault.DefaultConfig()
+	cfg.Address = "https://vault.example.com"
+	vc, err := vault.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := gitops.DefaultBackupDirectory(vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// outside of any repository, and only readable by whoever applies since backups aren't redacted
+	if !strings.HasPrefix(dir, cacheDir) {
+		t.Errorf("expected the backup directory to be in the user cache directory %s, got %s", cacheDir, dir)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o700 {
+		t.Errorf("expected the backup directory to be 0700, got %o", mode)
+	}
+}
@@ -0,0 +1,69 @@
+package gitops_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+// Writes a repository with n objects, half policies and half approle roles that reference them.
+func writeSyntheticRepo(b *testing.B, n int) (authDir, policyDir string) {
+	b.Helper()
+	dir := b.TempDir()
+	authDir = filepath.Join(dir, "auth")
+	policyDir = filepath.Join(dir, "sys", "policies", "acl")
+	roleDir := filepath.Join(authDir, "approle", "role")
+	for _, d := range []string{policyDir, roleDir} {
+		if err := os.MkdirAll(d, 0o750); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 0; i < n/2; i++ {
+		policy := fmt.Sprintf(`path "secret/data/app-%d/*" { capabilities = ["read", "list"] }`, i)
+		if err := os.WriteFile(filepath.Join(policyDir, fmt.Sprintf("policy-%06d", i)), []byte(policy), 0o640); err != nil {
+			b.Fatal(err)
+		}
+		role := fmt.Sprintf(`{"token_policies": ["policy-%06d"]}`, i)
+		if err := os.WriteFile(filepath.Join(roleDir, fmt.Sprintf("role-%06d", i)), []byte(role), 0o640); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return authDir, policyDir
+}
+
+// Reconciles an already-applied repository, which is what most runs in CI look like.
+func BenchmarkApplyChanges(b *testing.B) {
+	for _, size := range []int{1_000, 10_000, 100_000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			if size > 10_000 && testing.Short() {
+				b.Skip("skipping large apply in short mode")
+			}
+			ctx := context.Background()
+			vc := testcluster.NewTestCluster(b)
+			if err := vc.Sys().EnableAuthWithOptions("approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+				b.Fatal(err)
+			}
+			authDir, policyDir := writeSyntheticRepo(b, size)
+			if err := gitops.ApplyChanges(ctx, vc, authDir, policyDir); err != nil {
+				b.Fatal(err)
+			}
+			for _, skipUnchanged := range []bool{false, true} {
+				b.Run(fmt.Sprintf("SkipUnchanged=%v", skipUnchanged), func(b *testing.B) {
+					opts := gitops.ApplyOptions{SkipUnchanged: skipUnchanged}
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		})
+	}
+}
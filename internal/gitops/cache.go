@@ -0,0 +1,167 @@
+package gitops
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// StateCache remembers a hash of each Vault object as hvresult last saw it, so unchanged objects don't have to be re-read on the next run.
+//
+// It's keyed by cluster address, namespace, and path, and stored in the user's cache directory.
+type StateCache struct {
+	path      string
+	namespace string
+
+	mu      sync.Mutex
+	dirty   bool
+	Cluster string `json:"cluster"`
+	// Fingerprint of the auth mounts the auth entries were recorded under.
+	Mounts string `json:"mounts"`
+	// namespace|path -> hash
+	Objects map[string]string `json:"objects"`
+}
+
+// OpenStateCache loads the cache for the cluster and namespace a Vault client points at, or starts an empty one.
+func OpenStateCache(vc *vault.Client) (*StateCache, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("error finding user cache directory: %w", err)
+	}
+	sum := sha256.Sum256([]byte(vc.Address()))
+	cache := &StateCache{
+		path:      filepath.Join(cacheDir, "hvresult", "state-"+hex.EncodeToString(sum[:8])+".json"),
+		namespace: vc.Namespace(),
+		Cluster:   vc.Address(),
+		Objects:   map[string]string{},
+	}
+	data, err := os.ReadFile(cache.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading state cache: %w", err)
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		log.Warn().Err(err).Str("path", cache.path).Msg("ignoring corrupt state cache")
+		cache.Objects = map[string]string{}
+	}
+	if cache.Objects == nil {
+		cache.Objects = map[string]string{}
+	}
+	return cache, nil
+}
+
+// Get returns the last known hash of an object. A nil StateCache never has anything.
+func (c *StateCache) Get(path string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hash, ok := c.Objects[c.key(path)]
+	return hash, ok
+}
+
+// Put records the hash of an object as it is in Vault.
+func (c *StateCache) Put(path, hash string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Objects[c.key(path)] = hash
+	c.dirty = true
+}
+
+// Forget drops an object, e.g. after it's been deleted.
+func (c *StateCache) Forget(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.Objects, c.key(path))
+	c.dirty = true
+}
+
+// CheckMounts drops every cached auth object if the auth mounts changed since they were recorded.
+func (c *StateCache) CheckMounts(mounts map[string]*vault.AuthMount) {
+	if c == nil {
+		return
+	}
+	fingerprints := make([]string, 0, len(mounts))
+	for path, mount := range mounts {
+		fingerprints = append(fingerprints, path+":"+mount.Type+":"+mount.Accessor)
+	}
+	sort.Strings(fingerprints)
+	sum := sha256.Sum256([]byte(strings.Join(fingerprints, ",")))
+	fingerprint := hex.EncodeToString(sum[:])
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Mounts == fingerprint {
+		return
+	}
+	if c.Mounts != "" {
+		log.Info().Msg("auth mounts changed, invalidating cached auth objects")
+	}
+	prefix := c.namespace + "|auth/"
+	for key := range c.Objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.Objects, key)
+		}
+	}
+	c.Mounts = fingerprint
+	c.dirty = true
+}
+
+// Save writes the cache back to disk if anything changed.
+func (c *StateCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return fmt.Errorf("error creating state cache directory: %w", err)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.path, data, 0o600); err != nil {
+		return fmt.Errorf("error writing state cache: %w", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+func (c *StateCache) key(path string) string {
+	return c.namespace + "|" + path
+}
+
+// hashes a policy or role the same way whether it came from a file or from Vault
+func contentHash(content any) string {
+	var data []byte
+	switch v := content.(type) {
+	case string:
+		data = []byte(v)
+	default:
+		// map keys are sorted by encoding/json
+		data, _ = json.Marshal(v)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
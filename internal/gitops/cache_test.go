@@ -0,0 +1,91 @@
+package gitops_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestStateCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	cfg := vault.DefaultConfig()
+	cfg.Address = "https://vault.example.com:8200"
+	vc, err := vault.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := gitops.OpenStateCache(vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts := map[string]*vault.AuthMount{"approle/": {Type: "approle", Accessor: "auth_approle_1"}}
+	cache.CheckMounts(mounts)
+	cache.Put("sys/policies/acl/test", "abc")
+	cache.Put("auth/approle/role/test", "def")
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// reopen from disk
+	cache, err = gitops.OpenStateCache(vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := cache.Get("auth/approle/role/test"); hash != "def" {
+		t.Fatalf("expected cached auth role hash, got '%s'", hash)
+	}
+	// same mounts keep auth entries
+	cache.CheckMounts(mounts)
+	if _, ok := cache.Get("auth/approle/role/test"); !ok {
+		t.Fatal("auth entry dropped without a mount change")
+	}
+	// a remounted approle invalidates auth but not policies
+	cache.CheckMounts(map[string]*vault.AuthMount{"approle/": {Type: "approle", Accessor: "auth_approle_2"}})
+	if _, ok := cache.Get("auth/approle/role/test"); ok {
+		t.Fatal("auth entry survived a mount change")
+	}
+	if hash, _ := cache.Get("sys/policies/acl/test"); hash != "abc" {
+		t.Fatalf("expected cached policy hash, got '%s'", hash)
+	}
+}
+
+func TestApplyCachedDrift(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	const policy = `path "secret/*" { capabilities = ["read"] }`
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "cached"), []byte(policy), 0o644)
+	cache, err := gitops.OpenStateCache(vc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := gitops.ApplyOptions{SkipUnchanged: true, Cache: cache}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// changed in Vault after it was cached, which the next apply still reverts
+	if err := vc.Sys().PutPolicyWithContext(ctx, "cached", `path "secret/*" { capabilities = ["list"] }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := vc.Sys().GetPolicyWithContext(ctx, "cached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gitops.PolicyUnchanged(policy, remote) {
+		t.Errorf("expected the policy changed in Vault to be reverted, got %q", remote)
+	}
+}
@@ -0,0 +1,139 @@
+package gitops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// CheckpointFileName is where a download records what it's written so far, so a failed download can be resumed
+// without reading everything from Vault again. It's removed once a download finishes.
+const CheckpointFileName = ".hvresult-checkpoint.json"
+
+// How many objects are downloaded between saves of the checkpoint.
+const checkpointEvery = 100
+
+// Checkpoint records every object a download has written, like a Manifest that's saved as it goes.
+//
+// A nil Checkpoint ignores everything.
+type Checkpoint struct {
+	mu    sync.Mutex
+	root  string
+	dirty int
+
+	Address   string `json:"address"`
+	Namespace string `json:"namespace,omitempty"`
+	// Vault path -> what was written for it
+	Objects map[string]ManifestResource `json:"objects"`
+}
+
+// OpenCheckpoint starts a checkpoint for a download of the cluster and namespace `vc` points at to `directory`. With
+// `resume`, it picks up from the checkpoint a failed download left there, if any, so the objects it has are skipped.
+func OpenCheckpoint(vc *vault.Client, directory string, resume bool) (*Checkpoint, error) {
+	c := &Checkpoint{
+		root:      directory,
+		Address:   vc.Address(),
+		Namespace: vc.Namespace(),
+		Objects:   map[string]ManifestResource{},
+	}
+	if !resume {
+		return c, nil
+	}
+	content, err := os.ReadFile(filepath.Join(directory, CheckpointFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		log.Info().Str("directory", directory).Msg("No checkpoint to resume from, downloading everything")
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint: %w", err)
+	}
+	var saved Checkpoint
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return nil, fmt.Errorf("error decoding checkpoint: %w", err)
+	}
+	if saved.Address != c.Address || saved.Namespace != c.Namespace {
+		return nil, fmt.Errorf("the checkpoint in %s is for %s, not %s", directory, clusterName(saved.Address, saved.Namespace), clusterName(c.Address, c.Namespace))
+	}
+	if saved.Objects != nil {
+		c.Objects = saved.Objects
+	}
+	log.Info().Int("count", len(c.Objects)).Msg("Resuming download from checkpoint")
+	return c, nil
+}
+
+// records a downloaded file, saving the checkpoint every so often
+func (c *Checkpoint) record(kind ResourceKind, vaultPath, file string, content []byte) error {
+	if c == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(c.root, file)
+	if err != nil {
+		return fmt.Errorf("error finding %s in the download directory: %w", file, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Objects[vaultPath] = ManifestResource{Path: vaultPath, Kind: kind, File: filepath.ToSlash(rel), SHA256: contentHash(string(content))}
+	if c.dirty++; c.dirty < checkpointEvery {
+		return nil
+	}
+	return c.save()
+}
+
+// Returns the file and content the object at `vaultPath` was downloaded to before resuming, if it's still there as it
+// was written.
+func (c *Checkpoint) downloaded(vaultPath string) (string, []byte, bool) {
+	if c == nil {
+		return "", nil, false
+	}
+	c.mu.Lock()
+	object, ok := c.Objects[vaultPath]
+	c.mu.Unlock()
+	if !ok || checkNoTraversal(object.File) != nil {
+		return "", nil, false
+	}
+	file := filepath.Join(c.root, filepath.FromSlash(object.File))
+	content, err := os.ReadFile(file)
+	if err != nil || contentHash(string(content)) != object.SHA256 {
+		return "", nil, false
+	}
+	return file, content, true
+}
+
+// Save writes the checkpoint, e.g. after a download failed.
+func (c *Checkpoint) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.save()
+}
+
+func (c *Checkpoint) save() error {
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("error encoding checkpoint: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(c.root, CheckpointFileName), encoded, 0o600); err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+	c.dirty = 0
+	return nil
+}
+
+// Remove removes the checkpoint once a download has finished.
+func (c *Checkpoint) Remove() error {
+	if c == nil {
+		return nil
+	}
+	err := os.Remove(filepath.Join(c.root, CheckpointFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"gopkg.in/yaml.v3"
+)
+
+// ClustersFileName is the file in the repository listing the clusters `apply --cluster` can target.
+const ClustersFileName = "clusters.yaml"
+
+// Where Kubernetes mounts a pod's service account token.
+const kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// ClustersConfig is a clusters.yaml, like:
+//
+//	clusters:
+//	  prod-us:
+//	    address: https://vault.us.example.com:8200
+//	    namespace: admin
+//	    auth:
+//	      method: approle
+//	      role_id: 0f6bf8a4-...
+//	      secret_id_env: PROD_US_SECRET_ID
+type ClustersConfig struct {
+	Clusters map[string]ClusterConfig `yaml:"clusters"`
+}
+
+// ClusterConfig is a Vault cluster and how to log in to it.
+type ClusterConfig struct {
+	Address string `yaml:"address"`
+	// Vault Enterprise namespace to work in, if any
+	Namespace string      `yaml:"namespace"`
+	Auth      ClusterAuth `yaml:"auth"`
+}
+
+// ClusterAuth is how to get a token for a cluster. Secrets come from environment variables or files, so they're never
+// in the repository.
+type ClusterAuth struct {
+	// token, which is the default, approle, kubernetes, or jwt
+	Method string `yaml:"method"`
+	// where the auth method is mounted, if it isn't the method's name
+	Mount string `yaml:"mount"`
+	// for token, the variable with the token instead of $VAULT_TOKEN
+	TokenEnv string `yaml:"token_env"`
+	// for approle
+	RoleID      string `yaml:"role_id"`
+	SecretIDEnv string `yaml:"secret_id_env"`
+	// for kubernetes and jwt. kubernetes defaults to the pod's service account token.
+	Role    string `yaml:"role"`
+	JWTFile string `yaml:"jwt_file"`
+	JWTEnv  string `yaml:"jwt_env"`
+}
+
+// LoadClustersConfig reads a clusters.yaml.
+func LoadClustersConfig(filename string) (*ClustersConfig, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading clusters file: %w", err)
+	}
+	var config ClustersConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	// a typo shouldn't quietly log in some other way
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error decoding clusters file %s: %w", filename, err)
+	}
+	for name, cluster := range config.Clusters {
+		if err := cluster.check(); err != nil {
+			return nil, fmt.Errorf("bad cluster %s in %s: %w", name, filename, err)
+		}
+	}
+	return &config, nil
+}
+
+// Cluster returns the cluster called `name`.
+func (c *ClustersConfig) Cluster(name string) (ClusterConfig, error) {
+	cluster, ok := c.Clusters[name]
+	if !ok {
+		return ClusterConfig{}, fmt.Errorf("there's no cluster called %s", name)
+	}
+	return cluster, nil
+}
+
+// makes sure the cluster has everything its auth method needs
+func (c ClusterConfig) check() error {
+	if c.Address == "" {
+		return errors.New("address is required")
+	}
+	switch c.Auth.Method {
+	case "", "token":
+	case "approle":
+		if c.Auth.RoleID == "" || c.Auth.SecretIDEnv == "" {
+			return errors.New("approle needs role_id and secret_id_env")
+		}
+	case "kubernetes", "jwt":
+		if c.Auth.Role == "" {
+			return fmt.Errorf("%s needs role", c.Auth.Method)
+		}
+		if c.Auth.Method == "jwt" && c.Auth.JWTFile == "" && c.Auth.JWTEnv == "" {
+			return errors.New("jwt needs jwt_file or jwt_env")
+		}
+	default:
+		return fmt.Errorf("unsupported auth method %q, it has to be token, approle, kubernetes, or jwt", c.Auth.Method)
+	}
+	return nil
+}
+
+// Login points `vc` at the cluster and gives it a token for it.
+func (c ClusterConfig) Login(ctx context.Context, vc *vault.Client) error {
+	if err := vc.SetAddress(c.Address); err != nil {
+		return fmt.Errorf("error setting Vault address: %w", err)
+	}
+	if c.Namespace != "" {
+		vc.SetNamespace(c.Namespace)
+	}
+	var data map[string]interface{}
+	switch c.Auth.Method {
+	case "", "token":
+		env := c.Auth.TokenEnv
+		if env == "" {
+			env = "VAULT_TOKEN"
+		}
+		token := os.Getenv(env)
+		if token == "" {
+			return fmt.Errorf("$%s isn't set", env)
+		}
+		vc.SetToken(token)
+		return nil
+	case "approle":
+		secretID := os.Getenv(c.Auth.SecretIDEnv)
+		if secretID == "" {
+			return fmt.Errorf("$%s isn't set", c.Auth.SecretIDEnv)
+		}
+		data = map[string]interface{}{"role_id": c.Auth.RoleID, "secret_id": secretID}
+	case "kubernetes", "jwt":
+		jwt, err := c.Auth.jwt()
+		if err != nil {
+			return err
+		}
+		data = map[string]interface{}{"role": c.Auth.Role, "jwt": jwt}
+	}
+	mount := c.Auth.Mount
+	if mount == "" {
+		mount = c.Auth.Method
+	}
+	loginPath := "auth/" + strings.Trim(mount, "/") + "/login"
+	// logging in doesn't need a token, and whatever's in $VAULT_TOKEN is probably for some other cluster
+	vc.ClearToken()
+	var secret *vault.Secret
+	err := newLimiter(1, 0, 0).Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = vc.Logical().WriteWithContext(ctx, loginPath, data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error logging in with %s: %w", loginPath, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return fmt.Errorf("logging in with %s didn't return a token", loginPath)
+	}
+	vc.SetToken(secret.Auth.ClientToken)
+	return nil
+}
+
+func (a ClusterAuth) jwt() (string, error) {
+	if a.JWTEnv != "" {
+		jwt := os.Getenv(a.JWTEnv)
+		if jwt == "" {
+			return "", fmt.Errorf("$%s isn't set", a.JWTEnv)
+		}
+		return jwt, nil
+	}
+	file := a.JWTFile
+	if file == "" {
+		file = kubernetesTokenFile
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("error reading JWT: %w", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
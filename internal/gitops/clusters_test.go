@@ -0,0 +1,90 @@
+package gitops_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestClusters(t *testing.T) {
+	var (
+		ctx = context.Background()
+		vc  = testcluster.NewTestCluster(t)
+	)
+	if err := vc.Sys().EnableAuthWithOptionsWithContext(ctx, "ci-approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vc.Logical().WriteWithContext(ctx, "auth/ci-approle/role/hvresult", map[string]interface{}{"token_policies": []string{"default"}}); err != nil {
+		t.Fatal(err)
+	}
+	roleID, err := vc.Logical().ReadWithContext(ctx, "auth/ci-approle/role/hvresult/role-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretID, err := vc.Logical().WriteWithContext(ctx, "auth/ci-approle/role/hvresult/secret-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SECRET_ID", secretID.Data["secret_id"].(string))
+	t.Setenv("TEST_TOKEN", vc.Token())
+
+	dir := t.TempDir()
+	write := func(content string) string {
+		filename := filepath.Join(dir, gitops.ClustersFileName)
+		if err := os.WriteFile(filename, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	config, err := gitops.LoadClustersConfig(write(`clusters:
+  dev:
+    address: ` + vc.Address() + `
+    auth:
+      token_env: TEST_TOKEN
+  prod:
+    address: ` + vc.Address() + `
+    auth:
+      method: approle
+      mount: ci-approle
+      role_id: ` + roleID.Data["role_id"].(string) + `
+      secret_id_env: TEST_SECRET_ID
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dev", "prod"} {
+		cluster, err := config.Cluster(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := vault.NewClient(vault.DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cluster.Login(ctx, client); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := client.Auth().Token().LookupSelfWithContext(ctx); err != nil {
+			t.Errorf("%s: expected a working token: %v", name, err)
+		}
+	}
+	if _, err := config.Cluster("staging"); err == nil {
+		t.Error("expected an error for a cluster that isn't in the file")
+	}
+
+	for _, bad := range []string{
+		"clusters:\n  prod:\n    auth:\n      method: token\n",
+		"clusters:\n  prod:\n    address: https://vault:8200\n    auth:\n      method: approle\n      role_id: abc\n",
+		"clusters:\n  prod:\n    address: https://vault:8200\n    auth:\n      method: ldap\n",
+		"clusters:\n  prod:\n    address: https://vault:8200\n    auth:\n      methd: approle\n",
+	} {
+		if _, err := gitops.LoadClustersConfig(write(bad)); err == nil {
+			t.Errorf("expected an error loading %q", bad)
+		}
+	}
+}
@@ -50,7 +50,7 @@ func MustEmitMarkdownDiffs(ctx context.Context, gitDirectory, compareRef string)
 			diffs[change.Path] = diff
 		} else if change.Policy {
 			logger.Info().Msg("processing policy change")
-			affected, err := GetPolicyChangeDifferentials(changes, gitDirectory, filepath.Base(change.Path), relativePolicyDirectory, "auth", compareRef)
+			affected, err := GetPolicyChangeDifferentials(changes, gitDirectory, policyNameFromFile(filepath.Base(change.Path)), relativePolicyDirectory, "auth", compareRef)
 			if err != nil {
 				logger.Fatal().Err(err).Msg("error getting differentials for policy change")
 			}
@@ -3,15 +3,19 @@ package gitops
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/mitchellh/mapstructure"
 	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -23,27 +27,211 @@ type authPrincipalData struct {
 	Policies        []string `mapstructure:"policies,omitempty" json:"policies,omitempty"`
 	TokenPolicies   []string `mapstructure:"token_policies,omitempty" json:"token_policies,omitempty"`
 	AllowedPolicies []string `mapstructure:"allowed_policies,omitempty" json:"allowed_policies,omitempty"`
+	// Whether tokens the role issues go without the default policy.
+	TokenNoDefaultPolicy bool `mapstructure:"token_no_default_policy,omitempty" json:"token_no_default_policy,omitempty"`
+	// The comma-separated policies of a GitHub team or user mapping.
+	Value string `mapstructure:"value,omitempty" json:"value,omitempty"`
+	// Token roles also allow policies matching these globs, and never allow disallowed ones.
+	AllowedPoliciesGlob    []string `mapstructure:"allowed_policies_glob,omitempty" json:"allowed_policies_glob,omitempty"`
+	DisallowedPolicies     []string `mapstructure:"disallowed_policies,omitempty" json:"disallowed_policies,omitempty"`
+	DisallowedPoliciesGlob []string `mapstructure:"disallowed_policies_glob,omitempty" json:"disallowed_policies_glob,omitempty"`
 }
 
-// Merges and sorts TokenPolicies, AllowedPolicies, and Policies.
+// Merges and sorts TokenPolicies, AllowedPolicies, Policies, and Value, leaving out disallowed policies.
 func (a authPrincipalData) AllPolicies() []string {
 	all := append(
 		append(
-			a.TokenPolicies,
+			slices.Clone(a.TokenPolicies),
 			a.AllowedPolicies...,
 		),
 		a.Policies...,
 	)
+	for _, policy := range strings.Split(a.Value, ",") {
+		if policy = strings.TrimSpace(policy); policy != "" {
+			all = append(all, policy)
+		}
+	}
+	all = slices.DeleteFunc(all, a.disallows)
 	sort.StringSlice(all).Sort()
 	return all
 }
 
+// EffectivePolicies is AllPolicies plus the default policy, unless TokenNoDefaultPolicy says otherwise.
+func (a authPrincipalData) EffectivePolicies() []string {
+	all := internal.WithDefaultPolicy(a.AllPolicies(), a.TokenNoDefaultPolicy)
+	all = slices.DeleteFunc(all, a.disallows)
+	sort.Strings(all)
+	return all
+}
+
+// The policies in `available` that a token role allows through AllowedPoliciesGlob but doesn't name.
+func (a authPrincipalData) GlobbedPolicies(available []string) []string {
+	var globbed []string
+	for _, policy := range available {
+		if matchAny(a.AllowedPoliciesGlob, policy) && !a.disallows(policy) && !slices.Contains(a.AllowedPolicies, policy) {
+			globbed = append(globbed, policy)
+		}
+	}
+	sort.Strings(globbed)
+	return globbed
+}
+
+func (a authPrincipalData) disallows(policy string) bool {
+	return slices.Contains(a.DisallowedPolicies, policy) || matchAny(a.DisallowedPoliciesGlob, policy)
+}
+
+// DownloadOptions change how DownloadAuthWithOptions and DownloadPoliciesWithOptions behave.
+type DownloadOptions struct {
+	// If set, the hash of every downloaded object is recorded so later applies know it's in sync.
+	Cache *StateCache
+	// Skip mounts and objects the token isn't allowed to list or read instead of failing, recording them in Report.
+	SkipForbidden bool
+	// If set, collects what was skipped.
+	Report *Report
+	// Permissions of downloaded files, which directories get execute bits added to. Zero means DefaultFileMode.
+	FileMode os.FileMode
+	// How many objects are downloaded at once. Zero means DefaultConcurrency.
+	Concurrency int
+	// Like ApplyOptions.RequestTimeout and ApplyOptions.Retries.
+	RequestTimeout time.Duration
+	Retries        int
+	// Write secret auth mount config and role fields as Vault returns them instead of as RedactedValue.
+	KeepSecrets bool
+	// JSONFormat or YAMLFormat for auth role and identity files. YAML files get a .yaml extension. Empty means JSON.
+	Format string
+	// If set, records every downloaded file and its hash.
+	Manifest *Manifest
+	// If set, counts the objects downloaded.
+	Progress *Progress
+	// If set, records every downloaded file as it goes, and objects it already has from a download that failed aren't
+	// read from Vault again.
+	Checkpoint *Checkpoint
+	// Only download auth mounts and secrets engines with these names, like approle or database, leaving the files of
+	// other mounts alone. Empty means every mount.
+	Mounts []string
+}
+
+// Whether the mount named `mountName`, with or without its trailing slash, is one DownloadOptions.Mounts includes.
+func (o DownloadOptions) includesMount(mountName string) bool {
+	if len(o.Mounts) == 0 {
+		return true
+	}
+	mountName = strings.TrimSuffix(mountName, "/")
+	for _, name := range o.Mounts {
+		if strings.Trim(name, "/") == mountName {
+			return true
+		}
+	}
+	return false
+}
+
+// The applier download functions make Vault requests through, so they're limited, timed out, and retried like an
+// apply's.
+func (o DownloadOptions) applier(vc *vault.Client) *applier {
+	return newApplier(vc, ApplyOptions{Concurrency: o.Concurrency, RequestTimeout: o.RequestTimeout, Retries: o.Retries})
+}
+
+// The permissions of downloaded files unless DownloadOptions.FileMode says otherwise, since auth roles can contain
+// bound secrets.
+const DefaultFileMode os.FileMode = 0o600
+
+func (o DownloadOptions) fileMode() os.FileMode {
+	if o.FileMode == 0 {
+		return DefaultFileMode
+	}
+	return o.FileMode.Perm()
+}
+
+// 0600 -> 0700, 0640 -> 0750 and so on.
+func (o DownloadOptions) dirMode() os.FileMode {
+	mode := o.fileMode()
+	return mode | (mode&0o444)>>2
+}
+
+// Creates a directory for downloaded files, fixing the permissions of one left behind by an earlier download since
+// MkdirAll doesn't touch existing directories and the umask gets a say in new ones.
+func (o DownloadOptions) mkdir(dir string) error {
+	if err := os.MkdirAll(dir, o.dirMode()); err != nil {
+		return err
+	}
+	return os.Chmod(dir, o.dirMode())
+}
+
+// Writes the downloaded file for the object at `vaultPath` unless it already has exactly `content`, so files that
+// didn't change in Vault aren't rewritten, and records it in Report as added or changed.
+func (o DownloadOptions) writeFile(file string, kind ResourceKind, vaultPath string, content []byte) error {
+	mutation := Add
+	existing, err := os.ReadFile(file)
+	switch {
+	case err == nil && contentHash(string(existing)) == contentHash(string(content)):
+		o.Report.Unchange(PlannedChange{Kind: kind, Path: vaultPath})
+		// an existing file keeps its old permissions otherwise
+		if err := os.Chmod(file, o.fileMode()); err != nil {
+			return fmt.Errorf("error setting %s file permissions: %w", vaultPath, err)
+		}
+		if err := o.Checkpoint.record(kind, vaultPath, file, content); err != nil {
+			return err
+		}
+		return o.Manifest.add(kind, vaultPath, file, content)
+	case err == nil:
+		mutation = Change
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("error reading %s: %w", file, err)
+	}
+	if err := os.WriteFile(file, content, o.fileMode()); err != nil {
+		return fmt.Errorf("error writing %s to file: %w", vaultPath, err)
+	}
+	if err := os.Chmod(file, o.fileMode()); err != nil {
+		return fmt.Errorf("error setting %s file permissions: %w", vaultPath, err)
+	}
+	o.Report.Apply(PlannedChange{Mutation: mutation, Kind: kind, Path: vaultPath})
+	if err := o.Checkpoint.record(kind, vaultPath, file, content); err != nil {
+		return err
+	}
+	return o.Manifest.add(kind, vaultPath, file, content)
+}
+
+// Whether the object at `vaultPath` was already downloaded by the download being resumed and its file hasn't changed
+// since, in which case it counts as unchanged without being read from Vault again.
+func (o DownloadOptions) resumed(kind ResourceKind, vaultPath string) (bool, error) {
+	file, content, ok := o.Checkpoint.downloaded(vaultPath)
+	if !ok {
+		return false, nil
+	}
+	log.Debug().Str("path", vaultPath).Msg("already downloaded before resuming")
+	o.Report.Unchange(PlannedChange{Kind: kind, Path: vaultPath})
+	return true, o.Manifest.add(kind, vaultPath, file, content)
+}
+
+// Removes the file of an object at `vaultPath` that no longer exists in Vault, recording it in Report.
+func (o DownloadOptions) removeFile(file string, kind ResourceKind, vaultPath string) error {
+	log.Info().Str("path", file).Msg("removing extraneous file path")
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("error removing extraneous file path '%s': %w", file, err)
+	}
+	o.Report.Apply(PlannedChange{Mutation: Delete, Kind: kind, Path: vaultPath})
+	return nil
+}
+
 func DownloadAuth(ctx context.Context, vc *vault.Client, authDirectory string) error {
-	mounts, err := vc.Sys().ListAuthWithContext(ctx)
+	return DownloadAuthWithOptions(ctx, vc, authDirectory, DownloadOptions{})
+}
+
+func DownloadAuthWithOptions(ctx context.Context, vc *vault.Client, authDirectory string, opts DownloadOptions) error {
+	a := opts.applier(vc)
+	mounts, err := a.authMounts(ctx)
 	if err != nil {
-		return fmt.Errorf("error listing auth mounts: %w", err)
+		return err
+	}
+	opts.Cache.CheckMounts(mounts)
+	for name := range mounts {
+		if !opts.includesMount(name) {
+			delete(mounts, name)
+		}
+	}
+	if err := downloadAuthMounts(authDirectory, mounts, opts); err != nil {
+		return err
 	}
-	vaultLogical := vc.Logical()
 	for name, mount := range mounts {
 		log.Debug().Str("name", name).Any("mount", mount).Send()
 		abspath := strings.TrimRight(fmt.Sprintf("auth/%s", name), "/")
@@ -55,7 +243,7 @@ func DownloadAuth(ctx context.Context, vc *vault.Client, authDirectory string) e
 			rolePaths = map[string]string{
 				abspath + "/roles": abspath + "/role/",
 			}
-		case "azure", "kubernetes", "oidc", "oci", "saml":
+		case "azure", "kubernetes", "oidc", "oci", "saml", "approle":
 			rolePaths = map[string]string{
 				abspath + "/role": abspath + "/role/",
 			}
@@ -80,107 +268,242 @@ func DownloadAuth(ctx context.Context, vc *vault.Client, authDirectory string) e
 			rolePaths = map[string]string{
 				abspath + "/roles": abspath + "/roles/",
 			}
+		case "github":
+			rolePaths = map[string]string{
+				abspath + "/map/teams": abspath + "/map/teams/",
+				abspath + "/map/users": abspath + "/map/users/",
+			}
+		case "cert":
+			rolePaths = map[string]string{
+				abspath + "/certs": abspath + "/certs/",
+			}
 		case "tls":
 			rolePaths = map[string]string{
 				abspath + "/roles": abspath + "/roles/",
 			}
-		// TODO: support cert mount
 		default:
 			return fmt.Errorf("unknown paths for listing Vault identities for this mount type: '%s'", mount.Type)
 		}
 		var mountPrincipalCount int
 		for listPath, readPathPrefix := range rolePaths {
-			var targetDir string
-			if filepath.Separator == '/' {
-				targetDir = filepath.Join(authDirectory, name, filepath.Base(readPathPrefix))
-			} else {
-				lp := strings.ReplaceAll(readPathPrefix, "/", string(filepath.Separator))
-				targetDir = filepath.Join(authDirectory, name, filepath.Base(lp))
-			}
-			if err := os.MkdirAll(targetDir, 0o750); err != nil {
+			// e.g. role, or map/teams for GitHub
+			prefix := strings.Trim(strings.TrimPrefix(readPathPrefix, abspath), "/")
+			targetDir := filepath.Join(authDirectory, name, filepath.FromSlash(prefix))
+			if err := opts.mkdir(targetDir); err != nil {
 				return fmt.Errorf("error creating auth mount directory: %w", err)
 			}
-			// LIST
-			secret, err := vaultLogical.ListWithContext(ctx, listPath)
+			// a page at a time, downloading each one before listing the next
+			var listed bool
+			err := a.listPages(ctx, listPath, func(secret *vault.Secret, keys []string) error {
+				listed = true
+				opts.Progress.Add(len(keys))
+				keyInfo := listKeyInfo(secret)
+				// GET
+				var eg errgroup.Group
+				eg.SetLimit(concurrency(opts.Concurrency))
+				for i := range keys {
+					key := keys[i]
+					eg.Go(func() error {
+						defer opts.Progress.Done(readPathPrefix + key)
+						if err := checkSafeName(key); err != nil {
+							return err
+						}
+						getPath := readPathPrefix + key
+						if done, err := opts.resumed(AuthRoleResource, getPath); done || err != nil {
+							return err
+						}
+						data, detailed := keyInfo[key]
+						if detailed {
+							log.Debug().Str("getPath", getPath).Msg("using auth principal from LIST key_info")
+						} else {
+							log.Debug().Str("getPath", getPath).Msg("reading remote auth principal")
+							var secret *vault.Secret
+							err := a.limiter.Do(ctx, func(ctx context.Context) error {
+								var err error
+								secret, err = a.vc.Logical().ReadWithContext(ctx, getPath)
+								return err
+							})
+							if err != nil {
+								if opts.SkipForbidden && isPermissionDenied(err) {
+									opts.Report.Skip(getPath, "read", err)
+									return nil
+								}
+								return fmt.Errorf("error reading auth prinicpal: %w", err)
+							}
+							data = secret.Data
+						}
+						var getData interface{}
+						switch mount.Type {
+						case "cert":
+							// the CA certificate and constraints are the point of a cert role, not just its policies
+							getData = nonDefaultFields(data)
+						case "token":
+							// so are which policies and orphan settings tokens created with a token role can have
+							getData = tokenRoleData(data)
+						default:
+							var principal authPrincipalData
+							if err := mapstructure.Decode(data, &principal); err != nil {
+								return fmt.Errorf("error decoding auth mount GET response: %w", err)
+							}
+							getData = principal
+						}
+						content, err := marshalFile(getData)
+						if err != nil {
+							return fmt.Errorf("error encoding auth prinicpal GET data: %w", err)
+						}
+						fileName := dataFileName(key, opts.Format)
+						if err := removeOtherFormats(targetDir, key, fileName); err != nil {
+							return err
+						}
+						if opts.Cache != nil {
+							// hash it the way apply will see it after reading the file back
+							var asRead map[string]interface{}
+							if err := json.Unmarshal(content, &asRead); err == nil {
+								opts.Cache.Put(getPath, contentHash(asRead))
+							}
+						}
+						if opts.Format == YAMLFormat {
+							if content, err = jsonToYAML(content); err != nil {
+								return fmt.Errorf("error encoding auth prinicpal GET data as YAML: %w", err)
+							}
+						}
+						if err := opts.writeFile(filepath.Join(targetDir, fileName), AuthRoleResource, getPath, content); err != nil {
+							return err
+						}
+						return nil
+					})
+				}
+				if err := eg.Wait(); err != nil {
+					return err
+				}
+				mountPrincipalCount += len(keys)
+				return nil
+			})
 			if err != nil {
-				return fmt.Errorf("error listing auth mount identities: %w", err)
-			}
-			if secret == nil {
-				log.Warn().Any("secret", secret).Str("listPath", listPath).Msg("LIST path returned empty response, skipping")
-				continue
-			}
-			var listData authListData
-			if err := mapstructure.Decode(secret.Data, &listData); err != nil {
-				return fmt.Errorf("error decoding auth mount LIST response: %w", err)
-			}
-			// GET
-			var eg errgroup.Group
-			eg.SetLimit(5)
-			for i := range listData.Keys {
-				key := listData.Keys[i]
-				eg.Go(func() error {
-					getPath := readPathPrefix + key
-					log.Debug().Str("getPath", getPath).Msg("reading remote auth principal")
-					secret, err := vaultLogical.ReadWithContext(ctx, getPath)
-					if err != nil {
-						return fmt.Errorf("error reading auth prinicpal: %w", err)
-					}
-					var getData authPrincipalData
-					if err := mapstructure.Decode(secret.Data, &getData); err != nil {
-						return fmt.Errorf("error decoding auth mount GET response: %w", err)
-					}
-					path := filepath.Join(targetDir, key)
-					f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
-					if err != nil {
-						return fmt.Errorf("error opening auth prinicpal file for writing: %w", err)
-					}
-					defer f.Close()
-					enc := json.NewEncoder(f)
-					enc.SetIndent("", "  ") // 2 spaces
-					if err := enc.Encode(getData); err != nil {
-						return fmt.Errorf("error encoding auth prinicpal GET data: %w", err)
-					}
-					return nil
-				})
+				if opts.SkipForbidden && isPermissionDenied(err) {
+					opts.Report.Skip(listPath, "list", err)
+					continue
+				}
+				return fmt.Errorf("error downloading auth mount identities from %s: %w", listPath, err)
 			}
-			if err := eg.Wait(); err != nil {
-				return err
+			if !listed {
+				log.Warn().Str("listPath", listPath).Msg("LIST path returned empty response, skipping")
 			}
-			mountPrincipalCount += len(listData.Keys)
+		}
+		if err := a.downloadAuthConfig(ctx, authDirectory, strings.TrimSuffix(name, "/"), mount, opts); err != nil {
+			return err
 		}
 		log.Info().Str("mount", "auth/"+name).Int("count", mountPrincipalCount).Msg("downloaded all auth principals")
 	}
 	return nil
 }
 
+// Returns the per-key details some LIST endpoints include, but only for keys whose details have policies.
+//
+// Anything missing has to be read individually, which is also what happens on Vault versions that don't send key_info.
+func listKeyInfo(secret *vault.Secret) map[string]map[string]interface{} {
+	keyInfo, _ := secret.Data["key_info"].(map[string]interface{})
+	detailed := make(map[string]map[string]interface{}, len(keyInfo))
+	for key, info := range keyInfo {
+		info, ok := info.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, field := range []string{"policies", "token_policies", "allowed_policies"} {
+			if _, ok := info[field]; ok {
+				detailed[key] = info
+				break
+			}
+		}
+	}
+	return detailed
+}
+
+// Every field of a token role other than its name and the deprecated fields Vault returns next to their token_
+// replacements. Even false and empty fields are kept, since Vault leaves fields that aren't written alone.
+func tokenRoleData(data map[string]interface{}) map[string]interface{} {
+	kept := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		switch key {
+		case "name", "bound_cidrs", "explicit_max_ttl", "period":
+			continue
+		}
+		kept[key] = value
+	}
+	return kept
+}
+
+// Everything a cert role or auth mount config has that isn't a default, so files only have what was set. Strings
+// like certificate PEMs are kept exactly as Vault has them.
+func nonDefaultFields(data map[string]interface{}) map[string]interface{} {
+	set := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		if !isServerDefault(key, normalizeField(key, value)) {
+			set[key] = value
+		}
+	}
+	return set
+}
+
 func DownloadPolicies(ctx context.Context, vc *vault.Client, policyDirectory string) error {
-	vaultSys := vc.Sys()
-	policyNames, err := vaultSys.ListPoliciesWithContext(ctx)
+	return DownloadPoliciesWithOptions(ctx, vc, policyDirectory, DownloadOptions{})
+}
+
+func DownloadPoliciesWithOptions(ctx context.Context, vc *vault.Client, policyDirectory string, opts DownloadOptions) error {
+	a := opts.applier(vc)
+	var policyNames []string
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		policyNames, err = a.vc.Sys().ListPoliciesWithContext(ctx)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("error listing Vault policies: %w", err)
 	}
-	if err := os.MkdirAll(policyDirectory, 0o755); err != nil {
+	if err := opts.mkdir(policyDirectory); err != nil {
 		return fmt.Errorf("error creating directory: %w", err)
 	}
+	// policies already kept in a subdirectory are downloaded where they are, instead of next to them at the top
+	existing, err := localPolicyFiles(policyDirectory)
+	if err != nil {
+		return err
+	}
+	opts.Progress.Add(len(policyNames))
 	var eg errgroup.Group
-	eg.SetLimit(5)
+	eg.SetLimit(concurrency(opts.Concurrency))
 	for i := range policyNames {
 		policyName := policyNames[i]
 		eg.Go(func() error {
+			defer opts.Progress.Done("sys/policies/acl/" + policyName)
+			if err := checkSafeName(policyFileName(policyName)); err != nil {
+				return err
+			}
+			if done, err := opts.resumed(PolicyResource, "sys/policies/acl/"+policyName); done || err != nil {
+				return err
+			}
 			log.Debug().Str("policy", policyName).Msg("downloading policy")
-			hclData, err := vaultSys.GetPolicyWithContext(ctx, policyName)
+			var hclData string
+			err := a.limiter.Do(ctx, func(ctx context.Context) error {
+				var err error
+				hclData, err = a.vc.Sys().GetPolicyWithContext(ctx, policyName)
+				return err
+			})
 			if err != nil {
+				if opts.SkipForbidden && isPermissionDenied(err) {
+					opts.Report.Skip("sys/policies/acl/"+policyName, "read", err)
+					return nil
+				}
 				return fmt.Errorf("error reading policy: %w", err)
 			}
 			// TODO: find out if this is a decent Windows SACL
-			err = os.WriteFile(
-				filepath.Join(policyDirectory, policyName),
-				[]byte(hclData),
-				0o640,
-			)
-			if err != nil {
-				return fmt.Errorf("error writing Vault policy to file: %w", err)
+			policyPath, ok := existing[strings.ToLower(policyName)]
+			if !ok {
+				policyPath = filepath.Join(policyDirectory, policyFileName(policyName))
+			}
+			if err := opts.writeFile(policyPath, PolicyResource, "sys/policies/acl/"+policyName, []byte(hclData)); err != nil {
+				return err
 			}
+			opts.Cache.Put("sys/policies/acl/"+policyName, contentHash(hclData))
 			return nil
 		})
 	}
@@ -188,24 +511,114 @@ func DownloadPolicies(ctx context.Context, vc *vault.Client, policyDirectory str
 		return err
 	}
 	log.Info().Int("count", len(policyNames)).Msg("downloaded all policies")
-	// delete anything extraenous
+	// password policies go next to them
+	if err := a.downloadObjects(ctx, PasswordPolicyResource, "sys/policies/password", filepath.Join(filepath.Dir(policyDirectory), "password"), opts); err != nil {
+		return err
+	}
+	// delete anything extraenous, wherever it is
 	justDownloadedPolicyNames := make(map[string]bool, len(policyNames))
 	for _, name := range policyNames {
-		justDownloadedPolicyNames[name] = true
+		justDownloadedPolicyNames[strings.ToLower(name)] = true
 	}
-	entries, err := os.ReadDir(policyDirectory)
-	if err != nil {
-		return fmt.Errorf("error reading policy directory: %w", err)
+	for name, toRemove := range existing {
+		if !justDownloadedPolicyNames[name] {
+			if err := opts.removeFile(toRemove, PolicyResource, "sys/policies/acl/"+name); err != nil {
+				return err
+			}
+		}
 	}
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	return nil
+}
+
+// Downloads every object listed under `listPath` to a file named after it in `dir`, in the format readRemote returns,
+// and removes files for objects that no longer exist.
+func (a *applier) downloadObjects(ctx context.Context, kind ResourceKind, listPath, dir string, opts DownloadOptions) error {
+	names, err := a.listObjects(ctx, kind, listPath)
+	if err != nil {
+		if opts.SkipForbidden && isPermissionDenied(err) {
+			opts.Report.Skip(listPath, "list", err)
+			return nil
 		}
-		if !justDownloadedPolicyNames[entry.Name()] {
-			toRemove := filepath.Join(policyDirectory, entry.Name())
-			log.Info().Str("path", toRemove).Msg("removing extraneous file path")
-			if err := os.Remove(toRemove); err != nil {
-				return fmt.Errorf("error removing extraneous file path '%s': %w", toRemove, err)
+		return fmt.Errorf("error listing %s from Vault: %w", listPath, err)
+	}
+	if err := opts.mkdir(dir); err != nil {
+		return err
+	}
+	opts.Progress.Add(len(names))
+	var eg errgroup.Group
+	eg.SetLimit(concurrency(opts.Concurrency))
+	for _, name := range names {
+		name := name
+		eg.Go(func() error {
+			defer opts.Progress.Done(listPath + "/" + name)
+			if err := checkSafeName(name); err != nil {
+				return err
+			}
+			change := PlannedChange{Kind: kind, Path: listPath + "/" + name}
+			if done, err := opts.resumed(kind, change.Path); done || err != nil {
+				return err
+			}
+			content, err := a.readRemote(ctx, change)
+			if err != nil {
+				if opts.SkipForbidden && isPermissionDenied(err) {
+					opts.Report.Skip(change.Path, "read", err)
+					return nil
+				}
+				return err
+			}
+			if content == nil {
+				return nil
+			}
+			// password policies are HCL
+			if json.Valid(content) {
+				data, err := decodeJSON(content)
+				if err != nil {
+					return err
+				}
+				if fields, ok := data.(map[string]interface{}); ok && kind == SecretRoleResource && !opts.KeepSecrets {
+					redactSecrets(fields)
+				}
+				if content, err = marshalFile(data); err != nil {
+					return fmt.Errorf("error encoding %s: %w", change.Path, err)
+				}
+			}
+			fileName := name
+			if isIdentityKind(kind) {
+				fileName = dataFileName(name, opts.Format)
+				if opts.Format == YAMLFormat {
+					if content, err = jsonToYAML(content); err != nil {
+						return fmt.Errorf("error encoding %s as YAML: %w", change.Path, err)
+					}
+				}
+				if err := removeOtherFormats(dir, name, fileName); err != nil {
+					return err
+				}
+			}
+			return opts.writeFile(filepath.Join(dir, fileName), kind, change.Path, content)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	log.Info().Int("count", len(names)).Str("path", listPath).Msgf("downloaded every %s", kind)
+
+	// delete anything extraenous
+	justDownloaded := make(map[string]bool, len(names))
+	for _, name := range names {
+		justDownloaded[name] = true
+	}
+	listLocal := localFiles
+	if isIdentityKind(kind) {
+		listLocal = localDataFiles
+	}
+	local, err := listLocal(dir)
+	if err != nil {
+		return err
+	}
+	for name, file := range local {
+		if !justDownloaded[name] {
+			if err := opts.removeFile(file, kind, listPath+"/"+name); err != nil {
+				return err
 			}
 		}
 	}
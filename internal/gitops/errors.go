@@ -0,0 +1,41 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Returned by writes that were skipped because Vault already matched, so they can be told apart from changes.
+var errUnchanged = errors.New("unchanged")
+
+// Collects errors from concurrent work, since errgroup only keeps the first one.
+type errorCollector struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (c *errorCollector) add(err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err)
+}
+
+func (c *errorCollector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.errs)
+}
+
+// Returns nil if nothing failed, or every error prefixed with how many there were and `summary`.
+func (c *errorCollector) join(summary string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d %s: %w", len(c.errs), summary, errors.Join(c.errs...))
+}
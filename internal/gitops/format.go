@@ -0,0 +1,195 @@
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Formats auth role and identity files can be downloaded in.
+const (
+	JSONFormat = "json"
+	YAMLFormat = "yaml"
+)
+
+// Extensions auth role and identity files can have. Files without one are JSON, which is what download writes by
+// default.
+var dataFileExtensions = []string{".json", ".yaml", ".yml"}
+
+// The name of the object a file is for, e.g. billing for billing.yaml.
+func objectName(fileName string) string {
+	for _, ext := range dataFileExtensions {
+		if name := strings.TrimSuffix(fileName, ext); name != fileName && name != "" {
+			return name
+		}
+	}
+	return fileName
+}
+
+func isYAMLFile(fileName string) bool {
+	ext := filepath.Ext(fileName)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Converts the content of an auth role or identity file to JSON if it's YAML, so everything can decode it the same way.
+func dataFileJSON(fileName string, content []byte) ([]byte, error) {
+	if !isYAMLFile(fileName) {
+		return content, nil
+	}
+	var data interface{}
+	if err := yaml.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("error decoding YAML in %s: %w", fileName, err)
+	}
+	// an empty file is an empty object, like {}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("error converting %s to JSON, keys have to be strings: %w", fileName, err)
+	}
+	return encoded, nil
+}
+
+// Reads an auth role or identity file as JSON.
+func readDataFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return dataFileJSON(path, content)
+}
+
+// Encodes `data` the way download writes JSON files, which is the same every time so downloading again when nothing
+// changed leaves nothing for git to diff: sorted keys, two-space indents, <, >, and & as they are, lists in a stable
+// order, and a trailing newline.
+func marshalFile(data interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = decodeJSON(encoded); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(sortLists("", data)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decodes JSON with numbers as json.Number, so large ones come out the way they went in.
+func decodeJSON(encoded []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var data interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Sorts lists of strings, which Vault doesn't always return in the same order and whose order doesn't matter to it
+// (see RoleUnchanged), except SQL statements, which run in order.
+func sortLists(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = sortLists(k, item)
+		}
+	case []interface{}:
+		if strings.HasSuffix(key, "statements") {
+			return v
+		}
+		strs := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return v
+			}
+			strs[i] = s
+		}
+		sort.Strings(strs)
+		for i, s := range strs {
+			v[i] = s
+		}
+	}
+	return value
+}
+
+// Converts JSON from Vault to YAML for download.
+func jsonToYAML(encoded []byte) ([]byte, error) {
+	var data interface{}
+	if err := json.Unmarshal(encoded, &data); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(data)
+}
+
+// The file download writes an object to in `format`.
+func dataFileName(name, format string) string {
+	if format == YAMLFormat {
+		return name + ".yaml"
+	}
+	return name
+}
+
+// name -> file for every file in `dir` like localFiles, but keyed by object name so billing.yaml is billing. Two files
+// for the same object are an error.
+func localDataFiles(dir string) (map[string]string, error) {
+	files, err := localFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]string, len(files))
+	for fileName, file := range files {
+		name := objectName(fileName)
+		if other, ok := byName[name]; ok {
+			return nil, fmt.Errorf("files %s and %s are both for %s", other, file, name)
+		}
+		byName[name] = file
+	}
+	return byName, nil
+}
+
+// Finds the file for `name` in `dir` in any format, e.g. after a rename from billing.json to billing.yaml.
+func findDataFile(dir, name string) (string, bool) {
+	for _, fileName := range append([]string{name}, withExtensions(name)...) {
+		file := filepath.Join(dir, fileName)
+		if _, err := os.Stat(file); err == nil {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+func withExtensions(name string) []string {
+	names := make([]string, len(dataFileExtensions))
+	for i, ext := range dataFileExtensions {
+		names[i] = name + ext
+	}
+	return names
+}
+
+// Removes files for `name` in `dir` in formats other than `keep`, so switching formats doesn't leave duplicates behind.
+func removeOtherFormats(dir, name, keep string) error {
+	for _, fileName := range append([]string{name}, withExtensions(name)...) {
+		if fileName == keep {
+			continue
+		}
+		err := os.Remove(filepath.Join(dir, fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing %s: %w", filepath.Join(dir, fileName), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package gitops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CommitOptions says how CommitDirectory records a download in git.
+type CommitOptions struct {
+	// Create or reset this branch at HEAD and commit to it instead of the current branch.
+	Branch  string
+	Message string
+	// Push the branch to Remote afterwards.
+	Push bool
+	// Empty means origin.
+	Remote string
+}
+
+// Commit is what CommitDirectory did.
+type Commit struct {
+	SHA string
+	// The branch that was committed to, and the one it was started from, which a pull request would merge into.
+	Branch, Base string
+}
+
+// CommitDirectory commits everything added, changed, or removed in `directory`, which has to be in a git repository.
+// Returns nil if nothing changed, in which case no branch is created either.
+func CommitDirectory(directory string, opts CommitOptions) (*Commit, error) {
+	git := Git{Dir: directory}
+	base, err := git.CombinedOutput("rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("error finding the current branch: %w: %s", err, base)
+	}
+	// only what's in the directory, in case it's a subdirectory of the repository
+	if output, err := git.CombinedOutput("add", "--all", "--", "."); err != nil {
+		return nil, fmt.Errorf("error staging downloaded files: %w: %s", err, output)
+	}
+	output, err := git.CombinedOutput("diff", "--cached", "--quiet", "--", ".")
+	if err == nil {
+		log.Info().Msg("Nothing changed, not committing")
+		return nil, nil
+	}
+	// which exits 1 when there are changes
+	var exitErr *exec.ExitError
+	if !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return nil, fmt.Errorf("error checking for staged changes: %w: %s", err, output)
+	}
+	commit := &Commit{Branch: base, Base: base}
+	if opts.Branch != "" {
+		// the staged files come along
+		if output, err := git.CombinedOutput("checkout", "-B", opts.Branch); err != nil {
+			return nil, fmt.Errorf("error creating branch %s: %w: %s", opts.Branch, err, output)
+		}
+		commit.Branch = opts.Branch
+	}
+	if output, err := git.CombinedOutput("commit", "--message", opts.Message, "--", "."); err != nil {
+		return nil, fmt.Errorf("error committing: %w: %s", err, output)
+	}
+	if commit.SHA, err = git.CombinedOutput("rev-parse", "HEAD"); err != nil {
+		return nil, fmt.Errorf("error getting the new commit: %w: %s", err, commit.SHA)
+	}
+	log.Info().Str("sha", commit.SHA).Str("branch", commit.Branch).Msg("Committed download")
+	if !opts.Push {
+		return commit, nil
+	}
+	remote := opts.Remote
+	if remote == "" {
+		remote = "origin"
+	}
+	// a reused branch name is a new drift capture, not an update to the old one
+	if output, err := git.CombinedOutput("push", "--force", "--set-upstream", remote, commit.Branch); err != nil {
+		return nil, fmt.Errorf("error pushing %s to %s: %w: %s", commit.Branch, remote, err, output)
+	}
+	log.Info().Str("remote", remote).Str("branch", commit.Branch).Msg("Pushed download")
+	return commit, nil
+}
+
+// PullRequest is a pull request (or merge request) to open from a pushed branch.
+type PullRequest struct {
+	Title, Body string
+	// The pushed branch, and the one to merge it into.
+	Head, Base string
+}
+
+// OpenGitHubPullRequest opens `pr` with the environment variables set in GitHub Actions, $GITHUB_TOKEN,
+// $GITHUB_REPOSITORY, and optionally $GITHUB_API_URL, and returns its URL.
+func OpenGitHubPullRequest(ctx context.Context, pr PullRequest) (string, error) {
+	var (
+		apiURL     = os.Getenv("GITHUB_API_URL")
+		repository = os.Getenv("GITHUB_REPOSITORY")
+		token      = os.Getenv("GITHUB_TOKEN")
+	)
+	if apiURL == "" {
+		apiURL = "https://api.github.com"
+	}
+	if repository == "" {
+		return "", fmt.Errorf("$GITHUB_REPOSITORY must be set to owner/name")
+	}
+	if token == "" {
+		return "", fmt.Errorf("$GITHUB_TOKEN must be set")
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	header.Set("Accept", "application/vnd.github+json")
+	var created struct {
+		HTMLURL string `json:"html_url"`
+	}
+	err := requestJSON(ctx, nil, http.MethodPost, strings.TrimRight(apiURL, "/")+"/repos/"+repository+"/pulls", header, map[string]any{
+		"title": pr.Title,
+		"body":  pr.Body,
+		"head":  pr.Head,
+		"base":  pr.Base,
+	}, &created)
+	if err != nil {
+		return "", fmt.Errorf("error opening GitHub pull request: %w", err)
+	}
+	return created.HTMLURL, nil
+}
+
+// OpenGitLabMergeRequest opens `pr` as a merge request with $GITLAB_TOKEN and the environment variables set in GitLab
+// CI, $CI_PROJECT_ID (or $CI_PROJECT_PATH) and $CI_API_V4_URL, and returns its URL.
+func OpenGitLabMergeRequest(ctx context.Context, pr PullRequest) (string, error) {
+	var (
+		apiURL  = os.Getenv("CI_API_V4_URL")
+		project = os.Getenv("CI_PROJECT_ID")
+		token   = os.Getenv("GITLAB_TOKEN")
+	)
+	if apiURL == "" {
+		apiURL = "https://gitlab.com/api/v4"
+	}
+	if project == "" {
+		project = os.Getenv("CI_PROJECT_PATH")
+	}
+	if project == "" {
+		return "", fmt.Errorf("$CI_PROJECT_ID or $CI_PROJECT_PATH must be set")
+	}
+	// CI job tokens can't open merge requests
+	if token == "" {
+		return "", fmt.Errorf("$GITLAB_TOKEN must be set")
+	}
+	header := http.Header{}
+	header.Set("PRIVATE-TOKEN", token)
+	var created struct {
+		WebURL string `json:"web_url"`
+	}
+	err := requestJSON(ctx, nil, http.MethodPost, strings.TrimRight(apiURL, "/")+"/projects/"+url.PathEscape(project)+"/merge_requests", header, map[string]any{
+		"title":         pr.Title,
+		"description":   pr.Body,
+		"source_branch": pr.Head,
+		"target_branch": pr.Base,
+	}, &created)
+	if err != nil {
+		return "", fmt.Errorf("error opening GitLab merge request: %w", err)
+	}
+	return created.WebURL, nil
+}
@@ -0,0 +1,137 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// GitHubReporter records an apply as a GitHub deployment and commit status on the applied SHA.
+type GitHubReporter struct {
+	// e.g. https://api.github.com
+	APIURL string
+	// owner/name
+	Repository string
+	SHA        string
+	Token      string
+	// The deployment environment, which should identify the Vault cluster.
+	Environment string
+	Client      *http.Client
+
+	deploymentID int64
+}
+
+// NewGitHubReporter creates a GitHubReporter from the environment variables set in GitHub Actions.
+//
+// If $GITHUB_SHA is not set, HEAD of the git repository at `directory` is used.
+func NewGitHubReporter(directory, environment string) (*GitHubReporter, error) {
+	r := &GitHubReporter{
+		APIURL:      os.Getenv("GITHUB_API_URL"),
+		Repository:  os.Getenv("GITHUB_REPOSITORY"),
+		SHA:         os.Getenv("GITHUB_SHA"),
+		Token:       os.Getenv("GITHUB_TOKEN"),
+		Environment: environment,
+	}
+	if r.APIURL == "" {
+		r.APIURL = "https://api.github.com"
+	}
+	if r.Repository == "" {
+		return nil, fmt.Errorf("$GITHUB_REPOSITORY must be set to owner/name")
+	}
+	if r.Token == "" {
+		return nil, fmt.Errorf("$GITHUB_TOKEN must be set")
+	}
+	if r.SHA == "" {
+		sha, err := Git{Dir: directory}.CombinedOutput("rev-parse", "HEAD")
+		if err != nil {
+			return nil, fmt.Errorf("error getting HEAD commit: %w: %s", err, sha)
+		}
+		r.SHA = sha
+	}
+	return r, nil
+}
+
+// Started implements ApplyReporter.
+func (r *GitHubReporter) Started(ctx context.Context) error {
+	var deployment struct {
+		ID int64 `json:"id"`
+	}
+	err := r.post(ctx, fmt.Sprintf("/repos/%s/deployments", r.Repository), map[string]any{
+		"ref":               r.SHA,
+		"environment":       r.Environment,
+		"description":       "hvresult gitops apply",
+		"auto_merge":        false,
+		"required_contexts": []string{},
+	}, &deployment)
+	if err != nil {
+		return fmt.Errorf("error creating GitHub deployment: %w", err)
+	}
+	r.deploymentID = deployment.ID
+	if err := r.deploymentStatus(ctx, "in_progress", "applying"); err != nil {
+		return err
+	}
+	return r.commitStatus(ctx, "pending", "applying to "+r.Environment)
+}
+
+// Finished implements ApplyReporter.
+func (r *GitHubReporter) Finished(ctx context.Context, applyErr error) error {
+	var (
+		state       = "success"
+		description = "applied to " + r.Environment
+	)
+	if applyErr != nil {
+		state = "failure"
+		description = applyErr.Error()
+	}
+	if r.deploymentID != 0 {
+		if err := r.deploymentStatus(ctx, state, description); err != nil {
+			return err
+		}
+	}
+	return r.commitStatus(ctx, state, description)
+}
+
+func (r *GitHubReporter) deploymentStatus(ctx context.Context, state, description string) error {
+	err := r.post(ctx, fmt.Sprintf("/repos/%s/deployments/%d/statuses", r.Repository, r.deploymentID), map[string]any{
+		"state":       state,
+		"description": truncate(description, 140),
+		"environment": r.Environment,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error creating GitHub deployment status: %w", err)
+	}
+	return nil
+}
+
+func (r *GitHubReporter) commitStatus(ctx context.Context, state, description string) error {
+	err := r.post(ctx, fmt.Sprintf("/repos/%s/statuses/%s", r.Repository, r.SHA), map[string]any{
+		"state":       state,
+		"description": truncate(description, 140),
+		"context":     "hvresult/apply (" + r.Environment + ")",
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error creating GitHub commit status: %w", err)
+	}
+	return nil
+}
+
+func (r *GitHubReporter) post(ctx context.Context, path string, body, v any) error {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+r.Token)
+	header.Set("Accept", "application/vnd.github+json")
+	return requestJSON(ctx, r.Client, http.MethodPost, strings.TrimRight(r.APIURL, "/")+path, header, body, v)
+}
+
+// GitHub rejects status descriptions over 140 characters
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+var (
+	_ ApplyReporter = &GitHubReporter{}
+)
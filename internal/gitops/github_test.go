@@ -0,0 +1,61 @@
+package gitops_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestGitHubReporter(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding request body: %v", err)
+		}
+		mu.Lock()
+		requests = append(requests, fmt.Sprintf("%s %v", r.URL.Path, body["state"]))
+		mu.Unlock()
+		if r.URL.Path == "/repos/octo/vault-policy/deployments" {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": 42}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	reporter := &gitops.GitHubReporter{
+		APIURL:      server.URL,
+		Repository:  "octo/vault-policy",
+		SHA:         "abc123",
+		Token:       "test-token",
+		Environment: "https://vault.example.com",
+	}
+	ctx := context.Background()
+	if err := reporter.Started(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := reporter.Finished(ctx, errors.New("oops")); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{
+		"/repos/octo/vault-policy/deployments <nil>",
+		"/repos/octo/vault-policy/deployments/42/statuses in_progress",
+		"/repos/octo/vault-policy/statuses/abc123 pending",
+		"/repos/octo/vault-policy/deployments/42/statuses failure",
+		"/repos/octo/vault-policy/statuses/abc123 failure",
+	}, requests); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -24,6 +24,17 @@ func (m Mutation) MarshalText() ([]byte, error) {
 	return []byte(m.String()), nil
 }
 
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *Mutation) UnmarshalText(text []byte) error {
+	for _, mutation := range []Mutation{Add, Delete, Change} {
+		if mutation.String() == string(text) {
+			*m = mutation
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown mutation %q", text)
+}
+
 const (
 	Add Mutation = iota
 	Delete
@@ -35,6 +46,18 @@ type ChangedFile struct {
 	Mutation  Mutation
 	Principal bool `json:",omitempty"`
 	Policy    bool `json:",omitempty"`
+	// An identity entity or group.
+	Identity bool `json:",omitempty"`
+	// A Sentinel EGP or RGP.
+	Sentinel bool `json:",omitempty"`
+	// A password policy.
+	PasswordPolicy bool `json:",omitempty"`
+	// A secrets engine role or transit key.
+	Secret bool `json:",omitempty"`
+	// A secrets engine in sys/mounts.
+	Mount bool `json:",omitempty"`
+	// A rate limit or lease count quota in sys/quotas.
+	Quota bool `json:",omitempty"`
 }
 
 // Computes a change between HEAD and some reference, like a branch. Leave blank to use the default branch, which is usually named main or master.
@@ -60,7 +83,8 @@ func GetChangedFiles(ctx context.Context, repo string, referenceName string) ([]
 			log.Info().Str("branch", referenceName).Msg("`git config init.defaultBranch` returned nothing, guessed default branch")
 		}
 	}
-	output, err := git.CombinedOutput("diff", referenceName, "--name-status")
+	// renames become a delete and an add, and paths are relative to `repo` in case it's a subdirectory
+	output, err := git.CombinedOutput("diff", referenceName, "--name-status", "--no-renames", "--relative")
 	if err != nil {
 		return nil, referenceName, fmt.Errorf("error running `git diff %s --name-status`: %w: %s", referenceName, err, output)
 	}
@@ -100,17 +124,13 @@ func GetChangedFiles(ctx context.Context, repo string, referenceName string) ([]
 			log.Warn().Str("status", status).Msg("unhandled git file status, skipping")
 			continue
 		}
-		cf := ChangedFile{
-			Path:     path,
-			Mutation: mutation,
+		// like a README.md, which isn't anything to apply
+		if !ignoredInRepo(repo, path) {
+			changes = append(changes, classifyChangedFile(ChangedFile{
+				Path:     path,
+				Mutation: mutation,
+			}))
 		}
-		// this heuristic might need adjustment
-		if strings.HasPrefix(path, "auth") {
-			cf.Principal = true
-		} else if strings.HasSuffix(filepath.Dir(path), "acl") {
-			cf.Policy = true
-		}
-		changes = append(changes, cf)
 		if done {
 			break
 		}
@@ -118,6 +138,29 @@ func GetChangedFiles(ctx context.Context, repo string, referenceName string) ([]
 	return changes, referenceName, nil
 }
 
+// Works out what kind of file a changed path is.
+func classifyChangedFile(cf ChangedFile) ChangedFile {
+	// this heuristic might need adjustment
+	if strings.HasPrefix(cf.Path, "auth") {
+		cf.Principal = true
+	} else if strings.HasPrefix(cf.Path, "sys/mounts/") {
+		cf.Mount = true
+	} else if strings.HasPrefix(cf.Path, "sys/quotas/") {
+		cf.Quota = true
+	} else if strings.HasPrefix(cf.Path, "sys/policies/password/") {
+		cf.PasswordPolicy = true
+	} else if strings.HasPrefix(filepath.ToSlash(cf.Path), "sys/policies/acl/") || strings.HasSuffix(filepath.Dir(cf.Path), "acl") {
+		cf.Policy = true
+	} else if dir := filepath.Base(filepath.Dir(cf.Path)); dir == "egp" || dir == "rgp" {
+		cf.Sentinel = true
+	} else if strings.HasPrefix(cf.Path, "identity/") {
+		cf.Identity = true
+	} else if strings.HasPrefix(cf.Path, "secrets/") {
+		cf.Secret = true
+	}
+	return cf
+}
+
 // A little wrapper for subprocess commands to git.
 //
 // If you're curious about why, github.com/go-git/go-git can get a little dicey and bugs are more easily triaged this way.
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -122,3 +123,109 @@ func generatePolicyACLData() []byte {
 	)
 	return buf.Bytes()
 }
+
+func TestCommitDirectory(t *testing.T) {
+	var (
+		repo      = t.TempDir()
+		directory = filepath.Join(repo, "vault")
+		git       = gitops.Git{Dir: repo}
+		must      = mustT[string](t)
+	)
+	if err := os.MkdirAll(filepath.Join(directory, "sys", "policies", "acl"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	policyFile := filepath.Join(directory, "sys", "policies", "acl", "reader")
+	if err := os.WriteFile(policyFile, generatePolicyACLData(), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	base := must(git.CombinedOutput("rev-parse", "--abbrev-ref", "HEAD"))
+
+	opts := gitops.CommitOptions{Branch: "drift/today", Message: "Download Vault state"}
+	commit, err := gitops.CommitDirectory(directory, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit != nil {
+		t.Fatalf("expected nothing to be committed without changes, got %+v", commit)
+	}
+
+	if err := os.WriteFile(policyFile, generatePolicyACLData(), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	// outside of the directory, so left alone
+	if err := os.WriteFile(filepath.Join(repo, "README.md"), []byte("notes"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	commit, err = gitops.CommitDirectory(directory, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit == nil {
+		t.Fatal("expected the changed policy to be committed")
+	}
+	if diff := cmp.Diff(gitops.Commit{SHA: must(git.CombinedOutput("rev-parse", "HEAD")), Branch: "drift/today", Base: base}, *commit); diff != "" {
+		t.Errorf("unexpected commit (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("?? README.md", must(git.CombinedOutput("status", "--porcelain"))); diff != "" {
+		t.Errorf("expected only the policy to be committed (-want +got):\n%s", diff)
+	}
+}
+
+func TestVerifyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for file, content := range map[string]string{
+		"README.md":                      "not a Vault object",
+		"sys/policies/acl/reader":        `path "secret/*" { capabilities = ["read"] }`,
+		"sys/policies/acl/broken":        `path "secret/*" { capabilities = ["read"`,
+		"auth/approle/_mount.json":       `{"type": "approle"}`,
+		"auth/approle/role/ci.json":      `{"token_policies": ["reader", "default", "writer"]}`,
+		"auth/approle/roles/typo.json":   `{"token_policies": ["reader"]}`,
+		"identity/entity/alice.json":     `{"policies": ["reader"]}`,
+		"identity/group/admins.json":     `{"member_entities": ["alice", "bob"]}`,
+		"identity/group/admins.yaml":     "member_entities: [alice]\n",
+		"identity/groups/engineers.json": `{}`,
+	} {
+		file = filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := gitops.VerifyDirectory(dir, gitops.ApplyOptions{IdentityDirectory: filepath.Join(dir, "identity")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// file -> part of its problem
+	want := map[string]string{
+		"sys/policies/acl/broken":        "sys/policies/acl/broken",
+		"auth/approle/role/ci.json":      "grants policies without a file: writer",
+		"auth/approle/roles/typo.json":   "approle auth mounts only have roles in role/",
+		"identity/group/admins.json":     "has members without a file: entity bob",
+		"identity/group/admins.yaml":     "would be written to identity/group/name/admins",
+		"identity/groups/engineers.json": "isn't anywhere apply looks",
+	}
+	got := map[string]string{}
+	for _, problem := range problems {
+		rel, message, _ := strings.Cut(strings.TrimPrefix(problem.Error(), dir+string(filepath.Separator)), ": ")
+		got[filepath.ToSlash(rel)] = message
+	}
+	for file, part := range want {
+		if !strings.Contains(got[file], part) {
+			t.Errorf("expected a problem with %s containing %q, got %q", file, part, got[file])
+		}
+	}
+	for file, message := range got {
+		if _, ok := want[file]; !ok {
+			t.Errorf("unexpected problem with %s: %s", file, message)
+		}
+	}
+}
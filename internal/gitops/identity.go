@@ -0,0 +1,617 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/mitchellh/mapstructure"
+	"github.com/rs/zerolog/log"
+)
+
+// Entities and groups are kept as a JSON file each in <identity>/entity/<name> and <identity>/group/<name>. Aliases,
+// members, and mounts are referred to by name instead of by the IDs Vault generates, so files mean the same thing in
+// every cluster.
+
+// IdentityAlias ties an entity or group to a name from an auth mount.
+type IdentityAlias struct {
+	Name string `json:"name"`
+	// The auth mount's path without the trailing slash, e.g. userpass or oidc.
+	Mount string `json:"mount"`
+}
+
+// IdentityEntity is the local file format of an identity entity.
+type IdentityEntity struct {
+	Policies []string          `json:"policies,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Disabled bool              `json:"disabled,omitempty"`
+	Aliases  []IdentityAlias   `json:"aliases,omitempty"`
+}
+
+// IdentityGroup is the local file format of an identity group.
+type IdentityGroup struct {
+	// internal (the default) or external. External groups get their members from Alias instead.
+	Type           string            `json:"type,omitempty"`
+	Policies       []string          `json:"policies,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	MemberEntities []string          `json:"member_entities,omitempty"`
+	MemberGroups   []string          `json:"member_groups,omitempty"`
+	Alias          *IdentityAlias    `json:"alias,omitempty"`
+}
+
+type vaultIdentityAlias struct {
+	ID            string `mapstructure:"id"`
+	Name          string `mapstructure:"name"`
+	MountAccessor string `mapstructure:"mount_accessor"`
+}
+
+type vaultIdentityEntity struct {
+	ID       string               `mapstructure:"id"`
+	Policies []string             `mapstructure:"policies"`
+	Metadata map[string]string    `mapstructure:"metadata"`
+	Disabled bool                 `mapstructure:"disabled"`
+	Aliases  []vaultIdentityAlias `mapstructure:"aliases"`
+}
+
+type vaultIdentityGroup struct {
+	ID              string             `mapstructure:"id"`
+	Type            string             `mapstructure:"type"`
+	Policies        []string           `mapstructure:"policies"`
+	Metadata        map[string]string  `mapstructure:"metadata"`
+	MemberEntityIDs []string           `mapstructure:"member_entity_ids"`
+	MemberGroupIDs  []string           `mapstructure:"member_group_ids"`
+	Alias           vaultIdentityAlias `mapstructure:"alias"`
+}
+
+// entity or group
+func identityType(kind ResourceKind) string {
+	if kind == IdentityGroupResource {
+		return "group"
+	}
+	return "entity"
+}
+
+// Whether `kind` is kept in the identity directory, as JSON or YAML.
+func isIdentityKind(kind ResourceKind) bool {
+	switch kind {
+	case IdentityEntityResource, IdentityGroupResource, MFAMethodResource, MFALoginEnforcementResource, OIDCResource:
+		return true
+	}
+	return false
+}
+
+// The kind of the files in a directory in the identity directory, like mfa/method/, and where their objects are in
+// Vault.
+func identityKindFor(dir string) (ResourceKind, string, bool) {
+	dir = strings.Trim(dir, "/")
+	switch dir {
+	case "entity":
+		return IdentityEntityResource, "identity/entity/name", true
+	case "group":
+		return IdentityGroupResource, "identity/group/name", true
+	case "mfa/method":
+		return MFAMethodResource, mfaMethodNamePath, true
+	case "mfa/login-enforcement":
+		return MFALoginEnforcementResource, mfaEnforcementListPath, true
+	}
+	if objectType, ok := strings.CutPrefix(dir, "oidc/"); ok && slices.Contains(oidcTypes, objectType) {
+		return OIDCResource, oidcListPath + "/" + objectType, true
+	}
+	return "", "", false
+}
+
+// Plans every entity and group, like planPolicies. Also returns how many there are in Vault.
+func (a *applier) planIdentity(ctx context.Context, identityDirectory string) ([]PlannedChange, int, error) {
+	var (
+		changes  []PlannedChange
+		existing int
+	)
+	for _, kind := range []ResourceKind{IdentityEntityResource, IdentityGroupResource} {
+		listPath := "identity/" + identityType(kind) + "/name"
+		names, err := a.listKeys(ctx, listPath)
+		if err != nil {
+			if a.opts.SkipForbidden && isPermissionDenied(err) {
+				a.opts.Report.Skip(listPath, "list", err)
+				continue
+			}
+			return nil, 0, fmt.Errorf("error listing %s from Vault: %w", listPath, err)
+		}
+		existing += len(names)
+		remote := make(map[string]bool, len(names))
+		for _, name := range names {
+			remote[name] = true
+		}
+
+		local, err := localDataFiles(filepath.Join(identityDirectory, identityType(kind)))
+		if err != nil {
+			return nil, 0, err
+		}
+		for name, file := range local {
+			mutation := Add
+			if remote[name] {
+				mutation = Change
+			}
+			changes = append(changes, PlannedChange{Mutation: mutation, Kind: kind, Path: listPath + "/" + name, File: file})
+		}
+		for _, name := range names {
+			if _, ok := local[name]; !ok {
+				changes = append(changes, PlannedChange{Mutation: Delete, Kind: kind, Path: listPath + "/" + name})
+			}
+		}
+	}
+	return changes, existing, nil
+}
+
+// Auth mounts, listed the first time they're needed.
+func (a *applier) authMounts(ctx context.Context) (map[string]*vault.AuthMount, error) {
+	a.mountsMu.Lock()
+	defer a.mountsMu.Unlock()
+	if a.mounts != nil {
+		return a.mounts, nil
+	}
+	var mounts map[string]*vault.AuthMount
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		mounts, err = a.vc.Sys().ListAuthWithContext(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing auth mounts from Vault: %w", err)
+	}
+	a.mounts = mounts
+	return mounts, nil
+}
+
+// The accessor of the mount an alias is for.
+func (a *applier) mountAccessor(ctx context.Context, alias IdentityAlias) (string, error) {
+	mounts, err := a.authMounts(ctx)
+	if err != nil {
+		return "", err
+	}
+	mount := mounts[strings.Trim(alias.Mount, "/")+"/"]
+	if mount == nil {
+		return "", fmt.Errorf("auth mount %s for alias %s doesn't exist", alias.Mount, alias.Name)
+	}
+	return mount.Accessor, nil
+}
+
+// The inverse of mountAccessor.
+func (a *applier) mountPath(ctx context.Context, accessor string) (string, error) {
+	mounts, err := a.authMounts(ctx)
+	if err != nil {
+		return "", err
+	}
+	for path, mount := range mounts {
+		if mount.Accessor == accessor {
+			return strings.TrimSuffix(path, "/"), nil
+		}
+	}
+	return "", fmt.Errorf("no auth mount has accessor %s", accessor)
+}
+
+// Reads identity/<type>/name/<name> or identity/<type>/id/<id>, returning nil if it doesn't exist.
+func (a *applier) readIdentity(ctx context.Context, path string) (*vault.Secret, error) {
+	var secret *vault.Secret
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = a.vc.Logical().ReadWithContext(ctx, path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s from Vault: %w", path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	return secret, nil
+}
+
+// Looks up the name of an entity or group by ID.
+func (a *applier) identityName(ctx context.Context, kind ResourceKind, id string) (string, error) {
+	secret, err := a.readIdentity(ctx, "identity/"+identityType(kind)+"/id/"+id)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", fmt.Errorf("identity %s %s doesn't exist", identityType(kind), id)
+	}
+	name, _ := secret.Data["name"].(string)
+	return name, nil
+}
+
+// Looks up the ID of an entity or group by name.
+func (a *applier) identityID(ctx context.Context, kind ResourceKind, name string) (string, error) {
+	secret, err := a.readIdentity(ctx, "identity/"+identityType(kind)+"/name/"+name)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", fmt.Errorf("identity %s %s doesn't exist", identityType(kind), name)
+	}
+	id, _ := secret.Data["id"].(string)
+	return id, nil
+}
+
+// An entity or group in Vault in the local file format, or nil if it doesn't exist.
+func (a *applier) readRemoteIdentity(ctx context.Context, change PlannedChange) ([]byte, error) {
+	secret, err := a.readIdentity(ctx, change.Path)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	var local interface{}
+	if change.Kind == IdentityGroupResource {
+		local, err = a.localGroup(ctx, secret)
+	} else {
+		local, err = a.localEntity(ctx, secret)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error converting %s: %w", change.Path, err)
+	}
+	return json.MarshalIndent(local, "", "  ")
+}
+
+func (a *applier) localEntity(ctx context.Context, secret *vault.Secret) (*IdentityEntity, error) {
+	var remote vaultIdentityEntity
+	if err := mapstructure.Decode(secret.Data, &remote); err != nil {
+		return nil, err
+	}
+	entity := &IdentityEntity{Policies: remote.Policies, Metadata: remote.Metadata, Disabled: remote.Disabled}
+	for _, alias := range remote.Aliases {
+		mount, err := a.mountPath(ctx, alias.MountAccessor)
+		if err != nil {
+			return nil, err
+		}
+		entity.Aliases = append(entity.Aliases, IdentityAlias{Name: alias.Name, Mount: mount})
+	}
+	sort.Slice(entity.Aliases, func(i, j int) bool {
+		return entity.Aliases[i].Mount+"/"+entity.Aliases[i].Name < entity.Aliases[j].Mount+"/"+entity.Aliases[j].Name
+	})
+	return entity, nil
+}
+
+func (a *applier) localGroup(ctx context.Context, secret *vault.Secret) (*IdentityGroup, error) {
+	var remote vaultIdentityGroup
+	if err := mapstructure.Decode(secret.Data, &remote); err != nil {
+		return nil, err
+	}
+	group := &IdentityGroup{Type: remote.Type, Policies: remote.Policies, Metadata: remote.Metadata}
+	for _, id := range remote.MemberEntityIDs {
+		name, err := a.identityName(ctx, IdentityEntityResource, id)
+		if err != nil {
+			return nil, err
+		}
+		group.MemberEntities = append(group.MemberEntities, name)
+	}
+	for _, id := range remote.MemberGroupIDs {
+		name, err := a.identityName(ctx, IdentityGroupResource, id)
+		if err != nil {
+			return nil, err
+		}
+		group.MemberGroups = append(group.MemberGroups, name)
+	}
+	sort.Strings(group.MemberEntities)
+	sort.Strings(group.MemberGroups)
+	if remote.Alias.ID != "" {
+		mount, err := a.mountPath(ctx, remote.Alias.MountAccessor)
+		if err != nil {
+			return nil, err
+		}
+		group.Alias = &IdentityAlias{Name: remote.Alias.Name, Mount: mount}
+	}
+	return group, nil
+}
+
+// Decodes a local entity or group file, refusing fields that don't exist.
+func readIdentityFile(path string, v interface{}) error {
+	content, err := readDataFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading local identity file %s: %w", path, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("error decoding local identity file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Checks an entity or group file is well formed.
+func validateIdentity(change PlannedChange) error {
+	if change.Kind == IdentityEntityResource {
+		var entity IdentityEntity
+		if err := readIdentityFile(change.File, &entity); err != nil {
+			return err
+		}
+		for _, alias := range entity.Aliases {
+			if alias.Name == "" || alias.Mount == "" {
+				return errors.New("entity aliases need a name and a mount")
+			}
+		}
+		return nil
+	}
+	var group IdentityGroup
+	if err := readIdentityFile(change.File, &group); err != nil {
+		return err
+	}
+	switch group.Type {
+	case "", "internal":
+		if group.Alias != nil {
+			return errors.New("only external groups can have an alias")
+		}
+	case "external":
+		if len(group.MemberEntities) > 0 || len(group.MemberGroups) > 0 {
+			return errors.New("external groups get their members from their alias and can't list any")
+		}
+		if group.Alias != nil && (group.Alias.Name == "" || group.Alias.Mount == "") {
+			return errors.New("group aliases need a name and a mount")
+		}
+	default:
+		return fmt.Errorf("group type must be internal or external, not %q", group.Type)
+	}
+	return nil
+}
+
+// Writes an entity or group, skipping the write with SkipUnchanged if it'd be the same.
+func (a *applier) writeIdentity(ctx context.Context, change PlannedChange) error {
+	if a.opts.SkipUnchanged && change.Mutation == Change {
+		same, err := a.unchanged(ctx, change)
+		if err != nil {
+			return err
+		}
+		if same {
+			log.Debug().Str("path", change.Path).Msgf("%s unchanged, skipping write", change.Kind)
+			return errUnchanged
+		}
+	}
+	log.Debug().Str("path", change.Path).Msgf("Writing %s to Vault", change.Kind)
+	var err error
+	if change.Kind == IdentityGroupResource {
+		err = a.writeGroup(ctx, change)
+	} else {
+		err = a.writeEntity(ctx, change)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s %s to Vault: %w", change.Kind, change.Name(), err)
+	}
+	return nil
+}
+
+func (a *applier) writeEntity(ctx context.Context, change PlannedChange) error {
+	var entity IdentityEntity
+	if err := readIdentityFile(change.File, &entity); err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"policies": nonNil(entity.Policies),
+		"metadata": entity.Metadata,
+		"disabled": entity.Disabled,
+	}
+	if err := a.write(ctx, change.Path, data); err != nil {
+		return err
+	}
+	secret, err := a.readIdentity(ctx, change.Path)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return errors.New("entity doesn't exist after writing it")
+	}
+	var remote vaultIdentityEntity
+	if err := mapstructure.Decode(secret.Data, &remote); err != nil {
+		return err
+	}
+
+	// accessor/name -> alias ID
+	existing := make(map[string]string, len(remote.Aliases))
+	for _, alias := range remote.Aliases {
+		existing[alias.MountAccessor+"/"+alias.Name] = alias.ID
+	}
+	for _, alias := range entity.Aliases {
+		accessor, err := a.mountAccessor(ctx, alias)
+		if err != nil {
+			return err
+		}
+		key := accessor + "/" + alias.Name
+		if _, ok := existing[key]; ok {
+			delete(existing, key)
+			continue
+		}
+		err = a.write(ctx, "identity/entity-alias", map[string]interface{}{
+			"name":           alias.Name,
+			"canonical_id":   remote.ID,
+			"mount_accessor": accessor,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating alias %s on %s: %w", alias.Name, alias.Mount, err)
+		}
+	}
+	// whatever's left isn't in the local file
+	for _, id := range existing {
+		if err := a.delete(ctx, "identity/entity-alias/id/"+id); err != nil {
+			return fmt.Errorf("error deleting entity alias %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (a *applier) writeGroup(ctx context.Context, change PlannedChange) error {
+	var group IdentityGroup
+	if err := readIdentityFile(change.File, &group); err != nil {
+		return err
+	}
+	if group.Type == "" {
+		group.Type = "internal"
+	}
+	data := map[string]interface{}{
+		"type":     group.Type,
+		"policies": nonNil(group.Policies),
+		"metadata": group.Metadata,
+	}
+	if group.Type == "internal" {
+		entityIDs := make([]string, 0, len(group.MemberEntities))
+		for _, name := range group.MemberEntities {
+			id, err := a.identityID(ctx, IdentityEntityResource, name)
+			if err != nil {
+				return err
+			}
+			entityIDs = append(entityIDs, id)
+		}
+		groupIDs := make([]string, 0, len(group.MemberGroups))
+		for _, name := range group.MemberGroups {
+			id, err := a.identityID(ctx, IdentityGroupResource, name)
+			if err != nil {
+				return err
+			}
+			groupIDs = append(groupIDs, id)
+		}
+		data["member_entity_ids"] = entityIDs
+		data["member_group_ids"] = groupIDs
+	}
+	if err := a.write(ctx, change.Path, data); err != nil {
+		return err
+	}
+	if group.Type != "external" {
+		return nil
+	}
+
+	secret, err := a.readIdentity(ctx, change.Path)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return errors.New("group doesn't exist after writing it")
+	}
+	var remote vaultIdentityGroup
+	if err := mapstructure.Decode(secret.Data, &remote); err != nil {
+		return err
+	}
+	if group.Alias == nil {
+		if remote.Alias.ID == "" {
+			return nil
+		}
+		return a.delete(ctx, "identity/group-alias/id/"+remote.Alias.ID)
+	}
+	accessor, err := a.mountAccessor(ctx, *group.Alias)
+	if err != nil {
+		return err
+	}
+	if remote.Alias.Name == group.Alias.Name && remote.Alias.MountAccessor == accessor {
+		return nil
+	}
+	aliasPath := "identity/group-alias"
+	if remote.Alias.ID != "" {
+		aliasPath += "/id/" + remote.Alias.ID
+	}
+	return a.write(ctx, aliasPath, map[string]interface{}{
+		"name":           group.Alias.Name,
+		"canonical_id":   remote.ID,
+		"mount_accessor": accessor,
+	})
+}
+
+func (a *applier) write(ctx context.Context, path string, data map[string]interface{}) error {
+	return a.limiter.Do(ctx, func(ctx context.Context) error {
+		_, err := a.vc.Logical().WriteWithContext(ctx, path, data)
+		return err
+	})
+}
+
+func (a *applier) delete(ctx context.Context, path string) error {
+	return a.limiter.Do(ctx, func(ctx context.Context) error {
+		_, err := a.vc.Logical().DeleteWithContext(ctx, path)
+		return err
+	})
+}
+
+// Vault leaves lists alone when they're null, so clearing one needs an empty list.
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// Groups can have groups as members, which have to exist first. Each group write gets a depth that's one more than
+// its deepest member group being written in the same plan, so they're written in order.
+func (p *Plan) orderGroups() error {
+	// group name -> member groups being written
+	members := map[string][]string{}
+	for _, change := range p.Changes {
+		if change.Kind != IdentityGroupResource || change.Mutation == Delete {
+			continue
+		}
+		var group IdentityGroup
+		if err := readIdentityFile(change.File, &group); err != nil {
+			return err
+		}
+		members[change.Name()] = group.MemberGroups
+	}
+	var (
+		depths   = map[string]int{}
+		visiting = map[string]bool{}
+		depthOf  func(name string) (int, error)
+	)
+	depthOf = func(name string) (int, error) {
+		if depth, ok := depths[name]; ok {
+			return depth, nil
+		}
+		if visiting[name] {
+			return 0, fmt.Errorf("identity group %s is a member of itself through its member groups", name)
+		}
+		visiting[name] = true
+		var depth int
+		for _, member := range members[name] {
+			if _, planned := members[member]; !planned {
+				continue
+			}
+			memberDepth, err := depthOf(member)
+			if err != nil {
+				return 0, err
+			}
+			depth = max(depth, memberDepth+1)
+		}
+		depths[name] = depth
+		return depth, nil
+	}
+	for i, change := range p.Changes {
+		if change.Kind != IdentityGroupResource || change.Mutation == Delete {
+			continue
+		}
+		depth, err := depthOf(change.Name())
+		if err != nil {
+			return err
+		}
+		p.Changes[i].depth = depth
+	}
+	p.sort()
+	return nil
+}
+
+// DownloadIdentity downloads every identity entity and group, MFA method and login enforcement, and OIDC provider
+// object to `identityDirectory`.
+func DownloadIdentity(ctx context.Context, vc *vault.Client, identityDirectory string) error {
+	return DownloadIdentityWithOptions(ctx, vc, identityDirectory, DownloadOptions{})
+}
+
+// DownloadIdentityWithOptions is DownloadIdentity with options. MFA methods and login enforcements and OIDC provider
+// objects are downloaded too, and files for anything that no longer exists are removed.
+func DownloadIdentityWithOptions(ctx context.Context, vc *vault.Client, identityDirectory string, opts DownloadOptions) error {
+	a := opts.applier(vc)
+	for _, kind := range []ResourceKind{IdentityEntityResource, IdentityGroupResource} {
+		listPath := "identity/" + identityType(kind) + "/name"
+		if err := a.downloadObjects(ctx, kind, listPath, filepath.Join(identityDirectory, identityType(kind)), opts); err != nil {
+			return err
+		}
+	}
+	if err := a.downloadMFA(ctx, identityDirectory, opts); err != nil {
+		return err
+	}
+	return a.downloadOIDC(ctx, identityDirectory, opts)
+}
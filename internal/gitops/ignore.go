@@ -0,0 +1,172 @@
+package gitops
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// IgnoreFileName is a file of patterns for files that aren't Vault objects, like README.md or OWNERS, which works like
+// a .gitignore: it covers the directory it's in and everything under it, patterns without a slash match names at any
+// depth, patterns with one match paths relative to it, a trailing slash only matches directories, and ! un-ignores.
+// Ignore files in parent directories count too, up to the root of the git repository.
+const IgnoreFileName = ".hvresultignore"
+
+// Editor swap and backup files, which are never Vault objects.
+var defaultIgnoreRules = ignoreRules{
+	{pattern: ".*.swp"},
+	{pattern: ".*.swo"},
+	{pattern: "*~"},
+	{pattern: ".#*"},
+	{pattern: ".DS_Store"},
+}
+
+type ignoreRule struct {
+	// the directory the ignore file is in, which anchored patterns are relative to
+	dir                       string
+	pattern                   string
+	anchored, dirOnly, negate bool
+}
+
+type ignoreRules []ignoreRule
+
+// The rules for files in `dir`, from its ignore file and its parents'.
+func loadIgnoreRules(dir string) ignoreRules {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return defaultIgnoreRules
+	}
+	var dirs []string
+	for d := abs; ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil || filepath.Dir(d) == d {
+			break
+		}
+	}
+	rules := slices.Clone(defaultIgnoreRules)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rules = append(rules, readIgnoreFile(dirs[i])...)
+	}
+	return rules
+}
+
+// The rules for files in `dir`, a subdirectory of the one `r` is for.
+func (r ignoreRules) enter(dir string) ignoreRules {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return r
+	}
+	return append(slices.Clip(r), readIgnoreFile(abs)...)
+}
+
+func readIgnoreFile(dir string) ignoreRules {
+	content, err := os.ReadFile(filepath.Join(dir, IgnoreFileName))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn().Err(err).Str("dir", dir).Msg("Error reading ignore file, ignoring it")
+		}
+		return nil
+	}
+	var rules ignoreRules
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{dir: dir}
+		line, rule.negate = strings.CutPrefix(line, "!")
+		line, rule.dirOnly = strings.CutSuffix(line, "/")
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			log.Warn().Str("dir", dir).Str("pattern", line).Msg("Skipping bad pattern in ignore file")
+			continue
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Whether `file` isn't a Vault object. The last matching pattern wins, like in a .gitignore.
+func (r ignoreRules) ignored(file string, isDir bool) bool {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	name := filepath.Base(abs)
+	if name == IgnoreFileName {
+		return true
+	}
+	var ignored bool
+	for _, rule := range r {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		target := name
+		if rule.anchored {
+			rel, err := filepath.Rel(rule.dir, abs)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			target = filepath.ToSlash(rel)
+		}
+		if ok, _ := path.Match(rule.pattern, target); ok {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// filepath.WalkDir, but leaving out ignored files and directories.
+func walkLocal(root string, fn fs.WalkDirFunc) error {
+	rules := map[string]ignoreRules{}
+	return filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fn(file, d, err)
+		}
+		if file == root {
+			if d.IsDir() {
+				rules[filepath.Clean(file)] = loadIgnoreRules(file)
+			}
+			return fn(file, d, err)
+		}
+		parent := rules[filepath.Dir(file)]
+		if parent.ignored(file, d.IsDir()) {
+			log.Debug().Str("path", file).Msg("Ignoring file")
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			rules[file] = parent.enter(file)
+		}
+		return fn(file, d, err)
+	})
+}
+
+// Whether `file`, relative to `repo`, is ignored or in an ignored directory. It doesn't have to exist anymore.
+func ignoredInRepo(repo, file string) bool {
+	var (
+		rules = loadIgnoreRules(repo)
+		parts = strings.Split(filepath.ToSlash(filepath.Clean(file)), "/")
+		dir   = repo
+	)
+	for i, part := range parts {
+		dir = filepath.Join(dir, part)
+		if rules.ignored(dir, i < len(parts)-1) {
+			return true
+		}
+		rules = rules.enter(dir)
+	}
+	return false
+}
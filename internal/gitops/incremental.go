@@ -0,0 +1,222 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Plans only ApplyOptions.Changes without listing anything in Vault.
+func (a *applier) planChangedFiles(authDirectory, policyDirectory string) (*Plan, error) {
+	log.Info().Int("count", len(a.opts.Changes)).Msg("Planning changed files...")
+	// a changed file can collide with one that didn't change, or be renamed to a different case of the same policy
+	localPolicies, err := localPolicyFiles(policyDirectory)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	plan := &Plan{}
+	for _, change := range a.opts.Changes {
+		// path.Clean would quietly resolve these
+		if err := checkNoTraversal(change.Path); err != nil {
+			return nil, err
+		}
+		planned := PlannedChange{Mutation: change.Mutation}
+		switch {
+		case change.Policy:
+			name := strings.ToLower(policyNameFromFile(filepath.Base(change.Path)))
+			if change.Mutation == Delete && (name == "root" || name == "default") {
+				log.Debug().Str("policy", name).Msg("Skipping deletion of protected policy")
+				continue
+			}
+			if _, stillExists := localPolicies[name]; change.Mutation == Delete && stillExists {
+				log.Debug().Str("policy", name).Msg("Skipping deletion of policy that was renamed to a different case")
+				continue
+			}
+			planned.Kind = PolicyResource
+			planned.Path = "sys/policies/acl/" + name
+			planned.File = filepath.Join(policyDirectory, filepath.FromSlash(policyRelPath(change.Path)))
+		case change.Principal && filepath.Base(change.Path) == AuthMountFileName:
+			if change.Mutation == Delete && !a.opts.DisableMounts {
+				log.Warn().Str("path", change.Path).Msg("Auth mount file was deleted, but mounts are only disabled with DisableMounts")
+				continue
+			}
+			// auth/<mount>/_mount.json
+			planned.Kind = AuthMountResource
+			planned.Path = "sys/" + path.Dir(path.Clean(filepath.ToSlash(change.Path)))
+			planned.File = filepath.Join(authDirectory, strings.TrimPrefix(planned.Path, "sys/auth/"), AuthMountFileName)
+		case change.Principal && filepath.Base(change.Path) == AuthConfigFileName:
+			if change.Mutation == Delete {
+				log.Debug().Str("path", change.Path).Msg("Ignoring deleted auth mount config file, since configs are never deleted")
+				continue
+			}
+			// auth/<mount>/_config.json, where the mount file says which path the config is at
+			mountName := strings.TrimPrefix(path.Dir(path.Clean(filepath.ToSlash(change.Path))), "auth/")
+			mount, err := readMountFile(filepath.Join(authDirectory, filepath.FromSlash(mountName), AuthMountFileName))
+			if err != nil {
+				return nil, fmt.Errorf("error finding the type of auth mount %s for its config: %w", mountName, err)
+			}
+			configPath, ok := authConfigPathFor(mount.Type)
+			if !ok {
+				log.Warn().Str("path", change.Path).Str("mount_type", mount.Type).Msg("Ignoring config file for an auth mount type without a config")
+				continue
+			}
+			planned.Mutation = Change
+			planned.Kind = AuthConfigResource
+			planned.Path = "auth/" + mountName + "/" + configPath
+			planned.File = filepath.Join(authDirectory, filepath.FromSlash(mountName), AuthConfigFileName)
+		case change.Principal:
+			// auth/<mount>/<prefix>/<name>, where the file can have an extension
+			file := path.Clean(filepath.ToSlash(change.Path))
+			rolePath, err := localRolePath(authDirectory, file)
+			if err != nil {
+				return nil, err
+			}
+			planned.Kind = AuthRoleResource
+			planned.Path = rolePath
+			planned.File = filepath.Join(authDirectory, filepath.FromSlash(strings.TrimPrefix(file, "auth/")))
+			if renamedToOtherFormat(planned, filepath.Dir(planned.File)) {
+				continue
+			}
+		case change.PasswordPolicy:
+			passwordDirectory := passwordPolicyDirectory(policyDirectory)
+			if passwordDirectory == "" {
+				log.Debug().Str("path", change.Path).Msg("Ignoring changed password policy file since password policies aren't managed")
+				continue
+			}
+			planned.Kind = PasswordPolicyResource
+			planned.Path = "sys/policies/password/" + filepath.Base(change.Path)
+			planned.File = filepath.Join(passwordDirectory, filepath.Base(change.Path))
+		case change.Quota:
+			if a.opts.QuotasDirectory == "" {
+				log.Debug().Str("path", change.Path).Msg("Ignoring changed quota file since quotas aren't managed")
+				continue
+			}
+			// sys/quotas/<rate-limit|lease-count>/<name>
+			quotaType := path.Base(path.Dir(filepath.ToSlash(change.Path)))
+			planned.Kind = QuotaResource
+			planned.Path = "sys/quotas/" + quotaType + "/" + path.Base(filepath.ToSlash(change.Path))
+			planned.File = filepath.Join(a.opts.QuotasDirectory, quotaType, filepath.Base(change.Path))
+		case change.Sentinel:
+			if a.opts.SentinelDirectory == "" {
+				log.Debug().Str("path", change.Path).Msg("Ignoring changed Sentinel policy file since Sentinel policies aren't managed")
+				continue
+			}
+			// sys/policies/<egp|rgp>/<name>
+			policyType := path.Base(path.Dir(filepath.ToSlash(change.Path)))
+			planned.Kind = SentinelPolicyResource
+			planned.Path = "sys/policies/" + policyType + "/" + path.Base(filepath.ToSlash(change.Path))
+			planned.File = filepath.Join(a.opts.SentinelDirectory, policyType, filepath.Base(change.Path))
+		case change.Mount:
+			if a.opts.MountsDirectory == "" {
+				log.Debug().Str("path", change.Path).Msg("Ignoring changed secrets engine file since secrets engines aren't managed")
+				continue
+			}
+			if change.Mutation == Delete && !a.opts.DisableMounts {
+				log.Warn().Str("path", change.Path).Msg("Secrets engine file was deleted, but mounts are only disabled with DisableMounts")
+				continue
+			}
+			planned.Kind = SecretsMountResource
+			planned.Path = path.Clean(filepath.ToSlash(change.Path))
+			planned.File = filepath.Join(a.opts.MountsDirectory, filepath.FromSlash(strings.TrimPrefix(planned.Path, "sys/mounts/")))
+		case change.Secret:
+			if a.opts.SecretsDirectory == "" {
+				log.Debug().Str("path", change.Path).Msg("Ignoring changed secrets engine role file since secrets engines aren't managed")
+				continue
+			}
+			planned.Kind = SecretRoleResource
+			planned.Path = strings.TrimPrefix(path.Clean(filepath.ToSlash(change.Path)), "secrets/")
+			planned.File = filepath.Join(a.opts.SecretsDirectory, filepath.FromSlash(planned.Path))
+			if planned.Mutation == Delete && isTransitKey(planned) {
+				log.Warn().Str("path", planned.Path).Msg("Transit key file was deleted, but transit keys are never deleted")
+				continue
+			}
+		case change.Identity:
+			if a.opts.IdentityDirectory == "" {
+				log.Debug().Str("path", change.Path).Msg("Ignoring changed identity file since identities aren't managed")
+				continue
+			}
+			// identity/<entity|group|mfa/...|oidc/...>/<name>
+			dir, name := path.Split(strings.TrimPrefix(path.Clean(filepath.ToSlash(change.Path)), "identity/"))
+			kind, listPath, ok := identityKindFor(dir)
+			if !ok {
+				log.Debug().Str("path", change.Path).Msg("Ignoring changed file that isn't an identity object")
+				continue
+			}
+			planned.Kind = kind
+			planned.Path = listPath + "/" + objectName(name)
+			if planned.Mutation == Delete && oidcBuiltins[planned.Path] {
+				log.Debug().Str("path", planned.Path).Msg("Skipping deletion of built in OIDC object")
+				continue
+			}
+			planned.File = filepath.Join(a.opts.IdentityDirectory, filepath.FromSlash(dir), name)
+			if renamedToOtherFormat(planned, filepath.Dir(planned.File)) {
+				continue
+			}
+		default:
+			log.Debug().Str("path", change.Path).Msg("Ignoring changed file that isn't a policy or auth principal")
+			continue
+		}
+		if planned.Mutation == Delete {
+			planned.File = ""
+		}
+		plan.Changes = append(plan.Changes, planned)
+	}
+	plan.sort()
+	return plan, nil
+}
+
+// Where a changed policy file is under the policy directory, including any organizing subdirectories.
+func policyRelPath(changedPath string) string {
+	changedPath = path.Clean(filepath.ToSlash(changedPath))
+	if rel, ok := strings.CutPrefix(changedPath, "sys/policies/acl/"); ok {
+		return rel
+	}
+	return path.Base(changedPath)
+}
+
+// The Vault path of the auth role file `file`, which is auth/<mount>/<prefix>/<name> even when the file is in a
+// subdirectory of the prefix, like planMountPrefix writes it. The mount is the nearest directory with a mount file,
+// and without one the file's directory is taken to be the prefix.
+func localRolePath(authDirectory, file string) (string, error) {
+	var (
+		name    = objectName(path.Base(file))
+		fileDir = path.Dir(file)
+	)
+	for mountDir := path.Dir(fileDir); strings.HasPrefix(mountDir, "auth/"); mountDir = path.Dir(mountDir) {
+		mountFile := filepath.Join(authDirectory, filepath.FromSlash(strings.TrimPrefix(mountDir, "auth/")), AuthMountFileName)
+		mount, err := readMountFile(mountFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		prefixes, _ := rolePathPrefixesFor(mount.Type)
+		rest := strings.TrimPrefix(fileDir, mountDir+"/")
+		for _, prefix := range prefixes {
+			if rest == prefix || strings.HasPrefix(rest, prefix+"/") {
+				return mountDir + "/" + prefix + "/" + name, nil
+			}
+		}
+		break
+	}
+	return path.Join(fileDir, name), nil
+}
+
+// Whether a deleted role or identity file still has a file in another format, e.g. billing.json became billing.yaml,
+// in which case the object is written rather than deleted.
+func renamedToOtherFormat(change PlannedChange, dir string) bool {
+	if change.Mutation != Delete {
+		return false
+	}
+	if _, ok := findDataFile(dir, change.Name()); ok {
+		log.Debug().Str("path", change.Path).Msg("Skipping deletion of object whose file was renamed to a different format")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// Refuses to delete policies that something still references, unless ApplyOptions.Force is set.
+//
+// Everything is checked as it will be after `plan` is applied: auth roles the plan writes as they are in their files,
+// and every auth role, token role, identity entity, and group it doesn't delete as it is in Vault.
+func (a *applier) checkPoliciesUnused(ctx context.Context, plan *Plan) error {
+	policies := plan.Names(PolicyResource, Delete)
+	if len(policies) == 0 {
+		return nil
+	}
+	references, err := a.policyReferences(ctx, plan, policies)
+	if err != nil {
+		return fmt.Errorf("error checking whether policies are in use: %w", err)
+	}
+	if len(references) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, policy := range policies {
+		if refs := references[policy]; len(refs) > 0 {
+			sort.Strings(refs)
+			lines = append(lines, fmt.Sprintf("%s (used by %s)", policy, strings.Join(refs, ", ")))
+			log.Warn().Str("policy", policy).Strs("references", refs).Msg("Deleting a policy that is still in use")
+		}
+	}
+	if a.opts.Force {
+		return nil
+	}
+	return fmt.Errorf("refusing to delete policies that are still in use, use --force to delete them anyway: %s", strings.Join(lines, "; "))
+}
+
+// policy -> what references it, for each of `policies` that's referenced
+func (a *applier) policyReferences(ctx context.Context, plan *Plan, policies []string) (map[string][]string, error) {
+	var (
+		wanted     = make(map[string]bool, len(policies))
+		references = map[string][]string{}
+		// Vault paths whose content after the apply isn't what's in Vault now
+		planned = make(map[string]bool, len(plan.Changes))
+		mu      sync.Mutex
+	)
+	for _, policy := range policies {
+		wanted[policy] = true
+	}
+	addReferences := func(referrer string, data authPrincipalData) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, policy := range append(data.AllPolicies(), data.GlobbedPolicies(policies)...) {
+			if wanted[policy] {
+				references[policy] = append(references[policy], referrer)
+			}
+		}
+	}
+	// auth roles the plan writes
+	for _, change := range plan.Changes {
+		planned[change.Path] = true
+		if change.Kind != AuthRoleResource || change.Mutation == Delete {
+			continue
+		}
+		content, err := readDataFile(change.File)
+		if err != nil {
+			return nil, err
+		}
+		var data authPrincipalData
+		if err := json.Unmarshal(content, &data); err != nil {
+			// schema problems are reported elsewhere
+			continue
+		}
+		addReferences(change.Path, data)
+	}
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(concurrency(a.opts.Concurrency))
+	// auth roles and token roles staying in Vault, leaving out mounts the plan disables
+	mounts, err := a.authMounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for mountPath, mount := range mounts {
+		mountName := strings.TrimSuffix(mountPath, "/")
+		if planned["sys/auth/"+mountName] {
+			continue
+		}
+		prefixes, ok := inUseRolePathPrefixesFor(mount.Type)
+		if !ok {
+			log.Warn().Str("mount", mountName).Str("mount_type", mount.Type).Msg("Can't check roles on an auth mount of this type for policies in use")
+			continue
+		}
+		for _, prefix := range prefixes {
+			listPath := "auth/" + mountName + "/" + prefix
+			names, err := a.listKeys(ctx, listPath)
+			if err != nil && a.opts.SkipForbidden && isPermissionDenied(err) {
+				a.opts.Report.Skip(listPath, "list", err)
+				continue
+			}
+			if err != nil {
+				_ = eg.Wait()
+				return nil, fmt.Errorf("error listing %s: %w", listPath, err)
+			}
+			for _, name := range names {
+				readPath := listPath + "/" + name
+				if planned[readPath] || strings.HasSuffix(name, "/") {
+					continue
+				}
+				eg.Go(func() error {
+					var data authPrincipalData
+					err := a.limiter.Do(egCtx, func(egCtx context.Context) error {
+						secret, err := a.vc.Logical().ReadWithContext(egCtx, readPath)
+						if err != nil || secret == nil {
+							return err
+						}
+						return mapstructure.WeakDecode(secret.Data, &data)
+					})
+					if err != nil {
+						return fmt.Errorf("error reading %s: %w", readPath, err)
+					}
+					addReferences(readPath, data)
+					return nil
+				})
+			}
+		}
+	}
+	// identity entities and groups
+	for _, kind := range []string{"entity", "group"} {
+		kind := kind
+		ids, err := a.listKeys(ctx, "identity/"+kind+"/id")
+		if err != nil {
+			_ = eg.Wait()
+			return nil, fmt.Errorf("error listing identity %s: %w", kind, err)
+		}
+		for _, id := range ids {
+			readPath := "identity/" + kind + "/id/" + id
+			eg.Go(func() error {
+				var data identityData
+				err := a.limiter.Do(egCtx, func(egCtx context.Context) error {
+					secret, err := a.vc.Logical().ReadWithContext(egCtx, readPath)
+					if err != nil || secret == nil {
+						return err
+					}
+					return mapstructure.WeakDecode(secret.Data, &data)
+				})
+				if err != nil {
+					return fmt.Errorf("error reading %s: %w", readPath, err)
+				}
+				namePath := fmt.Sprintf("identity/%s/name/%s", kind, data.Name)
+				if planned[namePath] {
+					return nil
+				}
+				addReferences(namePath, authPrincipalData{Policies: data.Policies})
+				return nil
+			})
+		}
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return references, nil
+}
+
+// Where roles that can reference policies are on an auth mount, which covers the types that are managed and a few
+// more that can still use policies being deleted.
+func inUseRolePathPrefixesFor(mountType string) ([]string, bool) {
+	if prefixes, ok := rolePathPrefixesFor(mountType); ok {
+		return prefixes, true
+	}
+	switch mountType {
+	case "jwt", "alicloud":
+		return []string{"role"}, true
+	case "cf":
+		return []string{"roles"}, true
+	}
+	return nil, false
+}
+
+type identityData struct {
+	Name     string   `mapstructure:"name"`
+	Policies []string `mapstructure:"policies"`
+}
@@ -0,0 +1,185 @@
+package gitops
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// JournalEntry is what's recorded about one apply.
+type JournalEntry struct {
+	Time        time.Time `json:"time"`
+	Environment string    `json:"environment"`
+	// The applied commit, if the repository is a git repository.
+	Commit  string        `json:"commit,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Applied []AppliedItem `json:"applied"`
+	Skipped []SkippedItem `json:"skipped"`
+	// The hash of the entry before this one, which chains every entry to everything before it.
+	PreviousHash string `json:"previous_hash"`
+}
+
+// A line in a journal file. The entry is kept as written so verifying it doesn't depend on re-encoding it the same way.
+type journalRecord struct {
+	Entry json.RawMessage `json:"entry"`
+	// hex SHA-256 of Entry
+	Hash string `json:"hash"`
+	// hex HMAC-SHA256 of Hash, if the journal is signed
+	Signature string `json:"signature,omitempty"`
+}
+
+// AppendJournal adds an entry to the end of the journal at `path`, chaining it to the last entry and signing it with
+// `key` if that's not empty.
+//
+// Nothing else should be writing to the journal at the same time. `apply` only appends to it while holding the apply
+// lock, so applies to the same cluster can share one unless the lock is skipped.
+func AppendJournal(path string, key []byte, entry JournalEntry) error {
+	records, err := readJournal(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(records) > 0 {
+		entry.PreviousHash = records[len(records)-1].Hash
+	}
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	record := journalRecord{Entry: encoded, Hash: journalHash(encoded)}
+	if len(key) > 0 {
+		record.Signature = journalSignature(key, record.Hash)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening journal: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+	return f.Close()
+}
+
+// VerifyJournal checks that no entry in the journal at `path` has been changed, removed, or reordered, and that every
+// entry was signed with `key` if it's not empty. It returns the entries and the hash of the last one.
+//
+// Entries removed from the end can't be detected from the journal alone, so keep the last hash somewhere else too.
+func VerifyJournal(path string, key []byte) ([]JournalEntry, string, error) {
+	records, err := readJournal(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var (
+		entries  = make([]JournalEntry, 0, len(records))
+		previous string
+	)
+	for i, record := range records {
+		if journalHash(record.Entry) != record.Hash {
+			return nil, "", fmt.Errorf("journal entry %d doesn't match its hash", i+1)
+		}
+		if len(key) > 0 && !hmac.Equal([]byte(journalSignature(key, record.Hash)), []byte(record.Signature)) {
+			return nil, "", fmt.Errorf("journal entry %d has a missing or bad signature", i+1)
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(record.Entry, &entry); err != nil {
+			return nil, "", fmt.Errorf("error decoding journal entry %d: %w", i+1, err)
+		}
+		if entry.PreviousHash != previous {
+			return nil, "", fmt.Errorf("journal entry %d doesn't follow the entry before it", i+1)
+		}
+		entries = append(entries, entry)
+		previous = record.Hash
+	}
+	return entries, previous, nil
+}
+
+func readJournal(path string) ([]journalRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		records []journalRecord
+		scanner = bufio.NewScanner(f)
+	)
+	// entries for big applies can be long
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("error decoding journal line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading journal: %w", err)
+	}
+	return records, nil
+}
+
+func journalHash(entry []byte) string {
+	sum := sha256.Sum256(entry)
+	return hex.EncodeToString(sum[:])
+}
+
+func journalSignature(key []byte, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// JournalReporter appends an entry to a journal when an apply finishes.
+type JournalReporter struct {
+	Path        string
+	Key         []byte
+	Environment string
+	Commit      string
+	// What the apply did, filled in as it runs.
+	Report *Report
+}
+
+// NewJournalReporter creates a JournalReporter that records HEAD of the git repository at `directory`, if it is one.
+func NewJournalReporter(directory, path string, key []byte, environment string, report *Report) *JournalReporter {
+	r := &JournalReporter{Path: path, Key: key, Environment: environment, Report: report}
+	if sha, err := (Git{Dir: directory}).CombinedOutput("rev-parse", "HEAD"); err == nil {
+		r.Commit = sha
+	}
+	return r
+}
+
+// Started implements ApplyReporter.
+func (r *JournalReporter) Started(ctx context.Context) error {
+	return nil
+}
+
+// Finished implements ApplyReporter.
+func (r *JournalReporter) Finished(ctx context.Context, applyErr error) error {
+	entry := JournalEntry{
+		Time:        time.Now().UTC(),
+		Environment: r.Environment,
+		Commit:      r.Commit,
+		Applied:     r.Report.SortedApplied(),
+		Skipped:     r.Report.SortedSkipped(),
+	}
+	if applyErr != nil {
+		entry.Error = applyErr.Error()
+	}
+	if err := AppendJournal(r.Path, r.Key, entry); err != nil {
+		return fmt.Errorf("error appending to journal: %w", err)
+	}
+	return nil
+}
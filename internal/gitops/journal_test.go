@@ -0,0 +1,58 @@
+package gitops_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestJournal(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "journal")
+		key  = []byte("hunter2")
+	)
+	for _, environment := range []string{"first", "second", "third"} {
+		entry := gitops.JournalEntry{
+			Environment: environment,
+			Applied:     []gitops.AppliedItem{{Mutation: gitops.Add, Path: "sys/policies/acl/" + environment}},
+		}
+		if err := gitops.AppendJournal(path, key, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, last, err := gitops.VerifyJournal(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || last == "" {
+		t.Fatalf("expected 3 entries and a last hash, got %d and %q", len(entries), last)
+	}
+	if _, _, err := gitops.VerifyJournal(path, []byte("wrong")); err == nil {
+		t.Fatal("expected verifying with the wrong key to fail")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// editing an entry breaks its hash
+	edited := bytes.Replace(content, []byte("sys/policies/acl/second"), []byte("sys/policies/acl/sneaky"), 1)
+	if err := os.WriteFile(path, edited, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := gitops.VerifyJournal(path, nil); err == nil {
+		t.Fatal("expected an edited journal to fail verification")
+	}
+	// removing an entry breaks the chain even without a key
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	removed := append(append([]byte{}, lines[0]...), lines[2]...)
+	if err := os.WriteFile(path, removed, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := gitops.VerifyJournal(path, nil); err == nil {
+		t.Fatal("expected a journal with an entry removed to fail verification")
+	}
+}
@@ -0,0 +1,218 @@
+package gitops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// How many times a rate limited, timed out, transiently failed, or not yet consistent request is retried by default.
+const DefaultRequestRetries = 5
+
+// The most Do waits between attempts, before jitter.
+const maxRetryBackoff = 10 * time.Second
+
+// How long a single Vault request can take before it's abandoned and retried.
+const DefaultRequestTimeout = 15 * time.Second
+
+// AdaptiveLimiter bounds in-flight Vault requests, halving the bound when Vault rate limits us and
+// raising it by one after a bound's worth of consecutive successes (AIMD).
+type AdaptiveLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	max       int
+	inFlight  int
+	successes int
+	// per attempt, zero means requests only end with the context passed to Do
+	timeout time.Duration
+	retries int
+	// closed and replaced whenever a slot frees up or the limit changes
+	wake chan struct{}
+}
+
+// NewAdaptiveLimiter creates an AdaptiveLimiter that starts at and never exceeds `max` in-flight requests.
+func NewAdaptiveLimiter(max int) *AdaptiveLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &AdaptiveLimiter{limit: max, max: max, retries: DefaultRequestRetries, wake: make(chan struct{})}
+}
+
+// SetRetries sets how many times Do retries a request after the first attempt, which is DefaultRequestRetries unless
+// it's changed. Zero or less turns retrying off.
+func (l *AdaptiveLimiter) SetRetries(retries int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.retries = max(retries, 0)
+}
+
+// SetRequestTimeout bounds how long each attempt made by Do can take, independently of the context passed to it,
+// so a single hung request fails fast and is retried instead of stalling everything waiting on it.
+func (l *AdaptiveLimiter) SetRequestTimeout(timeout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.timeout = timeout
+}
+
+// Limit returns how many requests may currently be in flight.
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Do calls fn once a slot is free, retrying with backoff if it was rate limited, timed out, failed in a way that's
+// likely to go away (e.g. a 502 from a load balancer or a standby that's stepping up), or hit a node that hadn't
+// caught up with replication yet.
+//
+// fn must use the context it's given, which is cancelled when the request timeout runs out.
+func (l *AdaptiveLimiter) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err := l.acquire(ctx); err != nil {
+			return err
+		}
+		var timedOut bool
+		timedOut, err = l.attempt(ctx, fn)
+		l.release(err)
+		switch {
+		case timedOut:
+			log.Warn().Err(err).Int("attempt", attempt+1).Msg("Vault request timed out")
+		case IsConsistencyError(err):
+			log.Debug().Err(err).Int("attempt", attempt+1).Msg("Vault node hasn't caught up with replication yet")
+		case IsTransient(err):
+			log.Warn().Err(err).Int("attempt", attempt+1).Msg("Vault request failed, retrying")
+		}
+		l.mu.Lock()
+		retries := l.retries
+		l.mu.Unlock()
+		if !(IsRateLimited(err) || IsConsistencyError(err) || IsTransient(err) || timedOut) || attempt >= retries {
+			return err
+		}
+		select {
+		case <-time.After(retryBackoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Doubles from 100ms up to maxRetryBackoff, plus up to half again so clients that failed together don't retry together.
+func retryBackoff(attempt int) time.Duration {
+	backoff := maxRetryBackoff
+	if attempt < 10 {
+		backoff = min(time.Duration(1<<attempt)*100*time.Millisecond, maxRetryBackoff)
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+// Calls fn with the request timeout applied, reporting whether it ran out while ctx was still fine.
+func (l *AdaptiveLimiter) attempt(ctx context.Context, fn func(ctx context.Context) error) (bool, error) {
+	l.mu.Lock()
+	timeout := l.timeout
+	l.mu.Unlock()
+	if timeout <= 0 {
+		return false, fn(ctx)
+	}
+	requestCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fn(requestCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(requestCtx.Err(), context.DeadlineExceeded) {
+		return true, fmt.Errorf("request timed out after %s: %w", timeout, err)
+	}
+	return false, err
+}
+
+func (l *AdaptiveLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight < l.limit {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *AdaptiveLimiter) release(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	switch {
+	case IsRateLimited(err):
+		l.successes = 0
+		if l.limit > 1 {
+			l.limit /= 2
+			log.Warn().Int("concurrency", l.limit).Msg("Rate limited by Vault, reducing concurrency")
+		}
+	case err == nil:
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.max {
+			l.limit++
+			l.successes = 0
+			log.Debug().Int("concurrency", l.limit).Msg("Increasing concurrency")
+		}
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// IsRateLimited reports whether err is Vault (or something in front of it) telling us to slow down.
+func IsRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+	var respErr *vault.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "rate limit")
+}
+
+// IsConsistencyError reports whether err is a performance standby or replica refusing a request because it hasn't
+// caught up with the index state we sent yet, which goes away once it has.
+func IsConsistencyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var respErr *vault.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusPreconditionFailed {
+		return true
+	}
+	// Vault's ErrMissingRequiredState, for requests that didn't come back as a ResponseError
+	return strings.Contains(strings.ToLower(err.Error()), "required index state not present")
+}
+
+// IsTransient reports whether err is a failure that's likely to go away on its own, like a gateway error from a load
+// balancer, a sealed or stepping down node answering 503, or a connection that was dropped.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var respErr *vault.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,200 @@
+package gitops_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := gitops.NewAdaptiveLimiter(8)
+	rateLimited := &vault.ResponseError{StatusCode: http.StatusTooManyRequests}
+
+	// a request that's rate limited once is retried and succeeds
+	calls := 0
+	err := limiter.Do(ctx, func(context.Context) error {
+		calls++
+		if calls == 1 {
+			return rateLimited
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+	if limit := limiter.Limit(); limit != 4 {
+		t.Fatalf("expected limit to be halved to 4, got %d", limit)
+	}
+	// successes ramp back up
+	for i := 0; i < 4; i++ {
+		if err := limiter.Do(ctx, func(context.Context) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if limit := limiter.Limit(); limit != 5 {
+		t.Fatalf("expected limit to increase to 5, got %d", limit)
+	}
+	// other errors don't change anything and aren't retried
+	calls = 0
+	boom := errors.New("boom")
+	if err := limiter.Do(ctx, func(context.Context) error { calls++; return boom }); !errors.Is(err, boom) {
+		t.Fatalf("expected boom, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestAdaptiveLimiterRequestTimeout(t *testing.T) {
+	limiter := gitops.NewAdaptiveLimiter(2)
+	limiter.SetRequestTimeout(50 * time.Millisecond)
+
+	// a request that hangs once is abandoned and retried instead of waiting on it
+	calls := 0
+	start := time.Now()
+	err := limiter.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the hung request to be abandoned quickly, took %s", elapsed)
+	}
+	// the parent context ending isn't a timeout and isn't retried
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = limiter.Do(ctx, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+	// a request that always hangs gives up with a timeout
+	err = limiter.Do(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestAdaptiveLimiterConsistencyRetry(t *testing.T) {
+	limiter := gitops.NewAdaptiveLimiter(4)
+	calls := 0
+	err := limiter.Do(context.Background(), func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return &vault.ResponseError{StatusCode: http.StatusPreconditionFailed}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+	// lagging replication isn't load, so concurrency stays where it was
+	if limit := limiter.Limit(); limit != 4 {
+		t.Fatalf("expected limit to stay at 4, got %d", limit)
+	}
+}
+
+func TestIsConsistencyError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		nil: false,
+		&vault.ResponseError{StatusCode: http.StatusPreconditionFailed}: true,
+		&vault.ResponseError{StatusCode: http.StatusBadRequest}:         false,
+		errors.New("required index state not present"):                  true,
+		errors.New("permission denied"):                                 false,
+		// not something waiting will fix
+		&vault.ResponseError{StatusCode: http.StatusBadRequest, Errors: []string{"invalid read consistency setting"}}: false,
+		errors.New("error parsing policy: inconsistency in path rules"):                                               false,
+	} {
+		if actual := gitops.IsConsistencyError(err); actual != expected {
+			t.Errorf("IsConsistencyError(%v) = %v, expected %v", err, actual, expected)
+		}
+	}
+}
+
+func TestIsRateLimited(t *testing.T) {
+	for err, expected := range map[error]bool{
+		nil: false,
+		&vault.ResponseError{StatusCode: http.StatusTooManyRequests}:                  true,
+		&vault.ResponseError{StatusCode: http.StatusForbidden}:                        false,
+		errors.New("request path \"auth/approle/role/x\": rate limit quota exceeded"): true,
+	} {
+		if actual := gitops.IsRateLimited(err); actual != expected {
+			t.Errorf("IsRateLimited(%v) = %v, expected %v", err, actual, expected)
+		}
+	}
+}
+
+func TestAdaptiveLimiterTransientRetry(t *testing.T) {
+	limiter := gitops.NewAdaptiveLimiter(4)
+	limiter.SetRetries(1)
+	calls := 0
+	err := limiter.Do(context.Background(), func(context.Context) error {
+		calls++
+		return &vault.ResponseError{StatusCode: http.StatusBadGateway}
+	})
+	if !gitops.IsTransient(err) {
+		t.Fatalf("expected the 502 once retries ran out, got %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 calls with 1 retry, got %d", calls)
+	}
+
+	limiter.SetRetries(0)
+	calls = 0
+	_ = limiter.Do(context.Background(), func(context.Context) error {
+		calls++
+		return &vault.ResponseError{StatusCode: http.StatusServiceUnavailable}
+	})
+	if calls != 1 {
+		t.Fatalf("expected no retries, got %d calls", calls)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for err, expected := range map[error]bool{
+		nil: false,
+		&vault.ResponseError{StatusCode: http.StatusBadGateway}:          true,
+		&vault.ResponseError{StatusCode: http.StatusServiceUnavailable}:  true,
+		&vault.ResponseError{StatusCode: http.StatusGatewayTimeout}:      true,
+		&vault.ResponseError{StatusCode: http.StatusInternalServerError}: false,
+		&vault.ResponseError{StatusCode: http.StatusBadRequest}:          false,
+		fmt.Errorf("Put: %w", syscall.ECONNRESET):                        true,
+		errors.New("permission denied"):                                  false,
+	} {
+		if actual := gitops.IsTransient(err); actual != expected {
+			t.Errorf("IsTransient(%v) = %v, expected %v", err, actual, expected)
+		}
+	}
+}
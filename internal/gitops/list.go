@@ -0,0 +1,62 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/mitchellh/mapstructure"
+)
+
+// How many keys each LIST request asks for. Endpoints that don't support after and limit ignore them and return
+// everything, which works too.
+const listPageSize = 1000
+
+// Lists `listPath` a page at a time with Vault's after and limit parameters, calling `fn` with each page, so mounts with
+// a huge number of roles aren't listed in one response or downloaded all at once. Does nothing for a path that doesn't
+// exist.
+func (a *applier) listPages(ctx context.Context, listPath string, fn func(page *vault.Secret, keys []string) error) error {
+	var after, first string
+	for {
+		params := map[string][]string{
+			// a GET with list=true is a LIST that can have query parameters
+			"list":  {"true"},
+			"limit": {strconv.Itoa(listPageSize)},
+		}
+		if after != "" {
+			params["after"] = []string{after}
+		}
+		var secret *vault.Secret
+		err := a.limiter.Do(ctx, func(ctx context.Context) error {
+			var err error
+			secret, err = a.vc.Logical().ReadWithDataWithContext(ctx, listPath, params)
+			return err
+		})
+		if err != nil || secret == nil || secret.Data == nil {
+			return err
+		}
+		var listData authListData
+		if err := mapstructure.Decode(secret.Data, &listData); err != nil {
+			return fmt.Errorf("error decoding %s list: %w", listPath, err)
+		}
+		keys := listData.Keys
+		if len(keys) == 0 {
+			return nil
+		}
+		// an endpoint without pagination that happens to have exactly a page of keys sends them all again
+		if after != "" && keys[0] == first {
+			return nil
+		}
+		if first == "" {
+			first = keys[0]
+		}
+		if err := fn(secret, keys); err != nil {
+			return err
+		}
+		if len(keys) != listPageSize {
+			return nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
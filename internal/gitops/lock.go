@@ -0,0 +1,365 @@
+package gitops
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultLockPath is a KV v2 data path, written with check-and-set so only one writer can take it.
+const DefaultLockPath = "secret/data/hvresult/apply-lock"
+
+// How long a lock is honored if whoever took it never releases it, e.g. because they were killed.
+const DefaultLockTTL = time.Hour
+
+// How often AcquireLock checks a lock it's waiting for.
+const lockPollInterval = 5 * time.Second
+
+// How many times a held lock is renewed per TTL, so a slow renewal or two doesn't let it expire.
+const lockRenewalsPerTTL = 3
+
+// ErrLocked is what AcquireLock's error wraps when someone else has the lock.
+var ErrLocked = errors.New("another apply is running")
+
+// LockOptions change how AcquireLock behaves.
+type LockOptions struct {
+	// KV v2 data path of the lock in Vault. Empty means only the local lock is taken.
+	VaultPath string
+	// Zero means DefaultLockTTL.
+	TTL time.Duration
+	// How long to wait for someone else's lock to be released before giving up. Zero means not waiting at all.
+	Wait time.Duration
+}
+
+// ApplyLock keeps other hvresult runs from applying to the same Vault at the same time.
+type ApplyLock struct {
+	vc *vault.Client
+	// the lock's requests are timed out and retried like an apply's
+	limiter   *AdaptiveLimiter
+	vaultPath string
+	file      string
+	ttl       time.Duration
+
+	// what this process last wrote to the lock, which renewing and releasing check-and-set against so a lock that
+	// expired and was taken by someone else is left alone
+	holder  lockHolder
+	version int
+
+	stopRenewing context.CancelFunc
+	renewed      chan struct{}
+	// cancels the context AcquireLock returned
+	lost context.CancelCauseFunc
+}
+
+// what's stored in a lock, so whoever's waiting on it knows who to blame
+type lockHolder struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newLockHolder(ttl time.Duration) lockHolder {
+	hostname, _ := os.Hostname()
+	return lockHolder{
+		Holder:    fmt.Sprintf("%s (pid %d)", hostname, os.Getpid()),
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	}
+}
+
+func (h lockHolder) is(other lockHolder) bool {
+	return h.Holder == other.Holder && h.ExpiresAt.Equal(other.ExpiresAt)
+}
+
+func (h lockHolder) renewed(ttl time.Duration) lockHolder {
+	h.ExpiresAt = time.Now().Add(ttl).UTC()
+	return h
+}
+
+// AcquireLock takes a local file lock for the cluster a Vault client points at, and then a lock in Vault so runs
+// on other machines are kept out too.
+//
+// If the Vault lock's KV mount doesn't exist, only the local lock is held. Both are renewed in the background until
+// Release, so an apply that takes longer than the TTL keeps its lock. The returned context is cancelled, with a cause
+// wrapping ErrLocked, if the lock is lost anyway because someone else took it after it expired, so whatever runs
+// under it stops instead of applying alongside them. It's also cancelled by Release.
+func AcquireLock(ctx context.Context, vc *vault.Client, opts LockOptions) (context.Context, *ApplyLock, error) {
+	deadline := time.Now().Add(opts.Wait)
+	for {
+		lock, err := acquireLock(ctx, vc, opts)
+		if err == nil {
+			lockCtx, lost := context.WithCancelCause(ctx)
+			lock.lost = lost
+			go lock.renew(lock.renewCtx(ctx))
+			return lockCtx, lock, nil
+		}
+		if !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			return nil, nil, err
+		}
+		log.Info().Err(err).Time("deadline", deadline).Msg("Waiting for the apply lock")
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// A context for renewing the lock that lasts until Release, even if `ctx` ends first.
+func (l *ApplyLock) renewCtx(ctx context.Context) context.Context {
+	renewCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	l.stopRenewing = cancel
+	l.renewed = make(chan struct{})
+	return renewCtx
+}
+
+func acquireLock(ctx context.Context, vc *vault.Client, opts LockOptions) (*ApplyLock, error) {
+	if opts.TTL == 0 {
+		opts.TTL = DefaultLockTTL
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("error finding user cache directory: %w", err)
+	}
+	sum := sha256.Sum256([]byte(vc.Address()))
+	lock := &ApplyLock{
+		vc:      vc,
+		limiter: newLimiter(1, 0, 0),
+		file:    filepath.Join(cacheDir, "hvresult", "apply-"+hex.EncodeToString(sum[:8])+".lock"),
+		ttl:     opts.TTL,
+		holder:  newLockHolder(opts.TTL),
+	}
+	if err := lock.acquireFile(lock.holder); err != nil {
+		return nil, err
+	}
+	if opts.VaultPath != "" {
+		version, err := lock.acquireVault(ctx, opts.VaultPath, lock.holder)
+		if err != nil {
+			os.Remove(lock.file)
+			return nil, err
+		}
+		if version != 0 {
+			lock.vaultPath = opts.VaultPath
+			lock.version = version
+		}
+	}
+	return lock, nil
+}
+
+// Pushes the lock's expiry out every so often until ctx is cancelled, stopping and cancelling the lock's context if
+// someone else took it.
+func (l *ApplyLock) renew(ctx context.Context) {
+	defer close(l.renewed)
+	ticker := time.NewTicker(l.ttl / lockRenewalsPerTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.renewOnce(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error().Err(err).Msg("error renewing apply lock")
+			if errors.Is(err, ErrLocked) {
+				l.lost(err)
+				return
+			}
+		}
+	}
+}
+
+func (l *ApplyLock) renewOnce(ctx context.Context) error {
+	holder := l.holder.renewed(l.ttl)
+	if l.vaultPath != "" {
+		version, err := l.writeVault(ctx, l.vaultPath, l.version, holder)
+		if isCheckAndSetMismatch(err) {
+			return fmt.Errorf("%w: the Vault lock at %s expired and was taken by someone else", ErrLocked, l.vaultPath)
+		} else if err != nil {
+			return err
+		}
+		l.version = version
+	}
+	encoded, _ := json.Marshal(holder)
+	if err := os.WriteFile(l.file, encoded, 0o600); err != nil {
+		return fmt.Errorf("error renewing lock file: %w", err)
+	}
+	l.holder = holder
+	return nil
+}
+
+// Writes `holder` to the Vault lock at `vaultPath` with check-and-set on `version`, returning the new version.
+func (l *ApplyLock) writeVault(ctx context.Context, vaultPath string, version int, holder lockHolder) (int, error) {
+	var secret *vault.Secret
+	err := l.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = l.vc.Logical().WriteWithContext(ctx, vaultPath, map[string]interface{}{
+			"options": map[string]interface{}{"cas": version},
+			"data":    holder,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return writtenVersion(secret), nil
+}
+
+// The version KV v2 says a write created.
+func writtenVersion(secret *vault.Secret) int {
+	if secret == nil {
+		return 0
+	}
+	var written struct {
+		Version int `json:"version"`
+	}
+	encoded, _ := json.Marshal(secret.Data)
+	_ = json.Unmarshal(encoded, &written)
+	return written.Version
+}
+
+func (l *ApplyLock) acquireFile(holder lockHolder) error {
+	if err := os.MkdirAll(filepath.Dir(l.file), 0o700); err != nil {
+		return fmt.Errorf("error creating lock directory: %w", err)
+	}
+	encoded, _ := json.Marshal(holder)
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(l.file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			_, err = f.Write(encoded)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("error writing lock file: %w", err)
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("error creating lock file: %w", err)
+		}
+		var existing lockHolder
+		content, _ := os.ReadFile(l.file)
+		if json.Unmarshal(content, &existing) == nil && time.Now().Before(existing.ExpiresAt) {
+			return fmt.Errorf("%w: locked by %s until %s (%s)", ErrLocked, existing.Holder, existing.ExpiresAt.Format(time.RFC3339), l.file)
+		}
+		log.Warn().Str("holder", existing.Holder).Str("path", l.file).Msg("Removing expired lock file")
+		os.Remove(l.file)
+	}
+	return fmt.Errorf("error taking lock file %s", l.file)
+}
+
+// Returns the version of the lock that was written, or 0 if there's no KV mount at `vaultPath`.
+func (l *ApplyLock) acquireVault(ctx context.Context, vaultPath string, holder lockHolder) (int, error) {
+	// KV v1 would take the write without check-and-set, so two applies could both think they have the lock
+	var mount *vault.Secret
+	err := l.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		mount, err = l.vc.Logical().ReadWithContext(ctx, "sys/internal/ui/mounts/"+vaultPath)
+		return err
+	})
+	switch {
+	case isNotFound(err), isPermissionDenied(err), err == nil && mount == nil:
+		// Vault says permission denied when there's no mount, which reading the lock finds out below
+	case err != nil:
+		return 0, fmt.Errorf("error finding the Vault lock's KV version: %w", err)
+	default:
+		if options, _ := mount.Data["options"].(map[string]interface{}); options == nil || options["version"] != "2" {
+			return 0, fmt.Errorf("the Vault lock at %s has to be in a KV v2 mount, which can check-and-set, not a %v mount (use --lock-path to move it, or --lock-path '' to only lock locally)", vaultPath, mount.Data["type"])
+		}
+	}
+	// a deleted or expired lock is taken over with check-and-set on its current version
+	var (
+		version int
+		secret  *vault.Secret
+	)
+	err = l.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = l.vc.Logical().ReadWithContext(ctx, vaultPath)
+		return err
+	})
+	if isNotFound(err) {
+		log.Warn().Str("path", vaultPath).Msg("No KV mount for the Vault lock, only locking locally")
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("error reading Vault lock: %w", err)
+	}
+	if secret != nil {
+		var current struct {
+			Data     *lockHolder `json:"data"`
+			Metadata struct {
+				Version int `json:"version"`
+			} `json:"metadata"`
+		}
+		encoded, _ := json.Marshal(secret.Data)
+		_ = json.Unmarshal(encoded, &current)
+		if current.Data != nil && time.Now().Before(current.Data.ExpiresAt) {
+			return 0, fmt.Errorf("%w: locked by %s until %s (%s)", ErrLocked, current.Data.Holder, current.Data.ExpiresAt.Format(time.RFC3339), vaultPath)
+		}
+		version = current.Metadata.Version
+	}
+	written, err := l.writeVault(ctx, vaultPath, version, holder)
+	if isNotFound(err) {
+		log.Warn().Str("path", vaultPath).Msg("No KV mount for the Vault lock, only locking locally")
+		return 0, nil
+	} else if isCheckAndSetMismatch(err) {
+		// someone else got there first
+		return 0, fmt.Errorf("%w: someone else took %s first", ErrLocked, vaultPath)
+	} else if err != nil {
+		return 0, fmt.Errorf("error taking Vault lock at %s: %w", vaultPath, err)
+	}
+	if written == 0 {
+		return 0, fmt.Errorf("error taking Vault lock at %s: Vault didn't say which version was written", vaultPath)
+	}
+	return written, nil
+}
+
+// Release gives up the lock, unless it expired and someone else has it now. It's safe to call on a nil ApplyLock.
+func (l *ApplyLock) Release(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.stopRenewing()
+	<-l.renewed
+	l.lost(nil)
+	var errs []error
+	if l.vaultPath != "" {
+		// KV v2 can't delete with check-and-set, so the lock is released by writing it as already expired
+		_, err := l.writeVault(ctx, l.vaultPath, l.version, lockHolder{Holder: l.holder.Holder})
+		if isCheckAndSetMismatch(err) {
+			log.Warn().Str("path", l.vaultPath).Msg("The Vault lock expired and was taken by someone else, leaving it")
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("error releasing Vault lock: %w", err))
+		}
+		l.vaultPath = ""
+	}
+	var current lockHolder
+	content, err := os.ReadFile(l.file)
+	if err == nil && json.Unmarshal(content, &current) == nil && !current.is(l.holder) {
+		log.Warn().Str("holder", current.Holder).Str("path", l.file).Msg("The lock file expired and was taken by someone else, leaving it")
+	} else if err := os.Remove(l.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("error removing lock file: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// KV v2 rejects writes whose cas isn't the current version with a 400.
+func isCheckAndSetMismatch(err error) bool {
+	var respErr *vault.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusBadRequest
+}
+
+func isNotFound(err error) bool {
+	var respErr *vault.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,177 @@
+package gitops_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestApplyLock(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	opts := gitops.LockOptions{VaultPath: gitops.DefaultLockPath}
+	_, lock, err := gitops.AcquireLock(ctx, vc, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := gitops.AcquireLock(ctx, vc, opts); err == nil || !strings.Contains(err.Error(), "another apply is running") {
+		t.Fatalf("expected a second lock to fail, got: %v", err)
+	}
+	// another machine doesn't have the local lock, but still can't take the one in Vault
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	if _, _, err := gitops.AcquireLock(ctx, vc, opts); err == nil || !strings.Contains(err.Error(), opts.VaultPath) {
+		t.Fatalf("expected the Vault lock to stop a second lock, got: %v", err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, lock, err = gitops.AcquireLock(ctx, vc, opts)
+	if err != nil {
+		t.Fatalf("expected to lock again after releasing: %v", err)
+	}
+	_ = lock.Release(ctx)
+}
+
+func TestApplyLockWait(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	_, lock, err := gitops.AcquireLock(ctx, vc, gitops.LockOptions{VaultPath: gitops.DefaultLockPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(time.Second)
+		_ = lock.Release(ctx)
+	}()
+	_, waiter, err := gitops.AcquireLock(ctx, vc, gitops.LockOptions{VaultPath: gitops.DefaultLockPath, Wait: time.Minute})
+	if err != nil {
+		t.Fatalf("expected to get the lock once it was released: %v", err)
+	}
+	defer waiter.Release(ctx)
+
+	_, _, err = gitops.AcquireLock(ctx, vc, gitops.LockOptions{VaultPath: gitops.DefaultLockPath, Wait: time.Second})
+	if !errors.Is(err, gitops.ErrLocked) {
+		t.Fatalf("expected to give up waiting with ErrLocked, got: %v", err)
+	}
+}
+
+func TestApplyLockKVv1(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	if err := vc.Sys().MountWithContext(ctx, "kv1", &vault.MountInput{Type: "kv", Options: map[string]string{"version": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// KV v1 can't check-and-set, so it can't keep two applies out
+	_, _, err := gitops.AcquireLock(ctx, vc, gitops.LockOptions{VaultPath: "kv1/hvresult/apply-lock"})
+	if err == nil || !strings.Contains(err.Error(), "KV v2") {
+		t.Fatalf("expected a lock in KV v1 to be refused, got: %v", err)
+	}
+	// and the local lock isn't left behind
+	_, lock, err := gitops.AcquireLock(ctx, vc, gitops.LockOptions{})
+	if err != nil {
+		t.Fatalf("expected the local lock to be released: %v", err)
+	}
+	_ = lock.Release(ctx)
+}
+
+func TestApplyLockRenew(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	opts := gitops.LockOptions{VaultPath: gitops.DefaultLockPath, TTL: 3 * time.Second}
+	_, lock, err := gitops.AcquireLock(ctx, vc, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(ctx)
+	// a lock held past its TTL is renewed, so another machine still can't take it
+	time.Sleep(2 * opts.TTL)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	if _, _, err := gitops.AcquireLock(ctx, vc, opts); !errors.Is(err, gitops.ErrLocked) {
+		t.Fatalf("expected the renewed lock to keep a second lock out, got: %v", err)
+	}
+}
+
+func TestApplyLockReleaseTakenOver(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	_, lock, err := gitops.AcquireLock(ctx, vc, gitops.LockOptions{VaultPath: gitops.DefaultLockPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if the lock expired and another apply took it
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	_, err = vc.Logical().WriteWithContext(ctx, gitops.DefaultLockPath, map[string]interface{}{
+		"data": map[string]interface{}{"holder": "someone else", "expires_at": expiresAt},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := vc.Logical().ReadWithContext(ctx, gitops.DefaultLockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := secret.Data["data"].(map[string]interface{}); data == nil || data["holder"] != "someone else" {
+		t.Fatalf("expected releasing to leave someone else's lock alone, got %v", secret.Data["data"])
+	}
+}
+
+func TestApplyLockTakenOverMidApply(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	lockCtx, lock, err := gitops.AcquireLock(ctx, vc, gitops.LockOptions{VaultPath: gitops.DefaultLockPath, TTL: 3 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release(ctx)
+	// someone else takes the lock while the apply is running, which the next renewal finds out
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	_, err = vc.Logical().WriteWithContext(ctx, gitops.DefaultLockPath, map[string]interface{}{
+		"data": map[string]interface{}{"holder": "someone else", "expires_at": expiresAt},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lockCtx.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected losing the lock to cancel its context")
+	}
+	if cause := context.Cause(lockCtx); !errors.Is(cause, gitops.ErrLocked) {
+		t.Fatalf("expected the context to be cancelled with ErrLocked, got %v", cause)
+	}
+
+	// so the rest of the apply doesn't write anything
+	tempDir := t.TempDir()
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "late"), []byte(`path "secret/*" { capabilities = ["read"] }`), 0o644)
+	if err := gitops.ApplyChangesWithOptions(lockCtx, vc, filepath.Join(tempDir, "auth"), policyDir, gitops.ApplyOptions{}); err == nil {
+		t.Fatal("expected applying after the lock was lost to fail")
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "late"); policy != "" {
+		t.Error("expected nothing to be written after the lock was lost")
+	}
+}
@@ -0,0 +1,121 @@
+package gitops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// ManifestFileName is the file at the top of a downloaded directory listing everything in it.
+const ManifestFileName = "manifest.json"
+
+// Manifest records every object a download wrote and the SHA-256 of its file, so the files can be checked against it
+// later and compared with another download without reading them.
+type Manifest struct {
+	mu   sync.Mutex
+	root string
+
+	Address      string             `json:"address"`
+	Namespace    string             `json:"namespace,omitempty"`
+	DownloadedAt time.Time          `json:"downloaded_at"`
+	Resources    []ManifestResource `json:"resources"`
+}
+
+// ManifestResource is an object in a Manifest.
+type ManifestResource struct {
+	// Where the object is in Vault.
+	Path string       `json:"path"`
+	Kind ResourceKind `json:"kind"`
+	// The downloaded file, relative to the directory the manifest is in.
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewManifest starts a manifest for a download of the cluster and namespace `vc` points at to `directory`.
+func NewManifest(vc *vault.Client, directory string) *Manifest {
+	return &Manifest{
+		root:         directory,
+		Address:      vc.Address(),
+		Namespace:    vc.Namespace(),
+		DownloadedAt: time.Now().UTC(),
+	}
+}
+
+// records a downloaded file. A nil Manifest ignores everything.
+func (m *Manifest) add(kind ResourceKind, vaultPath, file string, content []byte) error {
+	if m == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(m.root, file)
+	if err != nil {
+		return fmt.Errorf("error finding %s in the download directory: %w", file, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Resources = append(m.Resources, ManifestResource{
+		Path:   vaultPath,
+		Kind:   kind,
+		File:   filepath.ToSlash(rel),
+		SHA256: contentHash(string(content)),
+	})
+	return nil
+}
+
+// Write writes the manifest to ManifestFileName in the directory it was started for.
+func (m *Manifest) Write() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sort.Slice(m.Resources, func(i, j int) bool {
+		return m.Resources[i].File < m.Resources[j].File
+	})
+	content, err := marshalFile(m)
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(m.root, ManifestFileName), content, 0o644); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest a download wrote to `directory`.
+func ReadManifest(directory string) (*Manifest, error) {
+	content, err := os.ReadFile(filepath.Join(directory, ManifestFileName))
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	m := &Manifest{root: directory}
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	return m, nil
+}
+
+// Verify checks every file in the manifest against its hash, returning the ones that are missing or were changed
+// since they were downloaded.
+func (m *Manifest) Verify() ([]string, error) {
+	var changed []string
+	for _, resource := range m.Resources {
+		if err := checkNoTraversal(resource.File); err != nil {
+			return nil, err
+		}
+		content, err := os.ReadFile(filepath.Join(m.root, filepath.FromSlash(resource.File)))
+		if errors.Is(err, os.ErrNotExist) {
+			changed = append(changed, resource.File)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", resource.File, err)
+		}
+		if contentHash(string(content)) != resource.SHA256 {
+			changed = append(changed, resource.File)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,409 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/mitchellh/mapstructure"
+	"github.com/rs/zerolog/log"
+)
+
+// Login MFA methods and enforcements are kept next to entities and groups, in <identity>/mfa/method/<name> and
+// <identity>/mfa/login-enforcement/<name>.
+//
+// Vault only knows methods by a generated ID, so they're named by their method_name instead, and planned changes to
+// them use the made up path identity/mfa/method/name/<name>. Methods without a method_name can't be managed.
+
+const (
+	mfaMethodListPath      = "identity/mfa/method"
+	mfaMethodNamePath      = "identity/mfa/method/name"
+	mfaEnforcementListPath = "identity/mfa/login-enforcement"
+)
+
+// MFALoginEnforcement is the local file format of a login enforcement. Everything is referred to by name.
+type MFALoginEnforcement struct {
+	MFAMethods []string `json:"mfa_methods"`
+	// Auth mount paths without the trailing slash, e.g. userpass or oidc.
+	AuthMounts       []string `json:"auth_mounts,omitempty"`
+	AuthMethodTypes  []string `json:"auth_method_types,omitempty"`
+	IdentityGroups   []string `json:"identity_groups,omitempty"`
+	IdentityEntities []string `json:"identity_entities,omitempty"`
+}
+
+type vaultMFALoginEnforcement struct {
+	MFAMethodIDs        []string `mapstructure:"mfa_method_ids"`
+	AuthMethodAccessors []string `mapstructure:"auth_method_accessors"`
+	AuthMethodTypes     []string `mapstructure:"auth_method_types"`
+	IdentityGroupIDs    []string `mapstructure:"identity_group_ids"`
+	IdentityEntityIDs   []string `mapstructure:"identity_entity_ids"`
+}
+
+type mfaMethod struct {
+	ID   string
+	Type string
+}
+
+// Fields of a method Vault fills in itself, which aren't kept in files.
+var mfaMethodMetadataFields = []string{"id", "type", "name", "method_name", "mount_accessor", "namespace_id", "namespace_path"}
+
+// Every named MFA method by name.
+func (a *applier) mfaMethods(ctx context.Context) (map[string]mfaMethod, error) {
+	var secret *vault.Secret
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = a.vc.Logical().ListWithContext(ctx, mfaMethodListPath)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing MFA methods from Vault: %w", err)
+	}
+	methods := map[string]mfaMethod{}
+	if secret == nil || secret.Data == nil {
+		return methods, nil
+	}
+	var listData struct {
+		KeyInfo map[string]struct {
+			Type       string `mapstructure:"type"`
+			MethodName string `mapstructure:"method_name"`
+		} `mapstructure:"key_info"`
+	}
+	if err := mapstructure.Decode(secret.Data, &listData); err != nil {
+		return nil, fmt.Errorf("error decoding MFA method list: %w", err)
+	}
+	for id, info := range listData.KeyInfo {
+		if info.MethodName == "" {
+			log.Debug().Str("id", id).Msg("MFA method has no name, ignoring it")
+			continue
+		}
+		methods[info.MethodName] = mfaMethod{ID: id, Type: info.Type}
+	}
+	return methods, nil
+}
+
+func (a *applier) mfaMethodNames(ctx context.Context) ([]string, error) {
+	methods, err := a.mfaMethods(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Plans every MFA method and login enforcement, like planIdentity.
+func (a *applier) planMFA(ctx context.Context, identityDirectory string) ([]PlannedChange, int, error) {
+	var (
+		changes  []PlannedChange
+		existing int
+	)
+	for _, kind := range []ResourceKind{MFAMethodResource, MFALoginEnforcementResource} {
+		listPath := mfaEnforcementListPath
+		if kind == MFAMethodResource {
+			listPath = mfaMethodNamePath
+		}
+		names, err := a.listObjects(ctx, kind, listPath)
+		if err != nil {
+			if a.opts.SkipForbidden && isPermissionDenied(err) {
+				a.opts.Report.Skip(listPath, "list", err)
+				continue
+			}
+			return nil, 0, fmt.Errorf("error listing %s from Vault: %w", listPath, err)
+		}
+		existing += len(names)
+		remote := make(map[string]bool, len(names))
+		for _, name := range names {
+			remote[name] = true
+		}
+
+		local, err := localDataFiles(filepath.Join(identityDirectory, mfaDirectory(kind)))
+		if err != nil {
+			return nil, 0, err
+		}
+		for name, file := range local {
+			mutation := Add
+			if remote[name] {
+				mutation = Change
+			}
+			changes = append(changes, PlannedChange{Mutation: mutation, Kind: kind, Path: listPath + "/" + name, File: file})
+		}
+		for _, name := range names {
+			if _, ok := local[name]; !ok {
+				changes = append(changes, PlannedChange{Mutation: Delete, Kind: kind, Path: listPath + "/" + name})
+			}
+		}
+	}
+	return changes, existing, nil
+}
+
+// The directory in the identity directory with files of `kind`.
+func mfaDirectory(kind ResourceKind) string {
+	if kind == MFAMethodResource {
+		return filepath.Join("mfa", "method")
+	}
+	return filepath.Join("mfa", "login-enforcement")
+}
+
+// An MFA method or login enforcement in Vault in the local file format, or nil if it doesn't exist.
+func (a *applier) readRemoteMFA(ctx context.Context, change PlannedChange) ([]byte, error) {
+	if change.Kind == MFAMethodResource {
+		methods, err := a.mfaMethods(ctx)
+		if err != nil {
+			return nil, err
+		}
+		method, ok := methods[change.Name()]
+		if !ok {
+			return nil, nil
+		}
+		secret, err := a.readIdentity(ctx, mfaMethodListPath+"/"+method.Type+"/"+method.ID)
+		if err != nil || secret == nil {
+			return nil, err
+		}
+		for _, field := range mfaMethodMetadataFields {
+			delete(secret.Data, field)
+		}
+		data := nonDefaultFields(secret.Data)
+		data["type"] = method.Type
+		return json.MarshalIndent(data, "", "  ")
+	}
+
+	secret, err := a.readIdentity(ctx, change.Path)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	var remote vaultMFALoginEnforcement
+	if err := mapstructure.Decode(secret.Data, &remote); err != nil {
+		return nil, fmt.Errorf("error converting %s: %w", change.Path, err)
+	}
+	enforcement := MFALoginEnforcement{AuthMethodTypes: remote.AuthMethodTypes}
+	if len(remote.MFAMethodIDs) > 0 {
+		methods, err := a.mfaMethods(ctx)
+		if err != nil {
+			return nil, err
+		}
+		names := make(map[string]string, len(methods))
+		for name, method := range methods {
+			names[method.ID] = name
+		}
+		for _, id := range remote.MFAMethodIDs {
+			name, ok := names[id]
+			if !ok {
+				return nil, fmt.Errorf("error converting %s: MFA method %s has no name", change.Path, id)
+			}
+			enforcement.MFAMethods = append(enforcement.MFAMethods, name)
+		}
+	}
+	for _, accessor := range remote.AuthMethodAccessors {
+		mount, err := a.mountPath(ctx, accessor)
+		if err != nil {
+			return nil, fmt.Errorf("error converting %s: %w", change.Path, err)
+		}
+		enforcement.AuthMounts = append(enforcement.AuthMounts, mount)
+	}
+	for _, id := range remote.IdentityGroupIDs {
+		name, err := a.identityName(ctx, IdentityGroupResource, id)
+		if err != nil {
+			return nil, fmt.Errorf("error converting %s: %w", change.Path, err)
+		}
+		enforcement.IdentityGroups = append(enforcement.IdentityGroups, name)
+	}
+	for _, id := range remote.IdentityEntityIDs {
+		name, err := a.identityName(ctx, IdentityEntityResource, id)
+		if err != nil {
+			return nil, fmt.Errorf("error converting %s: %w", change.Path, err)
+		}
+		enforcement.IdentityEntities = append(enforcement.IdentityEntities, name)
+	}
+	for _, list := range [][]string{enforcement.MFAMethods, enforcement.AuthMounts, enforcement.AuthMethodTypes, enforcement.IdentityGroups, enforcement.IdentityEntities} {
+		sort.Strings(list)
+	}
+	return json.MarshalIndent(enforcement, "", "  ")
+}
+
+func readMFALoginEnforcementFile(path string) (*MFALoginEnforcement, error) {
+	content, err := readDataFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading local MFA login enforcement file %s: %w", path, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	var enforcement MFALoginEnforcement
+	if err := decoder.Decode(&enforcement); err != nil {
+		return nil, fmt.Errorf("error decoding local MFA login enforcement file %s: %w", path, err)
+	}
+	return &enforcement, nil
+}
+
+// Checks an MFA method or login enforcement file is well formed.
+func validateMFA(change PlannedChange) error {
+	if change.Kind == MFAMethodResource {
+		data, err := readRoleFile(change.File)
+		if err != nil {
+			return err
+		}
+		switch data["type"] {
+		case "totp", "duo", "okta", "pingid":
+			return nil
+		case nil:
+			return errors.New("MFA methods need a type")
+		default:
+			return fmt.Errorf("MFA method type must be totp, duo, okta, or pingid, not %v", data["type"])
+		}
+	}
+	enforcement, err := readMFALoginEnforcementFile(change.File)
+	if err != nil {
+		return err
+	}
+	if len(enforcement.MFAMethods) == 0 {
+		return errors.New("MFA login enforcements need at least one MFA method")
+	}
+	if len(enforcement.AuthMounts)+len(enforcement.AuthMethodTypes)+len(enforcement.IdentityGroups)+len(enforcement.IdentityEntities) == 0 {
+		return errors.New("MFA login enforcements need at least one auth mount, auth method type, group, or entity")
+	}
+	return nil
+}
+
+// Writes an MFA method or login enforcement, skipping the write with SkipUnchanged if it'd be the same.
+func (a *applier) writeMFA(ctx context.Context, change PlannedChange) error {
+	if a.opts.SkipUnchanged && change.Mutation == Change {
+		same, err := a.unchanged(ctx, change)
+		if err != nil {
+			return err
+		}
+		if same {
+			log.Debug().Str("path", change.Path).Msgf("%s unchanged, skipping write", change.Kind)
+			return errUnchanged
+		}
+	}
+	log.Debug().Str("path", change.Path).Msgf("Writing %s to Vault", change.Kind)
+	var err error
+	if change.Kind == MFAMethodResource {
+		err = a.writeMFAMethod(ctx, change)
+	} else {
+		err = a.writeMFALoginEnforcement(ctx, change)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s %s to Vault: %w", change.Kind, change.Name(), err)
+	}
+	return nil
+}
+
+func (a *applier) writeMFAMethod(ctx context.Context, change PlannedChange) error {
+	data, err := readRoleFile(change.File)
+	if err != nil {
+		return err
+	}
+	methodType, _ := data["type"].(string)
+	delete(data, "type")
+	data = withoutRedacted(data)
+	data["method_name"] = change.Name()
+
+	methods, err := a.mfaMethods(ctx)
+	if err != nil {
+		return err
+	}
+	writePath := mfaMethodListPath + "/" + methodType
+	if method, ok := methods[change.Name()]; ok {
+		if method.Type != methodType {
+			return fmt.Errorf("it's a %s method in Vault and can't become a %s method without being deleted first", method.Type, methodType)
+		}
+		writePath += "/" + method.ID
+	}
+	return a.write(ctx, writePath, data)
+}
+
+func (a *applier) writeMFALoginEnforcement(ctx context.Context, change PlannedChange) error {
+	enforcement, err := readMFALoginEnforcementFile(change.File)
+	if err != nil {
+		return err
+	}
+	methods, err := a.mfaMethods(ctx)
+	if err != nil {
+		return err
+	}
+	methodIDs := make([]string, 0, len(enforcement.MFAMethods))
+	for _, name := range enforcement.MFAMethods {
+		method, ok := methods[name]
+		if !ok {
+			return fmt.Errorf("MFA method %s doesn't exist", name)
+		}
+		methodIDs = append(methodIDs, method.ID)
+	}
+	mounts, err := a.authMounts(ctx)
+	if err != nil {
+		return err
+	}
+	accessors := make([]string, 0, len(enforcement.AuthMounts))
+	for _, mountName := range enforcement.AuthMounts {
+		mount := mounts[strings.Trim(mountName, "/")+"/"]
+		if mount == nil {
+			return fmt.Errorf("auth mount %s doesn't exist", mountName)
+		}
+		accessors = append(accessors, mount.Accessor)
+	}
+	groupIDs := make([]string, 0, len(enforcement.IdentityGroups))
+	for _, name := range enforcement.IdentityGroups {
+		id, err := a.identityID(ctx, IdentityGroupResource, name)
+		if err != nil {
+			return err
+		}
+		groupIDs = append(groupIDs, id)
+	}
+	entityIDs := make([]string, 0, len(enforcement.IdentityEntities))
+	for _, name := range enforcement.IdentityEntities {
+		id, err := a.identityID(ctx, IdentityEntityResource, name)
+		if err != nil {
+			return err
+		}
+		entityIDs = append(entityIDs, id)
+	}
+	return a.write(ctx, change.Path, map[string]interface{}{
+		"mfa_method_ids":        methodIDs,
+		"auth_method_accessors": accessors,
+		"auth_method_types":     nonNil(enforcement.AuthMethodTypes),
+		"identity_group_ids":    groupIDs,
+		"identity_entity_ids":   entityIDs,
+	})
+}
+
+// Deletes an MFA method by name, which Vault refuses while an enforcement still uses it.
+func (a *applier) deleteMFAMethod(ctx context.Context, change PlannedChange) error {
+	methods, err := a.mfaMethods(ctx)
+	if err != nil {
+		return err
+	}
+	method, ok := methods[change.Name()]
+	if !ok {
+		return nil
+	}
+	log.Debug().Str("path", change.Path).Msgf("Deleting %s from Vault", change.Kind)
+	if err := a.delete(ctx, mfaMethodListPath+"/"+method.Type+"/"+method.ID); err != nil {
+		return fmt.Errorf("error deleting %s %s from Vault: %w", change.Kind, change.Name(), err)
+	}
+	a.opts.Cache.Forget(change.Path)
+	return nil
+}
+
+// Downloads every named MFA method and login enforcement to `identityDirectory`, removing files for ones that no
+// longer exist.
+func (a *applier) downloadMFA(ctx context.Context, identityDirectory string, opts DownloadOptions) error {
+	for _, kind := range []ResourceKind{MFAMethodResource, MFALoginEnforcementResource} {
+		listPath := mfaEnforcementListPath
+		if kind == MFAMethodResource {
+			listPath = mfaMethodNamePath
+		}
+		if err := a.downloadObjects(ctx, kind, listPath, filepath.Join(identityDirectory, mfaDirectory(kind)), opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
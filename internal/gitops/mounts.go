@@ -0,0 +1,500 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// The file in an auth mount's directory that describes the mount itself, e.g. auth/approle/_mount.json.
+//
+// Mounts without one are left alone unless ApplyOptions.DisableMounts is set.
+const AuthMountFileName = "_mount.json"
+
+// Secrets engines are kept in sys/mounts/<path>, in the same format as _mount.json.
+
+// MountConfig is the local file format of an auth mount or secrets engine.
+type MountConfig struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+	// Local and SealWrap can only be set when the mount is enabled, so they're ignored for existing mounts.
+	Local    bool `json:"local,omitempty"`
+	SealWrap bool `json:"seal_wrap,omitempty"`
+	// e.g. version for KV
+	Options map[string]string `json:"options,omitempty"`
+	Config  MountTune         `json:"config,omitempty"`
+}
+
+// MountTune is what can be tuned on an existing mount. Durations can be seconds or duration strings.
+type MountTune struct {
+	DefaultLeaseTTL           string   `json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL               string   `json:"max_lease_ttl,omitempty"`
+	ListingVisibility         string   `json:"listing_visibility,omitempty"`
+	TokenType                 string   `json:"token_type,omitempty"`
+	AuditNonHMACRequestKeys   []string `json:"audit_non_hmac_request_keys,omitempty"`
+	AuditNonHMACResponseKeys  []string `json:"audit_non_hmac_response_keys,omitempty"`
+	PassthroughRequestHeaders []string `json:"passthrough_request_headers,omitempty"`
+	AllowedResponseHeaders    []string `json:"allowed_response_headers,omitempty"`
+}
+
+// sys/auth/<mount> or sys/mounts/<mount> -> <mount>
+func mountName(change PlannedChange) string {
+	if change.Kind == AuthMountResource {
+		return strings.TrimPrefix(change.Path, "sys/auth/")
+	}
+	return strings.TrimPrefix(change.Path, "sys/mounts/")
+}
+
+// Secrets engines Vault mounts itself, which can't be disabled or moved.
+func isSystemMount(mount *vault.MountOutput) bool {
+	switch mount.Type {
+	case "system", "identity", "cubbyhole", "token":
+		return true
+	}
+	return strings.HasPrefix(mount.Type, "ns_")
+}
+
+// mount name -> _mount.json for every mount described in `authDirectory`, which doesn't have to exist.
+func localAuthMounts(authDirectory string) (map[string]string, error) {
+	files := map[string]string{}
+	err := walkLocal(authDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != AuthMountFileName {
+			return nil
+		}
+		rel, err := filepath.Rel(authDirectory, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = path
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error walking auth directory for mount files: %w", err)
+	}
+	return files, nil
+}
+
+// mount path -> file for every secrets engine in `mountsDirectory`, where mount paths with slashes are in
+// subdirectories.
+func localSecretsMounts(mountsDirectory string) (map[string]string, error) {
+	files := map[string]string{}
+	err := walkLocal(mountsDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(mountsDirectory, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = path
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error walking secrets engine directory: %w", err)
+	}
+	return files, nil
+}
+
+// Plans enabling and tuning every mount with a local file and, with DisableMounts, disabling the rest. `local` is
+// from localAuthMounts or localSecretsMounts and `mounts` is what Vault has, keyed with trailing slashes.
+//
+// Also returns the local mounts that aren't in Vault yet, whose roles still need planning.
+func (a *applier) planMounts(kind ResourceKind, local map[string]string, mounts map[string]*vault.MountOutput) ([]PlannedChange, map[string]*vault.MountOutput, error) {
+	prefix := "sys/auth/"
+	if kind == SecretsMountResource {
+		prefix = "sys/mounts/"
+	}
+	var (
+		changes []PlannedChange
+		missing = map[string]*vault.MountOutput{}
+	)
+	for name, file := range local {
+		mutation := Change
+		if mounts[name+"/"] == nil {
+			mutation = Add
+			config, err := readMountFile(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			// no accessor since it doesn't exist yet, see planMount
+			missing[name] = &vault.MountOutput{Type: config.Type}
+		}
+		changes = append(changes, PlannedChange{Mutation: mutation, Kind: kind, Path: prefix + name, File: file})
+	}
+	if a.opts.DisableMounts {
+		for mountName, mount := range mounts {
+			name := strings.TrimSuffix(mountName, "/")
+			if isSystemMount(mount) {
+				continue
+			}
+			if _, ok := local[name]; !ok {
+				changes = append(changes, PlannedChange{Mutation: Delete, Kind: kind, Path: prefix + name})
+			}
+		}
+	}
+	return changes, missing, nil
+}
+
+// Plans every secrets engine in `mountsDirectory`, see planMounts.
+func (a *applier) planSecretsMounts(ctx context.Context, mountsDirectory string) ([]PlannedChange, map[string]*vault.MountOutput, error) {
+	local, err := localSecretsMounts(mountsDirectory)
+	if err != nil {
+		return nil, nil, err
+	}
+	mounts, err := a.secretsMounts(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a.planMounts(SecretsMountResource, local, mounts)
+}
+
+// Secrets engines as listed the first time they're needed.
+func (a *applier) secretsMounts(ctx context.Context) (map[string]*vault.MountOutput, error) {
+	a.mountsMu.Lock()
+	defer a.mountsMu.Unlock()
+	if a.engines != nil {
+		return a.engines, nil
+	}
+	var mounts map[string]*vault.MountOutput
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		mounts, err = a.vc.Sys().ListMountsWithContext(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets engines from Vault: %w", err)
+	}
+	a.engines = mounts
+	return mounts, nil
+}
+
+// The mount a change is for as it is in Vault, or nil if it doesn't exist.
+func (a *applier) remoteMount(ctx context.Context, change PlannedChange) (*vault.MountOutput, error) {
+	var (
+		mounts map[string]*vault.MountOutput
+		err    error
+	)
+	if change.Kind == AuthMountResource {
+		mounts, err = a.authMounts(ctx)
+	} else {
+		mounts, err = a.secretsMounts(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mounts[mountName(change)+"/"], nil
+}
+
+func readMountFile(path string) (*MountConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading local mount file %s: %w", path, err)
+	}
+	var config MountConfig
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("error decoding local mount file %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// Checks a mount file is complete and doesn't try to change the type of an existing mount.
+func (a *applier) validateMount(ctx context.Context, change PlannedChange) error {
+	config, err := validateMountFile(change)
+	if err != nil {
+		return err
+	}
+	mount, err := a.remoteMount(ctx, change)
+	if err != nil || mount == nil {
+		return err
+	}
+	if mount.Type != config.Type {
+		return fmt.Errorf("%s %s is %s in Vault, and changing its type means disabling it, which deletes everything in it", change.Kind, mountName(change), mount.Type)
+	}
+	if mount.Local != config.Local || mount.SealWrap != config.SealWrap {
+		log.Warn().Str("path", change.File).Msg("local and seal_wrap can only be set when enabling a mount, ignoring them")
+	}
+	return nil
+}
+
+// The parts of validateMount that don't need Vault.
+func validateMountFile(change PlannedChange) (*MountConfig, error) {
+	config, err := readMountFile(change.File)
+	if err != nil {
+		return nil, err
+	}
+	if config.Type == "" {
+		return nil, errors.New("the mount type is empty")
+	}
+	if _, ok := rolePathPrefixesFor(config.Type); change.Kind == AuthMountResource && !ok {
+		log.Warn().Str("path", change.File).Str("mount_type", config.Type).Msg("Auth mount type is unsupported, so its roles won't be managed")
+	}
+	for _, ttl := range []string{config.Config.DefaultLeaseTTL, config.Config.MaxLeaseTTL} {
+		if _, ok := durationSeconds(ttl); !ok {
+			return nil, fmt.Errorf("%q isn't a duration", ttl)
+		}
+	}
+	switch config.Config.TokenType {
+	case "", "default-service", "default-batch", "service", "batch":
+	default:
+		return nil, fmt.Errorf("token_type must be default-service, default-batch, service, or batch, not %q", config.Config.TokenType)
+	}
+	return config, nil
+}
+
+// A mount in Vault in the local file format, or nil if it doesn't exist.
+func (a *applier) readRemoteMount(ctx context.Context, change PlannedChange) ([]byte, error) {
+	mount, err := a.remoteMount(ctx, change)
+	if err != nil || mount == nil {
+		return nil, err
+	}
+	return json.MarshalIndent(localMount(mount), "", "  ")
+}
+
+func localMount(mount *vault.MountOutput) MountConfig {
+	seconds := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	config := MountConfig{
+		Type:        mount.Type,
+		Description: mount.Description,
+		Local:       mount.Local,
+		SealWrap:    mount.SealWrap,
+		Config: MountTune{
+			DefaultLeaseTTL:           seconds(mount.Config.DefaultLeaseTTL),
+			MaxLeaseTTL:               seconds(mount.Config.MaxLeaseTTL),
+			ListingVisibility:         mount.Config.ListingVisibility,
+			TokenType:                 mount.Config.TokenType,
+			AuditNonHMACRequestKeys:   mount.Config.AuditNonHMACRequestKeys,
+			AuditNonHMACResponseKeys:  mount.Config.AuditNonHMACResponseKeys,
+			PassthroughRequestHeaders: mount.Config.PassthroughRequestHeaders,
+			AllowedResponseHeaders:    mount.Config.AllowedResponseHeaders,
+		},
+	}
+	if len(mount.Options) > 0 {
+		config.Options = mount.Options
+	}
+	return config
+}
+
+// Like RoleUnchanged, but options and tune settings are compared the same way, and local and seal_wrap are left out
+// since they can't be changed anyway.
+func mountUnchanged(local, remote map[string]interface{}) bool {
+	top := make(map[string]interface{}, len(local))
+	for key, value := range local {
+		switch key {
+		case "local", "seal_wrap":
+		case "config", "options":
+			localNested, _ := value.(map[string]interface{})
+			remoteNested, _ := remote[key].(map[string]interface{})
+			if remoteNested == nil {
+				remoteNested = map[string]interface{}{}
+			}
+			if !RoleUnchanged(localNested, remoteNested) {
+				return false
+			}
+		default:
+			top[key] = value
+		}
+	}
+	return RoleUnchanged(top, remote)
+}
+
+// Enables a mount if it doesn't exist yet and tunes it otherwise, skipping the tune with SkipUnchanged if it'd be the
+// same.
+func (a *applier) writeMount(ctx context.Context, change PlannedChange) error {
+	config, err := readMountFile(change.File)
+	if err != nil {
+		return err
+	}
+	name := mountName(change)
+	// restores only know the mount existed when they were backed up
+	mount, err := a.remoteMount(ctx, change)
+	if err != nil {
+		return err
+	}
+	if mount == nil {
+		log.Info().Str("mount", name).Str("type", config.Type).Msgf("Enabling %s", change.Kind)
+		input := &vault.MountInput{
+			Type:        config.Type,
+			Description: config.Description,
+			Local:       config.Local,
+			SealWrap:    config.SealWrap,
+			Options:     config.Options,
+			Config:      config.tuneInput(),
+		}
+		err := a.limiter.Do(ctx, func(ctx context.Context) error {
+			if change.Kind == AuthMountResource {
+				return a.vc.Sys().EnableAuthWithOptionsWithContext(ctx, name, input)
+			}
+			return a.vc.Sys().MountWithContext(ctx, name, input)
+		})
+		if err != nil {
+			return fmt.Errorf("error enabling %s %s: %w", change.Kind, name, err)
+		}
+		a.forgetMounts()
+		return nil
+	}
+	if a.opts.SkipUnchanged {
+		same, err := a.unchanged(ctx, change)
+		if err != nil {
+			return err
+		}
+		if same {
+			log.Debug().Str("mount", name).Msgf("%s unchanged, skipping tune", change.Kind)
+			return errUnchanged
+		}
+	}
+	tunePath := name
+	if change.Kind == AuthMountResource {
+		tunePath = path.Join("auth", name)
+	}
+	log.Debug().Str("mount", name).Msgf("Tuning %s", change.Kind)
+	err = a.limiter.Do(ctx, func(ctx context.Context) error {
+		return a.vc.Sys().TuneMountWithContext(ctx, tunePath, config.tuneInput())
+	})
+	if err != nil {
+		return fmt.Errorf("error tuning %s %s: %w", change.Kind, name, err)
+	}
+	a.forgetMounts()
+	return nil
+}
+
+// Empty settings are left as they are.
+func (c MountConfig) tuneInput() vault.MountConfigInput {
+	input := vault.MountConfigInput{
+		Options:                   c.Options,
+		DefaultLeaseTTL:           c.Config.DefaultLeaseTTL,
+		MaxLeaseTTL:               c.Config.MaxLeaseTTL,
+		ListingVisibility:         c.Config.ListingVisibility,
+		TokenType:                 c.Config.TokenType,
+		AuditNonHMACRequestKeys:   c.Config.AuditNonHMACRequestKeys,
+		AuditNonHMACResponseKeys:  c.Config.AuditNonHMACResponseKeys,
+		PassthroughRequestHeaders: c.Config.PassthroughRequestHeaders,
+		AllowedResponseHeaders:    c.Config.AllowedResponseHeaders,
+	}
+	if c.Description != "" {
+		input.Description = &c.Description
+	}
+	return input
+}
+
+// Disables a mount, which deletes everything in it.
+func (a *applier) disableMount(ctx context.Context, change PlannedChange) error {
+	name := mountName(change)
+	log.Info().Str("mount", name).Msgf("Disabling %s", change.Kind)
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		if change.Kind == AuthMountResource {
+			return a.vc.Sys().DisableAuthWithContext(ctx, name)
+		}
+		return a.vc.Sys().UnmountWithContext(ctx, name)
+	})
+	if err != nil {
+		return fmt.Errorf("error disabling %s %s: %w", change.Kind, name, err)
+	}
+	a.forgetMounts()
+	return nil
+}
+
+// Makes the next authMounts and secretsMounts calls list them again, e.g. so aliases can find the accessor of a mount
+// that was just enabled.
+func (a *applier) forgetMounts() {
+	a.mountsMu.Lock()
+	defer a.mountsMu.Unlock()
+	a.mounts = nil
+	a.engines = nil
+}
+
+// Writes the _mount.json of every mount in `mounts` to its directory in `authDirectory`.
+func downloadAuthMounts(authDirectory string, mounts map[string]*vault.AuthMount, opts DownloadOptions) error {
+	for mountName, mount := range mounts {
+		name := strings.TrimSuffix(mountName, "/")
+		if err := checkNoTraversal(name); err != nil {
+			return err
+		}
+		if err := writeMountFile(filepath.Join(authDirectory, filepath.FromSlash(name), AuthMountFileName), AuthMountResource, "sys/auth/"+name, mount, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMountFile(file string, kind ResourceKind, vaultPath string, mount *vault.MountOutput, opts DownloadOptions) error {
+	if err := opts.mkdir(filepath.Dir(file)); err != nil {
+		return fmt.Errorf("error creating mount directory: %w", err)
+	}
+	content, err := marshalFile(localMount(mount))
+	if err != nil {
+		return err
+	}
+	return opts.writeFile(file, kind, vaultPath, content)
+}
+
+// DownloadSecretsMounts downloads every secrets engine other than the ones Vault mounts itself to `mountsDirectory`,
+// which is usually sys/mounts.
+func DownloadSecretsMounts(ctx context.Context, vc *vault.Client, mountsDirectory string) error {
+	return DownloadSecretsMountsWithOptions(ctx, vc, mountsDirectory, DownloadOptions{})
+}
+
+// DownloadSecretsMountsWithOptions is DownloadSecretsMounts with options. Files for secrets engines that no longer
+// exist are removed.
+func DownloadSecretsMountsWithOptions(ctx context.Context, vc *vault.Client, mountsDirectory string, opts DownloadOptions) error {
+	mounts, err := opts.applier(vc).secretsMounts(ctx)
+	if err != nil {
+		if opts.SkipForbidden && isPermissionDenied(err) {
+			opts.Report.Skip("sys/mounts", "read", err)
+			return nil
+		}
+		return err
+	}
+	if err := opts.mkdir(mountsDirectory); err != nil {
+		return err
+	}
+	downloaded := map[string]bool{}
+	for mountName, mount := range mounts {
+		if isSystemMount(mount) || !opts.includesMount(mountName) {
+			continue
+		}
+		name := strings.TrimSuffix(mountName, "/")
+		if err := checkNoTraversal(name); err != nil {
+			return err
+		}
+		if err := writeMountFile(filepath.Join(mountsDirectory, filepath.FromSlash(name)), SecretsMountResource, "sys/mounts/"+name, mount, opts); err != nil {
+			return err
+		}
+		downloaded[name] = true
+	}
+	log.Info().Int("count", len(downloaded)).Msg("downloaded all secrets engines")
+
+	// delete anything extraenous
+	local, err := localSecretsMounts(mountsDirectory)
+	if err != nil {
+		return err
+	}
+	for name, file := range local {
+		if !downloaded[name] && opts.includesMount(name) {
+			if err := opts.removeFile(file, SecretsMountResource, "sys/mounts/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
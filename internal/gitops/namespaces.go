@@ -0,0 +1,196 @@
+package gitops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/mitchellh/mapstructure"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// How many namespaces are processed at once.
+//
+// This is independent of DefaultConcurrency, which applies within each namespace.
+const DefaultNamespaceConcurrency = 4
+
+// ForEachNamespace calls fn for each namespace concurrently, at most `limit` at a time.
+//
+// Each call gets a copy of `vc` pointed at its namespace that shares the same connection pool.
+func ForEachNamespace(
+	ctx context.Context,
+	vc *vault.Client,
+	namespaces []string,
+	limit int,
+	fn func(ctx context.Context, nsClient *vault.Client, namespace string) error,
+) error {
+	if limit < 1 {
+		limit = DefaultNamespaceConcurrency
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(limit)
+	for _, namespace := range namespaces {
+		namespace := namespace
+		eg.Go(func() error {
+			log.Debug().Str("namespace", namespace).Msg("processing namespace")
+			if err := fn(egCtx, vc.WithNamespace(namespace), namespace); err != nil {
+				return fmt.Errorf("namespace '%s': %w", namespace, err)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// NamespaceDirectory is where the files for `namespace`, relative to the namespace `directory` is for, go. Each level
+// is under a namespaces directory so a namespace can't collide with anything else, e.g. team-a/dev is in
+// namespaces/team-a/namespaces/dev.
+func NamespaceDirectory(directory, namespace string) string {
+	for _, name := range strings.Split(strings.Trim(namespace, "/"), "/") {
+		if name != "" {
+			directory = filepath.Join(directory, "namespaces", name)
+		}
+	}
+	return directory
+}
+
+// ListNamespaces lists every namespace under the one `vc` points at, however deep, relative to it, e.g. team-a and
+// team-a/dev.
+func ListNamespaces(ctx context.Context, vc *vault.Client) ([]string, error) {
+	var (
+		namespaces []string
+		parents    = []string{""}
+		base       = vc.Namespace()
+		limiter    = newLimiter(1, 0, 0)
+	)
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+		var secret *vault.Secret
+		err := limiter.Do(ctx, func(ctx context.Context) error {
+			var err error
+			secret, err = vc.WithNamespace(path.Join(base, parent)).Logical().ListWithContext(ctx, "sys/namespaces")
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing namespaces in '%s': %w", path.Join(base, parent), err)
+		}
+		if secret == nil || secret.Data == nil {
+			continue
+		}
+		var listData authListData
+		if err := mapstructure.Decode(secret.Data, &listData); err != nil {
+			return nil, fmt.Errorf("error decoding namespace list: %w", err)
+		}
+		for _, key := range listData.Keys {
+			namespace := path.Join(parent, strings.TrimSuffix(key, "/"))
+			if err := checkSafeName(path.Base(namespace)); err != nil {
+				return nil, err
+			}
+			namespaces = append(namespaces, namespace)
+			parents = append(parents, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// MissingNamespaces returns the ones in `namespaces`, relative to the namespace `vc` points at, that don't exist in
+// Vault yet, parents first.
+func MissingNamespaces(ctx context.Context, vc *vault.Client, namespaces []string) ([]string, error) {
+	remote, err := ListNamespaces(ctx, vc)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool, len(remote))
+	for _, namespace := range remote {
+		exists[namespace] = true
+	}
+	var missing []string
+	for _, namespace := range namespaces {
+		if namespace = strings.Trim(namespace, "/"); namespace != "" && !exists[namespace] {
+			missing = append(missing, namespace)
+		}
+	}
+	// a parent sorts before its children
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// CreateNamespaces creates the namespaces in `namespaces` that don't exist in Vault yet, relative to the namespace `vc`
+// points at, parents first. Returns the ones it created.
+func CreateNamespaces(ctx context.Context, vc *vault.Client, namespaces []string) ([]string, error) {
+	missing, err := MissingNamespaces(ctx, vc, namespaces)
+	if err != nil {
+		return nil, err
+	}
+	limiter := newLimiter(1, 0, 0)
+	for _, namespace := range missing {
+		parent, name := path.Split(namespace)
+		if err := checkSafeName(name); err != nil {
+			return nil, err
+		}
+		log.Info().Str("namespace", path.Join(vc.Namespace(), namespace)).Msg("Creating namespace")
+		err := limiter.Do(ctx, func(ctx context.Context) error {
+			_, err := vc.WithNamespace(path.Join(vc.Namespace(), parent)).Logical().WriteWithContext(ctx, "sys/namespaces/"+name, nil)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating namespace '%s': %w", path.Join(vc.Namespace(), namespace), err)
+		}
+	}
+	return missing, nil
+}
+
+// LocalNamespaces finds every namespace with a directory under `directory`, laid out like NamespaceDirectory.
+func LocalNamespaces(directory string) ([]string, error) {
+	var namespaces []string
+	entries, err := os.ReadDir(filepath.Join(directory, "namespaces"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading namespaces directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		namespaces = append(namespaces, entry.Name())
+		children, err := LocalNamespaces(filepath.Join(directory, "namespaces", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			namespaces = append(namespaces, entry.Name()+"/"+child)
+		}
+	}
+	return namespaces, nil
+}
+
+// NamespaceChanges picks out the files changed in `namespace` from the files changed in a repository laid out like
+// NamespaceDirectory, with paths relative to the namespace's directory.
+func NamespaceChanges(changes []ChangedFile, namespace string) []ChangedFile {
+	prefix := filepath.ToSlash(NamespaceDirectory("", namespace))
+	if prefix != "" {
+		prefix += "/"
+	}
+	var picked []ChangedFile
+	for _, change := range changes {
+		rel, ok := strings.CutPrefix(filepath.ToSlash(change.Path), prefix)
+		// anything in a child namespace belongs to that namespace
+		if !ok || strings.HasPrefix(rel, "namespaces/") {
+			continue
+		}
+		picked = append(picked, classifyChangedFile(ChangedFile{Path: rel, Mutation: change.Mutation}))
+	}
+	return picked
+}
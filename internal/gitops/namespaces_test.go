@@ -0,0 +1,49 @@
+package gitops_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestNamespaceDirectories(t *testing.T) {
+	directory := t.TempDir()
+	for _, namespace := range []string{"team-a", "team-a/dev", "team-b"} {
+		_ = os.MkdirAll(filepath.Join(gitops.NamespaceDirectory(directory, namespace), "auth"), 0o755)
+	}
+	if got, want := gitops.NamespaceDirectory(directory, "team-a/dev"), filepath.Join(directory, "namespaces", "team-a", "namespaces", "dev"); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if got := gitops.NamespaceDirectory(directory, ""); got != directory {
+		t.Errorf("expected the root namespace to be in %s, got %s", directory, got)
+	}
+	namespaces, err := gitops.LocalNamespaces(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"team-a", "team-a/dev", "team-b"}, namespaces); diff != "" {
+		t.Errorf("unexpected local namespaces (-want +got):\n%s", diff)
+	}
+
+	changes := []gitops.ChangedFile{
+		{Path: "sys/policies/acl/root-policy", Mutation: gitops.Add},
+		{Path: "sys/policies/acl/team-b/nested-policy", Mutation: gitops.Add},
+		{Path: "namespaces/team-a/auth/approle/role/ci", Mutation: gitops.Change},
+		{Path: "namespaces/team-a/namespaces/dev/sys/policies/acl/dev-policy", Mutation: gitops.Delete},
+	}
+	for namespace, want := range map[string][]gitops.ChangedFile{
+		"": {
+			{Path: "sys/policies/acl/root-policy", Mutation: gitops.Add, Policy: true},
+			{Path: "sys/policies/acl/team-b/nested-policy", Mutation: gitops.Add, Policy: true},
+		},
+		"team-a":     {{Path: "auth/approle/role/ci", Mutation: gitops.Change, Principal: true}},
+		"team-a/dev": {{Path: "sys/policies/acl/dev-policy", Mutation: gitops.Delete, Policy: true}},
+	} {
+		if diff := cmp.Diff(want, gitops.NamespaceChanges(changes, namespace)); diff != "" {
+			t.Errorf("unexpected changes in namespace %q (-want +got):\n%s", namespace, diff)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package gitops
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RoleUnchanged reports whether writing `local` would leave `remote` as-is.
+//
+// Only fields set locally are compared since Vault fills in defaults for everything else, and values are normalized
+// first so equivalent spellings (e.g. "1h" and 3600, or lists in a different order) don't look like drift. Defaults
+// like zero, false, and token_type "default" match a field that's missing or empty on the other side.
+func RoleUnchanged(local, remote map[string]interface{}) bool {
+	for key, localValue := range local {
+		var (
+			localNormal        = normalizeField(key, localValue)
+			remoteValue, found = remote[key]
+		)
+		if !found {
+			// setting something to its zero value doesn't change anything
+			if isServerDefault(key, localNormal) {
+				continue
+			}
+			return false
+		}
+		remoteNormal := normalizeField(key, remoteValue)
+		if isServerDefault(key, localNormal) && isServerDefault(key, remoteNormal) {
+			continue
+		}
+		// Vault sometimes returns comma-separated strings for list fields, and accepts them too
+		if _, ok := localNormal.([]interface{}); ok {
+			remoteNormal = normalizeField(key, splitList(remoteNormal))
+		} else if _, ok := remoteNormal.([]interface{}); ok {
+			localNormal = normalizeField(key, splitList(localNormal))
+		}
+		if !reflect.DeepEqual(localNormal, remoteNormal) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a normalized field is what Vault fills in when it isn't set, so a local file can spell it out or leave it
+// out without it looking like drift.
+func isServerDefault(key string, value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return key == "token_type" && v == "default"
+	}
+	return false
+}
+
+// PolicyUnchanged reports whether writing the policy `local` would leave `remote` as-is.
+//
+// Vault keeps policies exactly as written, so anything but the same bytes is a change, or reformatting a hand-written
+// policy would never make it to Vault and the next download would undo it. `gitops fmt` normalizes formatting instead.
+func PolicyUnchanged(local, remote string) bool {
+	return local == remote
+}
+
+// Returns a comparable form of a role field, or nil for anything equivalent to not setting it.
+func normalizeField(key string, value interface{}) interface{} {
+	value = normalizeNumbers(value)
+	if isDurationField(key) {
+		if seconds, ok := durationSeconds(value); ok {
+			if seconds == 0 {
+				return nil
+			}
+			return seconds
+		}
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			return nil
+		}
+		normal := make([]interface{}, len(v))
+		for i := range v {
+			normal[i] = normalizeField("", v[i])
+		}
+		// order doesn't matter in any list a role has
+		sort.SliceStable(normal, func(i, j int) bool {
+			return fmt.Sprint(normal[i]) < fmt.Sprint(normal[j])
+		})
+		return normal
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return nil
+		}
+		normal := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			normal[k] = normalizeField(k, item)
+		}
+		return normal
+	}
+	return value
+}
+
+// Round-trips through JSON so float64 (local) and json.Number (remote) come out the same.
+func normalizeNumbers(value interface{}) interface{} {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return value
+	}
+	return decoded
+}
+
+// Vault accepts durations as seconds or duration strings, but always returns seconds.
+func isDurationField(key string) bool {
+	return strings.HasSuffix(key, "ttl") || strings.HasSuffix(key, "period") || strings.HasSuffix(key, "_leeway")
+}
+
+func durationSeconds(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case nil:
+		return 0, true
+	case float64:
+		return v, true
+	case string:
+		if v == "" {
+			return 0, true
+		}
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+			return seconds, true
+		}
+		// Go doesn't know about days, but Vault does
+		if days, ok := strings.CutSuffix(v, "d"); ok {
+			if n, err := strconv.ParseFloat(days, 64); err == nil {
+				return n * 24 * 60 * 60, true
+			}
+		}
+		if d, err := time.ParseDuration(v); err == nil {
+			return d.Seconds(), true
+		}
+	}
+	return 0, false
+}
+
+// turns a comma-separated string into a list
+func splitList(value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+	parts := strings.Split(s, ",")
+	list := make([]interface{}, 0, len(parts))
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			list = append(list, part)
+		}
+	}
+	return list
+}
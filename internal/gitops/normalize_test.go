@@ -0,0 +1,79 @@
+package gitops_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestRoleUnchanged(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		local, remote string
+		unchanged     bool
+	}{
+		{"same", `{"token_policies": ["a"]}`, `{"token_policies": ["a"], "token_ttl": 0}`, true},
+		{"duration string", `{"token_ttl": "1h"}`, `{"token_ttl": 3600}`, true},
+		{"duration in days", `{"token_max_ttl": "2d"}`, `{"token_max_ttl": 172800}`, true},
+		{"seconds as a string", `{"secret_id_ttl": "600"}`, `{"secret_id_ttl": 600}`, true},
+		{"zero ttl", `{"token_ttl": 0}`, `{}`, true},
+		{"null ttl", `{"token_ttl": null}`, `{"token_ttl": 0}`, true},
+		{"empty vs absent", `{"bound_cidrs": [], "description": ""}`, `{}`, true},
+		{"list order", `{"token_policies": ["b", "a"]}`, `{"token_policies": ["a", "b"]}`, true},
+		{"comma-separated", `{"policies": "a, b"}`, `{"policies": ["b", "a"]}`, true},
+		{"default token type", `{"token_type": "default"}`, `{"token_type": ""}`, true},
+		{"unset token type", `{"token_type": ""}`, `{"token_type": "default"}`, true},
+		{"zero vs absent", `{"token_num_uses": 0, "token_no_default_policy": false}`, `{}`, true},
+		{"null vs empty list", `{"token_bound_cidrs": null}`, `{"token_bound_cidrs": []}`, true},
+		{"different token type", `{"token_type": "batch"}`, `{"token_type": "default"}`, false},
+		{"different ttl", `{"token_ttl": "1h"}`, `{"token_ttl": 60}`, false},
+		{"different list", `{"token_policies": ["a", "b"]}`, `{"token_policies": ["a"]}`, false},
+		{"missing remotely", `{"token_policies": ["a"]}`, `{}`, false},
+		{"not a duration", `{"bind_secret_id": true}`, `{"bind_secret_id": false}`, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var local, remote map[string]interface{}
+			if err := json.Unmarshal([]byte(test.local), &local); err != nil {
+				t.Fatal(err)
+			}
+			// Vault's client decodes numbers as json.Number
+			dec := json.NewDecoder(strings.NewReader(test.remote))
+			dec.UseNumber()
+			if err := dec.Decode(&remote); err != nil {
+				t.Fatal(err)
+			}
+			if unchanged := gitops.RoleUnchanged(local, remote); unchanged != test.unchanged {
+				t.Errorf("RoleUnchanged(%s, %s) = %v, expected %v", test.local, test.remote, unchanged, test.unchanged)
+			}
+		})
+	}
+}
+
+func TestPolicyUnchanged(t *testing.T) {
+	const policy = `path "secret/*" {
+  capabilities = ["read", "list"]
+}
+`
+	for _, test := range []struct {
+		name      string
+		remote    string
+		unchanged bool
+	}{
+		{"same", policy, true},
+		{"reindented", "path \"secret/*\" {\n\tcapabilities = [ \"read\", \"list\" ]\n}", false},
+		{"one line", `path "secret/*" { capabilities = ["read","list"] }`, false},
+		{"no trailing newline", strings.TrimSuffix(policy, "\n"), false},
+		{"comment", "# readers\n" + policy, false},
+		{"whitespace in a string", `path "secret/ *" { capabilities = ["read", "list"] }`, false},
+		{"different capabilities", `path "secret/*" { capabilities = ["read"] }`, false},
+		{"commented out", "# path \"secret/*\" {\ncapabilities = [\"read\", \"list\"]\n}", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if unchanged := gitops.PolicyUnchanged(policy, test.remote); unchanged != test.unchanged {
+				t.Errorf("PolicyUnchanged(%q) = %v, expected %v", test.remote, unchanged, test.unchanged)
+			}
+		})
+	}
+}
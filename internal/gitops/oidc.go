@@ -0,0 +1,162 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Vault's OIDC provider objects are kept like auth roles, as a file of Vault's own fields each, in
+// <identity>/oidc/<key|scope|assignment|client|provider>/<name>. Client IDs in allowed_client_ids and entity and group
+// IDs in assignments are Vault's IDs, so "*" is usually what keys and providers want.
+
+const oidcListPath = "identity/oidc"
+
+// In dependency order: clients use keys and assignments, and providers use scopes and clients.
+var oidcTypes = []string{"key", "scope", "assignment", "client", "provider"}
+
+// Objects Vault creates itself. allow_all can't be changed at all, and the others can't be deleted.
+const oidcAllowAllAssignment = "identity/oidc/assignment/allow_all"
+
+var oidcBuiltins = map[string]bool{
+	"identity/oidc/key/default":      true,
+	"identity/oidc/provider/default": true,
+}
+
+// key, scope, assignment, client, or provider
+func oidcType(vaultPath string) string {
+	objectType, _, _ := strings.Cut(strings.TrimPrefix(vaultPath, oidcListPath+"/"), "/")
+	return objectType
+}
+
+// How many kinds of OIDC objects a change's object depends on.
+func oidcOrder(change PlannedChange) int {
+	order := slices.Index(oidcTypes, oidcType(change.Path))
+	// keys and scopes don't depend on each other
+	return max(order-1, 0)
+}
+
+// Plans every OIDC provider object, like planIdentity.
+func (a *applier) planOIDC(ctx context.Context, identityDirectory string) ([]PlannedChange, int, error) {
+	var (
+		changes  []PlannedChange
+		existing int
+	)
+	for _, objectType := range oidcTypes {
+		listPath := oidcListPath + "/" + objectType
+		names, err := a.listObjects(ctx, OIDCResource, listPath)
+		if err != nil {
+			if a.opts.SkipForbidden && isPermissionDenied(err) {
+				a.opts.Report.Skip(listPath, "list", err)
+				continue
+			}
+			return nil, 0, fmt.Errorf("error listing %s from Vault: %w", listPath, err)
+		}
+		existing += len(names)
+		remote := make(map[string]bool, len(names))
+		for _, name := range names {
+			remote[name] = true
+		}
+
+		local, err := localDataFiles(filepath.Join(identityDirectory, "oidc", objectType))
+		if err != nil {
+			return nil, 0, err
+		}
+		for name, file := range local {
+			mutation := Add
+			if remote[name] {
+				mutation = Change
+			}
+			changes = append(changes, PlannedChange{Mutation: mutation, Kind: OIDCResource, Path: listPath + "/" + name, File: file})
+		}
+		for _, name := range names {
+			if _, ok := local[name]; ok {
+				continue
+			}
+			if oidcBuiltins[listPath+"/"+name] {
+				log.Debug().Str("path", listPath+"/"+name).Msg("Skipping deletion of built in OIDC object")
+				continue
+			}
+			changes = append(changes, PlannedChange{Mutation: Delete, Kind: OIDCResource, Path: listPath + "/" + name})
+		}
+	}
+	return changes, existing, nil
+}
+
+// An OIDC provider object in Vault in the local file format, or nil if it doesn't exist.
+func (a *applier) readRemoteOIDC(ctx context.Context, change PlannedChange) ([]byte, error) {
+	secret, err := a.readIdentity(ctx, change.Path)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	data := nonDefaultFields(secret.Data)
+	switch oidcType(change.Path) {
+	case "client":
+		// generated, and the secret is a credential
+		delete(data, "client_id")
+		delete(data, "client_secret")
+	case "provider":
+		// Vault returns the whole issuer URL, but only takes the scheme, host, and port
+		if issuer, ok := data["issuer"].(string); ok {
+			data["issuer"] = strings.TrimSuffix(issuer, "/v1/"+change.Path)
+		}
+	}
+	return json.MarshalIndent(data, "", "  ")
+}
+
+// Checks an OIDC provider object file is well formed.
+func validateOIDC(change PlannedChange) error {
+	if change.Path == oidcAllowAllAssignment {
+		return errors.New("the allow_all assignment is built in and can't be changed")
+	}
+	data, err := readRoleFile(change.File)
+	if err != nil {
+		return err
+	}
+	if oidcType(change.Path) == "client" {
+		if _, ok := data["client_id"]; ok {
+			return errors.New("client IDs are generated by Vault and can't be set")
+		}
+	}
+	return nil
+}
+
+// Writes an OIDC provider object, skipping the write with SkipUnchanged if it'd be the same.
+func (a *applier) writeOIDC(ctx context.Context, change PlannedChange) error {
+	if a.opts.SkipUnchanged && change.Mutation == Change {
+		same, err := a.unchanged(ctx, change)
+		if err != nil {
+			return err
+		}
+		if same {
+			log.Debug().Str("path", change.Path).Msgf("%s unchanged, skipping write", change.Kind)
+			return errUnchanged
+		}
+	}
+	data, err := readRoleFile(change.File)
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("path", change.Path).Msgf("Writing %s to Vault", change.Kind)
+	if err := a.write(ctx, change.Path, withoutRedacted(data)); err != nil {
+		return fmt.Errorf("error writing OIDC %s %s to Vault: %w", oidcType(change.Path), change.Name(), err)
+	}
+	return nil
+}
+
+// Downloads every OIDC provider object to `identityDirectory`, removing files for ones that no longer exist.
+func (a *applier) downloadOIDC(ctx context.Context, identityDirectory string, opts DownloadOptions) error {
+	for _, objectType := range oidcTypes {
+		if err := a.downloadObjects(ctx, OIDCResource, path.Join(oidcListPath, objectType), filepath.Join(identityDirectory, "oidc", objectType), opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A repository with environments keeps everything they share in base/, laid out like any other directory, and only
+// what differs in overlays/<environment>/:
+//
+//   - a file that isn't in base/ is added, like an extra role
+//   - a JSON or YAML file is merged into the one in base/ as a JSON merge patch (RFC 7386), so {"token_max_ttl": "1h"}
+//     only changes that field and null removes a field
+//   - any other file, like a policy, replaces the one in base/
+//   - an empty file removes the one in base/
+const (
+	OverlayBaseDirectory = "base"
+	OverlaysDirectory    = "overlays"
+)
+
+// BuildOverlay writes `directory`/base with `directory`/overlays/`environment` on top of it to `dst`.
+func BuildOverlay(directory, environment, dst string) error {
+	var (
+		base    = filepath.Join(directory, OverlayBaseDirectory)
+		overlay = filepath.Join(directory, OverlaysDirectory, environment)
+	)
+	for _, dir := range []string{base, overlay} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("error building overlay %s: %s isn't a directory", environment, dir)
+		}
+	}
+	// base/ files by object name too, so overlays/prod/auth/approle/role/ci.yaml patches base/auth/approle/role/ci
+	var (
+		baseFiles = make(map[string]bool)
+		byObject  = make(map[string]string)
+	)
+	err := walkFiles(base, func(relPath string) error {
+		baseFiles[relPath] = true
+		byObject[filepath.Join(filepath.Dir(relPath), objectName(filepath.Base(relPath)))] = relPath
+		return copyFile(filepath.Join(base, relPath), filepath.Join(dst, relPath))
+	})
+	if err != nil {
+		return fmt.Errorf("error copying %s: %w", base, err)
+	}
+	err = walkFiles(overlay, func(relPath string) error {
+		target := relPath
+		if !baseFiles[target] {
+			if basePath, ok := byObject[filepath.Join(filepath.Dir(relPath), objectName(filepath.Base(relPath)))]; ok {
+				target = basePath
+			}
+		}
+		patch, err := os.ReadFile(filepath.Join(overlay, relPath))
+		if err != nil {
+			return err
+		}
+		if !baseFiles[target] {
+			return copyFile(filepath.Join(overlay, relPath), filepath.Join(dst, relPath))
+		}
+		if len(bytes.TrimSpace(patch)) == 0 {
+			return os.Remove(filepath.Join(dst, target))
+		}
+		merged, err := mergeOverlayFile(filepath.Join(base, target), relPath, patch)
+		if err != nil {
+			return fmt.Errorf("%s: %w", relPath, err)
+		}
+		return os.WriteFile(filepath.Join(dst, target), merged, 0o640)
+	})
+	if err != nil {
+		return fmt.Errorf("error applying overlay %s: %w", environment, err)
+	}
+	return nil
+}
+
+// The content of `baseFile` with `patch` on top, which is only merged if both are JSON or YAML objects.
+func mergeOverlayFile(baseFile, patchFile string, patch []byte) ([]byte, error) {
+	baseContent, err := readDataFile(baseFile)
+	if err != nil {
+		return nil, err
+	}
+	var baseData, patchData map[string]interface{}
+	if json.Unmarshal(baseContent, &baseData) != nil || baseData == nil {
+		// like a policy
+		return patch, nil
+	}
+	patchContent, err := dataFileJSON(patchFile, patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patchContent, &patchData); err != nil || patchData == nil {
+		return nil, errors.New("the base file is a JSON or YAML object, so the overlay has to be one too")
+	}
+	// JSON is valid YAML, so this is fine for base files named .yaml too
+	return json.MarshalIndent(mergePatch(baseData, patchData), "", "  ")
+}
+
+// RFC 7386: objects are merged, null removes a field, and everything else, including lists, is replaced.
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			existing, _ := target[key].(map[string]interface{})
+			if existing == nil {
+				existing = make(map[string]interface{})
+			}
+			target[key] = mergePatch(existing, value)
+		default:
+			target[key] = value
+		}
+	}
+	return target
+}
+
+// Calls fn with the path of every regular file under `dir` relative to it.
+func walkFiles(dir string, fn func(relPath string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return fn(relPath)
+	})
+}
+
+func copyFile(src, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, content, 0o640)
+}
+
+// IsOverlayRepository is whether `directory` has a base/ and overlays/, so it needs an environment to be read.
+func IsOverlayRepository(directory string) bool {
+	for _, dir := range []string{OverlayBaseDirectory, OverlaysDirectory} {
+		if info, err := os.Stat(filepath.Join(directory, dir)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
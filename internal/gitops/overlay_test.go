@@ -0,0 +1,85 @@
+package gitops_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestBuildOverlay(t *testing.T) {
+	var (
+		src = t.TempDir()
+		dst = t.TempDir()
+	)
+	files := map[string]string{
+		"base/sys/policies/acl/reader":            `path "secret/*" { capabilities = ["read"] }`,
+		"base/sys/policies/acl/debug":             `path "sys/*" { capabilities = ["read"] }`,
+		"base/auth/approle/role/ci":               `{"token_policies": ["reader"], "token_ttl": "1h", "token_max_ttl": "24h", "token_bound_cidrs": ["10.0.0.0/8"]}`,
+		"base/auth/approle/_mount.json":           `{"type": "approle", "config": {"default_lease_ttl": "1h", "token_type": "service"}}`,
+		"overlays/prod/sys/policies/acl/reader":   `path "secret/prod/*" { capabilities = ["read"] }`,
+		"overlays/prod/sys/policies/acl/debug":    "",
+		"overlays/prod/auth/approle/role/ci.yaml": "token_max_ttl: 2h\ntoken_bound_cidrs: [10.1.0.0/16]\ntoken_ttl: null\n",
+		"overlays/prod/auth/approle/_mount.json":  `{"config": {"default_lease_ttl": "10m"}}`,
+		"overlays/prod/auth/approle/role/deploy":  `{"token_policies": ["reader"]}`,
+		"overlays/dev/auth/approle/role/ci":       `{"token_policies": ["reader", "debug"]}`,
+	}
+	for path, content := range files {
+		path = filepath.Join(src, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !gitops.IsOverlayRepository(src) {
+		t.Fatal("expected an overlay repository")
+	}
+	if err := gitops.BuildOverlay(src, "prod", dst); err != nil {
+		t.Fatal(err)
+	}
+	read := func(path string) string {
+		content, err := os.ReadFile(filepath.Join(dst, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	readJSON := func(path string) map[string]interface{} {
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(read(path)), &data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	// policies are replaced, and an empty file removes one
+	if diff := cmp.Diff(files["overlays/prod/sys/policies/acl/reader"], read("sys/policies/acl/reader")); diff != "" {
+		t.Errorf("unexpected policy (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "sys/policies/acl/debug")); !os.IsNotExist(err) {
+		t.Error("expected the debug policy to be removed")
+	}
+	// JSON and YAML are merged into the base file, whatever the overlay file is named
+	expectedRole := map[string]interface{}{"token_policies": []interface{}{"reader"}, "token_max_ttl": "2h", "token_bound_cidrs": []interface{}{"10.1.0.0/16"}}
+	if diff := cmp.Diff(expectedRole, readJSON("auth/approle/role/ci")); diff != "" {
+		t.Errorf("unexpected role (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "auth/approle/role/ci.yaml")); !os.IsNotExist(err) {
+		t.Error("expected the overlay to be merged into the base file instead of written next to it")
+	}
+	expectedMount := map[string]interface{}{"type": "approle", "config": map[string]interface{}{"default_lease_ttl": "10m", "token_type": "service"}}
+	if diff := cmp.Diff(expectedMount, readJSON("auth/approle/_mount.json")); diff != "" {
+		t.Errorf("unexpected mount (-want +got):\n%s", diff)
+	}
+	// new files are added
+	if diff := cmp.Diff(files["overlays/prod/auth/approle/role/deploy"], read("auth/approle/role/deploy")); diff != "" {
+		t.Errorf("unexpected added role (-want +got):\n%s", diff)
+	}
+	if err := gitops.BuildOverlay(src, "stage", t.TempDir()); err == nil {
+		t.Error("expected an error building an overlay that doesn't exist")
+	}
+}
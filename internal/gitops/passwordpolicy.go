@@ -0,0 +1,113 @@
+package gitops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// Password policies are HCL files in sys/policies/password/<name>, next to ACL policies, and are only managed if that
+// directory exists.
+
+// The password policy directory next to `policyDirectory`, or "" if there isn't one.
+func passwordPolicyDirectory(policyDirectory string) string {
+	dir := filepath.Join(filepath.Dir(policyDirectory), "password")
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+// Plans every password policy, like planPolicies. Also returns how many there are in Vault.
+func (a *applier) planPasswordPolicies(ctx context.Context, passwordDirectory string) ([]PlannedChange, int, error) {
+	const listPath = "sys/policies/password"
+	names, err := a.listKeys(ctx, listPath)
+	if err != nil {
+		if a.opts.SkipForbidden && isPermissionDenied(err) {
+			a.opts.Report.Skip(listPath, "list", err)
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("error listing %s from Vault: %w", listPath, err)
+	}
+	remote := make(map[string]bool, len(names))
+	for _, name := range names {
+		remote[name] = true
+	}
+	local, err := localFiles(passwordDirectory)
+	if err != nil {
+		return nil, 0, err
+	}
+	var changes []PlannedChange
+	for name, file := range local {
+		mutation := Add
+		if remote[name] {
+			mutation = Change
+		}
+		changes = append(changes, PlannedChange{Mutation: mutation, Kind: PasswordPolicyResource, Path: listPath + "/" + name, File: file})
+	}
+	for _, name := range names {
+		if _, ok := local[name]; !ok {
+			changes = append(changes, PlannedChange{Mutation: Delete, Kind: PasswordPolicyResource, Path: listPath + "/" + name})
+		}
+	}
+	return changes, len(names), nil
+}
+
+// Vault checks the rules when it's written, so this only catches empty files.
+func validatePasswordPolicy(change PlannedChange) error {
+	content, err := os.ReadFile(change.File)
+	if err != nil {
+		return fmt.Errorf("error reading local password policy file %s: %w", change.File, err)
+	}
+	if strings.TrimSpace(string(content)) == "" {
+		return errors.New("the policy is empty")
+	}
+	return nil
+}
+
+// A password policy's HCL in Vault, or nil if it doesn't exist.
+func (a *applier) readRemotePasswordPolicy(ctx context.Context, change PlannedChange) ([]byte, error) {
+	var secret *vault.Secret
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = a.vc.Logical().ReadWithContext(ctx, change.Path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading password policy %s from Vault: %w", change.Name(), err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	policy, _ := secret.Data["policy"].(string)
+	return []byte(policy), nil
+}
+
+// Writes a password policy, skipping the write with SkipUnchanged if it'd be the same.
+func (a *applier) writePasswordPolicy(ctx context.Context, change PlannedChange) error {
+	content, err := os.ReadFile(change.File)
+	if err != nil {
+		return fmt.Errorf("error reading local password policy file %s: %w", change.File, err)
+	}
+	if a.opts.SkipUnchanged && change.Mutation == Change {
+		same, err := a.unchanged(ctx, change)
+		if err != nil {
+			return err
+		}
+		if same {
+			log.Debug().Str("path", change.Path).Msg("Password policy unchanged, skipping write")
+			return errUnchanged
+		}
+	}
+	log.Debug().Str("path", change.Path).Msg("Writing password policy to Vault")
+	if err := a.write(ctx, change.Path, map[string]interface{}{"policy": string(content)}); err != nil {
+		return fmt.Errorf("error writing password policy %s to Vault: %w", change.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,913 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	mdtf "github.com/fbiville/markdown-table-formatter/pkg/markdown"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// The kinds of objects a Plan changes.
+type ResourceKind string
+
+const (
+	PolicyResource              ResourceKind = "policy"
+	AuthRoleResource            ResourceKind = "auth role"
+	IdentityEntityResource      ResourceKind = "identity entity"
+	IdentityGroupResource       ResourceKind = "identity group"
+	SentinelPolicyResource      ResourceKind = "Sentinel policy"
+	PasswordPolicyResource      ResourceKind = "password policy"
+	QuotaResource               ResourceKind = "quota"
+	SecretRoleResource          ResourceKind = "secrets engine role"
+	AuthMountResource           ResourceKind = "auth mount"
+	AuthConfigResource          ResourceKind = "auth config"
+	SecretsMountResource        ResourceKind = "secrets engine"
+	MFAMethodResource           ResourceKind = "MFA method"
+	MFALoginEnforcementResource ResourceKind = "MFA login enforcement"
+	OIDCResource                ResourceKind = "OIDC provider object"
+)
+
+// The kind of object at a Vault path a plan changes.
+func resourceKindFor(vaultPath string) (ResourceKind, bool) {
+	switch {
+	case strings.HasPrefix(vaultPath, "sys/policies/acl/"):
+		return PolicyResource, true
+	case strings.HasPrefix(vaultPath, "sys/policies/egp/"), strings.HasPrefix(vaultPath, "sys/policies/rgp/"):
+		return SentinelPolicyResource, true
+	case strings.HasPrefix(vaultPath, "sys/policies/password/"):
+		return PasswordPolicyResource, true
+	case strings.HasPrefix(vaultPath, "sys/quotas/"):
+		return QuotaResource, true
+	case strings.HasPrefix(vaultPath, "sys/auth/"):
+		return AuthMountResource, true
+	case strings.HasPrefix(vaultPath, "sys/mounts/"):
+		return SecretsMountResource, true
+	case strings.HasPrefix(vaultPath, "auth/") && (strings.HasSuffix(vaultPath, "/config") || strings.HasSuffix(vaultPath, "/config/client")):
+		return AuthConfigResource, true
+	case strings.HasPrefix(vaultPath, "auth/"):
+		return AuthRoleResource, true
+	case strings.HasPrefix(vaultPath, "identity/entity/name/"):
+		return IdentityEntityResource, true
+	case strings.HasPrefix(vaultPath, "identity/group/name/"):
+		return IdentityGroupResource, true
+	case strings.HasPrefix(vaultPath, mfaMethodNamePath+"/"):
+		return MFAMethodResource, true
+	case strings.HasPrefix(vaultPath, mfaEnforcementListPath+"/"):
+		return MFALoginEnforcementResource, true
+	case strings.HasPrefix(vaultPath, oidcListPath+"/"):
+		return OIDCResource, true
+	}
+	return "", false
+}
+
+// PlannedChange is a single write or delete that an apply makes.
+type PlannedChange struct {
+	Mutation Mutation
+	Kind     ResourceKind
+	// Where the object lives in Vault, e.g. sys/policies/acl/admin or auth/approle/role/ci.
+	Path string
+	// The local file with the desired content, which isn't read until it's needed. Empty for deletes.
+	File string
+	// Why the change might not go through, e.g. because the token lacks a capability.
+	Warning string
+	// What the change does to the object, if the plan was made with ApplyOptions.Diff.
+	Diff string
+	// how many member groups have to be written before this group, see orderGroups
+	depth int
+}
+
+// Name is the last element of Path, e.g. the role name, or the whole policy name, which can have slashes in it.
+func (c PlannedChange) Name() string {
+	if c.Kind == PolicyResource {
+		return strings.TrimPrefix(c.Path, "sys/policies/acl/")
+	}
+	return path.Base(c.Path)
+}
+
+// Plan is every change an apply makes, in the order they're made: policy (ACL and Sentinel) and mount writes, role
+// writes, entity writes, group writes, and then deletes in the opposite order, so nothing references something that
+// doesn't exist yet or anymore.
+type Plan struct {
+	Changes []PlannedChange
+	// How many objects were listed in Vault while planning, or zero if nothing was listed.
+	Existing int
+	// Deletes that were left out because ApplyOptions.Prune isn't set.
+	Unpruned []PlannedChange
+}
+
+// Moves every delete to Unpruned.
+func (p *Plan) holdBackDeletes() {
+	kept := p.Changes[:0]
+	var paths []string
+	for _, change := range p.Changes {
+		if change.Mutation == Delete {
+			p.Unpruned = append(p.Unpruned, change)
+			paths = append(paths, change.Path)
+			continue
+		}
+		kept = append(kept, change)
+	}
+	p.Changes = kept
+	if len(paths) == 0 {
+		return
+	}
+	log.Info().Strs("paths", paths).Int("count", len(paths)).Msg("Not deleting objects without local files since pruning is off")
+}
+
+// Drops changes that aren't one of `kinds` or don't match one of `patterns`, unless they're empty.
+func (p *Plan) keepTargeted(kinds []ResourceKind, patterns []string) error {
+	if len(kinds) == 0 && len(patterns) == 0 {
+		return nil
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad target %q: %w", pattern, err)
+		}
+	}
+	var (
+		kept    = p.Changes[:0]
+		dropped int
+	)
+	for _, change := range p.Changes {
+		if len(kinds) > 0 && !slices.Contains(kinds, change.Kind) || len(patterns) > 0 && !matchAny(patterns, change.Path) {
+			dropped++
+			continue
+		}
+		kept = append(kept, change)
+	}
+	p.Changes = kept
+	if dropped > 0 {
+		log.Info().Int("count", dropped).Msg("Leaving out changes that weren't targeted")
+	}
+	return nil
+}
+
+// Count returns how many changes are `mutation`.
+func (p *Plan) Count(mutation Mutation) int {
+	var count int
+	for _, change := range p.Changes {
+		if change.Mutation == mutation {
+			count++
+		}
+	}
+	return count
+}
+
+// Names returns the names of every `kind` that's getting `mutation`.
+func (p *Plan) Names(kind ResourceKind, mutation Mutation) []string {
+	var names []string
+	for _, change := range p.Changes {
+		if change.Kind == kind && change.Mutation == mutation {
+			names = append(names, change.Name())
+		}
+	}
+	return names
+}
+
+// MarkdownTable lists every change, or returns an empty string if there aren't any.
+func (p *Plan) MarkdownTable() string {
+	if len(p.Changes) == 0 {
+		return ""
+	}
+	rows := make([][]string, 0, len(p.Changes))
+	for _, change := range p.Changes {
+		rows = append(rows, []string{
+			strings.ToLower(change.Mutation.String()),
+			string(change.Kind),
+			fmt.Sprintf("`%s`", change.Path),
+			change.Warning,
+		})
+	}
+	table, err := mdtf.NewTableFormatterBuilder().
+		WithPrettyPrint().
+		Build("Action", "Kind", "Path", "Notes").
+		Format(rows)
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+// the phase of an apply a change happens in
+func (c PlannedChange) phase() int {
+	// after every group write, however deep
+	const deletes = 1 << 16
+	if c.Mutation != Delete {
+		switch c.Kind {
+		case PolicyResource, SentinelPolicyResource, PasswordPolicyResource, AuthMountResource, SecretsMountResource, MFAMethodResource:
+			return 0
+		case AuthRoleResource, AuthConfigResource, SecretRoleResource, QuotaResource:
+			return 1
+		case IdentityEntityResource:
+			return 2
+		case MFALoginEnforcementResource:
+			return deletes - 1
+		case OIDCResource:
+			// assignments refer to groups
+			return deletes - 16 + oidcOrder(c)
+		default:
+			return 3 + c.depth
+		}
+	}
+	switch c.Kind {
+	case AuthRoleResource, SecretRoleResource, MFALoginEnforcementResource, QuotaResource:
+		return deletes
+	case OIDCResource:
+		return deletes + 3 - oidcOrder(c)
+	case IdentityGroupResource:
+		return deletes + 1
+	case IdentityEntityResource:
+		return deletes + 2
+	case AuthMountResource, SecretsMountResource:
+		return deletes + 3
+	default:
+		return deletes + 4
+	}
+}
+
+func (p *Plan) sort() {
+	sort.SliceStable(p.Changes, func(i, j int) bool {
+		if pi, pj := p.Changes[i].phase(), p.Changes[j].phase(); pi != pj {
+			return pi < pj
+		}
+		return p.Changes[i].Path < p.Changes[j].Path
+	})
+}
+
+// Plans reconciling everything: every local file is written and every object in Vault without one is deleted.
+//
+// Policies, mounts, and identities are listed concurrently.
+func (a *applier) planAll(ctx context.Context, authDirectory, policyDirectory string) (*Plan, error) {
+	var mounts map[string]*vault.AuthMount
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		mounts, err = a.vc.Sys().ListAuthWithContext(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing auth mounts from Vault: %w", err)
+	}
+	a.mounts = mounts
+	a.opts.Cache.CheckMounts(mounts)
+	if a.opts.Strict {
+		if err := checkMountsSupported(mounts); err != nil {
+			return nil, err
+		}
+	}
+
+	localMounts, err := localAuthMounts(authDirectory)
+	if err != nil {
+		return nil, err
+	}
+	mountChanges, missingMounts, err := a.planMounts(AuthMountResource, localMounts, mounts)
+	if err != nil {
+		return nil, err
+	}
+	// secrets engines are planned up front too, since roles in new ones need planning
+	var missingEngines map[string]*vault.MountOutput
+	if a.opts.MountsDirectory != "" {
+		var engineChanges []PlannedChange
+		engineChanges, missingEngines, err = a.planSecretsMounts(ctx, a.opts.MountsDirectory)
+		if err != nil {
+			return nil, err
+		}
+		mountChanges = append(mountChanges, engineChanges...)
+	}
+
+	var (
+		plan = &Plan{Changes: mountChanges}
+		mu   sync.Mutex
+		eg   errgroup.Group
+		errs errorCollector
+	)
+	add := func(changes []PlannedChange, existing int) {
+		mu.Lock()
+		defer mu.Unlock()
+		plan.Changes = append(plan.Changes, changes...)
+		plan.Existing += existing
+	}
+	eg.SetLimit(concurrency(a.opts.Concurrency))
+	eg.Go(func() error {
+		changes, existing, err := a.planPolicies(ctx, policyDirectory)
+		errs.add(err)
+		add(changes, existing)
+		return nil
+	})
+	if passwordDirectory := passwordPolicyDirectory(policyDirectory); passwordDirectory != "" {
+		eg.Go(func() error {
+			changes, existing, err := a.planPasswordPolicies(ctx, passwordDirectory)
+			errs.add(err)
+			add(changes, existing)
+			return nil
+		})
+	}
+	if a.opts.SecretsDirectory != "" {
+		eg.Go(func() error {
+			changes, existing, err := a.planSecrets(ctx, a.opts.SecretsDirectory, missingEngines)
+			errs.add(err)
+			add(changes, existing)
+			return nil
+		})
+	}
+	if a.opts.QuotasDirectory != "" {
+		eg.Go(func() error {
+			changes, existing, err := a.planQuotas(ctx, a.opts.QuotasDirectory)
+			errs.add(err)
+			add(changes, existing)
+			return nil
+		})
+	}
+	if a.opts.SentinelDirectory != "" {
+		eg.Go(func() error {
+			changes, existing, err := a.planSentinelPolicies(ctx, a.opts.SentinelDirectory)
+			errs.add(err)
+			add(changes, existing)
+			return nil
+		})
+	}
+	if a.opts.IdentityDirectory != "" {
+		eg.Go(func() error {
+			changes, existing, err := a.planIdentity(ctx, a.opts.IdentityDirectory)
+			errs.add(err)
+			add(changes, existing)
+			return nil
+		})
+		eg.Go(func() error {
+			changes, existing, err := a.planMFA(ctx, a.opts.IdentityDirectory)
+			errs.add(err)
+			add(changes, existing)
+			return nil
+		})
+		eg.Go(func() error {
+			changes, existing, err := a.planOIDC(ctx, a.opts.IdentityDirectory)
+			errs.add(err)
+			add(changes, existing)
+			return nil
+		})
+	}
+	for mountName, mount := range mounts {
+		mountName := strings.TrimSuffix(mountName, "/")
+		mount := mount
+		eg.Go(func() error {
+			changes, existing, err := a.planMount(ctx, authDirectory, mountName, mount)
+			errs.add(err)
+			add(changes, existing)
+			return nil
+		})
+	}
+	// roles in mounts that are about to be enabled are all new
+	for mountName, mount := range missingMounts {
+		mountName, mount := mountName, mount
+		eg.Go(func() error {
+			changes, existing, err := a.planMount(ctx, authDirectory, mountName, mount)
+			errs.add(err)
+			add(changes, existing)
+			return nil
+		})
+	}
+	_ = eg.Wait()
+	if err := errs.join("errors while planning"); err != nil {
+		return nil, err
+	}
+	plan.sort()
+	return plan, nil
+}
+
+// Lists every auth mount whose roles can't be managed, if there are any.
+func checkMountsSupported(mounts map[string]*vault.AuthMount) error {
+	var unsupported []string
+	for mountName, mount := range mounts {
+		if _, ok := rolePathPrefixesFor(mount.Type); !ok {
+			unsupported = append(unsupported, fmt.Sprintf("%s (%s)", strings.TrimSuffix(mountName, "/"), mount.Type))
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	sort.Strings(unsupported)
+	return fmt.Errorf("%d auth mounts have unsupported types and would be skipped: %s", len(unsupported), strings.Join(unsupported, ", "))
+}
+
+// Also returns how many policies are in Vault.
+func (a *applier) planPolicies(ctx context.Context, policyDirectory string) ([]PlannedChange, int, error) {
+	var existingPolicies []string
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		existingPolicies, err = a.vc.Sys().ListPoliciesWithContext(ctx)
+		return err
+	})
+	if err != nil {
+		if a.opts.SkipForbidden && isPermissionDenied(err) {
+			a.opts.Report.Skip("sys/policies/acl", "list", err)
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("error listing existing policies from Vault: %w", err)
+	}
+	existing := make(map[string]bool, len(existingPolicies))
+	for _, name := range existingPolicies {
+		existing[name] = true
+	}
+
+	local, err := localPolicyFiles(policyDirectory)
+	if err != nil {
+		return nil, 0, err
+	}
+	var changes []PlannedChange
+	for name, file := range local {
+		mutation := Add
+		if existing[name] {
+			mutation = Change
+		}
+		changes = append(changes, PlannedChange{
+			Mutation: mutation,
+			Kind:     PolicyResource,
+			Path:     "sys/policies/acl/" + name,
+			File:     file,
+		})
+	}
+
+	// Delete policies not present locally
+	for _, name := range existingPolicies {
+		// Skip deleting root and default policies
+		if name == "root" || name == "default" {
+			log.Debug().Str("policy", name).Msg("Skipping deletion of protected policy")
+			continue
+		}
+		if _, ok := local[name]; !ok {
+			changes = append(changes, PlannedChange{
+				Mutation: Delete,
+				Kind:     PolicyResource,
+				Path:     "sys/policies/acl/" + name,
+			})
+		}
+	}
+	return changes, len(existingPolicies), nil
+}
+
+// Policy names can have slashes in them, like team/payments/reader, but subdirectories of the policy directory are only
+// for organizing files, so slashes are escaped as %2F in file names, and % as %25.
+var (
+	policyNameEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	policyNameUnescaper = strings.NewReplacer("%25", "%", "%2F", "/", "%2f", "/")
+)
+
+// The name of the file policy `name` is downloaded to.
+func policyFileName(name string) string {
+	return policyNameEscaper.Replace(name)
+}
+
+// The policy a file named `fileName` is for.
+func policyNameFromFile(fileName string) string {
+	return policyNameUnescaper.Replace(fileName)
+}
+
+// Vault lowercases policy names, so local files are keyed by what they'll be called in Vault.
+//
+// Files that would be the same policy, because their names differ only by case or they're in different
+// subdirectories, would overwrite each other, which is an error.
+func localPolicyFiles(policyDirectory string) (map[string]string, error) {
+	files := map[string]string{}
+	err := walkLocal(policyDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := strings.ToLower(policyNameFromFile(d.Name()))
+		if other, ok := files[name]; ok {
+			if filepath.Dir(other) == filepath.Dir(path) {
+				return fmt.Errorf("policy files %s and %s differ only by case, but Vault treats them as the same policy", other, path)
+			}
+			return fmt.Errorf("policy files %s and %s would both be written to policy %s", other, path, name)
+		}
+		if name != policyNameFromFile(d.Name()) {
+			log.Warn().Str("path", path).Str("policy", name).Msg("Policy file name isn't lowercase, Vault will lowercase it")
+		}
+		files[name] = path
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking policy directory: %w", err)
+	}
+	return files, nil
+}
+
+// name -> file for every file in `dir`, which doesn't have to exist. Subdirectories and ignored files are left out.
+func localFiles(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", dir, err)
+	}
+	var (
+		files = make(map[string]string, len(entries))
+		rules = loadIgnoreRules(dir)
+	)
+	for _, entry := range entries {
+		if rules.ignored(filepath.Join(dir, entry.Name()), entry.IsDir()) {
+			continue
+		}
+		if entry.IsDir() {
+			log.Warn().Str("path", filepath.Join(dir, entry.Name())).Msg("Ignoring unexpected directory")
+			continue
+		}
+		files[entry.Name()] = filepath.Join(dir, entry.Name())
+	}
+	return files, nil
+}
+
+// Lists the keys under a Vault path, which is empty if there's nothing there.
+func (a *applier) listKeys(ctx context.Context, listPath string) ([]string, error) {
+	var keys []string
+	err := a.listPages(ctx, listPath, func(_ *vault.Secret, page []string) error {
+		keys = append(keys, page...)
+		return nil
+	})
+	return keys, err
+}
+
+// Like listKeys, but for any kind of object, leaving out ones that are never managed.
+func (a *applier) listObjects(ctx context.Context, kind ResourceKind, listPath string) ([]string, error) {
+	if kind == MFAMethodResource {
+		return a.mfaMethodNames(ctx)
+	}
+	names, err := a.listKeys(ctx, listPath)
+	if kind == OIDCResource {
+		names = slices.DeleteFunc(names, func(name string) bool {
+			return listPath+"/"+name == oidcAllowAllAssignment
+		})
+	}
+	return names, err
+}
+
+// Also returns how many roles the mount has in Vault.
+func (a *applier) planMount(ctx context.Context, authDirectory, mountName string, mount *vault.AuthMount) ([]PlannedChange, int, error) {
+	log.Debug().Str("mount", mountName).Msg("Processing auth mount")
+
+	rolePathPrefixes, ok := rolePathPrefixesFor(mount.Type)
+	if !ok {
+		log.Warn().Str("mount_type", mount.Type).Msg("Unsupported auth mount type, skipping")
+		return nil, 0, nil
+	}
+	var (
+		changes  = planAuthConfig(authDirectory, mountName, mount)
+		existing int
+	)
+	for _, rolePathPrefix := range rolePathPrefixes {
+		prefixChanges, prefixExisting, err := a.planMountPrefix(ctx, authDirectory, mountName, mount, rolePathPrefix)
+		if err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, prefixChanges...)
+		existing += prefixExisting
+	}
+	return changes, existing, nil
+}
+
+// Plans the roles, users, or groups under one path of a mount, like planMount.
+func (a *applier) planMountPrefix(ctx context.Context, authDirectory, mountName string, mount *vault.AuthMount, rolePathPrefix string) ([]PlannedChange, int, error) {
+	// Get existing roles for this mount from Vault, unless it hasn't been enabled yet
+	listPath := fmt.Sprintf("auth/%s/%s", mountName, rolePathPrefix)
+	existingRoles := make(map[string]bool)
+	var err error
+	if mount.Accessor != "" {
+		err = a.listPages(ctx, listPath, func(_ *vault.Secret, keys []string) error {
+			for _, key := range keys {
+				existingRoles[key] = true
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		if a.opts.SkipForbidden && isPermissionDenied(err) {
+			a.opts.Report.Skip(listPath, "list", err)
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("error listing existing roles for mount %s from Vault: %w", mountName, err)
+	}
+
+	localMountDir := filepath.Join(authDirectory, mountName, rolePathPrefix)
+	log.Debug().Str("local_mount_dir", localMountDir).Msg("Reading local auth roles for mount")
+
+	var (
+		changes []PlannedChange
+		// role name -> file
+		localRoles = make(map[string]string)
+	)
+	err = walkLocal(localMountDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// billing.yaml is the billing role, and files in subdirectories are still written to the mount's top level
+		roleName := objectName(d.Name())
+		if other, ok := localRoles[roleName]; ok {
+			return fmt.Errorf("auth role files %s and %s would both be written to auth/%s/%s/%s", other, path, mountName, rolePathPrefix, roleName)
+		}
+		localRoles[roleName] = path
+		mutation := Add
+		if existingRoles[roleName] {
+			mutation = Change
+		}
+		changes = append(changes, PlannedChange{
+			Mutation: mutation,
+			Kind:     AuthRoleResource,
+			Path:     fmt.Sprintf("auth/%s/%s/%s", mountName, rolePathPrefix, roleName),
+			File:     path,
+		})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("error walking local auth mount directory %s: %w", localMountDir, err)
+	}
+
+	// Delete roles not present locally
+	for existingRole := range existingRoles {
+		if _, ok := localRoles[existingRole]; !ok {
+			changes = append(changes, PlannedChange{
+				Mutation: Delete,
+				Kind:     AuthRoleResource,
+				Path:     fmt.Sprintf("auth/%s/%s/%s", mountName, rolePathPrefix, existingRole),
+			})
+		}
+	}
+	return changes, len(existingRoles), nil
+}
+
+// Asks ConfirmDeletions about the plan's deletions, if there are any.
+func (a *applier) confirmDeletions(plan *Plan) error {
+	if a.opts.ConfirmDeletions == nil {
+		return nil
+	}
+	var deletes []PlannedChange
+	for _, change := range plan.Changes {
+		if change.Mutation == Delete {
+			deletes = append(deletes, change)
+		}
+	}
+	if len(deletes) == 0 {
+		return nil
+	}
+	return a.opts.ConfirmDeletions(deletes)
+}
+
+// Refuses plans that delete suspiciously much, e.g. because the directory is empty or wrong.
+func (a *applier) checkDeletionThreshold(plan *Plan) error {
+	deletions := plan.Count(Delete)
+	if a.opts.MaxDeletions > 0 && deletions > a.opts.MaxDeletions {
+		return fmt.Errorf("refusing to delete %d objects, which is more than the limit of %d", deletions, a.opts.MaxDeletions)
+	}
+	if a.opts.MaxDeletionPercent > 0 && plan.Existing > 0 {
+		percent := float64(deletions) / float64(plan.Existing) * 100
+		if percent > a.opts.MaxDeletionPercent {
+			return fmt.Errorf(
+				"refusing to delete %d of %d objects (%.0f%%), which is more than the limit of %.0f%%",
+				deletions, plan.Existing, percent, a.opts.MaxDeletionPercent,
+			)
+		}
+	}
+	return nil
+}
+
+// Leaves out changes to objects that already match their local files, comparing them the same way SkipUnchanged does
+// when applying.
+func (a *applier) dropUnchanged(ctx context.Context, plan *Plan) error {
+	var (
+		unchanged = make([]bool, len(plan.Changes))
+		eg        errgroup.Group
+		errs      errorCollector
+	)
+	eg.SetLimit(concurrency(a.opts.Concurrency))
+	for i, change := range plan.Changes {
+		if change.Mutation != Change {
+			continue
+		}
+		a.opts.Progress.Add(1)
+		i, change := i, change
+		eg.Go(func() error {
+			defer a.opts.Progress.Done(change.Path)
+			same, err := a.unchanged(ctx, change)
+			errs.add(err)
+			unchanged[i] = same
+			return nil
+		})
+	}
+	_ = eg.Wait()
+	if err := errs.join("errors reading objects from Vault"); err != nil {
+		return err
+	}
+	changed := plan.Changes[:0]
+	for i, change := range plan.Changes {
+		if !unchanged[i] {
+			changed = append(changed, change)
+		}
+	}
+	plan.Changes = changed
+	return nil
+}
+
+// Whether the object in Vault matches its local file.
+func (a *applier) unchanged(ctx context.Context, change PlannedChange) (bool, error) {
+	remote, err := a.readRemote(ctx, change)
+	if err != nil || remote == nil {
+		return false, err
+	}
+	if change.Kind == PolicyResource || change.Kind == PasswordPolicyResource {
+		local, err := os.ReadFile(change.File)
+		if err != nil {
+			return false, fmt.Errorf("error reading local policy file %s: %w", change.File, err)
+		}
+		return PolicyUnchanged(string(local), string(remote)), nil
+	}
+	if change.Kind == AuthMountResource || change.Kind == SecretsMountResource {
+		local, err := readRoleFile(change.File)
+		if err != nil {
+			return false, err
+		}
+		var remoteData map[string]interface{}
+		if err := json.Unmarshal(remote, &remoteData); err != nil {
+			return false, err
+		}
+		return mountUnchanged(local, remoteData), nil
+	}
+	// entities and groups are read back in the local format, so they compare the same way as roles
+	local, err := readRoleFile(change.File)
+	if err != nil {
+		return false, err
+	}
+	// Vault keeps whatever it has for redacted fields
+	local = withoutRedacted(local)
+	// Vault never returns MFA methods' credentials
+	if change.Kind == MFAMethodResource {
+		for key := range local {
+			if secretConfigFields[key] {
+				delete(local, key)
+			}
+		}
+	}
+	var remoteData map[string]interface{}
+	if err := json.Unmarshal(remote, &remoteData); err != nil {
+		return false, err
+	}
+	return RoleUnchanged(local, remoteData), nil
+}
+
+// Makes every change in a plan, one phase at a time.
+//
+// A failed change doesn't stop the rest of its phase, so every failure is reported at once, but later phases aren't
+// started since they can depend on earlier ones, unless ApplyOptions.KeepGoing says to.
+func (a *applier) execute(ctx context.Context, plan *Plan) error {
+	var (
+		attempted int
+		applied   []PlannedChange
+		errs      errorCollector
+		mu        sync.Mutex
+	)
+	a.opts.Progress.Add(len(plan.Changes))
+	for start := 0; start < len(plan.Changes); {
+		end := start
+		for end < len(plan.Changes) && plan.Changes[end].phase() == plan.Changes[start].phase() {
+			end++
+		}
+		var eg errgroup.Group
+		eg.SetLimit(concurrency(a.opts.Concurrency))
+		for _, change := range plan.Changes[start:end] {
+			change := change
+			eg.Go(func() error {
+				defer a.opts.Progress.Done(change.Path)
+				err := a.applyChange(ctx, change)
+				if errors.Is(err, errUnchanged) {
+					a.opts.Report.Unchange(change)
+					a.opts.State.record(change)
+					return nil
+				}
+				if err != nil && a.opts.SkipForbidden && isPermissionDenied(err) {
+					a.opts.Report.Skip(change.Path, requiredCapability(change.Mutation), err)
+					return nil
+				}
+				if err != nil {
+					a.opts.Report.Fail(change, err)
+					errs.add(err)
+					return nil
+				}
+				a.opts.Report.Apply(change)
+				if a.opts.SkipUnchanged && a.opts.State.drifted(change) {
+					log.Warn().Str("path", change.Path).Msg("Overwrote a change made in Vault since this was last applied")
+				}
+				a.opts.State.record(change)
+				mu.Lock()
+				applied = append(applied, change)
+				mu.Unlock()
+				return nil
+			})
+		}
+		_ = eg.Wait()
+		attempted += end - start
+		start = end
+		if errs.count() == 0 || a.opts.KeepGoing && start < len(plan.Changes) {
+			continue
+		}
+		summary := fmt.Sprintf("of %d attempted changes failed", attempted)
+		if remaining := len(plan.Changes) - attempted; remaining > 0 {
+			summary += fmt.Sprintf(" and the remaining %d weren't attempted", remaining)
+		}
+		err := errs.join(summary)
+		if len(applied) > 0 {
+			return &PartialApplyError{Applied: len(applied), Changes: applied, Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// PartialApplyError is returned when some changes were made before others failed, leaving Vault somewhere between
+// how it was and how the plan wanted it.
+type PartialApplyError struct {
+	// How many changes were made.
+	Applied int
+	// The changes that were made.
+	Changes []PlannedChange
+	Err     error
+}
+
+func (e *PartialApplyError) Error() string {
+	return fmt.Sprintf("partially applied, %d changes were made before: %s", e.Applied, e.Err)
+}
+
+func (e *PartialApplyError) Unwrap() error {
+	return e.Err
+}
+
+func (a *applier) applyChange(ctx context.Context, change PlannedChange) error {
+	switch {
+	case change.Kind == PolicyResource && change.Mutation == Delete:
+		log.Debug().Str("policy", change.Name()).Msg("Deleting policy from Vault")
+		err := a.limiter.Do(ctx, func(ctx context.Context) error {
+			return a.vc.Sys().DeletePolicyWithContext(ctx, change.Name())
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting policy %s from Vault: %w", change.Name(), err)
+		}
+		a.opts.Cache.Forget(change.Path)
+		return nil
+	case change.Kind == PolicyResource:
+		content, err := os.ReadFile(change.File)
+		if err != nil {
+			return fmt.Errorf("error reading local policy file %s: %w", change.File, err)
+		}
+		return a.writePolicy(ctx, change.Name(), string(content))
+	case (change.Kind == AuthMountResource || change.Kind == SecretsMountResource) && change.Mutation == Delete:
+		return a.disableMount(ctx, change)
+	case change.Kind == AuthMountResource, change.Kind == SecretsMountResource:
+		return a.writeMount(ctx, change)
+	case change.Kind == MFAMethodResource && change.Mutation == Delete:
+		return a.deleteMFAMethod(ctx, change)
+	case change.Mutation == Delete:
+		log.Debug().Str("path", change.Path).Msgf("Deleting %s from Vault", change.Kind)
+		if err := a.delete(ctx, change.Path); err != nil {
+			return fmt.Errorf("error deleting %s %s from Vault: %w", change.Kind, change.Path, err)
+		}
+		a.opts.Cache.Forget(change.Path)
+		return nil
+	case change.Kind == IdentityEntityResource, change.Kind == IdentityGroupResource:
+		return a.writeIdentity(ctx, change)
+	case change.Kind == MFAMethodResource, change.Kind == MFALoginEnforcementResource:
+		return a.writeMFA(ctx, change)
+	case change.Kind == OIDCResource:
+		return a.writeOIDC(ctx, change)
+	case change.Kind == SentinelPolicyResource:
+		return a.writeSentinelPolicy(ctx, change)
+	case change.Kind == PasswordPolicyResource:
+		return a.writePasswordPolicy(ctx, change)
+	case change.Kind == QuotaResource:
+		return a.writeQuota(ctx, change)
+	case change.Kind == SecretRoleResource:
+		return a.writeSecretRole(ctx, change)
+	case change.Kind == AuthConfigResource:
+		return a.writeAuthConfig(ctx, change)
+	default:
+		data, err := readRoleFile(change.File)
+		if err != nil {
+			return err
+		}
+		return a.writeRole(ctx, change.Path, withoutRedacted(data), change.Mutation == Change)
+	}
+}
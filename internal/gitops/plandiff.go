@@ -0,0 +1,183 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Fills in every change's Diff.
+func (a *applier) addDiffs(ctx context.Context, plan *Plan) error {
+	var (
+		eg   errgroup.Group
+		errs errorCollector
+	)
+	eg.SetLimit(concurrency(a.opts.Concurrency))
+	for i := range plan.Changes {
+		change := &plan.Changes[i]
+		eg.Go(func() error {
+			diff, err := a.diff(ctx, *change)
+			errs.add(err)
+			change.Diff = diff
+			return nil
+		})
+	}
+	_ = eg.Wait()
+	return errs.join("errors diffing changes")
+}
+
+// Diffs what's in Vault with the local file, both formatted the way a downloaded file would be.
+//
+// Vault fills in defaults for every field of an auth role, so only fields that are set locally are shown unless the
+// role is being deleted.
+func (a *applier) diff(ctx context.Context, change PlannedChange) (string, error) {
+	var remote, local string
+	if change.Mutation != Add {
+		content, err := a.readRemote(ctx, change)
+		if err != nil {
+			return "", err
+		}
+		remote = string(content)
+	}
+	if change.Mutation == Delete {
+		return lineDiff(remote, local), nil
+	}
+	if change.Kind == PolicyResource || change.Kind == PasswordPolicyResource {
+		content, err := os.ReadFile(change.File)
+		if err != nil {
+			return "", fmt.Errorf("error reading local policy file %s: %w", change.File, err)
+		}
+		return lineDiff(remote, string(content)), nil
+	}
+	localData, err := readRoleFile(change.File)
+	if err != nil {
+		return "", err
+	}
+	// which also keeps the secret in Vault out of the diff
+	localData = withoutRedacted(localData)
+	if remote != "" {
+		var remoteData map[string]interface{}
+		if err := json.Unmarshal([]byte(remote), &remoteData); err != nil {
+			return "", err
+		}
+		for key := range remoteData {
+			if _, ok := localData[key]; !ok {
+				delete(remoteData, key)
+			}
+		}
+		remote = indentJSON(remoteData)
+	}
+	return lineDiff(remote, indentJSON(localData)), nil
+}
+
+func indentJSON(data map[string]interface{}) string {
+	encoded, _ := json.MarshalIndent(data, "", "  ")
+	return string(encoded)
+}
+
+// A diff of every line in `from` and `to`, prefixed with "-", "+", or " " for lines in both. Empty if they're the same.
+func lineDiff(from, to string) string {
+	if strings.TrimSpace(from) == strings.TrimSpace(to) {
+		return ""
+	}
+	var (
+		a = splitLines(from)
+		b = splitLines(to)
+		// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+		lcs = make([][]int, len(a)+1)
+	)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var (
+		sb   strings.Builder
+		i, j int
+	)
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			sb.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		// removals before additions, like diff(1)
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return sb.String()
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// MarkdownDiffs renders the Diff of every change that has one as a fenced diff block under its path.
+func (p *Plan) MarkdownDiffs() string {
+	var sb strings.Builder
+	for _, change := range p.Changes {
+		if change.Diff == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "#### %s `%s`\n\n```diff\n%s```\n\n", strings.ToLower(change.Mutation.String()), change.Path, change.Diff)
+	}
+	return sb.String()
+}
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiBold  = "\x1b[1m"
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+)
+
+// UnifiedDiffs renders the Diff of every change that has one for a terminal, Vault's side first, with ANSI colors if
+// `color` is set.
+func (p *Plan) UnifiedDiffs(color bool) string {
+	paint := func(code, line string) string {
+		if !color {
+			return line
+		}
+		return code + line + ansiReset
+	}
+	var sb strings.Builder
+	for _, change := range p.Changes {
+		if change.Diff == "" {
+			continue
+		}
+		sb.WriteString(paint(ansiBold, fmt.Sprintf("%s %s %s", strings.ToLower(change.Mutation.String()), change.Kind, change.Path)) + "\n")
+		sb.WriteString(paint(ansiBold, "--- vault/"+change.Path) + "\n")
+		sb.WriteString(paint(ansiBold, "+++ local/"+change.Path) + "\n")
+		for _, line := range splitLines(change.Diff) {
+			switch {
+			case strings.HasPrefix(line, "-"):
+				line = paint(ansiRed, line)
+			case strings.HasPrefix(line, "+"):
+				line = paint(ansiGreen, line)
+			}
+			sb.WriteString(line + "\n")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
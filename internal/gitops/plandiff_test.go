@@ -0,0 +1,34 @@
+package gitops_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestUnifiedDiffs(t *testing.T) {
+	plan := &gitops.Plan{Changes: []gitops.PlannedChange{
+		{Mutation: gitops.Change, Kind: gitops.PolicyResource, Path: "sys/policies/acl/dev", Diff: "  path \"a\" {\n-   capabilities = [\"read\"]\n+   capabilities = [\"list\"]\n  }\n"},
+		// nothing to show
+		{Mutation: gitops.Change, Kind: gitops.PolicyResource, Path: "sys/policies/acl/same"},
+	}}
+	expected := strings.Join([]string{
+		"change policy sys/policies/acl/dev",
+		"--- vault/sys/policies/acl/dev",
+		"+++ local/sys/policies/acl/dev",
+		`  path "a" {`,
+		`-   capabilities = ["read"]`,
+		`+   capabilities = ["list"]`,
+		"  }",
+		"",
+		"",
+	}, "\n")
+	if diff := cmp.Diff(expected, plan.UnifiedDiffs(false)); diff != "" {
+		t.Errorf("unexpected diff output (-want +got):\n%s", diff)
+	}
+	if colored := plan.UnifiedDiffs(true); !strings.Contains(colored, "\x1b[31m-   capabilities") || !strings.Contains(colored, "\x1b[32m+   capabilities") {
+		t.Errorf("expected removed lines in red and added lines in green, got %q", colored)
+	}
+}
@@ -0,0 +1,63 @@
+package gitops
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2/hclwrite"
+)
+
+// FormatPolicy rewrites an HCL policy in the canonical style `terraform fmt` uses, keeping comments.
+func FormatPolicy(content []byte) []byte {
+	return hclwrite.Format(content)
+}
+
+// FormatPolicies formats every ACL policy in `directory`, which is usually the root of a repository, and every
+// password policy next to them, returning the files that weren't formatted. With `check`, nothing is rewritten.
+//
+// Apply sends policies to Vault byte for byte, so this is the only thing that changes how they're written.
+func FormatPolicies(directory string, check bool) ([]string, error) {
+	policyDirectory := filepath.Join(directory, "sys", "policies", "acl")
+	files, err := localPolicyFiles(policyDirectory)
+	if err != nil {
+		return nil, err
+	}
+	passwordPolicies, err := localFiles(filepath.Join(directory, "sys", "policies", "password"))
+	if err != nil {
+		return nil, err
+	}
+	var all []string
+	for _, file := range files {
+		all = append(all, file)
+	}
+	for _, file := range passwordPolicies {
+		all = append(all, file)
+	}
+	sort.Strings(all)
+	var unformatted []string
+	for _, file := range all {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading policy file: %w", err)
+		}
+		formatted := FormatPolicy(content)
+		if bytes.Equal(content, formatted) {
+			continue
+		}
+		unformatted = append(unformatted, file)
+		if check {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading policy file: %w", err)
+		}
+		if err := os.WriteFile(file, formatted, info.Mode().Perm()); err != nil {
+			return nil, fmt.Errorf("error writing formatted policy file: %w", err)
+		}
+	}
+	return unformatted, nil
+}
@@ -0,0 +1,161 @@
+package gitops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Checks that the token can make the kinds of changes in a plan, so a missing capability stops the apply before
+// anything changes instead of partway through with a bare 403.
+//
+// Changes to the same directory are assumed to need the same capabilities, so only one path from each is checked.
+// With SkipForbidden, changes the token can't make are dropped from the plan and reported instead.
+func (a *applier) checkCapabilities(ctx context.Context, plan *Plan) error {
+	var (
+		// directory|mutation -> the path checked for it
+		samples = map[string]string{}
+		// sampled path -> capabilities it needs
+		required = map[string]map[string]bool{}
+	)
+	sampleKey := func(change PlannedChange) string {
+		return path.Dir(change.Path) + "|" + change.Mutation.String()
+	}
+	for _, change := range plan.Changes {
+		key := sampleKey(change)
+		if _, seen := samples[key]; seen {
+			continue
+		}
+		samples[key] = change.Path
+		if required[change.Path] == nil {
+			required[change.Path] = map[string]bool{}
+		}
+		required[change.Path][requiredCapability(change.Mutation)] = true
+		if a.opts.BackupDirectory != "" || (a.opts.SkipUnchanged && change.Mutation == Change) {
+			required[change.Path]["read"] = true
+		}
+	}
+	if len(required) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(required))
+	for p := range required {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	capabilities, err := a.selfCapabilities(ctx, paths)
+	if err != nil {
+		// not being able to check isn't a reason not to try
+		log.Warn().Err(err).Msg("error checking token capabilities, continuing without a preflight check")
+		return nil
+	}
+
+	var (
+		errs []error
+		// sampled path -> first missing capability
+		missing = map[string]string{}
+	)
+	for _, p := range paths {
+		for _, needed := range missingCapabilities(required[p], capabilities[p]) {
+			errs = append(errs, fmt.Errorf("token lacks %s on %s", needed, p))
+			if _, ok := missing[p]; !ok {
+				missing[p] = needed
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if !a.opts.SkipForbidden {
+		return fmt.Errorf("token can't make the planned changes, nothing was applied: %w", errors.Join(errs...))
+	}
+	allowed := plan.Changes[:0]
+	for _, change := range plan.Changes {
+		sample := samples[sampleKey(change)]
+		if capability, ok := missing[sample]; ok {
+			a.opts.Report.Skip(change.Path, capability, fmt.Errorf("token lacks %s on %s", capability, sample))
+			continue
+		}
+		allowed = append(allowed, change)
+	}
+	plan.Changes = allowed
+	return nil
+}
+
+// Marks every change in a plan that the token likely isn't allowed to make, so it shows up in review.
+func (a *applier) annotateCapabilities(ctx context.Context, plan *Plan) error {
+	if len(plan.Changes) == 0 {
+		return nil
+	}
+	paths := make([]string, len(plan.Changes))
+	for i, change := range plan.Changes {
+		paths[i] = change.Path
+	}
+	capabilities, err := a.selfCapabilities(ctx, paths)
+	if err != nil {
+		return err
+	}
+	for i, change := range plan.Changes {
+		required := map[string]bool{requiredCapability(change.Mutation): true}
+		if missing := missingCapabilities(required, capabilities[change.Path]); len(missing) > 0 {
+			plan.Changes[i].Warning = fmt.Sprintf("will likely fail: permission denied (token lacks %s)", strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+// Asks Vault what the token can do on every path at once.
+func (a *applier) selfCapabilities(ctx context.Context, paths []string) (map[string][]string, error) {
+	var capabilities map[string][]string
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		secret, err := a.vc.Logical().WriteWithContext(ctx, "sys/capabilities-self", map[string]interface{}{
+			"paths": paths,
+		})
+		if err != nil {
+			return err
+		}
+		if secret == nil {
+			return fmt.Errorf("empty response from sys/capabilities-self")
+		}
+		capabilities = map[string][]string{}
+		for _, p := range paths {
+			raw, _ := secret.Data[p].([]interface{})
+			for _, c := range raw {
+				if s, ok := c.(string); ok {
+					capabilities[p] = append(capabilities[p], s)
+				}
+			}
+		}
+		return nil
+	})
+	return capabilities, err
+}
+
+// The capabilities in `required` that `has` doesn't grant, in the order Vault documents them.
+func missingCapabilities(required map[string]bool, has []string) []string {
+	granted := map[string]bool{}
+	for _, c := range has {
+		granted[c] = true
+	}
+	if granted["root"] {
+		return nil
+	}
+	var missing []string
+	for _, needed := range []string{"create", "read", "update", "delete"} {
+		if !required[needed] || granted[needed] {
+			continue
+		}
+		// Vault asks for update instead of create on endpoints that don't check whether things exist
+		if needed == "create" && granted["update"] {
+			continue
+		}
+		missing = append(missing, needed)
+	}
+	return missing
+}
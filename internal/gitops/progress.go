@@ -0,0 +1,90 @@
+package gitops
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultProgressInterval is how often a long download or apply logs how far along it is.
+const DefaultProgressInterval = 10 * time.Second
+
+// Progress logs how many objects a download or apply has gotten through every so often, so a run over a large cluster
+// doesn't look hung.
+//
+// A nil Progress ignores everything.
+type Progress struct {
+	what string
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	mu          sync.Mutex
+	done, total int
+	current     string
+}
+
+// StartProgress logs the progress of `what`, e.g. download, every `interval` until Stop is called. Zero means
+// DefaultProgressInterval.
+func StartProgress(what string, interval time.Duration) *Progress {
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	p := &Progress{what: what, stop: make(chan struct{})}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.log("in progress")
+			}
+		}
+	}()
+	return p
+}
+
+// Add counts `n` more objects to get through, as they're listed.
+func (p *Progress) Add(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total += n
+}
+
+// Done counts the object at `path` as gotten through, whether or not it had to be written.
+func (p *Progress) Done(path string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.current = path
+}
+
+// Stop stops logging progress and logs the final count.
+func (p *Progress) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.log("finished")
+}
+
+func (p *Progress) log(state string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	event := log.Info().Int("done", p.done).Int("total", p.total)
+	if p.current != "" {
+		event = event.Str("current", p.current)
+	}
+	event.Msgf("%s %s", p.what, state)
+}
@@ -0,0 +1,146 @@
+package gitops
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// The file at the top of a repository that lists what apply must never change.
+const ProtectFileName = ".hvresult-protect.yaml"
+
+// ProtectConfig lists policies, auth mounts, and auth roles that apply leaves alone, e.g. because Terraform manages
+// them or they're for breaking glass. Patterns are matched with path.Match.
+//
+// root and default are always protected.
+type ProtectConfig struct {
+	// Policy name patterns, e.g. terraform-*.
+	Policies []string `yaml:"policies"`
+	// Auth mounts whose roles are all protected, e.g. kubernetes.
+	AuthMounts []string `yaml:"auth_mounts"`
+	// Auth role name patterns, which can be prefixed with a mount to only match roles in it, e.g. approle/breakglass-*.
+	Roles []string `yaml:"roles"`
+	// If set, only policies matching one of these patterns are managed and the rest are left alone, for adopting
+	// hvresult gradually on a cluster where other things own some policies.
+	ManagedPolicies []string `yaml:"managed_policies"`
+	// Like ManagedPolicies, but for auth roles, with the same mount prefixes as Roles.
+	ManagedRoles []string `yaml:"managed_roles"`
+}
+
+// LoadProtectConfig reads a ProtectConfig. A file that doesn't exist protects nothing.
+func LoadProtectConfig(filename string) (*ProtectConfig, error) {
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &ProtectConfig{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading protect file: %w", err)
+	}
+	var config ProtectConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	// a typo shouldn't quietly unprotect something
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error decoding protect file %s: %w", filename, err)
+	}
+	if err := config.check(); err != nil {
+		return nil, fmt.Errorf("bad protect file %s: %w", filename, err)
+	}
+	return &config, nil
+}
+
+// makes sure every pattern is valid
+func (c *ProtectConfig) check() error {
+	for _, patterns := range [][]string{c.Policies, c.AuthMounts, c.Roles, c.ManagedPolicies, c.ManagedRoles} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("bad pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// AddManaged adds ManagedPolicies and ManagedRoles patterns, e.g. from flags.
+func (c *ProtectConfig) AddManaged(policies, roles []string) error {
+	c.ManagedPolicies = append(c.ManagedPolicies, policies...)
+	c.ManagedRoles = append(c.ManagedRoles, roles...)
+	return c.check()
+}
+
+// Protects reports whether `change` touches something protected. A nil ProtectConfig protects nothing.
+func (c *ProtectConfig) Protects(change PlannedChange) bool {
+	if c == nil {
+		return false
+	}
+	switch change.Kind {
+	case PolicyResource:
+		return matchAny(c.Policies, change.Name())
+	case IdentityEntityResource, IdentityGroupResource, MFAMethodResource, MFALoginEnforcementResource, OIDCResource, SentinelPolicyResource, PasswordPolicyResource, QuotaResource, SecretRoleResource, SecretsMountResource:
+		return false
+	case AuthMountResource:
+		return matchAny(c.AuthMounts, mountName(change))
+	}
+	mount := roleMount(change)
+	return matchAny(c.AuthMounts, mount) || matchAny(c.Roles, change.Name()) || matchAny(c.Roles, mount+"/"+change.Name())
+}
+
+// Manages reports whether `change` touches something that's managed according to ManagedPolicies and ManagedRoles.
+// Everything is managed when they're empty, as is everything but policies and auth roles.
+func (c *ProtectConfig) Manages(change PlannedChange) bool {
+	if c == nil {
+		return true
+	}
+	switch change.Kind {
+	case PolicyResource:
+		return len(c.ManagedPolicies) == 0 || matchAny(c.ManagedPolicies, change.Name())
+	case AuthRoleResource:
+		mount := roleMount(change)
+		return len(c.ManagedRoles) == 0 || matchAny(c.ManagedRoles, change.Name()) || matchAny(c.ManagedRoles, mount+"/"+change.Name())
+	}
+	return true
+}
+
+// auth/<mount>/<prefix>/<name>, where the mount can have slashes in it
+func roleMount(change PlannedChange) string {
+	mount, _, _ := splitRolePath(change.Path)
+	return mount
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Leaves out every change to something protected or unmanaged.
+func (p *Plan) dropProtected(config *ProtectConfig) {
+	if config == nil {
+		return
+	}
+	kept := p.Changes[:0]
+	for _, change := range p.Changes {
+		// there can be lots of these on a shared cluster, and leaving them alone is the point
+		if !config.Manages(change) {
+			log.Debug().Str("path", change.Path).Str("action", strings.ToLower(change.Mutation.String())).Msg("Leaving unmanaged object alone")
+			continue
+		}
+		if config.Protects(change) {
+			log.Warn().Str("path", change.Path).Str("action", strings.ToLower(change.Mutation.String())).Msg("Leaving protected object alone")
+			continue
+		}
+		kept = append(kept, change)
+	}
+	p.Changes = kept
+}
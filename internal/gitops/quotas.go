@@ -0,0 +1,146 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// Quotas are kept as a JSON file of Vault's fields each in <quotas>/rate-limit/<name> and <quotas>/lease-count/<name>,
+// usually sys/quotas. Lease count quotas need Vault Enterprise, and there just aren't any without it.
+
+var quotaTypes = []string{"rate-limit", "lease-count"}
+
+// Fields Vault fills in itself, which aren't kept in files.
+var quotaMetadataFields = []string{"name", "type", "counter", "id"}
+
+// rate-limit or lease-count
+func quotaType(change PlannedChange) string {
+	return filepath.Base(filepath.Dir(filepath.FromSlash(change.Path)))
+}
+
+// Plans every quota, like planSentinelPolicies. Also returns how many there are in Vault.
+func (a *applier) planQuotas(ctx context.Context, quotasDirectory string) ([]PlannedChange, int, error) {
+	var (
+		changes  []PlannedChange
+		existing int
+	)
+	for _, quotaType := range quotaTypes {
+		listPath := "sys/quotas/" + quotaType
+		names, err := a.listKeys(ctx, listPath)
+		if err != nil {
+			if a.opts.SkipForbidden && isPermissionDenied(err) {
+				a.opts.Report.Skip(listPath, "list", err)
+				continue
+			}
+			return nil, 0, fmt.Errorf("error listing %s from Vault: %w", listPath, err)
+		}
+		existing += len(names)
+		remote := make(map[string]bool, len(names))
+		for _, name := range names {
+			remote[name] = true
+		}
+		local, err := localFiles(filepath.Join(quotasDirectory, quotaType))
+		if err != nil {
+			return nil, 0, err
+		}
+		for name, file := range local {
+			mutation := Add
+			if remote[name] {
+				mutation = Change
+			}
+			changes = append(changes, PlannedChange{Mutation: mutation, Kind: QuotaResource, Path: listPath + "/" + name, File: file})
+		}
+		for _, name := range names {
+			if _, ok := local[name]; !ok {
+				changes = append(changes, PlannedChange{Mutation: Delete, Kind: QuotaResource, Path: listPath + "/" + name})
+			}
+		}
+	}
+	return changes, existing, nil
+}
+
+// Checks a quota file has the limit Vault needs.
+func validateQuota(change PlannedChange) error {
+	data, err := readRoleFile(change.File)
+	if err != nil {
+		return err
+	}
+	for _, field := range quotaMetadataFields {
+		if _, ok := data[field]; ok {
+			return fmt.Errorf("%s is set by Vault and can't be in the file", field)
+		}
+	}
+	limit := "rate"
+	if quotaType(change) == "lease-count" {
+		limit = "max_leases"
+	}
+	if _, ok := data[limit]; !ok {
+		return errors.New("a " + quotaType(change) + " quota needs " + limit)
+	}
+	return nil
+}
+
+// A quota in Vault in the local file format, or nil if it doesn't exist.
+func (a *applier) readRemoteQuota(ctx context.Context, change PlannedChange) ([]byte, error) {
+	var secret *vault.Secret
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = a.vc.Logical().ReadWithContext(ctx, change.Path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading quota %s from Vault: %w", change.Path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	for _, field := range quotaMetadataFields {
+		delete(secret.Data, field)
+	}
+	return json.MarshalIndent(nonDefaultFields(secret.Data), "", "  ")
+}
+
+// Writes a quota, skipping the write with SkipUnchanged if it'd be the same.
+func (a *applier) writeQuota(ctx context.Context, change PlannedChange) error {
+	data, err := readRoleFile(change.File)
+	if err != nil {
+		return err
+	}
+	if a.opts.SkipUnchanged && change.Mutation == Change {
+		same, err := a.unchanged(ctx, change)
+		if err != nil {
+			return err
+		}
+		if same {
+			log.Debug().Str("path", change.Path).Msg("Quota unchanged, skipping write")
+			return errUnchanged
+		}
+	}
+	log.Debug().Str("path", change.Path).Msg("Writing quota to Vault")
+	if err := a.write(ctx, change.Path, data); err != nil {
+		return fmt.Errorf("error writing quota %s to Vault: %w", change.Path, err)
+	}
+	return nil
+}
+
+// DownloadQuotas downloads every rate limit and lease count quota to `quotasDirectory`, which is usually sys/quotas.
+func DownloadQuotas(ctx context.Context, vc *vault.Client, quotasDirectory string) error {
+	return DownloadQuotasWithOptions(ctx, vc, quotasDirectory, DownloadOptions{})
+}
+
+// DownloadQuotasWithOptions is DownloadQuotas with options. Files for quotas that no longer exist are removed.
+func DownloadQuotasWithOptions(ctx context.Context, vc *vault.Client, quotasDirectory string, opts DownloadOptions) error {
+	a := opts.applier(vc)
+	for _, quotaType := range quotaTypes {
+		if err := a.downloadObjects(ctx, QuotaResource, "sys/quotas/"+quotaType, filepath.Join(quotasDirectory, quotaType), opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
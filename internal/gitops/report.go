@@ -0,0 +1,232 @@
+package gitops
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	mdtf "github.com/fbiville/markdown-table-formatter/pkg/markdown"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// Report collects what an apply or download changed, and what it left alone instead of failing.
+//
+// A nil Report ignores everything.
+type Report struct {
+	mu      sync.Mutex
+	Applied []AppliedItem `json:"applied"`
+	Skipped []SkippedItem `json:"skipped"`
+	Failed  []FailedItem  `json:"failed,omitempty"`
+	// Planned changes that weren't written because Vault already matched, with SkipUnchanged.
+	Unchanged []AppliedItem `json:"unchanged,omitempty"`
+}
+
+// AppliedItem is a change that was made in Vault.
+type AppliedItem struct {
+	Mutation Mutation     `json:"action"`
+	Kind     ResourceKind `json:"kind"`
+	Path     string       `json:"path"`
+}
+
+// FailedItem is a change that Vault refused or that couldn't be made.
+type FailedItem struct {
+	Mutation Mutation     `json:"action"`
+	Kind     ResourceKind `json:"kind"`
+	Path     string       `json:"path"`
+	Error    string       `json:"error"`
+}
+
+// SkippedItem is something that wasn't applied or downloaded because the token isn't allowed to.
+type SkippedItem struct {
+	Path string `json:"path"`
+	// e.g. list or update
+	Capability string `json:"capability"`
+	Reason     string `json:"reason"`
+}
+
+// Reset forgets everything recorded so far.
+func (r *Report) Reset() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Applied, r.Skipped, r.Failed, r.Unchanged = nil, nil, nil, nil
+}
+
+// Skip records that `path` was left alone for lack of `capability`.
+func (r *Report) Skip(path, capability string, reason error) {
+	log.Warn().Err(reason).Str("path", path).Str("capability", capability).Msg("Skipping, token lacks capability")
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped = append(r.Skipped, SkippedItem{Path: path, Capability: capability, Reason: reason.Error()})
+}
+
+// Apply records that `change` was made.
+func (r *Report) Apply(change PlannedChange) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Applied = append(r.Applied, AppliedItem{Mutation: change.Mutation, Kind: change.Kind, Path: change.Path})
+}
+
+// Unchange records that `change` wasn't needed.
+func (r *Report) Unchange(change PlannedChange) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Unchanged = append(r.Unchanged, AppliedItem{Mutation: change.Mutation, Kind: change.Kind, Path: change.Path})
+}
+
+// SummaryCounts is how many objects of one kind an apply did something to.
+type SummaryCounts struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Deleted   int `json:"deleted"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+}
+
+// Summary counts what was applied, left unchanged, and failed for each kind of object.
+func (r *Report) Summary() map[ResourceKind]*SummaryCounts {
+	summary := map[ResourceKind]*SummaryCounts{}
+	if r == nil {
+		return summary
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := func(kind ResourceKind) *SummaryCounts {
+		if summary[kind] == nil {
+			summary[kind] = &SummaryCounts{}
+		}
+		return summary[kind]
+	}
+	for _, item := range r.Applied {
+		switch item.Mutation {
+		case Add:
+			counts(item.Kind).Created++
+		case Change:
+			counts(item.Kind).Updated++
+		case Delete:
+			counts(item.Kind).Deleted++
+		}
+	}
+	for _, item := range r.Unchanged {
+		counts(item.Kind).Unchanged++
+	}
+	for _, item := range r.Failed {
+		counts(item.Kind).Failed++
+	}
+	return summary
+}
+
+// SummaryTable formats Summary as a Markdown table, or returns an empty string if nothing was planned.
+func (r *Report) SummaryTable() string {
+	summary := r.Summary()
+	if len(summary) == 0 {
+		return ""
+	}
+	kinds := make([]string, 0, len(summary))
+	for kind := range summary {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+	rows := make([][]string, 0, len(kinds))
+	for _, kind := range kinds {
+		counts := summary[ResourceKind(kind)]
+		rows = append(rows, []string{
+			kind,
+			strconv.Itoa(counts.Created),
+			strconv.Itoa(counts.Updated),
+			strconv.Itoa(counts.Deleted),
+			strconv.Itoa(counts.Unchanged),
+			strconv.Itoa(counts.Failed),
+		})
+	}
+	table, err := mdtf.NewTableFormatterBuilder().
+		WithPrettyPrint().
+		Build("Kind", "Created", "Updated", "Deleted", "Unchanged", "Failed").
+		Format(rows)
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+// Fail records that `change` couldn't be made.
+func (r *Report) Fail(change PlannedChange, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Failed = append(r.Failed, FailedItem{Mutation: change.Mutation, Kind: change.Kind, Path: change.Path, Error: err.Error()})
+}
+
+// SortedFailed returns the failed changes ordered by path.
+func (r *Report) SortedFailed() []FailedItem {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failed := append([]FailedItem(nil), r.Failed...)
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].Path < failed[j].Path
+	})
+	return failed
+}
+
+// SortedApplied returns the applied changes ordered by path.
+func (r *Report) SortedApplied() []AppliedItem {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	applied := append([]AppliedItem(nil), r.Applied...)
+	sort.Slice(applied, func(i, j int) bool {
+		return applied[i].Path < applied[j].Path
+	})
+	return applied
+}
+
+// SortedSkipped returns the skipped items ordered by path.
+func (r *Report) SortedSkipped() []SkippedItem {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	skipped := append([]SkippedItem(nil), r.Skipped...)
+	sort.Slice(skipped, func(i, j int) bool {
+		return skipped[i].Path < skipped[j].Path
+	})
+	return skipped
+}
+
+func isPermissionDenied(err error) bool {
+	var respErr *vault.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden
+}
+
+// the capability a change needs
+func requiredCapability(mutation Mutation) string {
+	switch mutation {
+	case Add:
+		return "create"
+	case Delete:
+		return "delete"
+	}
+	return "update"
+}
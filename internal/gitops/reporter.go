@@ -0,0 +1,58 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ApplyReporter is told when an apply starts and how it ended, e.g. to update an external system.
+type ApplyReporter interface {
+	Started(ctx context.Context) error
+	Finished(ctx context.Context, applyErr error) error
+}
+
+// PlanReporter is told what's about to be applied in a namespace once it's been planned and checked, between Started
+// and Finished. See ApplyOptions.Planned.
+type PlanReporter interface {
+	Planned(ctx context.Context, namespace string, plan *Plan) error
+}
+
+// sends `body` as JSON and decodes the response into `v` if it's not nil
+func requestJSON(ctx context.Context, client *http.Client, method, url string, header http.Header, body, v any) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	log.Debug().Str("method", method).Str("url", url).Msg("sending report request")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"github.com/threatkey-oss/hvresult/internal"
@@ -47,7 +48,7 @@ func GetPolicyChangeDifferentials(
 		affectedPrincipals = make(map[string]*internal.RSoPDifferential, len(changedFiles))
 	)
 	// determine if any relevant files got deleted
-	// (these are not covered by the filepath.WalkDir invocation below)
+	// (these are not covered by the walk below)
 	for _, changed := range changedFiles {
 		if changed.Principal && changed.Mutation == Delete {
 			policies, err := readPrincipalPolicies(git, changed.Path, relativePolicyDirectory, historicalGitRef)
@@ -74,11 +75,11 @@ func GetPolicyChangeDifferentials(
 		return nil, fmt.Errorf("error getting absolute path of auth principal directory: %w", err)
 	}
 	log.Debug().Str("root", absWalkRoot).Str("policy", policyName).Msg("walking auth directory for policy matches")
-	err = filepath.WalkDir(absWalkRoot, func(path string, d fs.DirEntry, _ error) error {
+	err = walkLocal(absWalkRoot, func(path string, d fs.DirEntry, _ error) error {
 		if d.IsDir() {
 			return nil
 		}
-		content, err := os.ReadFile(path)
+		content, err := readDataFile(path)
 		if err != nil {
 			return err
 		}
@@ -86,7 +87,7 @@ func GetPolicyChangeDifferentials(
 		if err := json.Unmarshal(content, &authData); err != nil {
 			return fmt.Errorf("error unmarshalling %s as auth principal data: %w", path, err)
 		}
-		for _, name := range authData.AllPolicies() {
+		for _, name := range append(authData.EffectivePolicies(), authData.GlobbedPolicies([]string{policyName})...) {
 			if name == policyName {
 				relPath, err := filepath.Rel(git.Dir, path)
 				if err != nil {
@@ -105,6 +106,35 @@ func GetPolicyChangeDifferentials(
 	return affectedPrincipals, err
 }
 
+// Names of the policies in the policy directory, from the working copy when gitRef is the empty string.
+func listPolicyNames(git Git, relativePolicyDirectory, historicalGitRef string) ([]string, error) {
+	if historicalGitRef == "" {
+		entries, err := os.ReadDir(filepath.Join(git.Dir, relativePolicyDirectory))
+		if err != nil {
+			return nil, fmt.Errorf("error listing working copy policies: %w", err)
+		}
+		var (
+			names []string
+			rules = loadIgnoreRules(filepath.Join(git.Dir, relativePolicyDirectory))
+		)
+		for _, entry := range entries {
+			if !entry.IsDir() && !rules.ignored(filepath.Join(git.Dir, relativePolicyDirectory, entry.Name()), false) {
+				names = append(names, policyNameFromFile(entry.Name()))
+			}
+		}
+		return names, nil
+	}
+	output, err := git.CombinedOutput("ls-tree", "--name-only", historicalGitRef+":"+filepath.ToSlash(relativePolicyDirectory))
+	if err != nil {
+		return nil, fmt.Errorf("error listing policies at ref %s: %w", historicalGitRef, err)
+	}
+	names := strings.Fields(output)
+	for i, name := range names {
+		names[i] = policyNameFromFile(name)
+	}
+	return names, nil
+}
+
 // when gitRef is the empty string, this reads from the working copy.
 func readPrincipalPolicies(git Git, relativePrincipalPath, relativePolicyDirectory, historicalGitRef string) ([]*internal.Policy, error) {
 	var (
@@ -128,16 +158,25 @@ func readPrincipalPolicies(git Git, relativePrincipalPath, relativePolicyDirecto
 		log.Debug().Str("output", contentStr).Msgf("git show %s", readThing)
 		principalData = []byte(contentStr)
 	}
+	principalData, err := dataFileJSON(relativePrincipalPath, principalData)
+	if err != nil {
+		return nil, err
+	}
 	// find out what policies apply
 	var data authPrincipalData
 	if err := json.Unmarshal(principalData, &data); err != nil {
 		return nil, fmt.Errorf("error unmarshalling %s as auth principal data: %w", readThing, err)
 	}
-	// get policies
-	var (
-		allPolicies = data.AllPolicies()
-		policies    = make([]*internal.Policy, 0, len(allPolicies))
-	)
+	// get policies, including the ones a token role allows by glob
+	allPolicies := data.EffectivePolicies()
+	if len(data.AllowedPoliciesGlob) > 0 {
+		available, err := listPolicyNames(git, relativePolicyDirectory, historicalGitRef)
+		if err != nil {
+			return nil, err
+		}
+		allPolicies = append(allPolicies, data.GlobbedPolicies(available)...)
+	}
+	policies := make([]*internal.Policy, 0, len(allPolicies))
 	for _, policyName := range allPolicies {
 		var (
 			policyReadThing string
@@ -145,9 +184,13 @@ func readPrincipalPolicies(git Git, relativePrincipalPath, relativePolicyDirecto
 			err             error
 		)
 		if historicalGitRef == "" {
-			policyReadThing = filepath.Join(git.Dir, relativePolicyDirectory, policyName)
+			policyReadThing = filepath.Join(git.Dir, relativePolicyDirectory, policyFileName(policyName))
 			data, err := os.ReadFile(policyReadThing)
 			if err != nil {
+				if errors.Is(err, os.ErrNotExist) && policyName == "default" {
+					log.Debug().Msg("default policy isn't in the repository, leaving it out")
+					continue
+				}
 				if errors.Is(err, os.ErrNotExist) {
 					log.Warn().Err(err).Msg("referenced policy does not exist on disk, treating as empty")
 					continue
@@ -156,9 +199,14 @@ func readPrincipalPolicies(git Git, relativePrincipalPath, relativePolicyDirecto
 			}
 			policyData = string(data)
 		} else {
-			policyReadThing = fmt.Sprintf("%s:%s", historicalGitRef, filepath.Join(relativePolicyDirectory, policyName))
+			policyReadThing = fmt.Sprintf("%s:%s", historicalGitRef, filepath.Join(relativePolicyDirectory, policyFileName(policyName)))
 			policyData, err = git.CombinedOutput("show", policyReadThing)
 			if err != nil {
+				// repositories don't have to track the default policy
+				if policyName == "default" {
+					log.Debug().Str("ref", historicalGitRef).Msg("default policy isn't in the repository, leaving it out")
+					continue
+				}
 				return nil, fmt.Errorf("error getting policy file at ref %s: %w", policyReadThing, err)
 			}
 		}
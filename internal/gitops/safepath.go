@@ -0,0 +1,86 @@
+package gitops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Refuses names that would end up somewhere other than a single file in the intended directory, e.g. a policy or role
+// name from Vault that's used as a file name.
+func checkSafeName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("refusing to use unsafe name %q", name)
+	}
+	return nil
+}
+
+// Refuses paths with `..` in them so they can't refer to anything outside where they're supposed to.
+func checkNoTraversal(path string) error {
+	for _, segment := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return fmt.Errorf("refusing path with '..' in it: %s", path)
+		}
+	}
+	return nil
+}
+
+// Refuses files under `root` that are symlinks to something outside of it, so a repository can't get anything else
+// read and sent to Vault.
+func checkInside(root, path string) error {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %w", root, err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %w", path, err)
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to read %s, which links to %s outside of %s", path, resolved, root)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("refusing to read %s, which isn't a regular file", path)
+	}
+	return nil
+}
+
+// Checks every file a plan will read.
+func checkPlanFiles(plan *Plan, authDirectory, policyDirectory, identityDirectory, sentinelDirectory, secretsDirectory, mountsDirectory, quotasDirectory string) error {
+	for _, change := range plan.Changes {
+		if err := checkNoTraversal(change.Path); err != nil {
+			return err
+		}
+		if change.File == "" {
+			continue
+		}
+		root := authDirectory
+		switch change.Kind {
+		case PolicyResource:
+			root = policyDirectory
+		case IdentityEntityResource, IdentityGroupResource, MFAMethodResource, MFALoginEnforcementResource, OIDCResource:
+			root = identityDirectory
+		case SentinelPolicyResource:
+			root = sentinelDirectory
+		case PasswordPolicyResource:
+			// next to the ACL policies, and backups have them all in one directory
+			root = filepath.Dir(policyDirectory)
+		case SecretRoleResource:
+			root = secretsDirectory
+		case SecretsMountResource:
+			root = mountsDirectory
+		case QuotaResource:
+			root = quotasDirectory
+		}
+		if err := checkInside(root, change.File); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// The saved plan format, bumped whenever older versions couldn't apply a new plan correctly.
+const savedPlanVersion = 1
+
+// SavedPlan is a plan written by `plan --out`, with the content of every file it writes, so `apply` can make exactly
+// those changes later without the repository.
+type SavedPlan struct {
+	Version int `json:"version"`
+	// The cluster and namespace the plan was made against, which it can't be applied anywhere else.
+	Address   string `json:"address"`
+	Namespace string `json:"namespace,omitempty"`
+	// How many objects were listed in Vault while planning, for MaxDeletionPercent.
+	Existing int           `json:"existing,omitempty"`
+	Changes  []SavedChange `json:"changes"`
+}
+
+// SavedChange is a PlannedChange in a SavedPlan.
+type SavedChange struct {
+	Mutation Mutation     `json:"action"`
+	Kind     ResourceKind `json:"kind"`
+	Path     string       `json:"path"`
+	// The local file's name, whose extension says how to parse it, and content. Empty for deletes.
+	FileName string `json:"file_name,omitempty"`
+	Content  string `json:"content,omitempty"`
+	// SHA-256 of the object in Vault when the plan was made, formatted like a downloaded file, or empty if it didn't
+	// exist. Applying refuses if it's different.
+	RemoteHash string `json:"remote_hash,omitempty"`
+	Depth      int    `json:"depth,omitempty"`
+}
+
+// SavePlan reads what everything in `plan` looks like in Vault right now and saves the plan with it.
+func SavePlan(ctx context.Context, vc *vault.Client, plan *Plan, opts ApplyOptions) (*SavedPlan, error) {
+	var (
+		a     = newApplier(vc, opts)
+		saved = &SavedPlan{
+			Version:   savedPlanVersion,
+			Address:   vc.Address(),
+			Namespace: vc.Namespace(),
+			Existing:  plan.Existing,
+			Changes:   make([]SavedChange, len(plan.Changes)),
+		}
+	)
+	for i, change := range plan.Changes {
+		saved.Changes[i] = SavedChange{
+			Mutation: change.Mutation,
+			Kind:     change.Kind,
+			Path:     change.Path,
+			Depth:    change.depth,
+		}
+		if change.File == "" {
+			continue
+		}
+		content, err := os.ReadFile(change.File)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s to save in the plan: %w", change.File, err)
+		}
+		saved.Changes[i].FileName = filepath.Base(change.File)
+		saved.Changes[i].Content = string(content)
+	}
+	hashes, err := a.remoteHashes(ctx, plan)
+	if err != nil {
+		return nil, err
+	}
+	for i, hash := range hashes {
+		saved.Changes[i].RemoteHash = hash
+	}
+	return saved, nil
+}
+
+// ReadSavedPlan reads a plan written by `plan --out`.
+func ReadSavedPlan(file string) (*SavedPlan, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading saved plan: %w", err)
+	}
+	var saved SavedPlan
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return nil, fmt.Errorf("error decoding saved plan %s: %w", file, err)
+	}
+	if saved.Version != savedPlanVersion {
+		return nil, fmt.Errorf("saved plan %s is version %d, but this version of hvresult can only apply version %d", file, saved.Version, savedPlanVersion)
+	}
+	return &saved, nil
+}
+
+// ApplySavedPlanWithOptions makes exactly the changes in `saved`. It refuses if the plan was made against another
+// cluster or namespace, or if anything it changes is different in Vault than when it was planned, since then the plan
+// might not do what was reviewed anymore.
+//
+// Deleting policies that are still in use is refused unless ApplyOptions.Force is set, like for ApplyChangesWithOptions.
+// The directory options in `opts` aren't used, and Targets, Only, Protect, and Prune were already applied when the
+// plan was made.
+func ApplySavedPlanWithOptions(ctx context.Context, vc *vault.Client, saved *SavedPlan, opts ApplyOptions) error {
+	log.Info().Msg("Applying saved plan to Vault...")
+	if saved.Address != vc.Address() || saved.Namespace != vc.Namespace() {
+		return fmt.Errorf("the plan was made against %s, not %s", clusterName(saved.Address, saved.Namespace), clusterName(vc.Address(), vc.Namespace()))
+	}
+	// the appliers read local files, so the content goes back in files, keeping their names for the extensions
+	dir, err := os.MkdirTemp("", "hvresult-plan-")
+	if err != nil {
+		return fmt.Errorf("error creating directory for the saved plan's files: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	plan := &Plan{Existing: saved.Existing}
+	for i, change := range saved.Changes {
+		planned := PlannedChange{Mutation: change.Mutation, Kind: change.Kind, Path: change.Path, depth: change.Depth}
+		if change.Mutation != Delete {
+			if change.FileName == "" || strings.ContainsAny(change.FileName, `/\`) {
+				return fmt.Errorf("saved plan has a bad file name %q for %s", change.FileName, change.Path)
+			}
+			planned.File = filepath.Join(dir, strconv.Itoa(i), change.FileName)
+			if err := os.MkdirAll(filepath.Dir(planned.File), 0o700); err != nil {
+				return fmt.Errorf("error creating directory for the saved plan's files: %w", err)
+			}
+			if err := os.WriteFile(planned.File, []byte(change.Content), 0o600); err != nil {
+				return fmt.Errorf("error writing %s from the saved plan: %w", change.Path, err)
+			}
+		}
+		plan.Changes = append(plan.Changes, planned)
+	}
+
+	a := newApplier(vc, opts)
+	hashes, err := a.remoteHashes(ctx, plan)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for i, hash := range hashes {
+		if hash != saved.Changes[i].RemoteHash {
+			stale = append(stale, saved.Changes[i].Path)
+		}
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("refusing to apply the saved plan, because %d objects changed in Vault since it was made, plan again: %s", len(stale), strings.Join(stale, ", "))
+	}
+	// what uses a policy can change without touching anything in the plan, so this is checked again
+	if err := a.checkPoliciesUnused(ctx, plan); err != nil {
+		return err
+	}
+	if err := a.checkDeletionThreshold(plan); err != nil {
+		return err
+	}
+	if err := a.checkCapabilities(ctx, plan); err != nil {
+		return err
+	}
+	if err := a.confirmDeletions(plan); err != nil {
+		return err
+	}
+	if a.opts.Planned != nil {
+		a.opts.Planned(ctx, a.vc.Namespace(), plan)
+	}
+	return a.apply(ctx, plan)
+}
+
+// The hash of every change's object in Vault, in the same order, or "" for ones that don't exist.
+func (a *applier) remoteHashes(ctx context.Context, plan *Plan) ([]string, error) {
+	var (
+		hashes = make([]string, len(plan.Changes))
+		eg     errgroup.Group
+		errs   errorCollector
+	)
+	eg.SetLimit(concurrency(a.opts.Concurrency))
+	for i, change := range plan.Changes {
+		i, change := i, change
+		eg.Go(func() error {
+			content, err := a.readRemote(ctx, change)
+			if err != nil {
+				errs.add(err)
+				return nil
+			}
+			if content != nil {
+				hashes[i] = contentHash(string(content))
+			}
+			return nil
+		})
+	}
+	_ = eg.Wait()
+	if err := errs.join("errors reading objects in the plan from Vault"); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func clusterName(address, namespace string) string {
+	if namespace == "" {
+		return address
+	}
+	return address + " namespace " + namespace
+}
@@ -0,0 +1,140 @@
+package gitops
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/agext/levenshtein"
+)
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// The subset of JSON Schema the files in schemas/ use.
+type roleSchema struct {
+	Title                string `json:"title"`
+	AdditionalProperties bool   `json:"additionalProperties"`
+	Properties           map[string]struct {
+		// a string or a list of strings
+		Type json.RawMessage `json:"type"`
+	} `json:"properties"`
+}
+
+var (
+	loadSchemasOnce sync.Once
+	roleSchemas     map[string]*roleSchema
+)
+
+// mount types that share a schema
+var schemaAliases = map[string]string{
+	"oidc": "jwt",
+}
+
+// Returns the schema for an auth mount type, or nil if there isn't one.
+func schemaForMountType(mountType string) *roleSchema {
+	loadSchemasOnce.Do(func() {
+		roleSchemas = map[string]*roleSchema{}
+		entries, _ := schemaFiles.ReadDir("schemas")
+		for _, entry := range entries {
+			data, err := schemaFiles.ReadFile("schemas/" + entry.Name())
+			if err != nil {
+				panic(err)
+			}
+			var schema roleSchema
+			if err := json.Unmarshal(data, &schema); err != nil {
+				panic(fmt.Sprintf("invalid embedded schema %s: %v", entry.Name(), err))
+			}
+			roleSchemas[strings.TrimSuffix(entry.Name(), ".json")] = &schema
+		}
+	})
+	if alias, ok := schemaAliases[mountType]; ok {
+		mountType = alias
+	}
+	return roleSchemas[mountType]
+}
+
+// ValidateRole checks role data against the schema for its auth mount type.
+//
+// Vault silently ignores fields it doesn't know, so a typo like `token_policie` would otherwise go unnoticed.
+// Roles for mount types without a schema are always valid.
+func ValidateRole(mountType string, data map[string]interface{}) error {
+	schema := schemaForMountType(mountType)
+	if schema == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var errs []error
+	for _, key := range keys {
+		property, ok := schema.Properties[key]
+		if !ok {
+			if !schema.AdditionalProperties {
+				errs = append(errs, unknownFieldError(schema, key))
+			}
+			continue
+		}
+		var types []string
+		if err := json.Unmarshal(property.Type, &types); err != nil {
+			types = []string{strings.Trim(string(property.Type), `"`)}
+		}
+		if actual := jsonType(data[key]); !contains(types, actual) {
+			errs = append(errs, fmt.Errorf("field '%s' is %s, expected %s", key, actual, strings.Join(types, " or ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func unknownFieldError(schema *roleSchema, key string) error {
+	var (
+		closest  string
+		distance = 3 // anything further away isn't a typo
+	)
+	for name := range schema.Properties {
+		if d := levenshtein.Distance(key, name, nil); d < distance || (d == distance && name < closest) {
+			closest, distance = name, d
+		}
+	}
+	if closest != "" {
+		return fmt.Errorf("unknown field '%s' for %s (did you mean '%s'?)", key, schema.Title, closest)
+	}
+	return fmt.Errorf("unknown field '%s' for %s", key, schema.Title)
+}
+
+// the JSON Schema type of a value decoded by encoding/json
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package gitops_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestValidateRole(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		mountType string
+		data      map[string]interface{}
+		// substring of the expected error, if any
+		expected string
+	}{
+		{"Valid", "approle", map[string]interface{}{"token_policies": []interface{}{"a"}, "token_ttl": "1h", "secret_id_num_uses": float64(0)}, ""},
+		{"CommaSeparatedList", "kubernetes", map[string]interface{}{"bound_service_account_names": "a,b"}, ""},
+		{"Typo", "approle", map[string]interface{}{"token_policie": []interface{}{"a"}}, "did you mean 'token_policies'"},
+		{"WrongType", "approle", map[string]interface{}{"bind_secret_id": "yes"}, "field 'bind_secret_id' is string, expected boolean"},
+		{"OIDCUsesJWT", "oidc", map[string]interface{}{"bound_audiences": []interface{}{"x"}, "user_claim": "sub"}, ""},
+		{"OCI", "oci", map[string]interface{}{"ocid_list": "ocid1.group.oc1..a", "token_policies": []interface{}{"a"}}, ""},
+		{"SAMLTypo", "saml", map[string]interface{}{"bound_subject": []interface{}{"x"}}, "did you mean 'bound_subjects'"},
+		{"UnknownMountType", "some-plugin", map[string]interface{}{"anything": true}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := gitops.ValidateRole(tc.mountType, tc.data)
+			switch {
+			case tc.expected == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)):
+				t.Fatalf("expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// Secrets engine roles are kept in <secrets>/<mount>/<prefix>/<name>, the same way auth roles are, since the mount
+// paths can't be told apart from anything else at the top of the repository.
+
+// Determines the path to roles for a secrets engine type.
+func secretRolePathPrefixFor(mountType string) (string, bool) {
+	switch mountType {
+	case "database", "pki", "aws":
+		return "roles", true
+	case "transit":
+		return "keys", true
+	}
+	return "", false
+}
+
+// Transit keys are kept as their type and config, since everything else Vault returns is key material or history.
+type transitKey struct {
+	Type                 string `json:"type,omitempty"`
+	Derived              bool   `json:"derived,omitempty"`
+	ConvergentEncryption bool   `json:"convergent_encryption,omitempty"`
+	Exportable           bool   `json:"exportable,omitempty"`
+	AllowPlaintextBackup bool   `json:"allow_plaintext_backup,omitempty"`
+	DeletionAllowed      bool   `json:"deletion_allowed,omitempty"`
+	MinDecryptionVersion int    `json:"min_decryption_version,omitempty"`
+	MinEncryptionVersion int    `json:"min_encryption_version,omitempty"`
+	// seconds or a duration string
+	AutoRotatePeriod interface{} `json:"auto_rotate_period,omitempty"`
+}
+
+// <mount>/keys/<name> is a transit key, everything else is a role
+func isTransitKey(change PlannedChange) bool {
+	return path.Base(path.Dir(change.Path)) == "keys"
+}
+
+// Plans every role in every supported secrets engine, like planMount, including `missing` ones that are about to be
+// enabled. Also returns how many there are in Vault.
+//
+// Transit keys are never deleted, since that destroys everything encrypted with them.
+func (a *applier) planSecrets(ctx context.Context, secretsDirectory string, missing map[string]*vault.MountOutput) ([]PlannedChange, int, error) {
+	var mounts map[string]*vault.MountOutput
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		mounts, err = a.vc.Sys().ListMountsWithContext(ctx)
+		return err
+	})
+	if err != nil {
+		if a.opts.SkipForbidden && isPermissionDenied(err) {
+			a.opts.Report.Skip("sys/mounts", "read", err)
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("error listing secrets engines from Vault: %w", err)
+	}
+	for name, mount := range missing {
+		mounts[name+"/"] = mount
+	}
+	var (
+		changes  []PlannedChange
+		existing int
+	)
+	for mountName, mount := range mounts {
+		prefix, ok := secretRolePathPrefixFor(mount.Type)
+		if !ok {
+			continue
+		}
+		listPath := strings.TrimSuffix(mountName, "/") + "/" + prefix
+		var (
+			names []string
+			err   error
+		)
+		// nothing to list in a mount that hasn't been enabled yet
+		if mount.Accessor != "" {
+			names, err = a.listKeys(ctx, listPath)
+		}
+		if err != nil {
+			if a.opts.SkipForbidden && isPermissionDenied(err) {
+				a.opts.Report.Skip(listPath, "list", err)
+				continue
+			}
+			return nil, 0, fmt.Errorf("error listing %s from Vault: %w", listPath, err)
+		}
+		existing += len(names)
+		remote := make(map[string]bool, len(names))
+		for _, name := range names {
+			remote[name] = true
+		}
+		local, err := localFiles(filepath.Join(secretsDirectory, filepath.FromSlash(listPath)))
+		if err != nil {
+			return nil, 0, err
+		}
+		for name, file := range local {
+			mutation := Add
+			if remote[name] {
+				mutation = Change
+			}
+			changes = append(changes, PlannedChange{Mutation: mutation, Kind: SecretRoleResource, Path: listPath + "/" + name, File: file})
+		}
+		for _, name := range names {
+			if _, ok := local[name]; ok {
+				continue
+			}
+			if mount.Type == "transit" {
+				log.Warn().Str("path", listPath+"/"+name).Msg("Transit key has no local file, but transit keys are never deleted")
+				continue
+			}
+			changes = append(changes, PlannedChange{Mutation: Delete, Kind: SecretRoleResource, Path: listPath + "/" + name})
+		}
+	}
+	return changes, existing, nil
+}
+
+func readTransitKeyFile(path string) (*transitKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading local transit key file %s: %w", path, err)
+	}
+	var key transitKey
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&key); err != nil {
+		return nil, fmt.Errorf("error decoding local transit key file %s: %w", path, err)
+	}
+	return &key, nil
+}
+
+// Checks a role or transit key file can be decoded.
+func validateSecretRole(change PlannedChange) error {
+	if isTransitKey(change) {
+		_, err := readTransitKeyFile(change.File)
+		return err
+	}
+	_, err := readRoleFile(change.File)
+	return err
+}
+
+// A role or transit key in Vault in the local file format, or nil if it doesn't exist.
+func (a *applier) readRemoteSecretRole(ctx context.Context, change PlannedChange) ([]byte, error) {
+	var secret *vault.Secret
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = a.vc.Logical().ReadWithContext(ctx, change.Path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s from Vault: %w", change.Path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	if !isTransitKey(change) {
+		return json.MarshalIndent(secret.Data, "", "  ")
+	}
+	// round trip through the local format to leave out key material
+	encoded, err := json.Marshal(secret.Data)
+	if err != nil {
+		return nil, err
+	}
+	var key transitKey
+	if err := json.Unmarshal(encoded, &key); err != nil {
+		return nil, fmt.Errorf("error decoding transit key %s: %w", change.Path, err)
+	}
+	return json.MarshalIndent(key, "", "  ")
+}
+
+// Writes a role or transit key, skipping the write with SkipUnchanged if it'd be the same.
+func (a *applier) writeSecretRole(ctx context.Context, change PlannedChange) error {
+	if a.opts.SkipUnchanged && change.Mutation == Change {
+		same, err := a.unchanged(ctx, change)
+		if err != nil {
+			return err
+		}
+		if same {
+			log.Debug().Str("path", change.Path).Msg("Secrets engine role unchanged, skipping write")
+			return errUnchanged
+		}
+	}
+	log.Debug().Str("path", change.Path).Msg("Writing secrets engine role to Vault")
+	var err error
+	if isTransitKey(change) {
+		err = a.writeTransitKey(ctx, change)
+	} else {
+		var data map[string]interface{}
+		if data, err = readRoleFile(change.File); err == nil {
+			err = a.write(ctx, change.Path, withoutRedacted(data))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s to Vault: %w", change.Path, err)
+	}
+	return nil
+}
+
+// Keys are created with the settings that can only be set then, and then configured.
+func (a *applier) writeTransitKey(ctx context.Context, change PlannedChange) error {
+	key, err := readTransitKeyFile(change.File)
+	if err != nil {
+		return err
+	}
+	config := map[string]interface{}{
+		"exportable":             key.Exportable,
+		"allow_plaintext_backup": key.AllowPlaintextBackup,
+		"deletion_allowed":       key.DeletionAllowed,
+	}
+	if key.MinDecryptionVersion > 0 {
+		config["min_decryption_version"] = key.MinDecryptionVersion
+	}
+	if key.MinEncryptionVersion > 0 {
+		config["min_encryption_version"] = key.MinEncryptionVersion
+	}
+	if key.AutoRotatePeriod != nil {
+		config["auto_rotate_period"] = key.AutoRotatePeriod
+	}
+	if change.Mutation == Add {
+		create := map[string]interface{}{
+			"derived":               key.Derived,
+			"convergent_encryption": key.ConvergentEncryption,
+		}
+		if key.Type != "" {
+			create["type"] = key.Type
+		}
+		for _, field := range []string{"exportable", "allow_plaintext_backup", "auto_rotate_period"} {
+			if value, ok := config[field]; ok {
+				create[field] = value
+			}
+		}
+		if err := a.write(ctx, change.Path, create); err != nil {
+			return err
+		}
+	}
+	return a.write(ctx, change.Path+"/config", config)
+}
+
+// DownloadSecrets downloads the roles of every supported secrets engine to `secretsDirectory`.
+func DownloadSecrets(ctx context.Context, vc *vault.Client, secretsDirectory string) error {
+	return DownloadSecretsWithOptions(ctx, vc, secretsDirectory, DownloadOptions{})
+}
+
+// DownloadSecretsWithOptions is DownloadSecrets with options. Files for roles that no longer exist are removed.
+func DownloadSecretsWithOptions(ctx context.Context, vc *vault.Client, secretsDirectory string, opts DownloadOptions) error {
+	a := opts.applier(vc)
+	mounts, err := a.secretsMounts(ctx)
+	if err != nil {
+		if opts.SkipForbidden && isPermissionDenied(err) {
+			opts.Report.Skip("sys/mounts", "read", err)
+			return nil
+		}
+		return err
+	}
+	for mountName, mount := range mounts {
+		prefix, ok := secretRolePathPrefixFor(mount.Type)
+		if !ok || !opts.includesMount(mountName) {
+			continue
+		}
+		listPath := strings.TrimSuffix(mountName, "/") + "/" + prefix
+		if err := checkNoTraversal(listPath); err != nil {
+			return err
+		}
+		if err := a.downloadObjects(ctx, SecretRoleResource, listPath, filepath.Join(secretsDirectory, filepath.FromSlash(listPath)), opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
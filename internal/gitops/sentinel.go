@@ -0,0 +1,187 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// Sentinel policies are Vault Enterprise only. They're kept as JSON files in <sentinel>/egp/<name> and
+// <sentinel>/rgp/<name>, next to ACL policies in sys/policies.
+
+// SentinelPolicy is the local file format of an endpoint or role governing policy.
+type SentinelPolicy struct {
+	// The Sentinel code.
+	Policy string `json:"policy"`
+	// advisory, soft-mandatory, or hard-mandatory
+	EnforcementLevel string `json:"enforcement_level"`
+	// The request paths an EGP applies to, which can end in a glob. RGPs don't have any.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// egp or rgp
+func sentinelType(change PlannedChange) string {
+	return filepath.Base(filepath.Dir(filepath.FromSlash(change.Path)))
+}
+
+// Plans every EGP and RGP, like planPolicies. Also returns how many there are in Vault.
+func (a *applier) planSentinelPolicies(ctx context.Context, sentinelDirectory string) ([]PlannedChange, int, error) {
+	var (
+		changes  []PlannedChange
+		existing int
+	)
+	for _, policyType := range []string{"egp", "rgp"} {
+		listPath := "sys/policies/" + policyType
+		names, err := a.listKeys(ctx, listPath)
+		if err != nil {
+			if a.opts.SkipForbidden && isPermissionDenied(err) {
+				a.opts.Report.Skip(listPath, "list", err)
+				continue
+			}
+			return nil, 0, fmt.Errorf("error listing %s from Vault: %w", listPath, err)
+		}
+		existing += len(names)
+		remote := make(map[string]bool, len(names))
+		for _, name := range names {
+			remote[name] = true
+		}
+		local, err := localFiles(filepath.Join(sentinelDirectory, policyType))
+		if err != nil {
+			return nil, 0, err
+		}
+		for name, file := range local {
+			mutation := Add
+			if remote[name] {
+				mutation = Change
+			}
+			changes = append(changes, PlannedChange{Mutation: mutation, Kind: SentinelPolicyResource, Path: listPath + "/" + name, File: file})
+		}
+		for _, name := range names {
+			if _, ok := local[name]; !ok {
+				changes = append(changes, PlannedChange{Mutation: Delete, Kind: SentinelPolicyResource, Path: listPath + "/" + name})
+			}
+		}
+	}
+	return changes, existing, nil
+}
+
+func readSentinelFile(path string) (*SentinelPolicy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading local Sentinel policy file %s: %w", path, err)
+	}
+	var policy SentinelPolicy
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("error decoding local Sentinel policy file %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+// Checks a Sentinel policy file has everything Vault needs.
+func validateSentinelPolicy(change PlannedChange) error {
+	policy, err := readSentinelFile(change.File)
+	if err != nil {
+		return err
+	}
+	if policy.Policy == "" {
+		return errors.New("the policy is empty")
+	}
+	switch policy.EnforcementLevel {
+	case "advisory", "soft-mandatory", "hard-mandatory":
+	default:
+		return fmt.Errorf("enforcement_level must be advisory, soft-mandatory, or hard-mandatory, not %q", policy.EnforcementLevel)
+	}
+	switch sentinelType(change) {
+	case "egp":
+		if len(policy.Paths) == 0 {
+			return errors.New("an EGP needs at least one path")
+		}
+	case "rgp":
+		if len(policy.Paths) > 0 {
+			return errors.New("an RGP applies to tokens, not paths")
+		}
+	}
+	return nil
+}
+
+// A Sentinel policy in Vault in the local file format, or nil if it doesn't exist.
+func (a *applier) readRemoteSentinelPolicy(ctx context.Context, change PlannedChange) ([]byte, error) {
+	var secret *vault.Secret
+	err := a.limiter.Do(ctx, func(ctx context.Context) error {
+		var err error
+		secret, err = a.vc.Logical().ReadWithContext(ctx, change.Path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading Sentinel policy %s from Vault: %w", change.Path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	policy := SentinelPolicy{}
+	policy.Policy, _ = secret.Data["policy"].(string)
+	policy.EnforcementLevel, _ = secret.Data["enforcement_level"].(string)
+	paths, _ := secret.Data["paths"].([]interface{})
+	for _, path := range paths {
+		if s, ok := path.(string); ok {
+			policy.Paths = append(policy.Paths, s)
+		}
+	}
+	return json.MarshalIndent(policy, "", "  ")
+}
+
+// Writes a Sentinel policy, skipping the write with SkipUnchanged if it'd be the same.
+func (a *applier) writeSentinelPolicy(ctx context.Context, change PlannedChange) error {
+	policy, err := readSentinelFile(change.File)
+	if err != nil {
+		return err
+	}
+	if a.opts.SkipUnchanged && change.Mutation == Change {
+		same, err := a.unchanged(ctx, change)
+		if err != nil {
+			return err
+		}
+		if same {
+			log.Debug().Str("path", change.Path).Msg("Sentinel policy unchanged, skipping write")
+			return errUnchanged
+		}
+	}
+	data := map[string]interface{}{
+		"policy":            policy.Policy,
+		"enforcement_level": policy.EnforcementLevel,
+	}
+	if sentinelType(change) == "egp" {
+		data["paths"] = policy.Paths
+	}
+	log.Debug().Str("path", change.Path).Msg("Writing Sentinel policy to Vault")
+	if err := a.write(ctx, change.Path, data); err != nil {
+		return fmt.Errorf("error writing Sentinel policy %s to Vault: %w", change.Path, err)
+	}
+	return nil
+}
+
+// DownloadSentinelPolicies downloads every EGP and RGP to `sentinelDirectory`, which is usually sys/policies.
+func DownloadSentinelPolicies(ctx context.Context, vc *vault.Client, sentinelDirectory string) error {
+	return DownloadSentinelPoliciesWithOptions(ctx, vc, sentinelDirectory, DownloadOptions{})
+}
+
+// DownloadSentinelPoliciesWithOptions is DownloadSentinelPolicies with options. Files for policies that no longer
+// exist are removed.
+func DownloadSentinelPoliciesWithOptions(ctx context.Context, vc *vault.Client, sentinelDirectory string, opts DownloadOptions) error {
+	a := opts.applier(vc)
+	for _, policyType := range []string{"egp", "rgp"} {
+		if err := a.downloadObjects(ctx, SentinelPolicyResource, "sys/policies/"+policyType, filepath.Join(sentinelDirectory, policyType), opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package gitops
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ServiceNowReporter opens a change request when an apply starts, updates it with the planned changes once they're
+// known, and closes it with the result.
+type ServiceNowReporter struct {
+	// e.g. https://example.service-now.com
+	InstanceURL string
+	Username    string
+	Password    string
+	// Short description of the change request.
+	Summary string
+	// The start of the change request's description, e.g. the commit being applied. The planned changes follow it.
+	Details string
+	// If set, what was applied and skipped is added to the close notes.
+	Report *Report
+	Client *http.Client
+
+	sysID string
+	mu    sync.Mutex
+	// namespace -> table of its planned changes
+	plans map[string]string
+}
+
+// NewServiceNowReporter creates a ServiceNowReporter for an instance using $SERVICENOW_USERNAME and $SERVICENOW_PASSWORD.
+//
+// The most recent commit in `directory` starts the change request's description, and what `report` recorded ends up in
+// its close notes.
+func NewServiceNowReporter(directory, instance, environment string, report *Report) (*ServiceNowReporter, error) {
+	r := &ServiceNowReporter{
+		InstanceURL: instance,
+		Username:    os.Getenv("SERVICENOW_USERNAME"),
+		Password:    os.Getenv("SERVICENOW_PASSWORD"),
+		Summary:     "hvresult gitops apply to " + environment,
+		Report:      report,
+	}
+	if !strings.HasPrefix(r.InstanceURL, "https://") {
+		r.InstanceURL = "https://" + r.InstanceURL
+	}
+	if r.Username == "" || r.Password == "" {
+		return nil, fmt.Errorf("$SERVICENOW_USERNAME and $SERVICENOW_PASSWORD must be set")
+	}
+	// only the commit, since what's applied can be more or less than its diff
+	details, err := Git{Dir: directory}.CombinedOutput("show", "--no-patch", "--format=commit %H%n%n%B", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("error describing HEAD commit: %w: %s", err, details)
+	}
+	r.Details = details
+	return r, nil
+}
+
+type serviceNowRecord struct {
+	Result struct {
+		SysID  string `json:"sys_id"`
+		Number string `json:"number"`
+	} `json:"result"`
+}
+
+// Started implements ApplyReporter.
+func (r *ServiceNowReporter) Started(ctx context.Context) error {
+	var record serviceNowRecord
+	err := r.request(ctx, http.MethodPost, "/api/now/table/change_request", map[string]any{
+		"short_description": r.Summary,
+		"description":       r.Details,
+		"type":              "standard",
+		// Implement
+		"state": "-1",
+	}, &record)
+	if err != nil {
+		return fmt.Errorf("error creating ServiceNow change request: %w", err)
+	}
+	r.sysID = record.Result.SysID
+	return nil
+}
+
+// Planned implements PlanReporter, adding the changes about to be applied in a namespace to the description.
+func (r *ServiceNowReporter) Planned(ctx context.Context, namespace string, plan *Plan) error {
+	if r.sysID == "" {
+		return fmt.Errorf("no ServiceNow change request to update")
+	}
+	r.mu.Lock()
+	if r.plans == nil {
+		r.plans = map[string]string{}
+	}
+	table := plan.MarkdownTable()
+	if table == "" {
+		table = "No changes.\n"
+	}
+	r.plans[namespace] = table
+	description := r.description()
+	r.mu.Unlock()
+	err := r.request(ctx, http.MethodPatch, "/api/now/table/change_request/"+r.sysID, map[string]any{
+		"description": description,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error updating ServiceNow change request: %w", err)
+	}
+	return nil
+}
+
+// Details followed by the planned changes in every namespace so far.
+func (r *ServiceNowReporter) description() string {
+	namespaces := make([]string, 0, len(r.plans))
+	for namespace := range r.plans {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(r.Details, "\n"))
+	for _, namespace := range namespaces {
+		if namespace == "" {
+			b.WriteString("\n\nPlanned changes:\n\n")
+		} else {
+			fmt.Fprintf(&b, "\n\nPlanned changes in namespace %s:\n\n", namespace)
+		}
+		b.WriteString(r.plans[namespace])
+	}
+	return b.String()
+}
+
+// Finished implements ApplyReporter.
+func (r *ServiceNowReporter) Finished(ctx context.Context, applyErr error) error {
+	if r.sysID == "" {
+		return fmt.Errorf("no ServiceNow change request to close")
+	}
+	var (
+		closeCode  = "successful"
+		closeNotes = "Applied successfully."
+	)
+	if applyErr != nil {
+		closeCode = "unsuccessful"
+		closeNotes = applyErr.Error()
+	}
+	if applied := r.Report.SortedApplied(); len(applied) > 0 {
+		closeNotes += "\n\nApplied:\n"
+		for _, item := range applied {
+			closeNotes += fmt.Sprintf("- %s %s %s\n", strings.ToLower(item.Mutation.String()), item.Kind, item.Path)
+		}
+	}
+	if skipped := r.Report.SortedSkipped(); len(skipped) > 0 {
+		closeNotes += "\n\nSkipped:\n"
+		for _, item := range skipped {
+			closeNotes += fmt.Sprintf("- %s (%s): %s\n", item.Path, item.Capability, item.Reason)
+		}
+	}
+	err := r.request(ctx, http.MethodPatch, "/api/now/table/change_request/"+r.sysID, map[string]any{
+		// Closed
+		"state":       "3",
+		"close_code":  closeCode,
+		"close_notes": closeNotes,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error closing ServiceNow change request: %w", err)
+	}
+	return nil
+}
+
+func (r *ServiceNowReporter) request(ctx context.Context, method, path string, body, v any) error {
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(r.Username+":"+r.Password)))
+	return requestJSON(ctx, r.Client, method, strings.TrimRight(r.InstanceURL, "/")+path, header, body, v)
+}
+
+var (
+	_ ApplyReporter = &ServiceNowReporter{}
+	_ PlanReporter  = &ServiceNowReporter{}
+)
@@ -0,0 +1,91 @@
+package gitops_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestServiceNowReporter(t *testing.T) {
+	type request struct {
+		method, path string
+		body         map[string]any
+	}
+	var (
+		mu       sync.Mutex
+		requests []request
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "admin" || pass != "secret" {
+			t.Errorf("expected basic auth, got %q:%q", user, pass)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding request body: %v", err)
+		}
+		mu.Lock()
+		requests = append(requests, request{r.Method, r.URL.Path, body})
+		mu.Unlock()
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"result": {"sys_id": "abc123", "number": "CHG0001"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"result": {"sys_id": "abc123"}}`)
+	}))
+	t.Cleanup(server.Close)
+
+	report := &gitops.Report{}
+	reporter := &gitops.ServiceNowReporter{
+		InstanceURL: server.URL,
+		Username:    "admin",
+		Password:    "secret",
+		Summary:     "hvresult gitops apply to https://vault.example.com",
+		Details:     "commit 0123abc",
+		Report:      report,
+	}
+	ctx := context.Background()
+	if err := reporter.Started(ctx); err != nil {
+		t.Fatal(err)
+	}
+	change := gitops.PlannedChange{Mutation: gitops.Add, Kind: gitops.PolicyResource, Path: "sys/policies/acl/billing"}
+	if err := reporter.Planned(ctx, "", &gitops.Plan{Changes: []gitops.PlannedChange{change}}); err != nil {
+		t.Fatal(err)
+	}
+	report.Apply(change)
+	report.Skip("auth/ldap/groups", "list", errors.New("permission denied"))
+	if err := reporter.Finished(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 3 {
+		t.Fatalf("expected a create, update, and close request, got %d", len(requests))
+	}
+	create, update, closing := requests[0], requests[1], requests[2]
+	if create.method != http.MethodPost || create.path != "/api/now/table/change_request" || create.body["short_description"] != reporter.Summary {
+		t.Errorf("unexpected create request: %+v", create)
+	}
+	if update.method != http.MethodPatch || update.path != "/api/now/table/change_request/abc123" {
+		t.Errorf("unexpected update request: %+v", update)
+	}
+	if description, _ := update.body["description"].(string); !strings.HasPrefix(description, "commit 0123abc") || !strings.Contains(description, "`sys/policies/acl/billing`") {
+		t.Errorf("expected the planned changes in the description, got %q", description)
+	}
+	if closing.method != http.MethodPatch || closing.path != "/api/now/table/change_request/abc123" || closing.body["state"] != "3" || closing.body["close_code"] != "successful" {
+		t.Errorf("unexpected close request: %+v", closing)
+	}
+	notes, _ := closing.body["close_notes"].(string)
+	for _, want := range []string{"- add policy sys/policies/acl/billing", "- auth/ldap/groups (list): permission denied"} {
+		if !strings.Contains(notes, want) {
+			t.Errorf("expected the close notes to have %q, got %q", want, notes)
+		}
+	}
+}
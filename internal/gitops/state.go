@@ -0,0 +1,253 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// The prefix of AppliedState locations that are KV v2 data paths in Vault rather than local files.
+const VaultStatePrefix = "vault:"
+
+// AppliedState remembers a hash of the local file every object was last applied from, Terraform style.
+//
+// Unlike StateCache, which only saves reads, it decides what an apply does: objects that aren't in it were never
+// created by hvresult and are never deleted, and an object whose file hasn't changed since it was applied but still
+// needs writing was changed in Vault by someone else. It's meant to be shared, so it can be kept in Vault, and covers
+// every namespace it's applied to.
+type AppliedState struct {
+	vc       *vault.Client
+	limiter  *AdaptiveLimiter
+	location string
+	// what ForNamespace made this from, which holds the objects of every namespace
+	shared    *AppliedState
+	namespace string
+
+	mu    sync.Mutex
+	dirty bool
+	// path, or namespace|path outside the root namespace -> hash of the local file
+	Objects map[string]string `json:"objects"`
+}
+
+// LoadAppliedState reads the state at `location`, a local file or VaultStatePrefix and a KV v2 data path like
+// vault:secret/data/hvresult/state, or starts an empty one if there's nothing there yet.
+func LoadAppliedState(ctx context.Context, vc *vault.Client, location string) (*AppliedState, error) {
+	state := &AppliedState{vc: vc, limiter: newLimiter(1, 0, 0), location: location, Objects: map[string]string{}}
+	if vaultPath, ok := strings.CutPrefix(location, VaultStatePrefix); ok {
+		var secret *vault.Secret
+		err := state.limiter.Do(ctx, func(ctx context.Context) error {
+			var err error
+			secret, err = vc.Logical().ReadWithContext(ctx, vaultPath)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading applied state from Vault at %s: %w", vaultPath, err)
+		}
+		if secret == nil || secret.Data == nil {
+			return state, nil
+		}
+		var stored struct {
+			Data *AppliedState `json:"data"`
+		}
+		stored.Data = state
+		encoded, _ := json.Marshal(secret.Data)
+		if err := json.Unmarshal(encoded, &stored); err != nil {
+			return nil, fmt.Errorf("error decoding applied state at %s: %w", vaultPath, err)
+		}
+	} else {
+		content, err := os.ReadFile(location)
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading applied state: %w", err)
+		}
+		if err := json.Unmarshal(content, state); err != nil {
+			return nil, fmt.Errorf("error decoding applied state in %s: %w", location, err)
+		}
+	}
+	if state.Objects == nil {
+		state.Objects = map[string]string{}
+	}
+	return state, nil
+}
+
+// ForNamespace is the part of the state for objects in `namespace`, like StateCache is keyed, so an object applied in
+// one namespace isn't owned in another with the same path. Every apply and plan uses the part for the namespace its
+// client points at.
+func (s *AppliedState) ForNamespace(namespace string) *AppliedState {
+	if s == nil {
+		return nil
+	}
+	return &AppliedState{shared: s.objects(), namespace: strings.Trim(namespace, "/")}
+}
+
+// The state holding the objects, which is `s` unless it was made by ForNamespace.
+func (s *AppliedState) objects() *AppliedState {
+	if s.shared != nil {
+		return s.shared
+	}
+	return s
+}
+
+func (s *AppliedState) key(path string) string {
+	if s.namespace == "" {
+		return path
+	}
+	return s.namespace + "|" + path
+}
+
+// Save writes the state back to where it was loaded from if anything changed.
+func (s *AppliedState) Save(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s = s.objects()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	if vaultPath, ok := strings.CutPrefix(s.location, VaultStatePrefix); ok {
+		err := s.limiter.Do(ctx, func(ctx context.Context) error {
+			_, err := s.vc.Logical().WriteWithContext(ctx, vaultPath, map[string]interface{}{"data": s})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error writing applied state to Vault at %s: %w", vaultPath, err)
+		}
+	} else {
+		encoded, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		if dir := filepath.Dir(s.location); dir != "" {
+			if err := os.MkdirAll(dir, 0o700); err != nil {
+				return fmt.Errorf("error creating applied state directory: %w", err)
+			}
+		}
+		if err := os.WriteFile(s.location, encoded, 0o600); err != nil {
+			return fmt.Errorf("error writing applied state: %w", err)
+		}
+	}
+	s.dirty = false
+	return nil
+}
+
+// Owns reports whether hvresult has applied an object before. A nil AppliedState owns everything, since without one
+// every object in Vault is managed.
+func (s *AppliedState) Owns(path string) bool {
+	if s == nil {
+		return true
+	}
+	shared := s.objects()
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	_, ok := shared.Objects[s.key(path)]
+	return ok
+}
+
+// Whether a change is to an object whose local file is the same as when it was last applied, so anything it changes
+// was changed in Vault instead.
+func (s *AppliedState) drifted(change PlannedChange) bool {
+	if s == nil || change.Mutation == Delete {
+		return false
+	}
+	hash, err := fileHash(change.File)
+	if err != nil {
+		return false
+	}
+	shared := s.objects()
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	applied, ok := shared.Objects[s.key(change.Path)]
+	return ok && applied == hash
+}
+
+// Records that a change was applied, or that its object already matched.
+func (s *AppliedState) record(change PlannedChange) {
+	if s == nil {
+		return
+	}
+	var hash string
+	if change.Mutation != Delete {
+		var err error
+		if hash, err = fileHash(change.File); err != nil {
+			log.Warn().Err(err).Str("path", change.Path).Msg("error hashing applied file, it won't be in the applied state")
+			return
+		}
+	}
+	shared := s.objects()
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	if change.Mutation == Delete {
+		delete(shared.Objects, s.key(change.Path))
+	} else {
+		shared.Objects[s.key(change.Path)] = hash
+	}
+	shared.dirty = true
+}
+
+func (s *AppliedState) snapshot() map[string]string {
+	if s == nil {
+		return nil
+	}
+	shared := s.objects()
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	return maps.Clone(shared.Objects)
+}
+
+// Puts back what `saved` had for the objects `changes` are for, after they were rolled back.
+func (s *AppliedState) revert(saved map[string]string, changes []PlannedChange) {
+	if s == nil {
+		return
+	}
+	shared := s.objects()
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	for _, change := range changes {
+		key := s.key(change.Path)
+		if hash, ok := saved[key]; ok {
+			shared.Objects[key] = hash
+		} else {
+			delete(shared.Objects, key)
+		}
+	}
+	shared.dirty = true
+}
+
+// Moves deletes of objects hvresult never applied to Unpruned, so even ApplyOptions.Prune only deletes objects it did
+// apply.
+func (p *Plan) keepOwnedDeletes(state *AppliedState) {
+	kept := p.Changes[:0]
+	var unowned []string
+	for _, change := range p.Changes {
+		if change.Mutation == Delete && !state.Owns(change.Path) {
+			p.Unpruned = append(p.Unpruned, change)
+			unowned = append(unowned, change.Path)
+			continue
+		}
+		kept = append(kept, change)
+	}
+	p.Changes = kept
+	if len(unowned) > 0 {
+		log.Info().Strs("paths", unowned).Int("count", len(unowned)).Msg("Not deleting objects hvresult never applied")
+	}
+}
+
+func fileHash(file string) (string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return contentHash(string(content)), nil
+}
@@ -0,0 +1,142 @@
+package gitops_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestApplyState(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	const policy = `path "secret/*" { capabilities = ["read"] }`
+	if err := vc.Sys().PutPolicyWithContext(ctx, "unmanaged", policy); err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	stateFile := filepath.Join(tempDir, "state", "applied.json")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "owned"), []byte(policy), 0o644)
+
+	apply := func(opts gitops.ApplyOptions) *gitops.AppliedState {
+		t.Helper()
+		state, err := gitops.LoadAppliedState(ctx, vc, stateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.State = state
+		if err := gitops.ApplyChangesWithOptions(ctx, vc, authDir, policyDir, opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := state.Save(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	state := apply(gitops.ApplyOptions{})
+	if !state.Owns("sys/policies/acl/owned") || state.Owns("sys/policies/acl/unmanaged") {
+		t.Fatalf("expected only the applied policy to be owned, got %v", state.Objects)
+	}
+
+	// changed in Vault, so it's drift rather than a local change
+	if err := vc.Sys().PutPolicyWithContext(ctx, "owned", `path "secret/*" { capabilities = ["list"] }`); err != nil {
+		t.Fatal(err)
+	}
+	state, err := gitops.LoadAppliedState(ctx, vc, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc, authDir, policyDir, gitops.ApplyOptions{SkipUnchanged: true, State: state})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Warning == "" {
+		t.Errorf("expected the policy changed in Vault to be flagged, got %+v", plan.Changes)
+	}
+
+	// deleting the file only deletes what was applied with Prune, like without State
+	_ = os.Remove(filepath.Join(policyDir, "owned"))
+	state = apply(gitops.ApplyOptions{})
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "owned"); policy == "" {
+		t.Error("expected the owned policy to be kept without Prune")
+	}
+	// and never what wasn't applied
+	state = apply(gitops.ApplyOptions{Prune: true})
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "owned"); policy != "" {
+		t.Error("expected the owned policy to be deleted")
+	}
+	if policy, _ := vc.Sys().GetPolicyWithContext(ctx, "unmanaged"); policy == "" {
+		t.Error("expected the policy hvresult never applied to be left alone")
+	}
+	if state.Owns("sys/policies/acl/owned") {
+		t.Error("expected the deleted policy to be dropped from the state")
+	}
+}
+
+func TestAppliedStateNamespaces(t *testing.T) {
+	ctx := context.Background()
+	stateFile := filepath.Join(t.TempDir(), "applied.json")
+	_ = os.WriteFile(stateFile, []byte(`{"objects": {"sys/policies/acl/root-only": "a", "team-a|sys/policies/acl/admin": "b"}}`), 0o600)
+	state, err := gitops.LoadAppliedState(ctx, nil, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		state *gitops.AppliedState
+		path  string
+		owned bool
+	}{
+		{state, "sys/policies/acl/root-only", true},
+		{state, "sys/policies/acl/admin", false},
+		{state.ForNamespace("team-a"), "sys/policies/acl/admin", true},
+		{state.ForNamespace("team-a"), "sys/policies/acl/root-only", false},
+		{state.ForNamespace("team-b"), "sys/policies/acl/admin", false},
+	} {
+		if got := tc.state.Owns(tc.path); got != tc.owned {
+			t.Errorf("expected Owns(%s) to be %t, got %t", tc.path, tc.owned, got)
+		}
+	}
+}
+
+func TestApplyStateNamespaces(t *testing.T) {
+	ctx := context.Background()
+	vc := testcluster.NewTestCluster(t)
+	const policy = `path "secret/*" { capabilities = ["read"] }`
+
+	tempDir := t.TempDir()
+	authDir := filepath.Join(tempDir, "auth")
+	policyDir := filepath.Join(tempDir, "sys", "policies", "acl")
+	_ = os.MkdirAll(policyDir, 0o755)
+	_ = os.WriteFile(filepath.Join(policyDir, "admin"), []byte(policy), 0o644)
+	state, err := gitops.LoadAppliedState(ctx, vc, filepath.Join(tempDir, "applied.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// applied in team-a, which owns it from then on
+	if err := gitops.ApplyChangesWithOptions(ctx, vc.WithNamespace("team-a"), authDir, policyDir, gitops.ApplyOptions{State: state}); err != nil {
+		t.Fatal(err)
+	}
+	if !state.ForNamespace("team-a").Owns("sys/policies/acl/admin") || state.ForNamespace("team-b").Owns("sys/policies/acl/admin") {
+		t.Fatalf("expected the policy to only be owned in team-a, got %v", state.Objects)
+	}
+	// so team-b, which has no file for it, doesn't delete it
+	_ = os.Remove(filepath.Join(policyDir, "admin"))
+	plan, err := gitops.PlanChangesWithOptions(ctx, vc.WithNamespace("team-b"), authDir, policyDir, gitops.ApplyOptions{State: state, Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range plan.Changes {
+		if change.Path == "sys/policies/acl/admin" {
+			t.Errorf("expected team-b not to delete a policy only applied in team-a, got %+v", change)
+		}
+	}
+}
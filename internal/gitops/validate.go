@@ -0,0 +1,204 @@
+package gitops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+// Checks every policy and auth role that's about to be written so a bad one stops the apply before anything changes.
+//
+// With SkipInvalid, invalid changes are dropped from the plan instead and left alone in Vault.
+func (a *applier) validatePlan(ctx context.Context, plan *Plan) error {
+	var (
+		errs  []error
+		valid = plan.Changes[:0]
+	)
+	for _, change := range plan.Changes {
+		var err error
+		switch {
+		case change.Mutation == Delete:
+		case change.Kind == AuthMountResource, change.Kind == SecretsMountResource:
+			err = a.validateMount(ctx, change)
+		case change.Kind == AuthRoleResource, change.Kind == AuthConfigResource:
+			err = a.validateRole(ctx, change)
+		default:
+			err = validateFile(change)
+		}
+		if err != nil {
+			if a.opts.SkipInvalid {
+				log.Warn().Err(err).Str("path", change.File).Msgf("Skipping invalid %s", change.Kind)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", change.File, err))
+		}
+		valid = append(valid, change)
+	}
+	plan.Changes = valid
+	if len(errs) > 0 {
+		return fmt.Errorf("%d invalid policies/auth roles/identities, nothing was applied: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// Checks the file of anything but an auth role on its own, which is all that's possible without reading Vault. Mounts
+// are also checked against Vault by validateMount.
+func validateFile(change PlannedChange) error {
+	switch change.Kind {
+	case PolicyResource:
+		content, err := os.ReadFile(change.File)
+		if err != nil {
+			return fmt.Errorf("error reading local policy file %s: %w", change.File, err)
+		}
+		return internal.ValidatePolicy(content, change.File)
+	case IdentityEntityResource, IdentityGroupResource:
+		return validateIdentity(change)
+	case MFAMethodResource, MFALoginEnforcementResource:
+		return validateMFA(change)
+	case OIDCResource:
+		return validateOIDC(change)
+	case SentinelPolicyResource:
+		return validateSentinelPolicy(change)
+	case PasswordPolicyResource:
+		return validatePasswordPolicy(change)
+	case QuotaResource:
+		return validateQuota(change)
+	case SecretRoleResource:
+		return validateSecretRole(change)
+	case AuthMountResource, SecretsMountResource:
+		_, err := validateMountFile(change)
+		return err
+	}
+	return nil
+}
+
+// Checks a role file against the schema for its mount type.
+func (a *applier) validateRole(ctx context.Context, change PlannedChange) error {
+	mounts, err := a.authMounts(ctx)
+	if err != nil {
+		return err
+	}
+	// auth/<mount>/<prefix>/<name>
+	if strings.Count(change.Path, "/") < 3 {
+		return nil
+	}
+	mountName, _, _ := splitRolePath(change.Path)
+	mount := mounts[mountName+"/"]
+	if mount == nil {
+		return nil
+	}
+	data, err := readRoleFile(change.File)
+	if err != nil {
+		return err
+	}
+	return ValidateRole(mount.Type, data)
+}
+
+// Checks that every policy an auth role, entity, or group that's about to be written grants exists locally or in
+// Vault, and isn't about to be deleted. Policies are written before everything else and deleted after it, so this is
+// all that's needed for nothing to point at a missing policy.
+//
+// With SkipInvalid, whatever has missing policies is dropped from the plan instead.
+func (a *applier) checkPolicyReferences(ctx context.Context, plan *Plan, policyDirectory string) error {
+	available := map[string]bool{"root": true, "default": true}
+	local, err := localPolicyFiles(policyDirectory)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for name := range local {
+		available[name] = true
+	}
+	deleted := map[string]bool{}
+	for _, name := range plan.Names(PolicyResource, Delete) {
+		deleted[name] = true
+	}
+
+	var (
+		// role/entity/group -> policies it grants that aren't local
+		missing = map[string][]string{}
+		listed  bool
+	)
+	for _, change := range plan.Changes {
+		// only these grant policies
+		switch {
+		case change.Mutation == Delete:
+			continue
+		case change.Kind != AuthRoleResource && change.Kind != IdentityEntityResource && change.Kind != IdentityGroupResource:
+			continue
+		}
+		data, err := readRoleFile(change.File)
+		if err != nil {
+			return err
+		}
+		for _, policy := range grantedPolicies(data) {
+			if deleted[policy] || !available[policy] {
+				missing[change.Path] = append(missing[change.Path], policy)
+			}
+		}
+		// only list Vault's policies if something isn't local
+		if len(missing[change.Path]) > 0 && !listed {
+			var existing []string
+			err := a.limiter.Do(ctx, func(ctx context.Context) error {
+				var err error
+				existing, err = a.vc.Sys().ListPoliciesWithContext(ctx)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("error listing existing policies from Vault: %w", err)
+			}
+			for _, name := range existing {
+				available[name] = true
+			}
+			listed = true
+		}
+	}
+
+	var (
+		errs  []error
+		valid = plan.Changes[:0]
+	)
+	for _, change := range plan.Changes {
+		var gone []string
+		for _, policy := range missing[change.Path] {
+			if deleted[policy] || !available[policy] {
+				gone = append(gone, policy)
+			}
+		}
+		if len(gone) > 0 {
+			err := fmt.Errorf("%s: grants policies that don't exist locally or in Vault or are being deleted: %s", change.File, strings.Join(gone, ", "))
+			if a.opts.SkipInvalid {
+				log.Warn().Err(err).Str("path", change.File).Msgf("Skipping %s with missing policies", change.Kind)
+				continue
+			}
+			errs = append(errs, err)
+		}
+		valid = append(valid, change)
+	}
+	plan.Changes = valid
+	if len(errs) > 0 {
+		return fmt.Errorf("%d auth roles/identities reference missing policies, nothing was applied: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// The policies tokens from a role get, lowercased the way Vault names policies. Lists can be JSON arrays or
+// comma-separated strings, which Vault accepts for both.
+func grantedPolicies(data map[string]interface{}) []string {
+	var policies []string
+	// GitHub team and user mappings have theirs in value
+	for _, field := range []string{"token_policies", "policies", "value"} {
+		items, _ := splitList(data[field]).([]interface{})
+		for _, item := range items {
+			if policy, ok := item.(string); ok && strings.TrimSpace(policy) != "" {
+				policies = append(policies, strings.ToLower(strings.TrimSpace(policy)))
+			}
+		}
+	}
+	return policies
+}
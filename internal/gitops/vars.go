@@ -0,0 +1,128 @@
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Files can use ${NAME} for anything that differs between clusters, like mount names or bound account IDs, and are
+// rendered into a copy of the directory before anything reads them. This isn't text/template since Vault's own policy
+// templating already uses {{ }}.
+
+// ${NAME}, or $${NAME} for a literal ${NAME}
+var varPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// VarEnvPrefix is the prefix of environment variables that can be used in files, e.g. HVRESULT_VAR_KV_MOUNT for
+// ${KV_MOUNT}. Only these are read so a file can't pull VAULT_TOKEN or other secrets in the environment into Vault.
+const VarEnvPrefix = "HVRESULT_VAR_"
+
+// EnvVars returns the variables for RenderDirectory in `environ`, which is formatted like os.Environ, with
+// VarEnvPrefix taken off their names.
+func EnvVars(environ []string) map[string]string {
+	vars := make(map[string]string)
+	for _, env := range environ {
+		name, value, ok := strings.Cut(env, "=")
+		if !ok {
+			continue
+		}
+		if name, ok = strings.CutPrefix(name, VarEnvPrefix); ok && name != "" {
+			vars[name] = value
+		}
+	}
+	return vars
+}
+
+// LoadVarFile reads variables for RenderDirectory from a JSON or YAML object, like a data file. Values can be strings,
+// numbers, or booleans.
+func LoadVarFile(file string) (map[string]string, error) {
+	content, err := readDataFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading var file %s: %w", file, err)
+	}
+	var data map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	// so account IDs don't become 1.23456789012e+11
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, fmt.Errorf("error unmarshalling var file %s: %w", file, err)
+	}
+	vars := make(map[string]string, len(data))
+	for name, value := range data {
+		switch value := value.(type) {
+		case string:
+			vars[name] = value
+		case json.Number, bool:
+			vars[name] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("error reading var file %s: %s must be a string, number, or boolean", file, name)
+		}
+	}
+	return vars, nil
+}
+
+// RenderDirectory copies every file in `src` to `dst`, replacing ${NAME} with the value of NAME in `vars`. A file using
+// a variable that isn't in `vars` is an error, since an empty mount name or account ID would be applied as is. .git
+// isn't copied.
+func RenderDirectory(src, dst string, vars map[string]string) error {
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() && !d.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o750)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rendered, err := renderVars(content, vars)
+		if err != nil {
+			return fmt.Errorf("%s: %w", relPath, err)
+		}
+		return os.WriteFile(target, rendered, 0o640)
+	})
+	if err != nil {
+		return fmt.Errorf("error rendering %s: %w", src, err)
+	}
+	return nil
+}
+
+func renderVars(content []byte, vars map[string]string) ([]byte, error) {
+	var missing []string
+	rendered := varPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		if bytes.HasPrefix(match, []byte("$$")) {
+			return match[1:]
+		}
+		name := string(match[2 : len(match)-1])
+		value, ok := vars[name]
+		if !ok {
+			if !slices.Contains(missing, name) {
+				missing = append(missing, name)
+			}
+			return match
+		}
+		return []byte(value)
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("undefined variables %s", strings.Join(missing, ", "))
+	}
+	return rendered, nil
+}
@@ -0,0 +1,80 @@
+package gitops_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestRenderDirectory(t *testing.T) {
+	var (
+		src = t.TempDir()
+		dst = t.TempDir()
+	)
+	files := map[string]string{
+		"sys/policies/acl/test":       `path "${KV_MOUNT}/*" { capabilities = ["read"] }`,
+		"auth/aws/role/test":          `{"bound_account_id": ["${ACCOUNT_ID}"], "token_policies": ["test"]}`,
+		"auth/approle/role/templated": `{"token_policies": ["$${NOT_A_VAR}", "{{identity.entity.name}}"]}`,
+		".git/HEAD":                   "ref: refs/heads/${BRANCH}",
+		"vars.yaml":                   "KV_MOUNT: kv-dev\nACCOUNT_ID: 123456789012\nDEBUG: true\n",
+	}
+	for path, content := range files {
+		path = filepath.Join(src, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vars, err := gitops.LoadVarFile(filepath.Join(src, "vars.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// numbers are kept as written rather than as floats
+	if diff := cmp.Diff(map[string]string{"KV_MOUNT": "kv-dev", "ACCOUNT_ID": "123456789012", "DEBUG": "true"}, vars); diff != "" {
+		t.Fatalf("unexpected vars (-want +got):\n%s", diff)
+	}
+	if err := gitops.RenderDirectory(src, dst, vars); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"sys/policies/acl/test":       `path "kv-dev/*" { capabilities = ["read"] }`,
+		"auth/aws/role/test":          `{"bound_account_id": ["123456789012"], "token_policies": ["test"]}`,
+		"auth/approle/role/templated": `{"token_policies": ["${NOT_A_VAR}", "{{identity.entity.name}}"]}`,
+	}
+	for path, want := range expected {
+		actual, err := os.ReadFile(filepath.Join(dst, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != want {
+			t.Errorf("%s: expected %q, got %q", path, want, actual)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, ".git")); !os.IsNotExist(err) {
+		t.Error("expected .git not to be copied")
+	}
+	// a missing variable fails rather than rendering an empty string
+	delete(vars, "KV_MOUNT")
+	if err := gitops.RenderDirectory(src, t.TempDir(), vars); err == nil {
+		t.Error("expected an error rendering with an undefined variable")
+	}
+}
+
+func TestEnvVars(t *testing.T) {
+	vars := gitops.EnvVars([]string{
+		"HVRESULT_VAR_KV_MOUNT=kv-prod",
+		"HVRESULT_VAR_EMPTY=",
+		"HVRESULT_VAR_=nameless",
+		"VAULT_TOKEN=hvs.secret",
+		"KV_MOUNT=unprefixed",
+	})
+	// only prefixed variables are read, so nothing else in the environment can end up in Vault
+	if diff := cmp.Diff(map[string]string{"KV_MOUNT": "kv-prod", "EMPTY": ""}, vars); diff != "" {
+		t.Errorf("unexpected vars (-want +got):\n%s", diff)
+	}
+}
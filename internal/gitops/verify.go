@@ -0,0 +1,61 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+)
+
+// How many times a written object is read back before it's considered wrong.
+const verifyAttempts = 3
+
+// Reads a policy back after writing it. Retries a few times since performance standbys can lag behind the active node.
+func (a *applier) verifyPolicy(ctx context.Context, name, content string) error {
+	return a.verify(ctx, "sys/policies/acl/"+name, func() (bool, error) {
+		var remote string
+		err := a.limiter.Do(ctx, func(ctx context.Context) error {
+			var err error
+			remote, err = a.vc.Sys().GetPolicyWithContext(ctx, name)
+			return err
+		})
+		return strings.TrimSpace(remote) == strings.TrimSpace(content), err
+	})
+}
+
+// Reads an auth role back after writing it, comparing it the same way SkipUnchanged does.
+func (a *applier) verifyRole(ctx context.Context, path string, data map[string]interface{}) error {
+	return a.verify(ctx, path, func() (bool, error) {
+		var remote *vault.Secret
+		err := a.limiter.Do(ctx, func(ctx context.Context) error {
+			var err error
+			remote, err = a.vc.Logical().ReadWithContext(ctx, path)
+			return err
+		})
+		return err == nil && remote != nil && RoleUnchanged(data, remote.Data), err
+	})
+}
+
+func (a *applier) verify(ctx context.Context, path string, matches func() (bool, error)) error {
+	for attempt := 0; attempt < verifyAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * 250 * time.Millisecond):
+			}
+		}
+		ok, err := matches()
+		if err != nil {
+			return fmt.Errorf("error reading %s back from Vault: %w", path, err)
+		}
+		if ok {
+			return nil
+		}
+		log.Debug().Str("path", path).Int("attempt", attempt+1).Msg("Object read back doesn't match what was written yet")
+	}
+	return fmt.Errorf("%s doesn't match what was written after %d reads", path, verifyAttempts)
+}
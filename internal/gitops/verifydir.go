@@ -0,0 +1,244 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// VerifyDirectory checks a repository the way apply does before writing anything, but without contacting Vault, so
+// it can run as a pre-commit hook. It finds:
+//   - files in auth/, sys/, identity/, and secrets/ that apply would ignore, like roles under a path their mount
+//     doesn't have
+//   - policies, roles, mounts, identities, and everything else that doesn't parse or validate
+//   - files that would be written to the same object
+//   - auth roles, entities, and groups that grant policies without a file, other than root and default
+//   - groups with member entities or groups without a file
+//
+// `directory` is the root of a repository, or of a namespace in one, whose own namespaces/ aren't checked, and `opts`
+// says which other directories are managed, like for PlanChangesWithOptions. Returns every problem found, prefixed
+// with the file it's in.
+func VerifyDirectory(directory string, opts ApplyOptions) ([]error, error) {
+	var (
+		authDirectory   = filepath.Join(directory, "auth")
+		policyDirectory = filepath.Join(directory, "sys", "policies", "acl")
+		problems        []error
+	)
+	problem := func(file string, err error) {
+		problems = append(problems, fmt.Errorf("%s: %w", file, err))
+	}
+
+	// references to policies are only checked if policies are managed
+	policies, err := localPolicyFiles(policyDirectory)
+	checkPolicies := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// which is files for the same policy
+		problems = append(problems, err)
+	}
+	var changes []PlannedChange
+	for name, file := range policies {
+		changes = append(changes, PlannedChange{Mutation: Add, Kind: PolicyResource, Path: "sys/policies/acl/" + name, File: file})
+	}
+
+	// auth mount name -> type, for mounts with a file saying what it is
+	mountTypes := map[string]string{}
+	localMounts, err := localAuthMounts(authDirectory)
+	if err != nil {
+		return nil, err
+	}
+	for name, file := range localMounts {
+		// a broken one shows up when it's validated
+		if config, err := readMountFile(file); err == nil {
+			mountTypes[name] = config.Type
+		}
+	}
+
+	// everything else is planned the way an incremental apply of every file would be
+	var (
+		files   []string
+		changed []ChangedFile
+		// every file apply would use
+		used = map[string]bool{}
+	)
+	err = walkLocal(directory, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(directory, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			// namespaces are checked on their own
+			if rel == "namespaces" || rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// like a README.md
+		switch top, _, _ := strings.Cut(rel, "/"); top {
+		case "auth", "sys", "identity", "secrets":
+		default:
+			return nil
+		}
+		files = append(files, file)
+		if strings.HasPrefix(rel, "sys/policies/acl/") {
+			// already listed, unless they couldn't be
+			used[file] = !checkPolicies
+			return nil
+		}
+		if path.Base(rel) == AuthConfigFileName {
+			// planning a config needs its mount's type, which might only be in Vault
+			if _, ok := mountTypes[strings.TrimPrefix(path.Dir(rel), "auth/")]; !ok {
+				used[file] = true
+				return nil
+			}
+		}
+		changed = append(changed, classifyChangedFile(ChangedFile{Path: rel, Mutation: Add}))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s: %w", directory, err)
+	}
+	opts.Changes = changed
+	plan, err := newApplier(nil, opts).planChangedFiles(authDirectory, policyDirectory)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, plan.Changes...)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].File < changes[j].File
+	})
+
+	// object -> file
+	objects := make(map[string]string, len(changes))
+	for _, change := range changes {
+		used[change.File] = true
+		if other, ok := objects[change.Path]; ok {
+			problem(change.File, fmt.Errorf("would be written to %s, like %s", change.Path, other))
+			continue
+		}
+		objects[change.Path] = change.File
+		if err := verifyFile(change, mountTypes); err != nil {
+			problem(change.File, err)
+		}
+	}
+
+	for _, change := range changes {
+		switch change.Kind {
+		case AuthRoleResource, IdentityEntityResource, IdentityGroupResource:
+		default:
+			continue
+		}
+		if objects[change.Path] != change.File {
+			continue
+		}
+		if checkPolicies {
+			// a file that doesn't parse is already a problem
+			data, err := readRoleFile(change.File)
+			if err != nil {
+				continue
+			}
+			var missing []string
+			for _, policy := range grantedPolicies(data) {
+				if _, ok := policies[policy]; !ok && policy != "root" && policy != "default" {
+					missing = append(missing, policy)
+				}
+			}
+			if len(missing) > 0 {
+				problem(change.File, fmt.Errorf("grants policies without a file: %s", strings.Join(missing, ", ")))
+			}
+		}
+		if change.Kind != IdentityGroupResource {
+			continue
+		}
+		var group IdentityGroup
+		if err := readIdentityFile(change.File, &group); err != nil {
+			continue
+		}
+		var missing []string
+		for _, entity := range group.MemberEntities {
+			if _, ok := objects["identity/entity/name/"+entity]; !ok {
+				missing = append(missing, "entity "+entity)
+			}
+		}
+		for _, member := range group.MemberGroups {
+			if _, ok := objects["identity/group/name/"+member]; !ok {
+				missing = append(missing, "group "+member)
+			}
+		}
+		if len(missing) > 0 {
+			problem(change.File, fmt.Errorf("has members without a file: %s", strings.Join(missing, ", ")))
+		}
+	}
+
+	for _, file := range files {
+		if !used[file] {
+			problem(file, errors.New("isn't anywhere apply looks, so it would be ignored"))
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Error() < problems[j].Error()
+	})
+	return problems, nil
+}
+
+// Checks a file with validateFile, and auth roles and configs as much as possible without Vault.
+func verifyFile(change PlannedChange, mountTypes map[string]string) error {
+	switch change.Kind {
+	case AuthRoleResource:
+		return verifyAuthRole(change, mountTypes)
+	case AuthConfigResource:
+		_, err := readRoleFile(change.File)
+		return err
+	case QuotaResource:
+		// sys/quotas/<type>/<name>
+		if quotaType := path.Base(path.Dir(change.Path)); !slices.Contains(quotaTypes, quotaType) {
+			return fmt.Errorf("quotas have to be in %s/, not %s/", strings.Join(quotaTypes, "/ or "), quotaType)
+		}
+	}
+	return validateFile(change)
+}
+
+// Checks an auth role is somewhere its mount has roles and against the schema for the mount's type, if there's a
+// mount file saying what type it is. Otherwise the mount might only be in Vault, so the file's only parsed.
+func verifyAuthRole(change PlannedChange, mountTypes map[string]string) error {
+	var (
+		rest  = strings.TrimPrefix(change.Path, "auth/")
+		mount string
+	)
+	// mounts can be nested
+	for name := range mountTypes {
+		if strings.HasPrefix(rest, name+"/") && len(name) > len(mount) {
+			mount = name
+		}
+	}
+	if mount == "" {
+		if strings.Count(rest, "/") < 2 {
+			return errors.New("auth roles have to be in auth/<mount>/<prefix>/, so it would be ignored")
+		}
+		_, err := readRoleFile(change.File)
+		return err
+	}
+	mountType := mountTypes[mount]
+	prefixes, ok := rolePathPrefixesFor(mountType)
+	if !ok {
+		return fmt.Errorf("roles of %s auth mounts aren't managed, so it would be ignored", mountType)
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(rest, mount+"/"+prefix+"/") {
+			data, err := readRoleFile(change.File)
+			if err != nil {
+				return err
+			}
+			return ValidateRole(mountType, data)
+		}
+	}
+	return fmt.Errorf("%s auth mounts only have roles in %s/, so it would be ignored", mountType, strings.Join(prefixes, "/ or "))
+}
@@ -0,0 +1,95 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// How long WatchDirectory waits for things to settle after a change, since editors write files in several steps.
+const DefaultWatchDebounce = 500 * time.Millisecond
+
+// WatchDirectory calls fn every time something under `directory` changes until ctx is done, waiting `debounce` after
+// the last change so a burst of them only calls it once. Errors from fn are logged, not returned.
+//
+// Directories whose names start with a dot, like .git, and anything in `exclude`, like a backup directory that fn
+// writes to, aren't watched.
+func WatchDirectory(ctx context.Context, directory string, exclude []string, debounce time.Duration, fn func(ctx context.Context) error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating file watcher: %w", err)
+	}
+	defer watcher.Close()
+	excluded := map[string]bool{}
+	for _, path := range exclude {
+		if abs, err := filepath.Abs(path); err == nil {
+			excluded[abs] = true
+		}
+	}
+	if err := watchTree(watcher, directory, excluded); err != nil {
+		return err
+	}
+	log.Info().Str("directory", directory).Msg("watching for changes")
+
+	var (
+		timer   = time.NewTimer(debounce)
+		pending bool
+	)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			log.Warn().Err(err).Msg("error watching files")
+		case event := <-watcher.Events:
+			// new directories aren't watched by their parents
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchTree(watcher, event.Name, excluded); err != nil {
+						log.Warn().Err(err).Msg("error watching new directory")
+					}
+				}
+			}
+			log.Debug().Str("path", event.Name).Str("op", event.Op.String()).Msg("file changed")
+			pending = true
+			timer.Reset(debounce)
+		case <-timer.C:
+			if !pending {
+				continue
+			}
+			pending = false
+			if err := fn(ctx); err != nil {
+				log.Error().Err(err).Msg("error handling changes, waiting for the next one")
+			}
+		}
+	}
+}
+
+// watches `root` and every directory under it that isn't excluded
+func watchTree(watcher *fsnotify.Watcher, root string, excluded map[string]bool) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && d.Name()[0] == '.' {
+			return filepath.SkipDir
+		}
+		if abs, err := filepath.Abs(path); err == nil && excluded[abs] {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			return fmt.Errorf("error watching %s: %w", path, err)
+		}
+		return nil
+	})
+}
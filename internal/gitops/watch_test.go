@@ -0,0 +1,53 @@
+package gitops_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestWatchDirectory(t *testing.T) {
+	var (
+		dir         = t.TempDir()
+		backups     = filepath.Join(dir, "backups")
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		called      = make(chan struct{}, 10)
+		// well above how long fsnotify takes to deliver events
+		debounce = gitops.DefaultWatchDebounce
+	)
+	defer cancel()
+	_ = os.MkdirAll(filepath.Join(dir, "sys", "policies", "acl"), 0o755)
+	_ = os.MkdirAll(backups, 0o755)
+	done := make(chan error)
+	go func() {
+		done <- gitops.WatchDirectory(ctx, dir, []string{backups}, debounce, func(ctx context.Context) error {
+			called <- struct{}{}
+			return nil
+		})
+	}()
+	// give the watcher a moment to start
+	time.Sleep(200 * time.Millisecond)
+
+	_ = os.WriteFile(filepath.Join(backups, "ignored"), []byte("x"), 0o644)
+	select {
+	case <-called:
+		t.Fatal("expected changes in an excluded directory to be ignored")
+	case <-time.After(3 * debounce):
+	}
+	for i := 0; i < 3; i++ {
+		_ = os.WriteFile(filepath.Join(dir, "sys", "policies", "acl", "dev"), []byte(`path "a" { capabilities = ["read"] }`), 0o644)
+	}
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a change to call fn")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
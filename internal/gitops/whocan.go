@@ -0,0 +1,230 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/idp"
+)
+
+// PathIndex answers "who can do what to this path" for a repository.
+//
+// It's built once so each query only walks the policy paths that could possibly match.
+type PathIndex struct {
+	// every policy path pattern
+	rules internal.PathTrie[indexedRule]
+	// policy name -> auth principals that have it, relative to the repository
+	principals map[string][]string
+	// external identity group principal -> the name of its group in the identity provider
+	externalGroups map[string]string
+}
+
+type indexedRule struct {
+	policy       string
+	capabilities []internal.Capability
+}
+
+// WhoCanResult is what a single auth principal can do to a path.
+type WhoCanResult struct {
+	// e.g. auth/approle/role/my-role
+	Principal string
+	// The policy path that decided the capabilities.
+	Pattern      string
+	Capabilities []internal.Capability
+	// Policies that grant (or deny) Capabilities through Pattern.
+	Policies []string
+	// The identity provider's name for the group when Principal is an external identity group, e.g.
+	// identity/group/devs, whose members get Capabilities by logging in.
+	ExternalGroup string
+	// The external group's members in the identity provider, after ExpandExternalGroups.
+	Members []string
+}
+
+// BuildPathIndex reads every policy and auth principal in a repository into a PathIndex.
+//
+// External identity groups in relativeGroupDirectory are principals too, if it's set.
+func BuildPathIndex(repositoryPath, relativePolicyDirectory, relativePrincipalDirectory, relativeGroupDirectory string) (*PathIndex, error) {
+	index := &PathIndex{
+		principals:     map[string][]string{},
+		externalGroups: map[string]string{},
+	}
+	// for token roles that allow policies by glob
+	policyNames, err := listPolicyNames(Git{Dir: repositoryPath}, relativePolicyDirectory, "")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	principalRoot := filepath.Join(repositoryPath, relativePrincipalDirectory)
+	err = walkLocal(principalRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := readDataFile(path)
+		if err != nil {
+			return err
+		}
+		var data authPrincipalData
+		if err := json.Unmarshal(content, &data); err != nil {
+			return fmt.Errorf("error unmarshalling %s as auth principal data: %w", path, err)
+		}
+		relPath, err := filepath.Rel(repositoryPath, path)
+		if err != nil {
+			return fmt.Errorf("error getting relative path to auth principal: %w", err)
+		}
+		for _, policy := range append(data.EffectivePolicies(), data.GlobbedPolicies(policyNames)...) {
+			index.principals[policy] = append(index.principals[policy], filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading auth principals: %w", err)
+	}
+	if relativeGroupDirectory != "" {
+		if err := index.addExternalGroups(repositoryPath, relativeGroupDirectory); err != nil {
+			return nil, fmt.Errorf("error reading identity groups: %w", err)
+		}
+	}
+	policyRoot := filepath.Join(repositoryPath, relativePolicyDirectory)
+	err = walkLocal(policyRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := policyNameFromFile(d.Name())
+		// policies nobody has can't grant anything
+		if len(index.principals[name]) == 0 {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		policy, err := internal.ParsePolicy(string(content), name)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		for _, pathConfig := range policy.Paths {
+			index.rules.Insert(pathConfig.Path, indexedRule{
+				policy:       policy.Name,
+				capabilities: pathConfig.Capabilities,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading policies: %w", err)
+	}
+	log.Debug().Int("policies", len(index.principals)).Msg("built path index")
+	return index, nil
+}
+
+// Indexes the external groups in a directory of identity group files under their Vault paths.
+func (x *PathIndex) addExternalGroups(repositoryPath, relativeGroupDirectory string) error {
+	entries, err := os.ReadDir(filepath.Join(repositoryPath, relativeGroupDirectory))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var group IdentityGroup
+		if err := readIdentityFile(filepath.Join(repositoryPath, relativeGroupDirectory, entry.Name()), &group); err != nil {
+			return err
+		}
+		if group.Type != "external" || group.Alias == nil || group.Alias.Name == "" {
+			continue
+		}
+		principal := "identity/group/name/" + objectName(entry.Name())
+		x.externalGroups[principal] = group.Alias.Name
+		for _, policy := range group.Policies {
+			x.principals[policy] = append(x.principals[policy], principal)
+		}
+	}
+	return nil
+}
+
+// WhoCan returns what every auth principal with a matching policy path can do to `path`, sorted by principal.
+//
+// Like Vault, only the most precise matching path counts, and deny overrides everything else on it.
+func (x *PathIndex) WhoCan(path string) []WhoCanResult {
+	byPrincipal := map[string]*WhoCanResult{}
+	for _, match := range x.rules.Match(strings.TrimPrefix(path, "/")) {
+		rule := match.Value
+		for _, principal := range x.principals[rule.policy] {
+			result := byPrincipal[principal]
+			switch {
+			case result == nil || internal.MorePrecise(match.Pattern, result.Pattern):
+				byPrincipal[principal] = &WhoCanResult{
+					Principal:     principal,
+					Pattern:       match.Pattern,
+					Capabilities:  append([]internal.Capability(nil), rule.capabilities...),
+					Policies:      []string{rule.policy},
+					ExternalGroup: x.externalGroups[principal],
+				}
+			case match.Pattern == result.Pattern:
+				result.Capabilities = append(result.Capabilities, rule.capabilities...)
+				result.Policies = append(result.Policies, rule.policy)
+			}
+		}
+	}
+	results := make([]WhoCanResult, 0, len(byPrincipal))
+	for _, result := range byPrincipal {
+		result.Capabilities = normalizeCapabilities(result.Capabilities)
+		sort.Strings(result.Policies)
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Principal < results[j].Principal
+	})
+	return results
+}
+
+// ExpandExternalGroups looks up the members of every external group in results with resolver, since Vault only
+// knows about the ones that have logged in.
+func ExpandExternalGroups(ctx context.Context, resolver idp.GroupResolver, results []WhoCanResult) error {
+	members := map[string][]string{}
+	for i, result := range results {
+		if result.ExternalGroup == "" {
+			continue
+		}
+		if _, ok := members[result.ExternalGroup]; !ok {
+			groupMembers, err := resolver.Members(ctx, result.ExternalGroup)
+			if err != nil {
+				return fmt.Errorf("error expanding identity provider group %s: %w", result.ExternalGroup, err)
+			}
+			members[result.ExternalGroup] = groupMembers
+		}
+		results[i].Members = members[result.ExternalGroup]
+	}
+	return nil
+}
+
+// dedupes and sorts, and deny wins
+func normalizeCapabilities(caps []internal.Capability) []internal.Capability {
+	seen := map[internal.Capability]bool{}
+	unique := caps[:0]
+	for _, c := range caps {
+		if c == internal.Deny {
+			return []internal.Capability{internal.Deny}
+		}
+		if !seen[c] {
+			seen[c] = true
+			unique = append(unique, c)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		return unique[i] < unique[j]
+	})
+	return unique
+}
@@ -0,0 +1,170 @@
+package gitops_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/idp"
+)
+
+func TestWhoCan(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"sys/policies/acl/readers":  `path "secret/data/*" { capabilities = ["read", "list"] }`,
+		"sys/policies/acl/writers":  `path "secret/data/*" { capabilities = ["create", "update"] }`,
+		"sys/policies/acl/no-prod":  `path "secret/data/prod/*" { capabilities = ["deny"] }`,
+		"sys/policies/acl/unused":   `path "*" { capabilities = ["sudo"] }`,
+		"auth/approle/role/reader":  `{"token_policies": ["readers"]}`,
+		"auth/approle/role/writer":  `{"token_policies": ["readers", "writers"]}`,
+		"auth/approle/role/limited": `{"token_policies": ["readers", "no-prod"]}`,
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := gitops.BuildPathIndex(dir, filepath.Join("sys", "policies", "acl"), "auth", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []gitops.WhoCanResult{
+		{
+			Principal:    "auth/approle/role/limited",
+			Pattern:      "secret/data/prod/*",
+			Capabilities: []internal.Capability{internal.Deny},
+			Policies:     []string{"no-prod"},
+		},
+		{
+			Principal:    "auth/approle/role/reader",
+			Pattern:      "secret/data/*",
+			Capabilities: []internal.Capability{internal.List, internal.Read},
+			Policies:     []string{"readers"},
+		},
+		{
+			Principal:    "auth/approle/role/writer",
+			Pattern:      "secret/data/*",
+			Capabilities: []internal.Capability{internal.Create, internal.List, internal.Read, internal.Update},
+			Policies:     []string{"readers", "writers"},
+		},
+	}
+	if diff := cmp.Diff(expected, index.WhoCan("secret/data/prod/db")); diff != "" {
+		t.Fatal(diff)
+	}
+	if results := index.WhoCan("sys/mounts"); len(results) != 0 {
+		t.Fatalf("expected nobody to have sys/mounts, got %v", results)
+	}
+}
+
+func TestWhoCanTokenRoles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"sys/policies/acl/ci-deploy": `path "secret/data/*" { capabilities = ["read"] }`,
+		"sys/policies/acl/ci-admin":  `path "secret/data/*" { capabilities = ["delete"] }`,
+		// tokens from the role can have any ci- policy but ci-admin
+		"auth/token/roles/ci": `{"allowed_policies_glob": ["ci-*"], "disallowed_policies": ["ci-admin"], "orphan": true}`,
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := gitops.BuildPathIndex(dir, filepath.Join("sys", "policies", "acl"), "auth", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []gitops.WhoCanResult{
+		{
+			Principal:    "auth/token/roles/ci",
+			Pattern:      "secret/data/*",
+			Capabilities: []internal.Capability{internal.Read},
+			Policies:     []string{"ci-deploy"},
+		},
+	}
+	if diff := cmp.Diff(expected, index.WhoCan("secret/data/app")); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestWhoCanExternalGroups(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"sys/policies/acl/readers":     `path "secret/data/*" { capabilities = ["read"] }`,
+		"auth/approle/role/reader":     `{"token_policies": ["readers"]}`,
+		"identity/group/devs":          `{"type": "external", "policies": ["readers"], "alias": {"name": "Engineering", "mount": "oidc"}}`,
+		"identity/group/admins.yaml":   "type: external\npolicies: [readers]\nalias: {name: Admins, mount: oidc}\n",
+		"identity/group/internal-devs": `{"policies": ["readers"]}`,
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := gitops.BuildPathIndex(dir, filepath.Join("sys", "policies", "acl"), "auth", filepath.Join("identity", "group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v1/groups":
+			fmt.Fprintf(w, `[{"id": "%[1]s", "profile": {"name": "%[1]s"}}]`, r.URL.Query().Get("q"))
+		case r.URL.Path == "/api/v1/groups/Engineering/users":
+			fmt.Fprint(w, `[{"profile": {"login": "alice@example.com"}}, {"profile": {"login": "bob@example.com"}}]`)
+		case r.URL.Path == "/api/v1/groups/Admins/users":
+			fmt.Fprint(w, `[{"profile": {"login": "carol@example.com"}}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	results := index.WhoCan("secret/data/app")
+	if err := gitops.ExpandExternalGroups(context.Background(), &idp.Okta{BaseURL: server.URL}, results); err != nil {
+		t.Fatal(err)
+	}
+	expected := []gitops.WhoCanResult{
+		{
+			Principal:    "auth/approle/role/reader",
+			Pattern:      "secret/data/*",
+			Capabilities: []internal.Capability{internal.Read},
+			Policies:     []string{"readers"},
+		},
+		{
+			Principal:     "identity/group/name/admins",
+			Pattern:       "secret/data/*",
+			Capabilities:  []internal.Capability{internal.Read},
+			Policies:      []string{"readers"},
+			ExternalGroup: "Admins",
+			Members:       []string{"carol@example.com"},
+		},
+		{
+			Principal:     "identity/group/name/devs",
+			Pattern:       "secret/data/*",
+			Capabilities:  []internal.Capability{internal.Read},
+			Policies:      []string{"readers"},
+			ExternalGroup: "Engineering",
+			Members:       []string{"alice@example.com", "bob@example.com"},
+		},
+	}
+	if diff := cmp.Diff(expected, results); diff != "" {
+		t.Fatal(diff)
+	}
+}
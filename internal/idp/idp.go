@@ -0,0 +1,221 @@
+// Package idp expands identity provider groups into their members.
+//
+// Vault only knows about the users of an external group once they've logged in, so anything that
+// asks "who can do this?" has to go ask the IdP itself.
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/mitchellh/mapstructure"
+	"github.com/rs/zerolog/log"
+)
+
+// GroupResolver reads the members of an identity provider group.
+type GroupResolver interface {
+	// Members returns the login name of every user in the named group, including nested groups where the IdP supports it.
+	Members(ctx context.Context, group string) ([]string, error)
+}
+
+// NewGroupResolver creates a read-only GroupResolver for "okta" or "azure".
+//
+// domain is the Okta org domain (e.g. example.okta.com) and is ignored for azure.
+func NewGroupResolver(kind, domain, token string) (GroupResolver, error) {
+	if token == "" {
+		return nil, fmt.Errorf("an API token is required for %s group enrichment", kind)
+	}
+	switch strings.ToLower(kind) {
+	case "okta":
+		if domain == "" {
+			return nil, fmt.Errorf("okta group enrichment requires a domain")
+		}
+		return &Okta{BaseURL: "https://" + strings.TrimPrefix(domain, "https://"), Token: token}, nil
+	case "azure", "azuread", "entra":
+		return &MicrosoftGraph{BaseURL: "https://graph.microsoft.com/v1.0", Token: token}, nil
+	}
+	return nil, fmt.Errorf("unsupported identity provider: '%s'", kind)
+}
+
+// Okta resolves group members with the Okta management API.
+type Okta struct {
+	BaseURL string
+	// An API token with okta.groups.read and okta.users.read.
+	Token  string
+	Client *http.Client
+}
+
+type oktaGroup struct {
+	ID      string `json:"id"`
+	Profile struct {
+		Name string `json:"name"`
+	} `json:"profile"`
+}
+
+type oktaUser struct {
+	Profile struct {
+		Login string `json:"login"`
+	} `json:"profile"`
+}
+
+// Members implements GroupResolver.
+func (o *Okta) Members(ctx context.Context, group string) ([]string, error) {
+	var groups []oktaGroup
+	searchURL := o.BaseURL + "/api/v1/groups?q=" + url.QueryEscape(group)
+	if _, err := getJSON(ctx, o.Client, searchURL, "SSWS "+o.Token, &groups); err != nil {
+		return nil, fmt.Errorf("error searching Okta groups: %w", err)
+	}
+	var groupID string
+	// q= is a prefix search
+	for _, g := range groups {
+		if g.Profile.Name == group {
+			groupID = g.ID
+			break
+		}
+	}
+	if groupID == "" {
+		return nil, fmt.Errorf("Okta group '%s' not found", group)
+	}
+	var (
+		members []string
+		next    = fmt.Sprintf("%s/api/v1/groups/%s/users?limit=200", o.BaseURL, groupID)
+	)
+	for next != "" {
+		var users []oktaUser
+		resp, err := getJSON(ctx, o.Client, next, "SSWS "+o.Token, &users)
+		if err != nil {
+			return nil, fmt.Errorf("error listing Okta group members: %w", err)
+		}
+		for _, user := range users {
+			members = append(members, user.Profile.Login)
+		}
+		next = nextLink(resp.Header)
+	}
+	return members, nil
+}
+
+// MicrosoftGraph resolves group members in Azure AD / Entra ID.
+type MicrosoftGraph struct {
+	BaseURL string
+	// A bearer token with GroupMember.Read.All.
+	Token  string
+	Client *http.Client
+}
+
+type graphPage[T any] struct {
+	Value    []T    `json:"value"`
+	NextLink string `json:"@odata.nextLink"`
+}
+
+// Members implements GroupResolver.
+func (g *MicrosoftGraph) Members(ctx context.Context, group string) ([]string, error) {
+	var (
+		groups    graphPage[struct{ ID string }]
+		filter    = fmt.Sprintf("displayName eq '%s'", strings.ReplaceAll(group, "'", "''"))
+		searchURL = g.BaseURL + "/groups?$select=id&$filter=" + url.QueryEscape(filter)
+	)
+	if _, err := getJSON(ctx, g.Client, searchURL, "Bearer "+g.Token, &groups); err != nil {
+		return nil, fmt.Errorf("error searching Microsoft Graph groups: %w", err)
+	}
+	if len(groups.Value) == 0 {
+		return nil, fmt.Errorf("Microsoft Graph group '%s' not found", group)
+	}
+	var (
+		members []string
+		next    = fmt.Sprintf("%s/groups/%s/transitiveMembers/microsoft.graph.user?$select=userPrincipalName", g.BaseURL, groups.Value[0].ID)
+	)
+	for next != "" {
+		var page graphPage[struct {
+			UserPrincipalName string `json:"userPrincipalName"`
+		}]
+		if _, err := getJSON(ctx, g.Client, next, "Bearer "+g.Token, &page); err != nil {
+			return nil, fmt.Errorf("error listing Microsoft Graph group members: %w", err)
+		}
+		for _, user := range page.Value {
+			members = append(members, user.UserPrincipalName)
+		}
+		next = page.NextLink
+	}
+	return members, nil
+}
+
+type externalGroupData struct {
+	Type  string `mapstructure:"type"`
+	Alias struct {
+		Name string `mapstructure:"name"`
+	} `mapstructure:"alias"`
+}
+
+// ExternalGroupName reads a Vault identity group and returns the IdP group name from its alias.
+//
+// Returns false if the path isn't an external group with an alias.
+func ExternalGroupName(ctx context.Context, vc *vault.Client, groupPath string) (string, bool, error) {
+	if !strings.HasPrefix(strings.TrimPrefix(groupPath, "/"), "identity/group/") {
+		return "", false, nil
+	}
+	secret, err := vc.Logical().ReadWithContext(ctx, groupPath)
+	if err != nil {
+		return "", false, fmt.Errorf("error reading identity group: %w", err)
+	}
+	if secret == nil {
+		return "", false, nil
+	}
+	var data externalGroupData
+	if err := mapstructure.Decode(secret.Data, &data); err != nil {
+		return "", false, fmt.Errorf("error decoding identity group: %w", err)
+	}
+	if data.Type != "external" || data.Alias.Name == "" {
+		return "", false, nil
+	}
+	return data.Alias.Name, true, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, target, authorization string, v any) (*http.Response, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Accept", "application/json")
+	log.Debug().Str("url", target).Msg("querying identity provider")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return resp, fmt.Errorf("error decoding response: %w", err)
+	}
+	return resp, nil
+}
+
+// parses `Link: <https://...>; rel="next"`
+func nextLink(header http.Header) string {
+	for _, link := range header.Values("Link") {
+		for _, part := range strings.Split(link, ",") {
+			segments := strings.Split(part, ";")
+			if len(segments) < 2 {
+				continue
+			}
+			for _, param := range segments[1:] {
+				if strings.TrimSpace(param) == `rel="next"` {
+					return strings.Trim(strings.TrimSpace(segments[0]), "<>")
+				}
+			}
+		}
+	}
+	return ""
+}
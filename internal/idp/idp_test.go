@@ -0,0 +1,75 @@
+package idp_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal/idp"
+)
+
+func TestOktaMembers(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "SSWS test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/groups":
+			// prefix search returns more than asked for
+			fmt.Fprint(w, `[{"id": "g2", "profile": {"name": "devs-contractors"}}, {"id": "g1", "profile": {"name": "devs"}}]`)
+		case "/api/v1/groups/g1/users":
+			if r.URL.Query().Get("after") == "" {
+				w.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/groups/g1/users?after=1>; rel="next"`, server.URL))
+				fmt.Fprint(w, `[{"profile": {"login": "alice@example.com"}}]`)
+			} else {
+				fmt.Fprint(w, `[{"profile": {"login": "bob@example.com"}}]`)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	okta := &idp.Okta{BaseURL: server.URL, Token: "test-token"}
+	members, err := okta.Members(context.Background(), "devs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"alice@example.com", "bob@example.com"}, members); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestMicrosoftGraphMembers(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/groups":
+			if r.URL.Query().Get("$filter") != "displayName eq 'devs'" {
+				t.Errorf("unexpected filter: %s", r.URL.Query().Get("$filter"))
+			}
+			fmt.Fprint(w, `{"value": [{"id": "abc"}]}`)
+		case "/groups/abc/transitiveMembers/microsoft.graph.user":
+			if r.URL.Query().Get("page") == "" {
+				fmt.Fprintf(w, `{"value": [{"userPrincipalName": "alice@example.com"}], "@odata.nextLink": "%s/groups/abc/transitiveMembers/microsoft.graph.user?page=2"}`, server.URL)
+			} else {
+				fmt.Fprint(w, `{"value": [{"userPrincipalName": "bob@example.com"}]}`)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	graph := &idp.MicrosoftGraph{BaseURL: server.URL, Token: "test-token"}
+	members, err := graph.Members(context.Background(), "devs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"alice@example.com", "bob@example.com"}, members); diff != "" {
+		t.Fatal(diff)
+	}
+}
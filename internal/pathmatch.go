@@ -0,0 +1,63 @@
+package internal
+
+import "strings"
+
+// MatchPath reports whether a policy path pattern applies to a request path.
+//
+// `+` matches exactly one segment and a trailing `*` matches any suffix, like Vault.
+func MatchPath(pattern, path string) bool {
+	glob := strings.HasSuffix(pattern, "*")
+	if glob {
+		pattern = strings.TrimSuffix(pattern, "*")
+	}
+	var (
+		patternSegments = strings.Split(pattern, "/")
+		pathSegments    = strings.Split(path, "/")
+		last            = len(patternSegments) - 1
+	)
+	if len(pathSegments) < len(patternSegments) || (!glob && len(pathSegments) != len(patternSegments)) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		switch {
+		case segment == "+":
+			continue
+		case glob && i == last:
+			if !strings.HasPrefix(pathSegments[i], segment) {
+				return false
+			}
+		case segment != pathSegments[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// MorePrecise reports whether pattern `a` takes priority over `b` when both match a path.
+//
+// Follows Vault's ordering: the later the first wildcard the better, then no trailing `*`, then fewer `+`
+// segments, then the longer pattern, then the lexically greater one.
+//
+// https://developer.hashicorp.com/vault/docs/concepts/policies#priority-matching
+func MorePrecise(a, b string) bool {
+	if ai, bi := firstWildcard(a), firstWildcard(b); ai != bi {
+		return ai > bi
+	}
+	if aGlob, bGlob := strings.HasSuffix(a, "*"), strings.HasSuffix(b, "*"); aGlob != bGlob {
+		return !aGlob
+	}
+	if aPlus, bPlus := strings.Count(a, "+"), strings.Count(b, "+"); aPlus != bPlus {
+		return aPlus < bPlus
+	}
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+func firstWildcard(pattern string) int {
+	if i := strings.IndexAny(pattern, "+*"); i >= 0 {
+		return i
+	}
+	return len(pattern)
+}
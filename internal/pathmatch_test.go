@@ -0,0 +1,74 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+func TestMatchPath(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		expected      bool
+	}{
+		{"secret/data/foo", "secret/data/foo", true},
+		{"secret/data/foo", "secret/data/foo/bar", false},
+		{"secret/data/*", "secret/data/foo/bar", true},
+		{"secret/data/*", "secret/data", false},
+		{"secret/data/fo*", "secret/data/foo", true},
+		{"secret/+/foo", "secret/data/foo", true},
+		{"secret/+/foo", "secret/data/bar", false},
+		{"secret/+/foo", "secret/foo", false},
+		{"secret/+/*", "secret/data/foo/bar", true},
+		{"*", "anything/at/all", true},
+	} {
+		if actual := internal.MatchPath(tc.pattern, tc.path); actual != tc.expected {
+			t.Errorf("MatchPath(%q, %q) = %v, expected %v", tc.pattern, tc.path, actual, tc.expected)
+		}
+	}
+}
+
+func TestMorePrecise(t *testing.T) {
+	for _, tc := range []struct{ a, b string }{
+		{"secret/data/foo", "secret/data/*"},
+		{"secret/data/foo/*", "secret/data/*"},
+		{"secret/data/+", "secret/+/foo"},
+		{"secret/data/+", "secret/data/*"},
+	} {
+		if !internal.MorePrecise(tc.a, tc.b) || internal.MorePrecise(tc.b, tc.a) {
+			t.Errorf("expected %q to be more precise than %q", tc.a, tc.b)
+		}
+	}
+}
+
+// the trie has to agree with MatchPath
+func TestPathTrie(t *testing.T) {
+	patterns := []string{
+		"secret/data/foo",
+		"secret/data/*",
+		"secret/data/fo*",
+		"secret/+/foo",
+		"secret/+/*",
+		"+/data/foo",
+		"*",
+		"sys/mounts",
+	}
+	var trie internal.PathTrie[int]
+	for i, pattern := range patterns {
+		trie.Insert(pattern, i)
+	}
+	for _, path := range []string{"secret/data/foo", "secret/data/foo/bar", "secret/data", "secret/foo", "sys/mounts", "sys/mounts/x", "kv/data/foo"} {
+		matched := map[string]bool{}
+		for _, match := range trie.Match(path) {
+			if patterns[match.Value] != match.Pattern {
+				t.Errorf("pattern %q has the wrong value %d", match.Pattern, match.Value)
+			}
+			matched[match.Pattern] = true
+		}
+		for _, pattern := range patterns {
+			if expected := internal.MatchPath(pattern, path); matched[pattern] != expected {
+				t.Errorf("trie match of %q against %q = %v, expected %v", pattern, path, matched[pattern], expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package internal
+
+import "strings"
+
+// PathTrie finds every policy path pattern matching a request path without testing each pattern.
+//
+// Patterns are split into segments, so a lookup only visits the exact and `+` branches the path could take.
+// The zero value is ready to use.
+type PathTrie[T any] struct {
+	root pathTrieNode[T]
+}
+
+// PathTrieMatch is a pattern that matched and the value it was inserted with.
+type PathTrieMatch[T any] struct {
+	Pattern string
+	Value   T
+}
+
+type pathTrieNode[T any] struct {
+	children map[string]*pathTrieNode[T]
+	plus     *pathTrieNode[T]
+	// patterns that end exactly here
+	exact []PathTrieMatch[T]
+	// patterns with a trailing `*`, which end here plus a prefix of the next segment
+	globs []pathTrieGlob[T]
+}
+
+type pathTrieGlob[T any] struct {
+	prefix string
+	match  PathTrieMatch[T]
+}
+
+// Insert adds a policy path pattern. The same pattern can be inserted more than once.
+func (t *PathTrie[T]) Insert(pattern string, value T) {
+	var (
+		match    = PathTrieMatch[T]{Pattern: pattern, Value: value}
+		glob     = strings.HasSuffix(pattern, "*")
+		segments = strings.Split(strings.TrimSuffix(pattern, "*"), "/")
+		node     = &t.root
+		last     string
+	)
+	if glob {
+		// the last segment is a prefix, not a node
+		last = segments[len(segments)-1]
+		segments = segments[:len(segments)-1]
+	}
+	for _, segment := range segments {
+		node = node.child(segment)
+	}
+	if glob {
+		node.globs = append(node.globs, pathTrieGlob[T]{prefix: last, match: match})
+	} else {
+		node.exact = append(node.exact, match)
+	}
+}
+
+func (n *pathTrieNode[T]) child(segment string) *pathTrieNode[T] {
+	if segment == "+" {
+		if n.plus == nil {
+			n.plus = &pathTrieNode[T]{}
+		}
+		return n.plus
+	}
+	if n.children == nil {
+		n.children = map[string]*pathTrieNode[T]{}
+	}
+	child, ok := n.children[segment]
+	if !ok {
+		child = &pathTrieNode[T]{}
+		n.children[segment] = child
+	}
+	return child
+}
+
+// Match returns every inserted pattern that applies to `path`, in no particular order.
+func (t *PathTrie[T]) Match(path string) []PathTrieMatch[T] {
+	var matches []PathTrieMatch[T]
+	t.root.match(strings.Split(path, "/"), &matches)
+	return matches
+}
+
+func (n *pathTrieNode[T]) match(segments []string, matches *[]PathTrieMatch[T]) {
+	if len(segments) == 0 {
+		*matches = append(*matches, n.exact...)
+		return
+	}
+	for _, glob := range n.globs {
+		if strings.HasPrefix(segments[0], glob.prefix) {
+			*matches = append(*matches, glob.match)
+		}
+	}
+	if child := n.children[segments[0]]; child != nil {
+		child.match(segments[1:], matches)
+	}
+	if n.plus != nil {
+		n.plus.match(segments[1:], matches)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"path/filepath"
 	"sort"
 
-	"github.com/hashicorp/hcl/v2/hclsimple"
 	vault "github.com/hashicorp/vault/api"
 	"github.com/mitchellh/mapstructure"
 )
@@ -28,6 +27,13 @@ type PolicyProvider interface {
 type ReadthroughPolicyProvider struct {
 	offlinePath string
 	client      *vault.Client
+	opts        PolicyProviderOptions
+}
+
+// PolicyProviderOptions change how a ReadthroughPolicyProvider computes an RSoP.
+type PolicyProviderOptions struct {
+	// Leave out the default policy, which Vault attaches to nearly every token, to only see what was granted on purpose.
+	ExcludeDefaultPolicy bool
 }
 
 // Reads a policy from Vault or the cache path.
@@ -61,8 +67,8 @@ func (p *ReadthroughPolicyProvider) getOfflinePolicy(name string) (*Policy, erro
 	if err != nil {
 		return nil, fmt.Errorf("error reading cached policy: %w", err)
 	}
-	var policy *Policy
-	if err = hclsimple.Decode(name, data, nil, &policy); err != nil {
+	policy, err := ParsePolicy(string(data), name)
+	if err != nil {
 		return nil, fmt.Errorf("error decoding cached policy: %w", err)
 	}
 	return policy, nil
@@ -118,17 +124,26 @@ func (p *ReadthroughPolicyProvider) GetRSoP(ctx context.Context, authThing strin
 		if err != nil {
 			return nil, VaultAPIError(fmt.Errorf("error reading guessed role path: %w", err))
 		}
-		if s.Data == nil || s.Data["token_policies"] == nil {
+		if s == nil || s.Data == nil || (s.Data["token_policies"] == nil && s.Data["policies"] == nil) {
 			return nil, fmt.Errorf(".data.token_policies not present in guessed role path")
 		}
 		var data logicalPolicyData
 		if err := mapstructure.Decode(s.Data, &data); err != nil {
 			return nil, fmt.Errorf("error decoding guessed role path data: %w", err)
 		}
-		policyNames = data.TokenPolicies
+		// identity groups and entities only have .policies
+		if s.Data["token_policies"] != nil {
+			noDefault, _ := s.Data["token_no_default_policy"].(bool)
+			policyNames = WithDefaultPolicy(data.TokenPolicies, noDefault)
+		} else {
+			policyNames = data.Policies
+		}
 	default:
 		return nil, fmt.Errorf("unhandled AuthKind: %s (%d)", ak.String(), ak)
 	}
+	if p.opts.ExcludeDefaultPolicy {
+		policyNames = withoutPolicy(policyNames, "default")
+	}
 	policies := make([]*Policy, len(policyNames))
 	for i, name := range policyNames {
 		policies[i], err = p.GetPolicy(ctx, name)
@@ -146,9 +161,33 @@ func (p *ReadthroughPolicyProvider) GetRSoP(ctx context.Context, authThing strin
 
 // ReadthroughPolicyProvider is a readthrough cache of Vault policies.
 func NewReadthroughPolicyProvider(offlinePath string, client *vault.Client) (PolicyProvider, error) {
+	return NewReadthroughPolicyProviderWithOptions(offlinePath, client, PolicyProviderOptions{})
+}
+
+func NewReadthroughPolicyProviderWithOptions(offlinePath string, client *vault.Client, opts PolicyProviderOptions) (PolicyProvider, error) {
 	pp := &ReadthroughPolicyProvider{
 		offlinePath: offlinePath,
 		client:      client,
+		opts:        opts,
 	}
 	return pp, nil
 }
+
+// WithDefaultPolicy adds the default policy to the policies of an auth role, since Vault attaches it to every token
+// the role issues unless token_no_default_policy is set.
+func WithDefaultPolicy(policies []string, noDefaultPolicy bool) []string {
+	if noDefaultPolicy || contains("default", policies...) {
+		return policies
+	}
+	return append(append([]string(nil), policies...), "default")
+}
+
+func withoutPolicy(policies []string, name string) []string {
+	without := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		if policy != name {
+			without = append(without, policy)
+		}
+	}
+	return without
+}
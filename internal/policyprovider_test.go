@@ -134,6 +134,53 @@ func TestProviderNoCache(t *testing.T) {
 	})
 }
 
+func TestRSoPDefaultPolicy(t *testing.T) {
+	ctx := context.Background()
+	client := testcluster.NewTestCluster(t)
+	if err := client.Sys().EnableAuthWithOptionsWithContext(ctx, "approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Sys().PutPolicyWithContext(ctx, "ci", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+	for role, noDefault := range map[string]bool{"with-default": false, "without-default": true} {
+		_, err := client.Logical().WriteWithContext(ctx, "auth/approle/role/"+role, map[string]interface{}{
+			"token_policies":          []string{"ci"},
+			"token_no_default_policy": noDefault,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		role           string
+		excludeDefault bool
+		expected       []string
+	}{
+		{"with-default", false, []string{"ci", "default"}},
+		{"with-default", true, []string{"ci"}},
+		{"without-default", false, []string{"ci"}},
+	} {
+		pp, err := internal.NewReadthroughPolicyProviderWithOptions("", client, internal.PolicyProviderOptions{
+			ExcludeDefaultPolicy: test.excludeDefault,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsop, err := pp.GetRSoP(ctx, "auth/approle/role/"+test.role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, policy := range rsop.Policies {
+			names = append(names, policy.Name)
+		}
+		if diff := cmp.Diff(test.expected, names); diff != "" {
+			t.Errorf("%s (exclude default: %v): %s", test.role, test.excludeDefault, diff)
+		}
+	}
+}
+
 // calls t.Fatal() on error
 func mustT[T any](t *testing.T) func(T, error) T {
 	return func(value T, err error) T {
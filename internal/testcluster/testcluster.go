@@ -24,7 +24,7 @@ type devClusterInfo struct {
 var mutex sync.Mutex
 
 // Creates a test cluster using whatever `vault` binary it finds in $PATH.
-func NewTestCluster(t *testing.T) *vault.Client {
+func NewTestCluster(t testing.TB) *vault.Client {
 	t.Helper()
 	if !mutex.TryLock() {
 		t.Log("waiting in line for NewTestCluster mutex")